@@ -0,0 +1,442 @@
+/*
+Package acme obtains and renews the key pairs of the hosts from the ACME (RFC 8555) certificate authorities,
+e.g. Let's Encrypt, validating the domains with HTTP-01 challenges.
+*/
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusReady      = "ready"
+	StatusValid      = "valid"
+	StatusInvalid    = "invalid"
+
+	ChallengeHTTP01 = "http-01"
+)
+
+// Client is a minimal ACME client that registers the account and orders the certificates
+type Client struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	httpClient   *http.Client
+
+	// pollInterval is used when the server does not tell how long to wait with Retry-After header
+	pollInterval time.Duration
+	pollTimeout  time.Duration
+
+	mtx    *sync.Mutex
+	dir    *directory
+	kid    string
+	nonces []string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type Order struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+}
+
+type Authorization struct {
+	Status     string      `json:"status"`
+	Identifier Identifier  `json:"identifier"`
+	Challenges []Challenge `json:"challenges"`
+}
+
+type Challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// Problem is the error returned by the ACME server
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+const badNonceProblem = "urn:ietf:params:acme:error:badNonce"
+
+// NewClient returns the client using the account key, httpClient may be nil to use the default one
+func NewClient(directoryURL string, key *ecdsa.PrivateKey, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		directoryURL: directoryURL,
+		key:          key,
+		httpClient:   httpClient,
+		pollInterval: time.Second,
+		pollTimeout:  2 * time.Minute,
+		mtx:          &sync.Mutex{},
+	}
+}
+
+// NewAccountKey generates the key identifying the ACME account
+func NewAccountKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Register creates the account, or finds the existing one registered with the same key,
+// and agrees to the terms of service of the certificate authority
+func (c *Client) Register(contact []string) error {
+	dir, err := c.directory()
+	if err != nil {
+		return err
+	}
+	req := struct {
+		Contact              []string `json:"contact,omitempty"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	}{Contact: contact, TermsOfServiceAgreed: true}
+
+	re, err := c.post(dir.NewAccount, req, nil)
+	if err != nil {
+		return err
+	}
+	location := re.header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("acme: account location is missing")
+	}
+	c.mtx.Lock()
+	c.kid = location
+	c.mtx.Unlock()
+	return nil
+}
+
+// NewOrder orders the certificate for the domains
+func (c *Client) NewOrder(domains []string) (*Order, error) {
+	dir, err := c.directory()
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		Identifiers []Identifier `json:"identifiers"`
+	}{}
+	for _, d := range domains {
+		req.Identifiers = append(req.Identifiers, Identifier{Type: "dns", Value: d})
+	}
+	var o Order
+	re, err := c.post(dir.NewOrder, req, &o)
+	if err != nil {
+		return nil, err
+	}
+	o.URL = re.header.Get("Location")
+	return &o, nil
+}
+
+func (c *Client) GetAuthorization(url string) (*Authorization, error) {
+	var a Authorization
+	if _, err := c.post(url, nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// AcceptChallenge tells the server that the challenge is ready to be validated
+func (c *Client) AcceptChallenge(ch Challenge) error {
+	_, err := c.post(ch.URL, struct{}{}, nil)
+	return err
+}
+
+// WaitAuthorization polls the authorization until it becomes valid or invalid
+func (c *Client) WaitAuthorization(url string) (*Authorization, error) {
+	deadline := time.Now().Add(c.pollTimeout)
+	for {
+		var a Authorization
+		re, err := c.post(url, nil, &a)
+		if err != nil {
+			return nil, err
+		}
+		switch a.Status {
+		case StatusValid:
+			return &a, nil
+		case StatusInvalid:
+			for _, ch := range a.Challenges {
+				if ch.Error != nil {
+					return nil, ch.Error
+				}
+			}
+			return nil, fmt.Errorf("acme: authorization for %s is invalid", a.Identifier.Value)
+		}
+		if err := c.sleep(re, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FinalizeOrder submits the certificate signing request in DER format and waits until the certificate is issued
+func (c *Client) FinalizeOrder(o *Order, csr []byte) (*Order, error) {
+	req := struct {
+		CSR string `json:"csr"`
+	}{CSR: encode(csr)}
+	if _, err := c.post(o.Finalize, req, nil); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.pollTimeout)
+	for {
+		var out Order
+		re, err := c.post(o.URL, nil, &out)
+		if err != nil {
+			return nil, err
+		}
+		out.URL = o.URL
+		switch out.Status {
+		case StatusValid:
+			return &out, nil
+		case StatusInvalid:
+			if out.Error != nil {
+				return nil, out.Error
+			}
+			return nil, fmt.Errorf("acme: order is invalid")
+		}
+		if err := c.sleep(re, deadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FetchCertificate downloads the PEM encoded certificate chain
+func (c *Client) FetchCertificate(url string) ([]byte, error) {
+	re, err := c.post(url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return re.body, nil
+}
+
+// KeyAuthorization returns the response to the challenge with the token
+func (c *Client) KeyAuthorization(token string) string {
+	return token + "." + thumbprint(&c.key.PublicKey)
+}
+
+func (c *Client) sleep(re *response, deadline time.Time) error {
+	wait := c.pollInterval
+	if s, err := strconv.Atoi(re.header.Get("Retry-After")); err == nil && s > 0 {
+		wait = time.Duration(s) * time.Second
+	}
+	if time.Now().Add(wait).After(deadline) {
+		return fmt.Errorf("acme: timed out waiting for %s", re.url)
+	}
+	time.Sleep(wait)
+	return nil
+}
+
+func (c *Client) directory() (*directory, error) {
+	c.mtx.Lock()
+	dir := c.dir
+	c.mtx.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+
+	re, err := c.httpClient.Get(c.directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: failed to get directory %s: %s", c.directoryURL, re.Status)
+	}
+	dir = &directory{}
+	if err := json.NewDecoder(re.Body).Decode(dir); err != nil {
+		return nil, fmt.Errorf("acme: bad directory: %s", err)
+	}
+
+	c.mtx.Lock()
+	c.dir = dir
+	c.mtx.Unlock()
+	return dir, nil
+}
+
+func (c *Client) nonce() (string, error) {
+	c.mtx.Lock()
+	if len(c.nonces) != 0 {
+		n := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		c.mtx.Unlock()
+		return n, nil
+	}
+	c.mtx.Unlock()
+
+	dir, err := c.directory()
+	if err != nil {
+		return "", err
+	}
+	re, err := c.httpClient.Head(dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	re.Body.Close()
+	n := re.Header.Get("Replay-Nonce")
+	if n == "" {
+		return "", fmt.Errorf("acme: server returned no nonce")
+	}
+	return n, nil
+}
+
+func (c *Client) saveNonce(h http.Header) {
+	if n := h.Get("Replay-Nonce"); n != "" {
+		c.mtx.Lock()
+		c.nonces = append(c.nonces, n)
+		c.mtx.Unlock()
+	}
+}
+
+type response struct {
+	url    string
+	header http.Header
+	body   []byte
+}
+
+// post sends the JWS signed request, nil payload stands for POST-as-GET request.
+// Requests rejected because of the stale nonce are retried once.
+func (c *Client) post(url string, payload interface{}, out interface{}) (*response, error) {
+	re, err := c.postOnce(url, payload, out)
+	if p, ok := err.(*Problem); ok && p.Type == badNonceProblem {
+		return c.postOnce(url, payload, out)
+	}
+	return re, err
+}
+
+func (c *Client) postOnce(url string, payload interface{}, out interface{}) (*response, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+	re, err := c.httpClient.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	c.saveNonce(re.Header)
+
+	data, err := ioutil.ReadAll(io.LimitReader(re.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if re.StatusCode >= 400 {
+		p := &Problem{}
+		if err := json.Unmarshal(data, p); err != nil || p.Type == "" {
+			return nil, fmt.Errorf("acme: %s returned %s", url, re.Status)
+		}
+		return nil, p
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("acme: bad response from %s: %s", url, err)
+		}
+	}
+	return &response{url: url, header: re.Header, body: data}, nil
+}
+
+// sign returns the request in JWS flattened JSON serialization signed with ES256,
+// the key is identified by the account URL once the account is registered
+func (c *Client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	c.mtx.Lock()
+	kid := c.kid
+	c.mtx.Unlock()
+	if kid != "" {
+		protected["kid"] = kid
+	} else {
+		protected["jwk"] = jwk(&c.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	h, p := encode(header), encode(body)
+	digest := sha256.Sum256([]byte(h + "." + p))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": h,
+		"payload":   p,
+		"signature": encode(sig),
+	})
+}
+
+func jwk(key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   encode(padded(key.X)),
+		"y":   encode(padded(key.Y)),
+	}
+}
+
+// thumbprint returns RFC 7638 thumbprint of the key, members are in lexicographic order
+func thumbprint(key *ecdsa.PublicKey) string {
+	k := jwk(key)
+	data := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, k["crv"], k["kty"], k["x"], k["y"])
+	digest := sha256.Sum256([]byte(data))
+	return encode(digest[:])
+}
+
+func padded(i *big.Int) []byte {
+	return i.FillBytes(make([]byte, 32))
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,385 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	DefaultRenewBefore = 30 * 24 * time.Hour
+	DefaultCheckPeriod = time.Minute
+	DefaultRetryPeriod = 10 * time.Minute
+	// challengeTTL limits the time the challenges of the failed orders stay in the engine
+	challengeTTL = 10 * time.Minute
+	// orderLockTTL limits the time the lock on ordering is held by the instance that failed while ordering
+	orderLockTTL = 10 * time.Minute
+)
+
+type Options struct {
+	// DirectoryURL is the ACME directory of the certificate authority, e.g. https://acme-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	// Email is the contact of the account, optional
+	Email string
+	// HTTPClient talks to the certificate authority, e.g. with the custom root CAs of the test server
+	HTTPClient *http.Client
+	// AccountKey identifies the account. If not set, the account key stored in the engine is used,
+	// the first vulcand instance to register generates the key and stores it in the engine
+	AccountKey *ecdsa.PrivateKey
+	// RenewBefore is the period before the certificate expiry when the certificate is renewed
+	RenewBefore time.Duration
+	// CheckPeriod is the period between the checks of the hosts
+	CheckPeriod time.Duration
+	// RetryPeriod is the time to wait before ordering the certificate for the host again after the failure
+	RetryPeriod  time.Duration
+	TimeProvider timetools.TimeProvider
+}
+
+// Manager obtains the key pairs for the hosts with AutoCert setting and renews them before they expire.
+// Key pairs are stored back through the engine, so every vulcand instance picks them up. The certificate
+// for the host is ordered by one instance at a time, the one holding the order lock in the engine.
+//
+// Pending HTTP-01 challenges are stored in the engine as well, so the validation requests are answered
+// by the http listeners of any vulcand instance sharing the engine, see Responder.
+type Manager struct {
+	ng      engine.Engine
+	options Options
+
+	mtx *sync.RWMutex
+	// client is set once the account is registered
+	client *Client
+	// failed holds the time of the last failure for the hosts
+	failed map[string]time.Time
+
+	stopC chan struct{}
+	wg    *sync.WaitGroup
+}
+
+func New(ng engine.Engine, o Options) (*Manager, error) {
+	if o.DirectoryURL == "" {
+		return nil, fmt.Errorf("ACME directory URL is required")
+	}
+	return &Manager{
+		ng:      ng,
+		options: setDefaults(o),
+		mtx:     &sync.RWMutex{},
+		failed:  make(map[string]time.Time),
+		stopC:   make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}, nil
+}
+
+func setDefaults(o Options) Options {
+	if o.RenewBefore == 0 {
+		o.RenewBefore = DefaultRenewBefore
+	}
+	if o.CheckPeriod == 0 {
+		o.CheckPeriod = DefaultCheckPeriod
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = DefaultRetryPeriod
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return o
+}
+
+func (m *Manager) String() string {
+	return fmt.Sprintf("acme.Manager(%s)", m.options.DirectoryURL)
+}
+
+// Start checks the hosts periodically until the manager is stopped
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			m.CheckHosts()
+			select {
+			case <-time.After(m.options.CheckPeriod):
+			case <-m.stopC:
+				return
+			}
+		}
+	}()
+}
+
+func (m *Manager) Stop() {
+	close(m.stopC)
+	m.wg.Wait()
+}
+
+// CheckHosts obtains the key pairs for the hosts with AutoCert setting that have no key pairs
+// or whose certificates are about to expire
+func (m *Manager) CheckHosts() {
+	hosts, err := m.ng.GetHosts()
+	if err != nil {
+		log.Errorf("%s failed to get hosts: %s", m, err)
+		return
+	}
+	for _, h := range hosts {
+		if m.needsKeyPair(h) {
+			m.updateKeyPair(h.Name)
+		}
+	}
+}
+
+// updateKeyPair obtains the key pair for the host under the lock in the engine, so the vulcand instances sharing
+// the engine do not order the certificate for the same host at once. The instances that fail to take the lock skip
+// the host, and the host is read again under the lock, as the key pair could have been updated in between.
+func (m *Manager) updateKeyPair(name string) {
+	if err := m.ng.CreateACMEOrderLock(name, orderLockTTL); err != nil {
+		if _, ok := err.(*engine.AlreadyExistsError); ok {
+			log.Infof("%s skips %s, the certificate is being ordered by another instance", m, name)
+			return
+		}
+		log.Errorf("%s failed to lock %s: %s", m, name, err)
+		return
+	}
+	defer func() {
+		if err := m.ng.DeleteACMEOrderLock(name); err != nil {
+			log.Warningf("%s failed to unlock %s: %s", m, name, err)
+		}
+	}()
+
+	h, err := m.ng.GetHost(engine.HostKey{Name: name})
+	if err != nil {
+		log.Errorf("%s failed to get %s: %s", m, name, err)
+		return
+	}
+	if !m.needsKeyPair(*h) {
+		return
+	}
+	log.Infof("%s obtaining certificate for %s", m, h.Name)
+	keyPair, err := m.ObtainKeyPair(h.Name)
+	if err != nil {
+		log.Errorf("%s failed to obtain certificate for %s: %s", m, h.Name, err)
+		m.setFailed(h.Name)
+		return
+	}
+	h.Settings.KeyPair = keyPair
+	if err := m.ng.UpsertHost(*h); err != nil {
+		log.Errorf("%s failed to update %s: %s", m, h.Name, err)
+		m.setFailed(h.Name)
+		return
+	}
+	m.mtx.Lock()
+	delete(m.failed, h.Name)
+	m.mtx.Unlock()
+	log.Infof("%s updated certificate for %s", m, h.Name)
+}
+
+func (m *Manager) needsKeyPair(h engine.Host) bool {
+	if !h.Settings.AutoCert {
+		return false
+	}
+	now := m.options.TimeProvider.UtcNow()
+	m.mtx.RLock()
+	failed, ok := m.failed[h.Name]
+	m.mtx.RUnlock()
+	if ok && now.Before(failed.Add(m.options.RetryPeriod)) {
+		return false
+	}
+	if h.Settings.KeyPair == nil {
+		return true
+	}
+	cert, err := parseCertificate(h.Settings.KeyPair.Cert)
+	if err != nil {
+		log.Warningf("%s replaces bad certificate of %s: %s", m, h.Name, err)
+		return true
+	}
+	return now.Add(m.options.RenewBefore).After(cert.NotAfter)
+}
+
+func (m *Manager) setFailed(name string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.failed[name] = m.options.TimeProvider.UtcNow()
+}
+
+// ObtainKeyPair orders the certificate for the domain and returns it along with the generated private key
+func (m *Manager) ObtainKeyPair(domain string) (*engine.KeyPair, error) {
+	client, err := m.register()
+	if err != nil {
+		return nil, err
+	}
+	o, err := client.NewOrder([]string{domain})
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range o.Authorizations {
+		if err := m.authorize(client, url); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	o, err = client.FinalizeOrder(o, csr)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := client.FetchCertificate(o.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewKeyPair(cert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// register registers the account, or finds the account registered with the same key, and returns the client
+func (m *Manager) register() (*Client, error) {
+	m.mtx.RLock()
+	client := m.client
+	m.mtx.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+
+	key := m.options.AccountKey
+	if key == nil {
+		var err error
+		if key, err = m.accountKey(); err != nil {
+			return nil, err
+		}
+	}
+	client = NewClient(m.options.DirectoryURL, key, m.options.HTTPClient)
+	var contact []string
+	if m.options.Email != "" {
+		contact = []string{"mailto:" + m.options.Email}
+	}
+	if err := client.Register(contact); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	m.client = client
+	m.mtx.Unlock()
+	return client, nil
+}
+
+// accountKey returns the account key stored in the engine, generating and storing it if there is none yet.
+// Instances racing to store the key end up with the key stored first, so the account is registered once.
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	data, err := m.ng.GetACMEAccountKey()
+	if _, ok := err.(*engine.NotFoundError); ok {
+		key, err := NewAccountKey()
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = m.ng.CreateACMEAccountKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+		if err == nil {
+			log.Infof("%s created account key", m)
+			return key, nil
+		}
+		if _, ok := err.(*engine.AlreadyExistsError); !ok {
+			return nil, err
+		}
+		data, err = m.ng.GetACMEAccountKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded account key found")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// authorize solves HTTP-01 challenge of the authorization, unless it is valid already
+func (m *Manager) authorize(client *Client, url string) error {
+	a, err := client.GetAuthorization(url)
+	if err != nil {
+		return err
+	}
+	if a.Status == StatusValid {
+		return nil
+	}
+	var ch *Challenge
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == ChallengeHTTP01 {
+			ch = &a.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("no %s challenge offered for %s", ChallengeHTTP01, a.Identifier.Value)
+	}
+
+	challenge := engine.ACMEChallenge{Token: ch.Token, KeyAuthorization: client.KeyAuthorization(ch.Token)}
+	if err := m.ng.UpsertACMEChallenge(challenge, challengeTTL); err != nil {
+		return err
+	}
+	defer func() {
+		if err := m.ng.DeleteACMEChallenge(ch.Token); err != nil {
+			log.Warningf("%s failed to delete challenge %s: %s", m, ch.Token, err)
+		}
+	}()
+
+	if err := client.AcceptChallenge(*ch); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(url)
+	return err
+}
+
+// Responder answers the HTTP-01 challenges stored in the engine by the manager of any vulcand instance
+type Responder struct {
+	ng engine.Engine
+}
+
+func NewResponder(ng engine.Engine) *Responder {
+	return &Responder{ng: ng}
+}
+
+// KeyAuthorization returns the response to the pending HTTP-01 challenge
+func (r *Responder) KeyAuthorization(token string) (string, bool) {
+	if engine.CheckACMEToken(token) != nil {
+		return "", false
+	}
+	ch, err := r.ng.GetACMEChallenge(token)
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			log.Errorf("failed to get ACME challenge %s: %s", token, err)
+		}
+		return "", false
+	}
+	return ch.KeyAuthorization, true
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,542 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin/registry"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestACME(t *testing.T) { TestingT(t) }
+
+type ManagerSuite struct {
+	ca    *testCA
+	ng    engine.Engine
+	clock *timetools.FreezedTime
+	m     *Manager
+}
+
+var _ = Suite(&ManagerSuite{})
+
+func (s *ManagerSuite) SetUpSuite(c *C) {
+	log.InitWithConfig(log.Config{Name: "console"})
+}
+
+func (s *ManagerSuite) SetUpTest(c *C) {
+	s.ca = newTestCA(c)
+	s.ng = memng.New(registry.GetRegistry())
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Now().UTC()}
+
+	m, err := New(s.ng, Options{
+		DirectoryURL: s.ca.srv.URL + "/directory",
+		Email:        "admin@example.com",
+		TimeProvider: s.clock,
+	})
+	c.Assert(err, IsNil)
+	s.m = m
+	s.ca.validate = NewResponder(s.ng).KeyAuthorization
+}
+
+func (s *ManagerSuite) TearDownTest(c *C) {
+	s.ca.srv.Close()
+}
+
+func (s *ManagerSuite) TestNewRequiresDirectory(c *C) {
+	_, err := New(s.ng, Options{})
+	c.Assert(err, NotNil)
+}
+
+func (s *ManagerSuite) TestObtainKeyPair(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com", Settings: engine.HostSettings{AutoCert: true}}), IsNil)
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "manual.example.com"}), IsNil)
+
+	s.m.CheckHosts()
+
+	h, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.AutoCert, Equals, true)
+	c.Assert(h.Settings.KeyPair, NotNil)
+	_, err = tls.X509KeyPair(h.Settings.KeyPair.Cert, h.Settings.KeyPair.Key)
+	c.Assert(err, IsNil)
+
+	cert, err := parseCertificate(h.Settings.KeyPair.Cert)
+	c.Assert(err, IsNil)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"example.com"})
+	c.Assert(s.ca.contact, DeepEquals, []string{"mailto:admin@example.com"})
+
+	// Hosts without AutoCert are left alone
+	h, err = s.ng.GetHost(engine.HostKey{Name: "manual.example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, IsNil)
+	c.Assert(s.ca.issued, Equals, 1)
+
+	// Challenges are not answered once the order is complete
+	_, ok := NewResponder(s.ng).KeyAuthorization(s.ca.lastToken)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *ManagerSuite) TestRenew(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com", Settings: engine.HostSettings{AutoCert: true}}), IsNil)
+
+	s.m.CheckHosts()
+	c.Assert(s.ca.issued, Equals, 1)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	first := h.Settings.KeyPair
+
+	// Certificate is valid for a while
+	s.m.CheckHosts()
+	c.Assert(s.ca.issued, Equals, 1)
+
+	// Certificate is about to expire
+	cert, err := parseCertificate(first.Cert)
+	c.Assert(err, IsNil)
+	s.clock.CurrentTime = cert.NotAfter.Add(-10 * 24 * time.Hour)
+	s.m.CheckHosts()
+	c.Assert(s.ca.issued, Equals, 2)
+
+	h, err = s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair.Equals(first), Equals, false)
+}
+
+func (s *ManagerSuite) TestRetryAfterFailure(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com", Settings: engine.HostSettings{AutoCert: true}}), IsNil)
+
+	s.ca.validate = func(token string) (string, bool) { return "", false }
+	s.m.CheckHosts()
+	c.Assert(s.ca.orders, Equals, 1)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, IsNil)
+
+	// The host is not ordered again right away
+	s.m.CheckHosts()
+	c.Assert(s.ca.orders, Equals, 1)
+
+	s.ca.validate = NewResponder(s.ng).KeyAuthorization
+	s.clock.CurrentTime = s.clock.CurrentTime.Add(DefaultRetryPeriod)
+	s.m.CheckHosts()
+	c.Assert(s.ca.orders, Equals, 2)
+	h, err = s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, NotNil)
+}
+
+func (s *ManagerSuite) TestOrderLocked(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com", Settings: engine.HostSettings{AutoCert: true}}), IsNil)
+
+	// Another instance is ordering the certificate
+	c.Assert(s.ng.CreateACMEOrderLock("example.com", time.Minute), IsNil)
+	s.m.CheckHosts()
+	c.Assert(s.ca.orders, Equals, 0)
+
+	c.Assert(s.ng.DeleteACMEOrderLock("example.com"), IsNil)
+	s.m.CheckHosts()
+	c.Assert(s.ca.orders, Equals, 1)
+
+	// The lock is released once the certificate is stored
+	c.Assert(s.ng.CreateACMEOrderLock("example.com", time.Minute), IsNil)
+}
+
+func (s *ManagerSuite) TestInstancesOrderOnce(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com", Settings: engine.HostSettings{AutoCert: true}}), IsNil)
+
+	ms := []*Manager{s.m}
+	for i := 0; i < 3; i++ {
+		m, err := New(s.ng, Options{DirectoryURL: s.ca.srv.URL + "/directory", TimeProvider: s.clock})
+		c.Assert(err, IsNil)
+		ms = append(ms, m)
+	}
+	var wg sync.WaitGroup
+	for _, m := range ms {
+		wg.Add(1)
+		go func(m *Manager) {
+			defer wg.Done()
+			m.CheckHosts()
+		}(m)
+	}
+	wg.Wait()
+
+	c.Assert(s.ca.issued, Equals, 1)
+	h, err := s.ng.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.KeyPair, NotNil)
+}
+
+func (s *ManagerSuite) TestAccountKeyShared(c *C) {
+	_, err := s.m.ObtainKeyPair("example.com")
+	c.Assert(err, IsNil)
+	_, err = s.ng.GetACMEAccountKey()
+	c.Assert(err, IsNil)
+
+	// Another instance sharing the engine uses the same account
+	m, err := New(s.ng, Options{DirectoryURL: s.ca.srv.URL + "/directory", TimeProvider: s.clock})
+	c.Assert(err, IsNil)
+	_, err = m.ObtainKeyPair("example.com")
+	c.Assert(err, IsNil)
+
+	c.Assert(len(s.ca.accounts), Equals, 2)
+	var keys []*ecdsa.PublicKey
+	for _, key := range s.ca.accounts {
+		keys = append(keys, key)
+	}
+	c.Assert(keys[0].X.Cmp(keys[1].X), Equals, 0)
+	c.Assert(keys[0].Y.Cmp(keys[1].Y), Equals, 0)
+}
+
+func (s *ManagerSuite) TestBadNonceRetried(c *C) {
+	s.ca.rejectNonce = true
+	keyPair, err := s.m.ObtainKeyPair("example.com")
+	c.Assert(err, IsNil)
+	c.Assert(keyPair, NotNil)
+	c.Assert(s.ca.rejectNonce, Equals, false)
+}
+
+func (s *ManagerSuite) TestProblem(c *C) {
+	_, err := s.m.ObtainKeyPair("forbidden.example.com")
+	c.Assert(err, FitsTypeOf, &Problem{})
+	c.Assert(err.(*Problem).Type, Equals, "urn:ietf:params:acme:error:rejectedIdentifier")
+}
+
+// testCA is ACME server issuing the certificates for the domains with validated HTTP-01 challenges
+type testCA struct {
+	srv *httptest.Server
+	key *ecdsa.PrivateKey
+	crt *x509.Certificate
+
+	// validate returns the key authorization served for the token
+	validate func(token string) (string, bool)
+	// rejectNonce rejects the next request with badNonce error
+	rejectNonce bool
+
+	mtx       sync.Mutex
+	lastID    int
+	nonces    map[string]bool
+	accounts  map[string]*ecdsa.PublicKey
+	contact   []string
+	authz     map[string]*testAuthz
+	ords      map[string]*testOrder
+	lastToken string
+	orders    int
+	issued    int
+}
+
+type testAuthz struct {
+	domain string
+	token  string
+	status string
+	thumb  string
+}
+
+type testOrder struct {
+	domain string
+	authz  string
+	status string
+	cert   []byte
+}
+
+func newTestCA(c *C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	crt, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	ca := &testCA{
+		key:      key,
+		crt:      crt,
+		nonces:   make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+		authz:    make(map[string]*testAuthz),
+		ords:     make(map[string]*testOrder),
+	}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serveHTTP))
+	return ca
+}
+
+func (ca *testCA) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	ca.mtx.Lock()
+	defer ca.mtx.Unlock()
+
+	w.Header().Set("Replay-Nonce", ca.newNonce())
+	switch {
+	case req.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.srv.URL + "/new-nonce",
+			"newAccount": ca.srv.URL + "/new-account",
+			"newOrder":   ca.srv.URL + "/new-order",
+		})
+		return
+	case req.URL.Path == "/new-nonce":
+		return
+	}
+
+	kid, payload, err := ca.verify(req)
+	if err != nil {
+		ca.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+	if ca.rejectNonce {
+		ca.rejectNonce = false
+		ca.problem(w, http.StatusBadRequest, "badNonce", "try again")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "new-account":
+		var a struct {
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &a)
+		ca.contact = a.Contact
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case "new-order":
+		var o struct {
+			Identifiers []Identifier `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &o)
+		domain := o.Identifiers[0].Value
+		if strings.HasPrefix(domain, "forbidden.") {
+			ca.problem(w, http.StatusBadRequest, "rejectedIdentifier", "policy forbids issuing for "+domain)
+			return
+		}
+		ca.orders++
+		id := ca.nextID()
+		ca.lastToken = "token" + id
+		ca.authz[id] = &testAuthz{domain: domain, token: ca.lastToken, status: StatusPending, thumb: ca.thumbprint(kid)}
+		ca.ords[id] = &testOrder{domain: domain, authz: id, status: StatusPending}
+		w.Header().Set("Location", ca.srv.URL+"/order/"+id)
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w, id)
+	case "authz":
+		ca.writeAuthz(w, parts[1])
+	case "chal":
+		a := ca.authz[parts[1]]
+		keyAuth, ok := ca.validate(a.token)
+		if ok && keyAuth == a.token+"."+a.thumb {
+			a.status = StatusValid
+			ca.ords[parts[1]].status = StatusReady
+		} else {
+			a.status = StatusInvalid
+			ca.ords[parts[1]].status = StatusInvalid
+		}
+		json.NewEncoder(w).Encode(Challenge{Type: ChallengeHTTP01, Token: a.token, Status: StatusProcessing})
+	case "finalize":
+		o := ca.ords[parts[1]]
+		if o.status != StatusReady {
+			ca.problem(w, http.StatusForbidden, "orderNotReady", "order is "+o.status)
+			return
+		}
+		var f struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &f)
+		if err := ca.issue(o, f.CSR); err != nil {
+			ca.problem(w, http.StatusBadRequest, "badCSR", err.Error())
+			return
+		}
+		ca.writeOrder(w, parts[1])
+	case "order":
+		ca.writeOrder(w, parts[1])
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.ords[parts[1]].cert)
+	default:
+		ca.problem(w, http.StatusNotFound, "malformed", "not found")
+	}
+}
+
+func (ca *testCA) writeOrder(w http.ResponseWriter, id string) {
+	o := ca.ords[id]
+	out := Order{
+		Status:         o.status,
+		Identifiers:    []Identifier{{Type: "dns", Value: o.domain}},
+		Authorizations: []string{ca.srv.URL + "/authz/" + id},
+		Finalize:       ca.srv.URL + "/finalize/" + id,
+	}
+	if o.status == StatusValid {
+		out.Certificate = ca.srv.URL + "/cert/" + id
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func (ca *testCA) writeAuthz(w http.ResponseWriter, id string) {
+	a := ca.authz[id]
+	ch := Challenge{Type: ChallengeHTTP01, URL: ca.srv.URL + "/chal/" + id, Token: a.token, Status: a.status}
+	if a.status == StatusInvalid {
+		ch.Error = &Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "bad key authorization"}
+	}
+	json.NewEncoder(w).Encode(Authorization{
+		Status:     a.status,
+		Identifier: Identifier{Type: "dns", Value: a.domain},
+		Challenges: []Challenge{{Type: "dns-01", URL: ca.srv.URL + "/dns/" + id, Token: a.token}, ch},
+	})
+}
+
+func (ca *testCA) issue(o *testOrder, encodedCSR string) error {
+	der, err := base64.RawURLEncoding.DecodeString(encodedCSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != o.domain {
+		return fmt.Errorf("unexpected names: %v", csr.DNSNames)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.lastID)),
+		Subject:      pkix.Name{CommonName: o.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, tmpl, ca.crt, csr.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	o.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.crt.Raw})...)
+	o.status = StatusValid
+	ca.issued++
+	return nil
+}
+
+// verify checks the JWS signature, nonce and url of the request and returns the account URL and the payload
+func (ca *testCA) verify(req *http.Request) (string, []byte, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := json.Unmarshal(data, &jws); err != nil {
+		return "", nil, err
+	}
+	var h struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		Kid   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}
+	if err := decodeJSON(jws.Protected, &h); err != nil {
+		return "", nil, err
+	}
+	if h.Alg != "ES256" {
+		return "", nil, fmt.Errorf("unsupported alg %s", h.Alg)
+	}
+	if !ca.nonces[h.Nonce] {
+		return "", nil, fmt.Errorf("unknown nonce %s", h.Nonce)
+	}
+	delete(ca.nonces, h.Nonce)
+	if h.URL != ca.srv.URL+req.URL.Path {
+		return "", nil, fmt.Errorf("url mismatch %s", h.URL)
+	}
+
+	kid := h.Kid
+	if req.URL.Path == "/new-account" {
+		x, _ := base64.RawURLEncoding.DecodeString(h.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(h.JWK["y"])
+		kid = ca.srv.URL + "/account/" + ca.nextID()
+		ca.accounts[kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	key, ok := ca.accounts[kid]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown account %s", kid)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(sig) != 64 {
+		return "", nil, fmt.Errorf("bad signature")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return "", nil, fmt.Errorf("signature verification failed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return kid, payload, err
+}
+
+// thumbprint computes RFC 7638 thumbprint, JSON encoder sorts the map keys
+func (ca *testCA) thumbprint(kid string) string {
+	key := ca.accounts[kid]
+	data, _ := json.Marshal(map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	})
+	digest := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func (ca *testCA) problem(w http.ResponseWriter, code int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Problem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: code})
+}
+
+func (ca *testCA) newNonce() string {
+	n := "nonce" + ca.nextID()
+	ca.nonces[n] = true
+	return n
+}
+
+func (ca *testCA) nextID() string {
+	ca.lastID++
+	return fmt.Sprint(ca.lastID)
+}
+
+func decodeJSON(s string, out interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
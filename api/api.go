@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
@@ -44,6 +45,9 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, app *scro
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"GET"}, Handler: c.getListener})
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/listeners/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteListener})
 
+	// Change sets apply several upserts and deletes as one unit
+	app.AddHandler(scroll.Spec{Paths: []string{"/v2/batch"}, Methods: []string{"POST"}, HandlerWithBody: c.applyChangeSet})
+
 	// Top provides top-style realtime statistics about frontends and servers
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/top/frontends"}, Methods: []string{"GET"}, Handler: c.getTopFrontends})
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/top/servers"}, Methods: []string{"GET"}, Handler: c.getTopServers})
@@ -65,6 +69,7 @@ func InitProxyController(ng engine.Engine, stats engine.StatsProvider, app *scro
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers"}, Methods: []string{"POST"}, HandlerWithBody: c.upsertServer})
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"GET"}, Handler: c.getServer})
 	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}"}, Methods: []string{"DELETE"}, Handler: c.deleteServer})
+	app.AddHandler(scroll.Spec{Paths: []string{"/v2/backends/{backendId}/servers/{id}/state"}, Methods: []string{"PUT"}, Handler: c.updateServerState})
 
 	// Middlewares
 	c.app.AddHandler(
@@ -123,6 +128,9 @@ func (c *ProxyController) updateLogSeverity(w http.ResponseWriter, r *http.Reque
 
 func (c *ProxyController) getHosts(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	hosts, err := c.ng.GetHosts()
+	for i := range hosts {
+		setCertificateInfo(&hosts[i])
+	}
 	return scroll.Response{
 		"Hosts": hosts,
 	}, err
@@ -133,9 +141,24 @@ func (c *ProxyController) getHost(w http.ResponseWriter, r *http.Request, params
 	if err != nil {
 		return nil, formatError(err)
 	}
+	setCertificateInfo(h)
+	setETag(w, h.Revision)
 	return formatResult(h, err)
 }
 
+// setCertificateInfo describes the host certificate, so the clients can see when it expires without parsing it
+func setCertificateInfo(h *engine.Host) {
+	if h.Settings.KeyPair == nil {
+		return
+	}
+	info, err := h.Settings.KeyPair.Info()
+	if err != nil {
+		log.Warningf("%s has bad certificate: %s", h, err)
+		return
+	}
+	h.Certificate = info
+}
+
 func (c *ProxyController) getFrontends(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	fs, err := c.ng.GetFrontends()
 	if err != nil {
@@ -168,7 +191,12 @@ func (c *ProxyController) getTopFrontends(w http.ResponseWriter, r *http.Request
 }
 
 func (c *ProxyController) getFrontend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
-	return formatResult(c.ng.GetFrontend(engine.FrontendKey{Id: params["id"]}))
+	f, err := c.ng.GetFrontend(engine.FrontendKey{Id: params["id"]})
+	if err != nil {
+		return nil, formatError(err)
+	}
+	setETag(w, f.Revision)
+	return f, nil
 }
 
 func (c *ProxyController) upsertHost(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -176,8 +204,14 @@ func (c *ProxyController) upsertHost(w http.ResponseWriter, r *http.Request, par
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if err := checkHost(host); err != nil {
+		return nil, formatError(err)
+	}
+	if err := c.ifMatch(r, engine.HostKey{Name: host.Name}, &host.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
 	log.Infof("Upsert %s", host)
-	return formatResult(host, c.ng.UpsertHost(*host))
+	return formatWriteResult(w, host, c.ng.UpsertHost(*host))
 }
 
 func (c *ProxyController) getListeners(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -192,13 +226,21 @@ func (c *ProxyController) upsertListener(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if err := c.ifMatch(r, engine.ListenerKey{Id: listener.Id}, &listener.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
 	log.Infof("Upsert %s", listener)
-	return formatResult(listener, c.ng.UpsertListener(*listener))
+	return formatWriteResult(w, listener, c.ng.UpsertListener(*listener))
 }
 
 func (c *ProxyController) getListener(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	log.Infof("Get Listener(id=%s)", params["id"])
-	return formatResult(c.ng.GetListener(engine.ListenerKey{Id: params["id"]}))
+	l, err := c.ng.GetListener(engine.ListenerKey{Id: params["id"]})
+	if err != nil {
+		return nil, formatError(err)
+	}
+	setETag(w, l.Revision)
+	return l, nil
 }
 
 func (c *ProxyController) deleteListener(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -223,8 +265,11 @@ func (c *ProxyController) upsertBackend(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if err := c.ifMatch(r, engine.BackendKey{Id: b.Id}, &b.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
 	log.Infof("Upsert Backend: %s", b)
-	return formatResult(b, c.ng.UpsertBackend(*b))
+	return formatWriteResult(w, b, c.ng.UpsertBackend(*b))
 }
 
 func (c *ProxyController) deleteBackend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -268,7 +313,12 @@ func (c *ProxyController) getTopServers(w http.ResponseWriter, r *http.Request,
 }
 
 func (c *ProxyController) getBackend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
-	return formatResult(c.ng.GetBackend(engine.BackendKey{Id: params["id"]}))
+	b, err := c.ng.GetBackend(engine.BackendKey{Id: params["id"]})
+	if err != nil {
+		return nil, formatError(err)
+	}
+	setETag(w, b.Revision)
+	return b, nil
 }
 
 func (c *ProxyController) upsertFrontend(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -276,8 +326,11 @@ func (c *ProxyController) upsertFrontend(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return nil, formatError(err)
 	}
+	if err := c.ifMatch(r, engine.FrontendKey{Id: frontend.Id}, &frontend.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
 	log.Infof("Upsert %s", frontend)
-	return formatResult(frontend, c.ng.UpsertFrontend(*frontend, ttl))
+	return formatWriteResult(w, frontend, c.ng.UpsertFrontend(*frontend, ttl))
 }
 
 func (c *ProxyController) deleteFrontend(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -295,8 +348,45 @@ func (c *ProxyController) upsertServer(w http.ResponseWriter, r *http.Request, p
 		return nil, formatError(err)
 	}
 	bk := engine.BackendKey{Id: backendId}
+	if err := c.ifMatch(r, engine.ServerKey{BackendKey: bk, Id: srv.Id}, &srv.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
+	c.keepServerState(bk, srv)
 	log.Infof("Upsert %v %v", bk, srv)
-	return formatResult(srv, c.ng.UpsertServer(bk, *srv, ttl))
+	return formatWriteResult(w, srv, c.ng.UpsertServer(bk, *srv, ttl))
+}
+
+func (c *ProxyController) updateServerState(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
+	srv, err := c.ng.GetServer(sk)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	state := r.Form.Get("state")
+	if state == "" {
+		return nil, formatError(scroll.MissingFieldError{Field: "state"})
+	}
+	if err := srv.SetState(state); err != nil {
+		return nil, formatError(&engine.InvalidFormatError{Message: err.Error()})
+	}
+	// the server is written back with the revision it has been read with, if the client expects it
+	if err := ifMatchCurrent(r, sk, srv.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
+	var ttl time.Duration
+	if v := r.Form.Get("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, formatError(&engine.InvalidFormatError{Message: err.Error()})
+		}
+	} else if srv.Expires != nil {
+		// the server registered with ttl keeps expiring, otherwise it would outlive its registrar
+		ttl = srv.Expires.Sub(time.Now())
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+	}
+	log.Infof("Update %v state to %v", sk, state)
+	return formatWriteResult(w, srv, c.ng.UpsertServer(sk.BackendKey, *srv, ttl))
 }
 
 func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -306,19 +396,42 @@ func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, para
 	if err != nil {
 		return nil, formatError(err)
 	}
+	c.setServerState(sk, srv)
+	setETag(w, srv.Revision)
 	return formatResult(srv, err)
 }
 
 func (c *ProxyController) getServers(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
-	srvs, err := c.ng.GetServers(engine.BackendKey{Id: params["backendId"]})
+	bk := engine.BackendKey{Id: params["backendId"]}
+	srvs, err := c.ng.GetServers(bk)
 	if err != nil {
 		return nil, formatError(err)
 	}
+	for i := range srvs {
+		sk := engine.ServerKey{BackendKey: bk, Id: srvs[i].Id}
+		c.setServerState(sk, &srvs[i])
+	}
 	return scroll.Response{
 		"Servers": srvs,
 	}, nil
 }
 
+// setServerState sets the health, ejection and slow start state of the server as seen by the proxy.
+// The server may be not known to the proxy yet, in this case the state is left empty.
+func (c *ProxyController) setServerState(sk engine.ServerKey, srv *engine.Server) {
+	var err error
+	if srv.Health, err = c.stats.ServerHealth(sk); err == nil {
+		if srv.Ejection, err = c.stats.ServerEjection(sk); err == nil {
+			srv.RampUp, err = c.stats.ServerRampUp(sk)
+		}
+	}
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			log.Warningf("failed to get %v state: %v", sk, err)
+		}
+	}
+}
+
 func (c *ProxyController) deleteServer(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
 	log.Infof("Delete %v", sk)
@@ -334,12 +447,20 @@ func (c *ProxyController) upsertMiddleware(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		return nil, formatError(err)
 	}
-	return formatResult(m, c.ng.UpsertMiddleware(engine.FrontendKey{Id: frontend}, *m, ttl))
+	if err := c.ifMatch(r, engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: frontend}, Id: m.Id}, &m.Revision); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
+	return formatWriteResult(w, m, c.ng.UpsertMiddleware(engine.FrontendKey{Id: frontend}, *m, ttl))
 }
 
 func (c *ProxyController) getMiddleware(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
 	fk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
-	return formatResult(c.ng.GetMiddleware(fk))
+	m, err := c.ng.GetMiddleware(fk)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	setETag(w, m.Revision)
+	return m, nil
 }
 
 func (c *ProxyController) getMiddlewares(w http.ResponseWriter, r *http.Request, params map[string]string) (interface{}, error) {
@@ -361,10 +482,199 @@ func (c *ProxyController) deleteMiddleware(w http.ResponseWriter, r *http.Reques
 	return scroll.Response{"message": "Middleware deleted"}, nil
 }
 
+func (c *ProxyController) applyChangeSet(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	cs, err := parseChangeSetPack(c.ng.GetRegistry(), body)
+	if err != nil {
+		return nil, formatError(err)
+	}
+	for _, ch := range cs.Changes {
+		switch e := ch.Event.(type) {
+		case *engine.HostUpserted:
+			if err := checkHost(&e.Host); err != nil {
+				return nil, formatError(err)
+			}
+		case *engine.ServerUpserted:
+			c.keepServerState(e.BackendKey, &e.Server)
+		}
+	}
+	log.Infof("Apply %v", cs)
+	if err := c.ng.Apply(*cs); err != nil {
+		return formatWriteResult(w, nil, err)
+	}
+	if p, ok := c.ng.(engine.PartialApplier); ok && p.AppliesPartially() {
+		return scroll.Response{
+			"message": fmt.Sprintf("%d changes applied one by one, the engine does not apply change sets as one unit", len(cs.Changes)),
+			"atomic":  false,
+		}, nil
+	}
+	return scroll.Response{"message": fmt.Sprintf("%d changes applied", len(cs.Changes)), "atomic": true}, nil
+}
+
+// keepServerState keeps the current administrative state of the server upserted without the state,
+// heartbeats do not know about the administrative state of the server
+func (c *ProxyController) keepServerState(bk engine.BackendKey, srv *engine.Server) {
+	if srv.State != "" {
+		return
+	}
+	existing, err := c.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	if err == nil {
+		srv.State = existing.State
+	}
+}
+
+const (
+	// ConflictHeader is set on the 409 Conflict response when the object has been changed since
+	// the revision the client expected, it is not set when the object already exists
+	ConflictHeader = "X-Vulcand-Conflict"
+	// RevisionConflict is the value of the ConflictHeader for the revision conflicts
+	RevisionConflict = "revision"
+)
+
+// setETag sets the ETag header to the revision of the object, the clients send it back in the If-Match header
+// to update the object only if nobody else has changed it since
+func setETag(w http.ResponseWriter, revision int64) {
+	if revision != 0 {
+		w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+	}
+}
+
+// ifMatch sets the expected revision of the upserted object from the If-Match header,
+// without the header the revision in the object body is expected. The header is either "*" matching
+// any current revision of the object, or the list of ETags matching any of them, in both cases
+// the current revision of the object is read by its key and expected unless it does not match.
+func (c *ProxyController) ifMatch(r *http.Request, key interface{}, revision *int64) error {
+	revs, any, err := parseIfMatch(r)
+	if err != nil || (len(revs) == 0 && !any) {
+		return err
+	}
+	if *revision != 0 {
+		if !any && !hasRevision(revs, *revision) {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("revision %d of the object does not match If-Match %s", *revision, r.Header.Get("If-Match"))}
+		}
+		return nil
+	}
+	if !any && len(revs) == 1 {
+		*revision = revs[0]
+		return nil
+	}
+	rev, err := c.storedRevision(key)
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return &engine.RevisionConflictError{Message: fmt.Sprintf("%v does not exist, If-Match %s", key, r.Header.Get("If-Match"))}
+		}
+		return err
+	}
+	if err := ifMatchCurrent(r, key, rev); err != nil {
+		return err
+	}
+	*revision = rev
+	return nil
+}
+
+// ifMatchCurrent checks the current revision of the object against the If-Match header
+func ifMatchCurrent(r *http.Request, key interface{}, rev int64) error {
+	revs, any, err := parseIfMatch(r)
+	if err != nil {
+		return err
+	}
+	if !any && len(revs) != 0 && !hasRevision(revs, rev) {
+		return &engine.RevisionConflictError{Message: fmt.Sprintf("revision %d of %v does not match If-Match %s", rev, key, r.Header.Get("If-Match"))}
+	}
+	return nil
+}
+
+// parseIfMatch returns the revisions from the If-Match header and whether the header is "*"
+func parseIfMatch(r *http.Request) ([]int64, bool, error) {
+	v := strings.Join(r.Header["If-Match"], ",")
+	var revs []int64
+	any := false
+	for _, tag := range strings.Split(v, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if tag == "*" {
+			any = true
+			continue
+		}
+		rev, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+		if err != nil || rev <= 0 {
+			return nil, false, &engine.InvalidFormatError{Message: fmt.Sprintf("If-Match should be * or the ETags of the object, got %s", v)}
+		}
+		revs = append(revs, rev)
+	}
+	return revs, any, nil
+}
+
+func hasRevision(revs []int64, rev int64) bool {
+	for _, r := range revs {
+		if r == rev {
+			return true
+		}
+	}
+	return false
+}
+
+// storedRevision returns the revision of the stored object by its key
+func (c *ProxyController) storedRevision(key interface{}) (int64, error) {
+	switch k := key.(type) {
+	case engine.HostKey:
+		h, err := c.ng.GetHost(k)
+		if err != nil {
+			return 0, err
+		}
+		return h.Revision, nil
+	case engine.ListenerKey:
+		l, err := c.ng.GetListener(k)
+		if err != nil {
+			return 0, err
+		}
+		return l.Revision, nil
+	case engine.BackendKey:
+		b, err := c.ng.GetBackend(k)
+		if err != nil {
+			return 0, err
+		}
+		return b.Revision, nil
+	case engine.ServerKey:
+		s, err := c.ng.GetServer(k)
+		if err != nil {
+			return 0, err
+		}
+		return s.Revision, nil
+	case engine.FrontendKey:
+		f, err := c.ng.GetFrontend(k)
+		if err != nil {
+			return 0, err
+		}
+		return f.Revision, nil
+	case engine.MiddlewareKey:
+		m, err := c.ng.GetMiddleware(k)
+		if err != nil {
+			return 0, err
+		}
+		return m.Revision, nil
+	}
+	return 0, fmt.Errorf("unsupported key: %#v", key)
+}
+
+// checkHost checks the key pair of the host and drops the certificate info, that is never stored
+func checkHost(host *engine.Host) error {
+	if host.Settings.KeyPair != nil {
+		if err := host.Settings.KeyPair.Check(time.Now()); err != nil {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("bad key pair: %s", err)}
+		}
+	}
+	host.Certificate = nil
+	return nil
+}
+
 func formatError(e error) error {
 	switch err := e.(type) {
 	case *engine.AlreadyExistsError:
 		return scroll.ConflictError{Description: err.Error()}
+	case *engine.RevisionConflictError:
+		return scroll.ConflictError{Description: err.Error()}
 	case *engine.NotFoundError:
 		return scroll.NotFoundError{Description: err.Error()}
 	case *engine.InvalidFormatError:
@@ -377,6 +687,15 @@ func formatError(e error) error {
 	return scroll.GenericAPIError{Reason: e.Error()}
 }
 
+// formatWriteResult formats the result of the write, marking the revision conflicts with the conflict header,
+// the API responds with 409 Conflict to them and to the objects that already exist
+func formatWriteResult(w http.ResponseWriter, in interface{}, err error) (interface{}, error) {
+	if _, ok := err.(*engine.RevisionConflictError); ok {
+		w.Header().Set(ConflictHeader, RevisionConflict)
+	}
+	return formatResult(in, err)
+}
+
 func formatResult(in interface{}, err error) (interface{}, error) {
 	if err != nil {
 		return nil, formatError(err)
@@ -439,6 +758,227 @@ type serverPack struct {
 	TTL    string
 }
 
+// changeSetPack is the change set accepted by the batch API, every change either upserts or deletes one object:
+//
+//	{"Upsert": {"Frontend": {...}, "TTL": "10s"}}
+//	{"Upsert": {"BackendId": "b1", "Server": {...}}}
+//	{"Delete": {"FrontendId": "f1", "Middleware": "m1"}}
+type changeSetPack struct {
+	Changes []changePack
+}
+
+type changePack struct {
+	Upsert *upsertPack `json:",omitempty"`
+	Delete *deletePack `json:",omitempty"`
+}
+
+type upsertPack struct {
+	Host       *engine.Host       `json:",omitempty"`
+	Listener   *engine.Listener   `json:",omitempty"`
+	Backend    *engine.Backend    `json:",omitempty"`
+	Server     *engine.Server     `json:",omitempty"`
+	Frontend   *engine.Frontend   `json:",omitempty"`
+	Middleware *engine.Middleware `json:",omitempty"`
+	// BackendId is the backend of the server, FrontendId is the frontend of the middleware
+	BackendId  string `json:",omitempty"`
+	FrontendId string `json:",omitempty"`
+	TTL        string `json:",omitempty"`
+}
+
+type upsertReadPack struct {
+	Host       json.RawMessage
+	Listener   json.RawMessage
+	Backend    json.RawMessage
+	Server     json.RawMessage
+	Frontend   json.RawMessage
+	Middleware json.RawMessage
+	BackendId  string
+	FrontendId string
+	TTL        string
+}
+
+// deletePack has the id of the deleted object, BackendId and FrontendId are the parents of the servers and middlewares
+type deletePack struct {
+	Host       string `json:",omitempty"`
+	Listener   string `json:",omitempty"`
+	Backend    string `json:",omitempty"`
+	Server     string `json:",omitempty"`
+	Frontend   string `json:",omitempty"`
+	Middleware string `json:",omitempty"`
+	BackendId  string `json:",omitempty"`
+	FrontendId string `json:",omitempty"`
+}
+
+type changeSetReadPack struct {
+	Changes []struct {
+		Upsert *upsertReadPack
+		Delete *deletePack
+	}
+}
+
+func parseChangeSetPack(r *plugin.Registry, v []byte) (*engine.ChangeSet, error) {
+	var cp changeSetReadPack
+	if err := json.Unmarshal(v, &cp); err != nil {
+		return nil, err
+	}
+	cs := &engine.ChangeSet{}
+	for i, p := range cp.Changes {
+		var ch *engine.Change
+		var err error
+		switch {
+		case p.Upsert != nil && p.Delete == nil:
+			ch, err = parseUpsertPack(r, p.Upsert)
+		case p.Delete != nil && p.Upsert == nil:
+			ch, err = parseDeletePack(p.Delete)
+		default:
+			err = fmt.Errorf("expected either Upsert or Delete")
+		}
+		if err != nil {
+			return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("change %d: %s", i, err)}
+		}
+		cs.Changes = append(cs.Changes, *ch)
+	}
+	return cs, cs.Check()
+}
+
+func parseUpsertPack(r *plugin.Registry, p *upsertReadPack) (*engine.Change, error) {
+	ttl, err := parseTTL(p.TTL)
+	if err != nil {
+		return nil, err
+	}
+	ch := &engine.Change{TTL: ttl}
+	found := 0
+	if len(p.Host) != 0 {
+		found++
+		h, err := engine.HostFromJSON(p.Host)
+		if err != nil {
+			return nil, err
+		}
+		ch.Event = &engine.HostUpserted{Host: *h}
+	}
+	if len(p.Listener) != 0 {
+		found++
+		l, err := engine.ListenerFromJSON(p.Listener)
+		if err != nil {
+			return nil, err
+		}
+		ch.Event = &engine.ListenerUpserted{Listener: *l}
+	}
+	if len(p.Backend) != 0 {
+		found++
+		b, err := engine.BackendFromJSON(p.Backend)
+		if err != nil {
+			return nil, err
+		}
+		ch.Event = &engine.BackendUpserted{Backend: *b}
+	}
+	if len(p.Server) != 0 {
+		found++
+		s, err := engine.ServerFromJSON(p.Server)
+		if err != nil {
+			return nil, err
+		}
+		// Stats, health, ejection and ramp up are the runtime state and are never stored
+		s.Stats, s.Health, s.Ejection, s.RampUp = nil, nil, nil, nil
+		ch.Event = &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: p.BackendId}, Server: *s}
+	}
+	if len(p.Frontend) != 0 {
+		found++
+		f, err := engine.FrontendFromJSON(r.GetRouter(), p.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		ch.Event = &engine.FrontendUpserted{Frontend: *f}
+	}
+	if len(p.Middleware) != 0 {
+		found++
+		m, err := engine.MiddlewareFromJSON(p.Middleware, r.GetSpec)
+		if err != nil {
+			return nil, err
+		}
+		ch.Event = &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: p.FrontendId}, Middleware: *m}
+	}
+	if found != 1 {
+		return nil, fmt.Errorf("expected one of Host, Listener, Backend, Server, Frontend or Middleware to upsert")
+	}
+	return ch, nil
+}
+
+func parseDeletePack(p *deletePack) (*engine.Change, error) {
+	var events []interface{}
+	if p.Host != "" {
+		events = append(events, &engine.HostDeleted{HostKey: engine.HostKey{Name: p.Host}})
+	}
+	if p.Listener != "" {
+		events = append(events, &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: p.Listener}})
+	}
+	if p.Backend != "" {
+		events = append(events, &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: p.Backend}})
+	}
+	if p.Server != "" {
+		events = append(events, &engine.ServerDeleted{
+			ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: p.BackendId}, Id: p.Server}})
+	}
+	if p.Frontend != "" {
+		events = append(events, &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: p.Frontend}})
+	}
+	if p.Middleware != "" {
+		events = append(events, &engine.MiddlewareDeleted{
+			MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: p.FrontendId}, Id: p.Middleware}})
+	}
+	if len(events) != 1 {
+		return nil, fmt.Errorf("expected one of Host, Listener, Backend, Server, Frontend or Middleware to delete")
+	}
+	return &engine.Change{Event: events[0]}, nil
+}
+
+// newChangeSetPack converts the change set to the format accepted by the batch API
+func newChangeSetPack(cs engine.ChangeSet) (*changeSetPack, error) {
+	out := &changeSetPack{Changes: make([]changePack, len(cs.Changes))}
+	for i, c := range cs.Changes {
+		var ttl string
+		if c.TTL != 0 {
+			ttl = c.TTL.String()
+		}
+		switch ch := c.Event.(type) {
+		case *engine.HostUpserted:
+			out.Changes[i].Upsert = &upsertPack{Host: &ch.Host}
+		case *engine.HostDeleted:
+			out.Changes[i].Delete = &deletePack{Host: ch.HostKey.Name}
+		case *engine.ListenerUpserted:
+			out.Changes[i].Upsert = &upsertPack{Listener: &ch.Listener}
+		case *engine.ListenerDeleted:
+			out.Changes[i].Delete = &deletePack{Listener: ch.ListenerKey.Id}
+		case *engine.BackendUpserted:
+			out.Changes[i].Upsert = &upsertPack{Backend: &ch.Backend}
+		case *engine.BackendDeleted:
+			out.Changes[i].Delete = &deletePack{Backend: ch.BackendKey.Id}
+		case *engine.ServerUpserted:
+			out.Changes[i].Upsert = &upsertPack{Server: &ch.Server, BackendId: ch.BackendKey.Id, TTL: ttl}
+		case *engine.ServerDeleted:
+			out.Changes[i].Delete = &deletePack{Server: ch.ServerKey.Id, BackendId: ch.ServerKey.BackendKey.Id}
+		case *engine.FrontendUpserted:
+			out.Changes[i].Upsert = &upsertPack{Frontend: &ch.Frontend, TTL: ttl}
+		case *engine.FrontendDeleted:
+			out.Changes[i].Delete = &deletePack{Frontend: ch.FrontendKey.Id}
+		case *engine.MiddlewareUpserted:
+			out.Changes[i].Upsert = &upsertPack{Middleware: &ch.Middleware, FrontendId: ch.FrontendKey.Id, TTL: ttl}
+		case *engine.MiddlewareDeleted:
+			out.Changes[i].Delete = &deletePack{Middleware: ch.MiddlewareKey.Id, FrontendId: ch.MiddlewareKey.FrontendKey.Id}
+		default:
+			return nil, fmt.Errorf("unsupported change: %#v", c.Event)
+		}
+	}
+	return out, nil
+}
+
+func parseTTL(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
 func parseListenerPack(v []byte) (*engine.Listener, error) {
 	var lp listenerReadPack
 	if err := json.Unmarshal(v, &lp); err != nil {
@@ -529,6 +1069,8 @@ func parseServerPack(v []byte) (*engine.Server, time.Duration, error) {
 	if err != nil {
 		return nil, 0, err
 	}
+	// Stats, health, ejection and ramp up are the runtime state and are never stored
+	s.Stats, s.Health, s.Ejection, s.RampUp = nil, nil, nil, nil
 	var ttl time.Duration
 	if sp.TTL != "" {
 		ttl, err = time.ParseDuration(sp.TTL)
@@ -1,9 +1,11 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/scroll"
@@ -24,6 +26,7 @@ func TestApi(t *testing.T) { TestingT(t) }
 
 type ApiSuite struct {
 	ng         engine.Engine
+	sv         *supervisor.Supervisor
 	testServer *httptest.Server
 	client     *Client
 }
@@ -41,10 +44,10 @@ func (s *ApiSuite) SetUpTest(c *C) {
 
 	s.ng = memng.New(registry.GetRegistry())
 
-	sv := supervisor.New(newProxy, s.ng, make(chan error), supervisor.Options{})
+	s.sv = supervisor.New(newProxy, s.ng, make(chan error), supervisor.Options{})
 
 	app := scroll.NewApp()
-	InitProxyController(s.ng, sv, app)
+	InitProxyController(s.ng, s.sv, app)
 	s.testServer = httptest.NewServer(app.GetHandler())
 	s.client = NewClient(s.testServer.URL, registry.GetRegistry())
 }
@@ -117,6 +120,40 @@ func (s *ApiSuite) TestHostCRUD(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *ApiSuite) TestHostCertificate(c *C) {
+	host := engine.Host{Name: "localhost"}
+	host.Settings.KeyPair = testutils.NewTestKeyPair()
+	c.Assert(s.client.UpsertHost(host), IsNil)
+
+	out, err := s.client.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(out.Certificate, NotNil)
+	c.Assert(out.Certificate.Subject, Equals, "O=Acme Co")
+	c.Assert(out.Certificate.NotAfter.Year(), Equals, 2049)
+
+	hosts, err := s.client.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hosts[0].Certificate, DeepEquals, out.Certificate)
+
+	// Certificate info is not stored
+	stored, err := s.ng.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(stored.Certificate, IsNil)
+}
+
+func (s *ApiSuite) TestHostBadKeyPair(c *C) {
+	keyPair := testutils.NewTestKeyPair()
+
+	// The chain is not signed by the second certificate
+	host := engine.Host{Name: "localhost", Settings: engine.HostSettings{
+		KeyPair: &engine.KeyPair{Key: keyPair.Key, Cert: testutils.LocalhostCertChain},
+	}}
+	c.Assert(s.client.UpsertHost(host), NotNil)
+
+	_, err := s.ng.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
 func (s *ApiSuite) TestHostDeleteBad(c *C) {
 	err := s.client.DeleteHost(engine.HostKey{Name: "localhost"})
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
@@ -130,6 +167,8 @@ func (s *ApiSuite) TestBackendCRUD(c *C) {
 
 	bs, _ := s.ng.GetBackends()
 	c.Assert(len(bs), Equals, 1)
+	c.Assert(bs[0].Revision, Not(Equals), int64(0))
+	b.Revision = bs[0].Revision
 	c.Assert(bs[0], DeepEquals, *b)
 
 	bs, err = s.client.GetBackends()
@@ -149,6 +188,8 @@ func (s *ApiSuite) TestBackendCRUD(c *C) {
 
 	out, err = s.client.GetBackend(bk)
 	c.Assert(err, IsNil)
+	c.Assert(out.Revision, Not(Equals), b.Revision)
+	b.Revision = out.Revision
 	c.Assert(out, DeepEquals, b)
 
 	err = s.client.DeleteBackend(bk)
@@ -173,6 +214,7 @@ func (s *ApiSuite) TestServerCRUD(c *C) {
 
 	srvs, _ := s.ng.GetServers(bk)
 	c.Assert(len(srvs), Equals, 2)
+	srv1.Revision, srv2.Revision = srvs[0].Revision, srvs[1].Revision
 	c.Assert(srvs[0], DeepEquals, srv1)
 	c.Assert(srvs[1], DeepEquals, srv2)
 
@@ -192,6 +234,7 @@ func (s *ApiSuite) TestServerCRUD(c *C) {
 
 	out, err = s.client.GetServer(sk)
 	c.Assert(err, IsNil)
+	srv1.Revision = out.Revision
 	c.Assert(out, DeepEquals, &srv1)
 
 	err = s.client.DeleteServer(sk)
@@ -201,6 +244,86 @@ func (s *ApiSuite) TestServerCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestServerState(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{Id: srv.Id, BackendKey: bk}
+	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
+
+	c.Assert(s.client.UpdateServerState(sk, engine.ServerStateDraining, 0), IsNil)
+
+	out, err := s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out.State, Equals, engine.ServerStateDraining)
+
+	// Heartbeats do not reset the state of the server
+	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
+
+	out, err = s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out.State, Equals, engine.ServerStateDraining)
+
+	c.Assert(s.client.UpdateServerState(sk, engine.ServerStateActive, 0), IsNil)
+
+	out, err = s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out.State, Equals, engine.ServerStateActive)
+
+	c.Assert(s.client.UpdateServerState(sk, "sleeping", 0), NotNil)
+
+	err = s.client.UpdateServerState(engine.ServerKey{Id: "srv2", BackendKey: bk}, engine.ServerStateDraining, 0)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+// ttlEngine reports all servers as registered with TTL and records the TTL of the last server upsert
+type ttlEngine struct {
+	engine.Engine
+	expires time.Time
+	ttl     time.Duration
+}
+
+func (e *ttlEngine) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	srv, err := e.Engine.GetServer(sk)
+	if err == nil {
+		srv.Expires = &e.expires
+	}
+	return srv, err
+}
+
+func (e *ttlEngine) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.Duration) error {
+	e.ttl = ttl
+	return e.Engine.UpsertServer(bk, srv, ttl)
+}
+
+func (s *ApiSuite) TestServerStateKeepsTTL(c *C) {
+	ng := &ttlEngine{Engine: s.ng, expires: time.Now().Add(time.Minute)}
+	app := scroll.NewApp()
+	InitProxyController(ng, s.sv, app)
+	srv := httptest.NewServer(app.GetHandler())
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertBackend(*b), IsNil)
+
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{Id: "srv1", BackendKey: bk}
+	c.Assert(client.UpsertServer(bk, engine.Server{Id: sk.Id, URL: "http://localhost:5000"}, time.Minute), IsNil)
+
+	// The server keeps expiring instead of becoming permanent
+	c.Assert(client.UpdateServerState(sk, engine.ServerStateDraining, 0), IsNil)
+	c.Assert(ng.ttl > 50*time.Second && ng.ttl <= time.Minute, Equals, true)
+
+	c.Assert(client.UpdateServerState(sk, engine.ServerStateActive, time.Hour), IsNil)
+	c.Assert(ng.ttl, Equals, time.Hour)
+}
+
 func (s *ApiSuite) TestFrontendCRUD(c *C) {
 	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
 	c.Assert(err, IsNil)
@@ -215,6 +338,7 @@ func (s *ApiSuite) TestFrontendCRUD(c *C) {
 
 	fs, err := s.client.GetFrontends()
 	c.Assert(err, IsNil)
+	f.Revision = fs[0].Revision
 	c.Assert(fs[0], DeepEquals, *f)
 
 	out, err := s.client.GetFrontend(fk)
@@ -241,6 +365,7 @@ func (s *ApiSuite) TestListenerCRUD(c *C) {
 
 	ls, err := s.client.GetListeners()
 	c.Assert(err, IsNil)
+	l.Revision = ls[0].Revision
 	c.Assert(ls[0], DeepEquals, l)
 
 	lk := engine.ListenerKey{Id: l.Id}
@@ -271,6 +396,7 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 
 	ms, err := s.client.GetMiddlewares(fk)
 	c.Assert(err, IsNil)
+	cl.Revision = ms[0].Revision
 	c.Assert(ms[0], DeepEquals, cl)
 
 	cl = s.makeConnLimit("c1", 10, "client.ip", 3, f)
@@ -279,6 +405,7 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 	mk := engine.MiddlewareKey{Id: cl.Id, FrontendKey: fk}
 	v, err := s.client.GetMiddleware(mk)
 	c.Assert(err, IsNil)
+	cl.Revision = v.Revision
 	c.Assert(v, DeepEquals, &cl)
 
 	c.Assert(s.client.DeleteMiddleware(mk), IsNil)
@@ -288,6 +415,184 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 
 }
 
+func (s *ApiSuite) TestApplyChangeSet(c *C) {
+	b0, err := engine.NewHTTPBackend("b0", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b0), IsNil)
+
+	b1, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b1.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	cl := s.makeConnLimit("c1", 10, "client.ip", 2, f)
+
+	err = s.client.Apply(engine.ChangeSet{Changes: []engine.Change{
+		{Event: &engine.BackendUpserted{Backend: *b1}},
+		{Event: &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: b1.Id}, Server: srv}, TTL: time.Minute},
+		{Event: &engine.FrontendUpserted{Frontend: *f}},
+		{Event: &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: cl}},
+		{Event: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: b0.Id}}},
+	}})
+	c.Assert(err, IsNil)
+
+	out, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out.BackendId, Equals, b1.Id)
+
+	m, err := s.client.GetMiddleware(engine.MiddlewareKey{Id: cl.Id, FrontendKey: fk})
+	c.Assert(err, IsNil)
+	cl.Revision = m.Revision
+	c.Assert(m, DeepEquals, &cl)
+
+	srvs, err := s.client.GetServers(engine.BackendKey{Id: b1.Id})
+	c.Assert(err, IsNil)
+	c.Assert(len(srvs), Equals, 1)
+	srv.Revision = srvs[0].Revision
+	c.Assert(srvs, DeepEquals, []engine.Server{srv})
+
+	_, err = s.client.GetBackend(engine.BackendKey{Id: b0.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// the change set fails as a whole when any of the changes fail
+	err = s.client.Apply(engine.ChangeSet{Changes: []engine.Change{
+		{Event: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: b1.Id}}},
+		{Event: &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: "missing"}}},
+	}})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	_, err = s.client.GetBackend(engine.BackendKey{Id: b1.Id})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.client.Apply(engine.ChangeSet{}), NotNil)
+}
+
+func (s *ApiSuite) TestRevisionConflict(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+
+	first, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	second, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+
+	first.Route = `Path("/v1")`
+	c.Assert(s.client.UpsertFrontend(*first, 0), IsNil)
+
+	// The second upsert does not overwrite the first one
+	second.Route = `Path("/v2")`
+	err = s.client.UpsertFrontend(*second, 0)
+	c.Assert(err, FitsTypeOf, &engine.RevisionConflictError{})
+
+	out, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Route, Equals, `Path("/v1")`)
+
+	// Unconditional upserts still overwrite the frontend
+	second.Revision = 0
+	c.Assert(s.client.UpsertFrontend(*second, 0), IsNil)
+
+	out, err = s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Route, Equals, `Path("/v2")`)
+}
+
+func (s *ApiSuite) TestETag(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	stored, err := s.ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+
+	re, _, err := oxytest.Get(s.client.endpoint("backends", b.Id))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("ETag"), Equals, fmt.Sprintf(`"%d"`, stored.Revision))
+
+	post := func(body, ifMatch string) *http.Response {
+		re, _, err := oxytest.MakeRequest(s.client.endpoint("backends"),
+			oxytest.Method("POST"), oxytest.Body(body),
+			oxytest.Header("Content-Type", "application/json"), oxytest.Header("If-Match", ifMatch))
+		c.Assert(err, IsNil)
+		return re
+	}
+	body := `{"Backend": {"Id": "b1", "Type": "http"}}`
+	c.Assert(post(body, "bad").StatusCode, Equals, http.StatusBadRequest)
+	// The revision in the body has to agree with the If-Match header
+	mismatch := fmt.Sprintf(`{"Backend": {"Id": "b1", "Type": "http", "Revision": %d}}`, stored.Revision+1)
+	c.Assert(post(mismatch, re.Header.Get("ETag")).StatusCode, Equals, http.StatusBadRequest)
+
+	c.Assert(post(body, re.Header.Get("ETag")).StatusCode, Equals, http.StatusOK)
+	// The backend has been changed by the previous request
+	conflict := post(body, re.Header.Get("ETag"))
+	c.Assert(conflict.StatusCode, Equals, http.StatusConflict)
+	c.Assert(conflict.Header.Get(ConflictHeader), Equals, RevisionConflict)
+
+	// Any of the listed ETags matches the current revision
+	stored, err = s.ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(post(body, fmt.Sprintf(`"%d", "%d"`, stored.Revision+1, stored.Revision)).StatusCode, Equals, http.StatusOK)
+
+	conflict = post(body, fmt.Sprintf(`"%d", "%d"`, stored.Revision, stored.Revision+1))
+	c.Assert(conflict.StatusCode, Equals, http.StatusConflict)
+	c.Assert(conflict.Header.Get(ConflictHeader), Equals, RevisionConflict)
+
+	// Star matches any current revision, but not the missing object
+	c.Assert(post(body, "*").StatusCode, Equals, http.StatusOK)
+	conflict = post(`{"Backend": {"Id": "b2", "Type": "http"}}`, "*")
+	c.Assert(conflict.StatusCode, Equals, http.StatusConflict)
+	c.Assert(conflict.Header.Get(ConflictHeader), Equals, RevisionConflict)
+}
+
+func (s *ApiSuite) TestUpdateRetries(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{Id: srv.Id, BackendKey: bk}
+	c.Assert(s.client.UpsertServer(bk, srv, 0), IsNil)
+
+	attempts := 0
+	err = s.client.UpdateServer(sk, 0, func(srv *engine.Server) error {
+		attempts++
+		if attempts == 1 {
+			// Someone else changes the server after it has been read
+			c.Assert(s.client.UpsertServer(bk, engine.Server{Id: srv.Id, URL: "http://localhost:5001"}, 0), IsNil)
+		}
+		c.Assert(srv.SetState(engine.ServerStateDraining), IsNil)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(attempts, Equals, 2)
+
+	// The update is applied to the latest server
+	out, err := s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out.URL, Equals, "http://localhost:5001")
+	c.Assert(out.State, Equals, engine.ServerStateDraining)
+
+	// The update gives up after a number of attempts
+	attempts = 0
+	err = s.client.UpdateServer(sk, 0, func(srv *engine.Server) error {
+		attempts++
+		c.Assert(s.client.UpsertServer(bk, engine.Server{Id: srv.Id, URL: "http://localhost:5002"}, 0), IsNil)
+		return nil
+	})
+	c.Assert(err, FitsTypeOf, &engine.RevisionConflictError{})
+	c.Assert(attempts, Equals, UpdateAttempts)
+}
+
 func (s *ApiSuite) makeConnLimit(id string, connections int64, variable string, priority int, f *engine.Frontend) engine.Middleware {
 	cl, err := connlimit.NewConnLimit(connections, variable)
 	if err != nil {
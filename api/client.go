@@ -19,6 +19,10 @@ import (
 
 const CurrentVersion = "v2"
 
+// UpdateAttempts is the number of times the Update helpers read, change and write the object
+// before giving up with engine.RevisionConflictError
+const UpdateAttempts = 5
+
 type Client struct {
 	Addr     string
 	Registry *plugin.Registry
@@ -65,16 +69,47 @@ func (c *Client) GetHost(hk engine.HostKey) (*engine.Host, error) {
 	return engine.HostFromJSON(response)
 }
 
+// UpsertHost writes the host, the host with non zero revision is written only if it has not been changed since it
+// has been read, otherwise engine.RevisionConflictError is returned
 func (c *Client) UpsertHost(h engine.Host) error {
 	_, err := c.Post(c.endpoint("hosts"), hostPack{Host: h})
 	return err
 }
 
+// UpdateHost reads the host, changes it with the function and writes it back, starting over if the host
+// has been changed by someone else in between
+func (c *Client) UpdateHost(hk engine.HostKey, fn func(*engine.Host) error) error {
+	return retryConflicts(func() error {
+		h, err := c.GetHost(hk)
+		if err != nil {
+			return err
+		}
+		if err := fn(h); err != nil {
+			return err
+		}
+		return c.UpsertHost(*h)
+	})
+}
+
 func (c *Client) UpsertListener(l engine.Listener) error {
 	_, err := c.Post(c.endpoint("listeners"), listenerPack{Listener: l})
 	return err
 }
 
+// UpdateListener is UpdateHost for the listeners
+func (c *Client) UpdateListener(lk engine.ListenerKey, fn func(*engine.Listener) error) error {
+	return retryConflicts(func() error {
+		l, err := c.GetListener(lk)
+		if err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+		return c.UpsertListener(*l)
+	})
+}
+
 func (c *Client) GetListener(lk engine.ListenerKey) (*engine.Listener, error) {
 	data, err := c.Get(c.endpoint("listeners", lk.Id), url.Values{})
 	if err != nil {
@@ -104,6 +139,20 @@ func (c *Client) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	return err
 }
 
+// UpdateFrontend is UpdateHost for the frontends
+func (c *Client) UpdateFrontend(fk engine.FrontendKey, ttl time.Duration, fn func(*engine.Frontend) error) error {
+	return retryConflicts(func() error {
+		f, err := c.GetFrontend(fk)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		return c.UpsertFrontend(*f, ttl)
+	})
+}
+
 func (c *Client) GetFrontend(fk engine.FrontendKey) (*engine.Frontend, error) {
 	response, err := c.Get(c.endpoint("frontends", fk.Id), url.Values{})
 	if err != nil {
@@ -146,6 +195,20 @@ func (c *Client) UpsertBackend(b engine.Backend) error {
 	return err
 }
 
+// UpdateBackend is UpdateHost for the backends
+func (c *Client) UpdateBackend(bk engine.BackendKey, fn func(*engine.Backend) error) error {
+	return retryConflicts(func() error {
+		b, err := c.GetBackend(bk)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+		return c.UpsertBackend(*b)
+	})
+}
+
 func (c *Client) DeleteBackend(bk engine.BackendKey) error {
 	return c.Delete(c.endpoint("backends", bk.Id))
 }
@@ -174,6 +237,20 @@ func (c *Client) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.
 	return err
 }
 
+// UpdateServer is UpdateHost for the servers
+func (c *Client) UpdateServer(sk engine.ServerKey, ttl time.Duration, fn func(*engine.Server) error) error {
+	return retryConflicts(func() error {
+		srv, err := c.GetServer(sk)
+		if err != nil {
+			return err
+		}
+		if err := fn(srv); err != nil {
+			return err
+		}
+		return c.UpsertServer(sk.BackendKey, *srv, ttl)
+	})
+}
+
 func (c *Client) TopServers(bk *engine.BackendKey, limit int) ([]engine.Server, error) {
 	values := url.Values{
 		"limit": {fmt.Sprintf("%d", limit)},
@@ -211,6 +288,23 @@ func (c *Client) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	return engine.ServersFromJSON(data)
 }
 
+// UpdateServerState changes the administrative state of the server, e.g. drains it.
+// Zero ttl keeps the server expiring when it has been registered with ttl, and permanent otherwise.
+// The state is retried if the server has been changed, e.g. by a heartbeat, while the state was being updated.
+func (c *Client) UpdateServerState(sk engine.ServerKey, state string, ttl time.Duration) error {
+	if sk.BackendKey.Id == "" || sk.Id == "" {
+		return fmt.Errorf("backend id and server id can not be empty")
+	}
+	values := url.Values{"state": {state}}
+	if ttl != 0 {
+		values.Set("ttl", ttl.String())
+	}
+	return retryConflicts(func() error {
+		// the server is always updated with the revision it has been read with
+		return c.PutForm(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "state"), values)
+	})
+}
+
 func (c *Client) DeleteServer(sk engine.ServerKey) error {
 	if sk.BackendKey.Id == "" {
 		return fmt.Errorf("backend id can not be empty")
@@ -227,6 +321,20 @@ func (c *Client) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, tt
 	return err
 }
 
+// UpdateMiddleware is UpdateHost for the middlewares
+func (c *Client) UpdateMiddleware(mk engine.MiddlewareKey, ttl time.Duration, fn func(*engine.Middleware) error) error {
+	return retryConflicts(func() error {
+		m, err := c.GetMiddleware(mk)
+		if err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		return c.UpsertMiddleware(mk.FrontendKey, *m, ttl)
+	})
+}
+
 func (c *Client) GetMiddleware(mk engine.MiddlewareKey) (*engine.Middleware, error) {
 	data, err := c.Get(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id), url.Values{})
 	if err != nil {
@@ -247,6 +355,17 @@ func (c *Client) DeleteMiddleware(mk engine.MiddlewareKey) error {
 	return c.Delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
 }
 
+// Apply applies the change set as one unit, either all of the changes are applied or none of them.
+// The etcd v2 engine checks the change set up front but applies its changes one by one, see engine.PartialApplier.
+func (c *Client) Apply(cs engine.ChangeSet) error {
+	pack, err := newChangeSetPack(cs)
+	if err != nil {
+		return err
+	}
+	_, err = c.Post(c.endpoint("batch"), pack)
+	return err
+}
+
 func (c *Client) PutForm(endpoint string, values url.Values) error {
 	_, err := c.RoundTrip(func() (*http.Response, error) {
 		req, err := http.NewRequest("PUT", endpoint, strings.NewReader(values.Encode()))
@@ -315,6 +434,21 @@ func (c *Client) Get(u string, params url.Values) ([]byte, error) {
 	})
 }
 
+// retryConflicts calls the read-modify-write function until it does not fail with the revision conflict
+func retryConflicts(fn func() error) error {
+	var err error
+	for i := 0; i < UpdateAttempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if _, ok := err.(*engine.RevisionConflictError); !ok {
+			return err
+		}
+		log.Infof("%v, attempt %d of %d", err, i+1, UpdateAttempts)
+	}
+	return err
+}
+
 type RoundTripFn func() (*http.Response, error)
 
 func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
@@ -336,6 +470,9 @@ func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
 			return nil, &engine.NotFoundError{Message: status.Message}
 		}
 		if response.StatusCode == http.StatusConflict {
+			if response.Header.Get(ConflictHeader) == RevisionConflict {
+				return nil, &engine.RevisionConflictError{Message: status.Message}
+			}
 			return nil, &engine.AlreadyExistsError{Message: status.Message}
 		}
 		return nil, status
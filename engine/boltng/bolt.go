@@ -0,0 +1,1272 @@
+// package boltng contains the implementation of the engine embedded in the vulcand process and backed by the BoltDB
+// database file, so the configuration survives restarts without the external storage. The database file is locked
+// by the process, so the engine is suitable for the single vulcand instance.
+//
+// Buckets mirror the keys of the Etcd-backed engine:
+//
+//	hosts/<name>                               - host
+//	listeners/<id>                             - listener
+//	backends/<id>/backend                      - backend
+//	backends/<id>/servers/<id>                 - server
+//	frontends/<id>/frontend                    - frontend
+//	frontends/<id>/middlewares/<id>            - middleware
+//	keypairs/hosts/<name>, keypairs/backends/<id> - key pairs, sealed if the box is provided
+//	acme/account                               - ACME account key, sealed if the box is provided
+//	acme/challenges/<token>                    - pending ACME HTTP-01 challenge
+//	acme/orders/<domain>                       - lock on ordering the certificate for the domain
+//	ttls/<path>                                - expiry time of the servers, frontends, middlewares, ACME challenges and locks, e.g. ttls/backends/b1/servers/s1
+//	revisions                                  - empty bucket, its sequence is the last revision of the upserted objects
+//
+// Expired objects are deleted by the reaper running in background.
+package boltng
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	bolt "github.com/vulcand/vulcand/Godeps/_workspace/src/go.etcd.io/bbolt"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+)
+
+const (
+	DefaultReapPeriod = time.Second
+	// openTimeout is the time to wait for the database file locked by another process
+	openTimeout = time.Second
+)
+
+var (
+	hostsB       = []byte("hosts")
+	listenersB   = []byte("listeners")
+	backendsB    = []byte("backends")
+	serversB     = []byte("servers")
+	frontendsB   = []byte("frontends")
+	middlewaresB = []byte("middlewares")
+	keyPairsB    = []byte("keypairs")
+	acmeB        = []byte("acme")
+	challengesB  = []byte("challenges")
+	ordersB      = []byte("orders")
+	ttlsB        = []byte("ttls")
+	revisionsB   = []byte("revisions")
+
+	backendK  = []byte("backend")
+	frontendK = []byte("frontend")
+	accountK  = []byte("account")
+)
+
+type Options struct {
+	// Box seals the key pairs of hosts and backends and the ACME account key, they are stored as is if not set
+	Box *secret.Box
+	// ReapPeriod is the longest period between the checks for the expired objects
+	ReapPeriod time.Duration
+}
+
+type ng struct {
+	path     string
+	db       *bolt.DB
+	registry *plugin.Registry
+	options  Options
+	logsev   log.Severity
+
+	// mtx makes sure the changes are emitted in the same order the transactions are committed
+	mtx       *sync.Mutex
+	changes   *engine.ChangeFeed
+	wakeC     chan bool
+	stopC     chan bool
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
+}
+
+// New opens the database file, creating it if necessary, and starts the reaper of the expired objects
+func New(path string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{hostsB, listenersB, backendsB, frontendsB, keyPairsB, acmeB, ttlsB, revisionsB} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{challengesB, ordersB} {
+			if _, err := tx.Bucket(acmeB).CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	n := &ng{
+		path:      path,
+		db:        db,
+		registry:  registry,
+		options:   setDefaults(options),
+		mtx:       &sync.Mutex{},
+		changes:   engine.NewChangeFeed(1000),
+		wakeC:     make(chan bool, 1),
+		stopC:     make(chan bool),
+		closeOnce: &sync.Once{},
+		wg:        &sync.WaitGroup{},
+	}
+	n.wg.Add(1)
+	go n.reap()
+	return n, nil
+}
+
+func setDefaults(o Options) Options {
+	if o.ReapPeriod == 0 {
+		o.ReapPeriod = DefaultReapPeriod
+	}
+	return o
+}
+
+func (n *ng) String() string {
+	return fmt.Sprintf("boltng(path=%s)", n.path)
+}
+
+func (n *ng) Close() {
+	n.closeOnce.Do(func() {
+		close(n.stopC)
+		n.wg.Wait()
+		if err := n.db.Close(); err != nil {
+			log.Errorf("%s failed to close: %s", n, err)
+		}
+	})
+}
+
+func (n *ng) GetLogSeverity() log.Severity {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Severity) {
+	n.logsev = sev
+	log.SetSeverity(n.logsev)
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	hosts := []engine.Host{}
+	err := n.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hostsB).ForEach(func(k, v []byte) error {
+			h, err := n.getHost(tx, string(k))
+			if err != nil {
+				return err
+			}
+			hosts = append(hosts, *h)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	var h *engine.Host
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var err error
+		h, err = n.getHost(tx, key.Name)
+		return err
+	})
+	return h, err
+}
+
+func (n *ng) getHost(tx *bolt.Tx, name string) (*engine.Host, error) {
+	val := tx.Bucket(hostsB).Get([]byte(name))
+	if val == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("host '%s' not found", name)}
+	}
+	h, err := engine.HostFromJSON(val, name)
+	if err != nil {
+		return nil, err
+	}
+	if h.Settings.KeyPair, err = n.getKeyPair(tx, hostPath(name)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertHost(tx, h)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertHost(tx *bolt.Tx, h engine.Host) (interface{}, error) {
+	revision, err := nextRevision(tx, engine.HostKey{Name: h.Name}, h.Revision, tx.Bucket(hostsB).Get([]byte(h.Name)))
+	if err != nil {
+		return nil, err
+	}
+	if err := n.putKeyPair(tx, hostPath(h.Name), h.Settings.KeyPair); err != nil {
+		return nil, err
+	}
+	// Key pair is stored separately and the certificate info is not stored at all
+	val := h
+	val.Settings.KeyPair = nil
+	val.Certificate = nil
+	val.Revision = revision
+	if err := putJSON(tx.Bucket(hostsB), []byte(h.Name), val); err != nil {
+		return nil, err
+	}
+	h.Revision = 0
+	return &engine.HostUpserted{Host: h}, nil
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteHost(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) deleteHost(tx *bolt.Tx, key engine.HostKey) (interface{}, error) {
+	b := tx.Bucket(hostsB)
+	if b.Get([]byte(key.Name)) == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("host '%s' not found", key.Name)}
+	}
+	if err := b.Delete([]byte(key.Name)); err != nil {
+		return nil, err
+	}
+	if err := n.putKeyPair(tx, hostPath(key.Name), nil); err != nil {
+		return nil, err
+	}
+	return &engine.HostDeleted{HostKey: key}, nil
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	ls := []engine.Listener{}
+	err := n.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(listenersB).ForEach(func(k, v []byte) error {
+			l, err := engine.ListenerFromJSON(v, string(k))
+			if err != nil {
+				return err
+			}
+			ls = append(ls, *l)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	var l *engine.Listener
+	err := n.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(listenersB).Get([]byte(key.Id))
+		if val == nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("listener '%s' not found", key.Id)}
+		}
+		var err error
+		l, err = engine.ListenerFromJSON(val, key.Id)
+		return err
+	})
+	return l, err
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	if l.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertListener(tx, l)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertListener(tx *bolt.Tx, l engine.Listener) (interface{}, error) {
+	val := l
+	var err error
+	val.Revision, err = nextRevision(tx, engine.ListenerKey{Id: l.Id}, l.Revision, tx.Bucket(listenersB).Get([]byte(l.Id)))
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(tx.Bucket(listenersB), []byte(l.Id), val); err != nil {
+		return nil, err
+	}
+	l.Revision = 0
+	return &engine.ListenerUpserted{Listener: l}, nil
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteListener(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) deleteListener(tx *bolt.Tx, key engine.ListenerKey) (interface{}, error) {
+	b := tx.Bucket(listenersB)
+	if b.Get([]byte(key.Id)) == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("listener '%s' not found", key.Id)}
+	}
+	if err := b.Delete([]byte(key.Id)); err != nil {
+		return nil, err
+	}
+	return &engine.ListenerDeleted{ListenerKey: key}, nil
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	var fs []engine.Frontend
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var err error
+		fs, err = n.getFrontends(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (n *ng) getFrontends(tx *bolt.Tx) ([]engine.Frontend, error) {
+	fs := []engine.Frontend{}
+	err := tx.Bucket(frontendsB).ForEach(func(k, v []byte) error {
+		f, err := n.getFrontend(tx, string(k))
+		if err != nil {
+			return err
+		}
+		fs = append(fs, *f)
+		return nil
+	})
+	return fs, err
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	var f *engine.Frontend
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var err error
+		f, err = n.getFrontend(tx, key.Id)
+		return err
+	})
+	return f, err
+}
+
+func (n *ng) getFrontend(tx *bolt.Tx, id string) (*engine.Frontend, error) {
+	b := tx.Bucket(frontendsB).Bucket([]byte(id))
+	if b == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("frontend '%s' not found", id)}
+	}
+	return engine.FrontendFromJSON(n.registry.GetRouter(), b.Get(frontendK), id)
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertFrontend(tx, f, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertFrontend(tx *bolt.Tx, f engine.Frontend, ttl time.Duration) (interface{}, error) {
+	for _, ref := range f.BackendRefs() {
+		if tx.Bucket(backendsB).Bucket([]byte(ref.Id)) == nil {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", ref.Id)}
+		}
+	}
+	var stored []byte
+	if b := tx.Bucket(frontendsB).Bucket([]byte(f.Id)); b != nil {
+		stored = b.Get(frontendK)
+	}
+	val := f
+	var err error
+	if val.Revision, err = nextRevision(tx, engine.FrontendKey{Id: f.Id}, f.Revision, stored); err != nil {
+		return nil, err
+	}
+	b, err := tx.Bucket(frontendsB).CreateBucketIfNotExists([]byte(f.Id))
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(b, frontendK, val); err != nil {
+		return nil, err
+	}
+	if err := n.setTTL(tx, frontendPath(f.Id), ttl); err != nil {
+		return nil, err
+	}
+	f.Revision = 0
+	return &engine.FrontendUpserted{Frontend: f}, nil
+}
+
+func (n *ng) DeleteFrontend(key engine.FrontendKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteFrontend(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+// deleteFrontend deletes the frontend along with its middlewares
+func (n *ng) deleteFrontend(tx *bolt.Tx, key engine.FrontendKey) (interface{}, error) {
+	if err := tx.Bucket(frontendsB).DeleteBucket([]byte(key.Id)); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("frontend '%s' not found", key.Id)}
+		}
+		return nil, err
+	}
+	if err := deleteTTLs(tx, frontendPath(key.Id)); err != nil {
+		return nil, err
+	}
+	return &engine.FrontendDeleted{FrontendKey: key}, nil
+}
+
+func (n *ng) GetMiddlewares(key engine.FrontendKey) ([]engine.Middleware, error) {
+	ms := []engine.Middleware{}
+	err := n.db.View(func(tx *bolt.Tx) error {
+		b := middlewaresBucket(tx, key.Id)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m, err := engine.MiddlewareFromJSON(v, n.registry.GetSpec, string(k))
+			if err != nil {
+				return err
+			}
+			ms = append(ms, *m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	var m *engine.Middleware
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var val []byte
+		if b := middlewaresBucket(tx, key.FrontendKey.Id); b != nil {
+			val = b.Get([]byte(key.Id))
+		}
+		if val == nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("middleware '%v' not found", key)}
+		}
+		var err error
+		m, err = engine.MiddlewareFromJSON(val, n.registry.GetSpec, key.Id)
+		return err
+	})
+	return m, err
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertMiddleware(tx, fk, m, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertMiddleware(tx *bolt.Tx, fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) (interface{}, error) {
+	if n.registry.GetSpec(m.Type) == nil {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("middleware of type %s is not supported", m.Type)}
+	}
+	f := tx.Bucket(frontendsB).Bucket([]byte(fk.Id))
+	if f == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("frontend '%s' not found", fk.Id)}
+	}
+	b, err := f.CreateBucketIfNotExists(middlewaresB)
+	if err != nil {
+		return nil, err
+	}
+	val := m
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: m.Id}
+	if val.Revision, err = nextRevision(tx, mk, m.Revision, b.Get([]byte(m.Id))); err != nil {
+		return nil, err
+	}
+	if err := putJSON(b, []byte(m.Id), val); err != nil {
+		return nil, err
+	}
+	if err := n.setTTL(tx, middlewarePath(fk.Id, m.Id), ttl); err != nil {
+		return nil, err
+	}
+	m.Revision = 0
+	return &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: m}, nil
+}
+
+func (n *ng) DeleteMiddleware(key engine.MiddlewareKey) error {
+	if key.FrontendKey.Id == "" || key.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteMiddleware(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) deleteMiddleware(tx *bolt.Tx, key engine.MiddlewareKey) (interface{}, error) {
+	b := middlewaresBucket(tx, key.FrontendKey.Id)
+	if b == nil || b.Get([]byte(key.Id)) == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("middleware '%v' not found", key)}
+	}
+	if err := b.Delete([]byte(key.Id)); err != nil {
+		return nil, err
+	}
+	if err := deleteTTLs(tx, middlewarePath(key.FrontendKey.Id, key.Id)); err != nil {
+		return nil, err
+	}
+	return &engine.MiddlewareDeleted{MiddlewareKey: key}, nil
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	bs := []engine.Backend{}
+	err := n.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(backendsB).ForEach(func(k, v []byte) error {
+			b, err := n.getBackend(tx, string(k))
+			if err != nil {
+				return err
+			}
+			bs = append(bs, *b)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	var b *engine.Backend
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, err = n.getBackend(tx, key.Id)
+		return err
+	})
+	return b, err
+}
+
+func (n *ng) getBackend(tx *bolt.Tx, id string) (*engine.Backend, error) {
+	bucket := tx.Bucket(backendsB).Bucket([]byte(id))
+	if bucket == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", id)}
+	}
+	b, err := engine.BackendFromJSON(bucket.Get(backendK), id)
+	if err != nil {
+		return nil, err
+	}
+	// Client key pair is stored separately from the backend
+	s := b.HTTPSettings()
+	if s.TLS == nil {
+		return b, nil
+	}
+	if s.TLS.KeyPair, err = n.getKeyPair(tx, backendPath(id)); err != nil {
+		return nil, err
+	}
+	b.Settings = s
+	return b, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if b.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertBackend(tx, b)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertBackend(tx *bolt.Tx, b engine.Backend) (interface{}, error) {
+	var stored []byte
+	if bucket := tx.Bucket(backendsB).Bucket([]byte(b.Id)); bucket != nil {
+		stored = bucket.Get(backendK)
+	}
+	revision, err := nextRevision(tx, engine.BackendKey{Id: b.Id}, b.Revision, stored)
+	if err != nil {
+		return nil, err
+	}
+	val := b
+	val.Revision = revision
+	s := b.HTTPSettings()
+	var keyPair *engine.KeyPair
+	if s.TLS != nil && s.TLS.KeyPair != nil {
+		keyPair = s.TLS.KeyPair
+		tlsSettings := *s.TLS
+		tlsSettings.KeyPair = nil
+		s.TLS = &tlsSettings
+		val.Settings = s
+	}
+	if err := n.putKeyPair(tx, backendPath(b.Id), keyPair); err != nil {
+		return nil, err
+	}
+	bucket, err := tx.Bucket(backendsB).CreateBucketIfNotExists([]byte(b.Id))
+	if err != nil {
+		return nil, err
+	}
+	if err := putJSON(bucket, backendK, val); err != nil {
+		return nil, err
+	}
+	b.Revision = 0
+	return &engine.BackendUpserted{Backend: b}, nil
+}
+
+// DeleteBackend checks that the backend is not used by the frontends and deletes it in the same transaction
+func (n *ng) DeleteBackend(key engine.BackendKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteBackend(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) deleteBackend(tx *bolt.Tx, key engine.BackendKey) (interface{}, error) {
+	fs, err := n.getFrontends(tx)
+	if err != nil {
+		return nil, err
+	}
+	var usedBy []string
+	for _, f := range fs {
+		if f.UsesBackend(key.Id) {
+			usedBy = append(usedBy, f.Id)
+		}
+	}
+	if len(usedBy) != 0 {
+		return nil, fmt.Errorf("can not delete backend '%v', it is in use by frontends %v", key, usedBy)
+	}
+	if err := tx.Bucket(backendsB).DeleteBucket([]byte(key.Id)); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", key.Id)}
+		}
+		return nil, err
+	}
+	if err := n.putKeyPair(tx, backendPath(key.Id), nil); err != nil {
+		return nil, err
+	}
+	if err := deleteTTLs(tx, backendPath(key.Id)); err != nil {
+		return nil, err
+	}
+	return &engine.BackendDeleted{BackendKey: key}, nil
+}
+
+func (n *ng) GetServers(key engine.BackendKey) ([]engine.Server, error) {
+	srvs := []engine.Server{}
+	err := n.db.View(func(tx *bolt.Tx) error {
+		b := serversBucket(tx, key.Id)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			s, err := engine.ServerFromJSON(v, string(k))
+			if err != nil {
+				return err
+			}
+			srvs = append(srvs, *s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return srvs, nil
+}
+
+func (n *ng) GetServer(key engine.ServerKey) (*engine.Server, error) {
+	var s *engine.Server
+	err := n.db.View(func(tx *bolt.Tx) error {
+		var val []byte
+		if b := serversBucket(tx, key.BackendKey.Id); b != nil {
+			val = b.Get([]byte(key.Id))
+		}
+		if val == nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("server '%v' not found", key)}
+		}
+		var err error
+		if s, err = engine.ServerFromJSON(val, key.Id); err != nil {
+			return err
+		}
+		s.Expires, err = getTTL(tx, serverPath(key.BackendKey.Id, key.Id))
+		return err
+	})
+	return s, err
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.upsertServer(tx, bk, s, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) upsertServer(tx *bolt.Tx, bk engine.BackendKey, s engine.Server, ttl time.Duration) (interface{}, error) {
+	backend := tx.Bucket(backendsB).Bucket([]byte(bk.Id))
+	if backend == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", bk.Id)}
+	}
+	b, err := backend.CreateBucketIfNotExists(serversB)
+	if err != nil {
+		return nil, err
+	}
+	s.Expires = nil
+	val := s
+	sk := engine.ServerKey{BackendKey: bk, Id: s.Id}
+	if val.Revision, err = nextRevision(tx, sk, s.Revision, b.Get([]byte(s.Id))); err != nil {
+		return nil, err
+	}
+	if err := putJSON(b, []byte(s.Id), val); err != nil {
+		return nil, err
+	}
+	if err := n.setTTL(tx, serverPath(bk.Id, s.Id), ttl); err != nil {
+		return nil, err
+	}
+	s.Revision = 0
+	return &engine.ServerUpserted{BackendKey: bk, Server: s}, nil
+}
+
+func (n *ng) DeleteServer(key engine.ServerKey) error {
+	if key.Id == "" || key.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		change, err := n.deleteServer(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{change}, nil
+	})
+}
+
+func (n *ng) deleteServer(tx *bolt.Tx, key engine.ServerKey) (interface{}, error) {
+	b := serversBucket(tx, key.BackendKey.Id)
+	if b == nil || b.Get([]byte(key.Id)) == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("server '%v' not found", key)}
+	}
+	if err := b.Delete([]byte(key.Id)); err != nil {
+		return nil, err
+	}
+	if err := deleteTTLs(tx, serverPath(key.BackendKey.Id, key.Id)); err != nil {
+		return nil, err
+	}
+	return &engine.ServerDeleted{ServerKey: key}, nil
+}
+
+func (n *ng) GetACMEAccountKey() ([]byte, error) {
+	var key []byte
+	err := n.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(acmeB).Get(accountK)
+		if val == nil {
+			return &engine.NotFoundError{Message: "ACME account key not found"}
+		}
+		var err error
+		key, err = n.open(val)
+		return err
+	})
+	return key, err
+}
+
+func (n *ng) CreateACMEAccountKey(key []byte) error {
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		b := tx.Bucket(acmeB)
+		if b.Get(accountK) != nil {
+			return nil, &engine.AlreadyExistsError{Message: "ACME account key already exists"}
+		}
+		val, err := n.seal(key)
+		if err != nil {
+			return nil, err
+		}
+		return nil, b.Put(accountK, val)
+	})
+}
+
+func (n *ng) UpsertACMEChallenge(ch engine.ACMEChallenge, ttl time.Duration) error {
+	if err := engine.CheckACMEToken(ch.Token); err != nil {
+		return err
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		if err := putJSON(tx.Bucket(acmeB).Bucket(challengesB), []byte(ch.Token), ch); err != nil {
+			return nil, err
+		}
+		return nil, n.setTTL(tx, challengePath(ch.Token), ttl)
+	})
+}
+
+func (n *ng) GetACMEChallenge(token string) (*engine.ACMEChallenge, error) {
+	var ch *engine.ACMEChallenge
+	err := n.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(acmeB).Bucket(challengesB).Get([]byte(token))
+		if val == nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+		}
+		return json.Unmarshal(val, &ch)
+	})
+	return ch, err
+}
+
+func (n *ng) DeleteACMEChallenge(token string) error {
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		return nil, deleteACMEChallenge(tx, token)
+	})
+}
+
+func deleteACMEChallenge(tx *bolt.Tx, token string) error {
+	b := tx.Bucket(acmeB).Bucket(challengesB)
+	if b.Get([]byte(token)) == nil {
+		return &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+	}
+	if err := b.Delete([]byte(token)); err != nil {
+		return err
+	}
+	return deleteTTLs(tx, challengePath(token))
+}
+
+// CreateACMEOrderLock takes the lock unless it is held, the expired lock the reaper has not deleted yet is taken over
+func (n *ng) CreateACMEOrderLock(domain string, ttl time.Duration) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		b := tx.Bucket(acmeB).Bucket(ordersB)
+		if b.Get([]byte(domain)) != nil {
+			expires, err := getTTL(tx, orderPath(domain))
+			if err != nil {
+				return nil, err
+			}
+			if expires == nil || time.Now().UTC().Before(*expires) {
+				return nil, &engine.AlreadyExistsError{Message: fmt.Sprintf("ACME order lock '%s' already exists", domain)}
+			}
+		}
+		if err := b.Put([]byte(domain), []byte{}); err != nil {
+			return nil, err
+		}
+		return nil, n.setTTL(tx, orderPath(domain), ttl)
+	})
+}
+
+func (n *ng) DeleteACMEOrderLock(domain string) error {
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		return nil, deleteACMEOrderLock(tx, domain)
+	})
+}
+
+func deleteACMEOrderLock(tx *bolt.Tx, domain string) error {
+	b := tx.Bucket(acmeB).Bucket(ordersB)
+	if b.Get([]byte(domain)) == nil {
+		return &engine.NotFoundError{Message: fmt.Sprintf("ACME order lock '%s' not found", domain)}
+	}
+	if err := b.Delete([]byte(domain)); err != nil {
+		return err
+	}
+	return deleteTTLs(tx, orderPath(domain))
+}
+
+// Apply applies all changes in one transaction and emits them as a single change
+func (n *ng) Apply(cs engine.ChangeSet) error {
+	if err := cs.Check(); err != nil {
+		return err
+	}
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		changes := make([]interface{}, len(cs.Changes))
+		for i, ch := range cs.Changes {
+			change, err := n.apply(tx, ch)
+			if err != nil {
+				return nil, engine.ChangeError(i, ch, err)
+			}
+			changes[i] = change
+		}
+		return []interface{}{&engine.ChangeSetApplied{Changes: changes}}, nil
+	})
+}
+
+func (n *ng) apply(tx *bolt.Tx, c engine.Change) (interface{}, error) {
+	switch ch := c.Event.(type) {
+	case *engine.HostUpserted:
+		return n.upsertHost(tx, ch.Host)
+	case *engine.HostDeleted:
+		return n.deleteHost(tx, ch.HostKey)
+	case *engine.ListenerUpserted:
+		return n.upsertListener(tx, ch.Listener)
+	case *engine.ListenerDeleted:
+		return n.deleteListener(tx, ch.ListenerKey)
+	case *engine.BackendUpserted:
+		return n.upsertBackend(tx, ch.Backend)
+	case *engine.BackendDeleted:
+		return n.deleteBackend(tx, ch.BackendKey)
+	case *engine.ServerUpserted:
+		return n.upsertServer(tx, ch.BackendKey, ch.Server, c.TTL)
+	case *engine.ServerDeleted:
+		return n.deleteServer(tx, ch.ServerKey)
+	case *engine.FrontendUpserted:
+		return n.upsertFrontend(tx, ch.Frontend, c.TTL)
+	case *engine.FrontendDeleted:
+		return n.deleteFrontend(tx, ch.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return n.upsertMiddleware(tx, ch.FrontendKey, ch.Middleware, c.TTL)
+	case *engine.MiddlewareDeleted:
+		return n.deleteMiddleware(tx, ch.MiddlewareKey)
+	}
+	return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", c.Event)}
+}
+
+// Subscribe generates the events for the changes committed by this engine, including the expired objects.
+// It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	return n.changes.Subscribe(changes, cancelC)
+}
+
+// update runs the function in the read-write transaction and emits the changes returned by the function
+// once the transaction is committed
+func (n *ng) update(fn func(tx *bolt.Tx) ([]interface{}, error)) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	var changes []interface{}
+	err := n.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		changes, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		n.changes.Emit(change)
+	}
+	return nil
+}
+
+// reap deletes the expired objects until the engine is closed
+func (n *ng) reap() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-time.After(n.nextReap()):
+		case <-n.wakeC:
+			continue
+		case <-n.stopC:
+			return
+		}
+		if err := n.deleteExpired(time.Now().UTC()); err != nil {
+			log.Errorf("%s failed to delete expired objects: %s", n, err)
+		}
+	}
+}
+
+// nextReap returns the time until the next object expires, but not longer than the reap period
+func (n *ng) nextReap() time.Duration {
+	d := n.options.ReapPeriod
+	now := time.Now().UTC()
+	err := n.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ttlsB).ForEach(func(k, v []byte) error {
+			expires, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return err
+			}
+			if expires.Sub(now) < d {
+				d = expires.Sub(now)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Errorf("%s failed to read expiry times: %s", n, err)
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (n *ng) deleteExpired(now time.Time) error {
+	return n.update(func(tx *bolt.Tx) ([]interface{}, error) {
+		var expired []string
+		err := tx.Bucket(ttlsB).ForEach(func(k, v []byte) error {
+			expires, err := time.Parse(time.RFC3339Nano, string(v))
+			if err != nil {
+				return err
+			}
+			if !now.Before(expires) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		var changes []interface{}
+		for _, path := range expired {
+			change, err := n.deletePath(tx, path)
+			if err != nil {
+				if _, ok := err.(*engine.NotFoundError); ok {
+					// deleted along with the expired parent
+					continue
+				}
+				// do not let the bad key block the expiry of other objects
+				log.Errorf("%s failed to delete expired %s: %s", n, path, err)
+				if err := tx.Bucket(ttlsB).Delete([]byte(path)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if change != nil {
+				changes = append(changes, change)
+			}
+		}
+		return changes, nil
+	})
+}
+
+// deletePath deletes the object with TTL by its path
+func (n *ng) deletePath(tx *bolt.Tx, path string) (interface{}, error) {
+	p := strings.Split(path, "/")
+	switch {
+	case len(p) == 2 && p[0] == "frontends":
+		return n.deleteFrontend(tx, engine.FrontendKey{Id: p[1]})
+	case len(p) == 4 && p[0] == "frontends" && p[2] == "middlewares":
+		return n.deleteMiddleware(tx, engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: p[1]}, Id: p[3]})
+	case len(p) == 4 && p[0] == "backends" && p[2] == "servers":
+		return n.deleteServer(tx, engine.ServerKey{BackendKey: engine.BackendKey{Id: p[1]}, Id: p[3]})
+	case len(p) == 3 && p[0] == "acme" && p[1] == "challenges":
+		// challenges are not the part of the configuration, so there is no change to emit
+		return nil, deleteACMEChallenge(tx, p[2])
+	case len(p) == 3 && p[0] == "acme" && p[1] == "orders":
+		return nil, deleteACMEOrderLock(tx, p[2])
+	}
+	return nil, fmt.Errorf("unsupported path: %s", path)
+}
+
+func (n *ng) setTTL(tx *bolt.Tx, path string, ttl time.Duration) error {
+	b := tx.Bucket(ttlsB)
+	if ttl == 0 {
+		return b.Delete([]byte(path))
+	}
+	expires := time.Now().UTC().Add(ttl)
+	if err := b.Put([]byte(path), []byte(expires.Format(time.RFC3339Nano))); err != nil {
+		return err
+	}
+	select {
+	case n.wakeC <- true:
+	default:
+	}
+	return nil
+}
+
+// getTTL returns the expiry time of the object, nil if the object does not expire
+func getTTL(tx *bolt.Tx, path string) (*time.Time, error) {
+	v := tx.Bucket(ttlsB).Get([]byte(path))
+	if v == nil {
+		return nil, nil
+	}
+	expires, err := time.Parse(time.RFC3339Nano, string(v))
+	if err != nil {
+		return nil, err
+	}
+	return &expires, nil
+}
+
+// deleteTTLs deletes the expiry time of the object and its children
+func deleteTTLs(tx *bolt.Tx, path string) error {
+	b := tx.Bucket(ttlsB)
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek([]byte(path)); k != nil && strings.HasPrefix(string(k), path); k, _ = c.Next() {
+		if string(k) == path || strings.HasPrefix(string(k), path+"/") {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ng) getKeyPair(tx *bolt.Tx, path string) (*engine.KeyPair, error) {
+	val := tx.Bucket(keyPairsB).Get([]byte(path))
+	if val == nil {
+		return nil, nil
+	}
+	data, err := n.open(val)
+	if err != nil {
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if err := json.Unmarshal(data, &keyPair); err != nil {
+		return nil, err
+	}
+	if keyPair == nil || len(keyPair.Cert) == 0 || len(keyPair.Key) == 0 {
+		return nil, fmt.Errorf("empty key pair at %s, it could be sealed with the other key", path)
+	}
+	return keyPair, nil
+}
+
+// putKeyPair stores the key pair, sealing it if the box is set, or deletes it if the key pair is nil
+func (n *ng) putKeyPair(tx *bolt.Tx, path string, keyPair *engine.KeyPair) error {
+	b := tx.Bucket(keyPairsB)
+	if keyPair == nil {
+		return b.Delete([]byte(path))
+	}
+	data, err := json.Marshal(keyPair)
+	if err != nil {
+		return err
+	}
+	if data, err = n.seal(data); err != nil {
+		return err
+	}
+	return b.Put([]byte(path), data)
+}
+
+// seal seals the data if the box is set
+func (n *ng) seal(data []byte) ([]byte, error) {
+	if n.options.Box == nil {
+		return data, nil
+	}
+	sv, err := n.options.Box.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(sv)
+}
+
+// open opens the data sealed by seal
+func (n *ng) open(val []byte) ([]byte, error) {
+	if n.options.Box == nil {
+		return val, nil
+	}
+	sv, err := secret.SealedValueFromJSON(val)
+	if err != nil {
+		return nil, err
+	}
+	return n.options.Box.Open(sv)
+}
+
+// nextRevision checks the expected revision against the revision of the stored object, nil if the object does not
+// exist, and returns the revision of the object written in the transaction. Revisions are stored along with
+// the objects and are increasing across the database.
+func nextRevision(tx *bolt.Tx, key interface{}, expected int64, stored []byte) (int64, error) {
+	var current struct {
+		Revision int64
+	}
+	if stored != nil {
+		if err := json.Unmarshal(stored, &current); err != nil {
+			return 0, err
+		}
+	}
+	if err := engine.CheckRevision(key, expected, current.Revision); err != nil {
+		return 0, err
+	}
+	seq, err := tx.Bucket(revisionsB).NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return int64(seq), nil
+}
+
+func putJSON(b *bolt.Bucket, key []byte, val interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func middlewaresBucket(tx *bolt.Tx, frontendId string) *bolt.Bucket {
+	f := tx.Bucket(frontendsB).Bucket([]byte(frontendId))
+	if f == nil {
+		return nil
+	}
+	return f.Bucket(middlewaresB)
+}
+
+func serversBucket(tx *bolt.Tx, backendId string) *bolt.Bucket {
+	b := tx.Bucket(backendsB).Bucket([]byte(backendId))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket(serversB)
+}
+
+func hostPath(name string) string {
+	return "hosts/" + name
+}
+
+func backendPath(id string) string {
+	return "backends/" + id
+}
+
+func serverPath(backendId, id string) string {
+	return "backends/" + backendId + "/servers/" + id
+}
+
+func challengePath(token string) string {
+	return "acme/challenges/" + token
+}
+
+func orderPath(domain string) string {
+	return "acme/orders/" + domain
+}
+
+func frontendPath(id string) string {
+	return "frontends/" + id
+}
+
+func middlewarePath(frontendId, id string) string {
+	return "frontends/" + frontendId + "/middlewares/" + id
+}
@@ -0,0 +1,364 @@
+package boltng
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	bolt "github.com/vulcand/vulcand/Godeps/_workspace/src/go.etcd.io/bbolt"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestBolt(t *testing.T) { TestingT(t) }
+
+type BoltSuite struct {
+	ng       *ng
+	path     string
+	box      *secret.Box
+	suite    test.EngineSuite
+	changesC chan interface{}
+	stopC    chan bool
+}
+
+var _ = Suite(&BoltSuite{})
+
+func (s *BoltSuite) SetUpSuite(c *C) {
+	log.InitWithConfig(log.Config{Name: "console"})
+
+	box, err := secret.NewBoxFromKeyString(mustKeyString())
+	c.Assert(err, IsNil)
+	s.box = box
+}
+
+func (s *BoltSuite) SetUpTest(c *C) {
+	s.path = filepath.Join(c.MkDir(), "vulcand.db")
+	s.ng = s.newEngine(c)
+
+	s.changesC = make(chan interface{})
+	s.stopC = make(chan bool)
+	go s.ng.Subscribe(s.changesC, s.stopC)
+
+	s.suite.ChangesC = s.changesC
+	s.suite.Engine = s.ng
+}
+
+func (s *BoltSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+}
+
+func (s *BoltSuite) newEngine(c *C) *ng {
+	e, err := New(s.path, registry.GetRegistry(), Options{Box: s.box})
+	c.Assert(err, IsNil)
+	return e.(*ng)
+}
+
+// reopen closes the engine and opens the same database again, the way vulcand restarts
+func (s *BoltSuite) reopen(c *C) {
+	s.ng.Close()
+	s.ng = s.newEngine(c)
+	s.suite.Engine = s.ng
+	go s.ng.Subscribe(s.changesC, s.stopC)
+}
+
+func (s *BoltSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *BoltSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *BoltSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *BoltSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *BoltSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *BoltSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *BoltSuite) TestHostWithAutoCert(c *C) {
+	s.suite.HostWithAutoCert(c)
+}
+
+func (s *BoltSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *BoltSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *BoltSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *BoltSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
+func (s *BoltSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *BoltSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *BoltSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *BoltSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *BoltSuite) TestServerWeight(c *C) {
+	s.suite.ServerWeight(c)
+}
+
+func (s *BoltSuite) TestServerExpire(c *C) {
+	s.suite.ServerExpire(c)
+}
+
+func (s *BoltSuite) TestServerExpires(c *C) {
+	s.suite.ServerExpires(c)
+}
+
+func (s *BoltSuite) TestACMEAccountKey(c *C) {
+	s.suite.ACMEAccountKey(c)
+}
+
+func (s *BoltSuite) TestACMEChallengeCRUD(c *C) {
+	s.suite.ACMEChallengeCRUD(c)
+}
+
+func (s *BoltSuite) TestACMEOrderLock(c *C) {
+	s.suite.ACMEOrderLock(c)
+}
+
+func (s *BoltSuite) TestACMEOrderLockExpire(c *C) {
+	s.suite.ACMEOrderLockExpire(c)
+}
+
+func (s *BoltSuite) TestACMEChallengeExpire(c *C) {
+	s.suite.ACMEChallengeExpire(c)
+}
+
+func (s *BoltSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *BoltSuite) TestFrontendExpire(c *C) {
+	s.suite.FrontendExpire(c)
+}
+
+func (s *BoltSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *BoltSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *BoltSuite) TestMiddlewareExpire(c *C) {
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *BoltSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *BoltSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *BoltSuite) TestChangeSetApply(c *C) {
+	s.suite.ChangeSetApply(c)
+}
+
+func (s *BoltSuite) TestChangeSetFailed(c *C) {
+	s.suite.ChangeSetFailed(c)
+}
+
+func (s *BoltSuite) TestRevisionConflict(c *C) {
+	s.suite.RevisionConflict(c)
+}
+
+func (s *BoltSuite) TestPersistence(c *C) {
+	h := engine.Host{Name: "localhost", Settings: engine.HostSettings{
+		Default: true,
+		KeyPair: &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")},
+	}}
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		Timeouts: engine.HTTPBackendTimeouts{Read: "1s"},
+	}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	f := engine.Frontend{Id: "f1", Type: engine.HTTP, BackendId: b.Id, Route: `Path("/hello")`, Settings: engine.HTTPFrontendSettings{}}
+	m := s.makeConnLimit(c, "cl1", 10)
+
+	c.Assert(s.ng.UpsertHost(h), IsNil)
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(engine.BackendKey{Id: b.Id}, srv, time.Hour), IsNil)
+	c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+	c.Assert(s.ng.UpsertMiddleware(engine.FrontendKey{Id: f.Id}, m, 0), IsNil)
+	s.collectChanges(c, 5)
+
+	s.reopen(c)
+
+	// Revisions are stored along with the objects
+	h.Revision, b.Revision, srv.Revision, f.Revision, m.Revision = 1, 2, 3, 4, 5
+
+	hs, err := s.ng.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(hs, DeepEquals, []engine.Host{h})
+
+	bs, err := s.ng.GetBackends()
+	c.Assert(err, IsNil)
+	c.Assert(bs, DeepEquals, []engine.Backend{b})
+
+	srvs, err := s.ng.GetServers(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(srvs, DeepEquals, []engine.Server{srv})
+
+	fs, err := s.ng.GetFrontends()
+	c.Assert(err, IsNil)
+	c.Assert(fs, DeepEquals, []engine.Frontend{f})
+
+	ms, err := s.ng.GetMiddlewares(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(ms, DeepEquals, []engine.Middleware{m})
+}
+
+// Key pairs and the ACME account key are sealed with the box, so the engine without the box can not read them
+func (s *BoltSuite) TestKeyPairSealed(c *C) {
+	h := engine.Host{Name: "localhost", Settings: engine.HostSettings{
+		KeyPair: &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")},
+	}}
+	c.Assert(s.ng.UpsertHost(h), IsNil)
+	c.Assert(s.ng.CreateACMEAccountKey([]byte("account")), IsNil)
+
+	err := s.ng.db.View(func(tx *bolt.Tx) error {
+		if _, err := secret.SealedValueFromJSON(tx.Bucket(keyPairsB).Get([]byte("hosts/localhost"))); err != nil {
+			return err
+		}
+		_, err := secret.SealedValueFromJSON(tx.Bucket(acmeB).Get(accountK))
+		return err
+	})
+	c.Assert(err, IsNil)
+
+	s.ng.Close()
+	e, err := New(s.path, registry.GetRegistry(), Options{})
+	c.Assert(err, IsNil)
+	s.ng = e.(*ng)
+
+	_, err = s.ng.GetHost(engine.HostKey{Name: h.Name})
+	c.Assert(err, NotNil)
+	key, err := s.ng.GetACMEAccountKey()
+	c.Assert(err, IsNil)
+	c.Assert(string(key), Not(Equals), "account")
+}
+
+// Objects that expired while the engine was closed are deleted when it is opened again
+func (s *BoltSuite) TestExpireAfterRestart(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	bk := engine.BackendKey{Id: b.Id}
+
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(bk, srv, time.Second), IsNil)
+	s.collectChanges(c, 2)
+
+	s.ng.Close()
+	time.Sleep(time.Second)
+	s.ng = s.newEngine(c)
+	s.suite.Engine = s.ng
+	go s.ng.Subscribe(s.changesC, s.stopC)
+
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: bk, Id: srv.Id}},
+	})
+	srvs, err := s.ng.GetServers(bk)
+	c.Assert(err, IsNil)
+	c.Assert(srvs, DeepEquals, []engine.Server{})
+}
+
+// Upsert without TTL makes the object permanent
+func (s *BoltSuite) TestUpsertClearsTTL(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	bk := engine.BackendKey{Id: b.Id}
+
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(bk, srv, time.Second), IsNil)
+	c.Assert(s.ng.UpsertServer(bk, srv, 0), IsNil)
+	s.collectChanges(c, 3)
+
+	time.Sleep(1500 * time.Millisecond)
+	out, err := s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+	srv.Revision = 3
+	c.Assert(out, DeepEquals, &srv)
+}
+
+// Deleting the backend deletes its servers along with their expiry times
+func (s *BoltSuite) TestDeleteBackendWithServers(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	bk := engine.BackendKey{Id: b.Id}
+
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(bk, engine.Server{Id: "srv1", URL: "http://localhost:5000"}, time.Hour), IsNil)
+	c.Assert(s.ng.DeleteBackend(bk), IsNil)
+	s.collectChanges(c, 3)
+
+	srvs, err := s.ng.GetServers(bk)
+	c.Assert(err, IsNil)
+	c.Assert(srvs, DeepEquals, []engine.Server{})
+
+	err = s.ng.db.View(func(tx *bolt.Tx) error {
+		c.Assert(tx.Bucket(ttlsB).Stats().KeyN, Equals, 0)
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *BoltSuite) makeConnLimit(c *C, id string, conns int64) engine.Middleware {
+	cl, err := connlimit.NewConnLimit(conns, "client.ip")
+	c.Assert(err, IsNil)
+	return engine.Middleware{Id: id, Type: "connlimit", Priority: 1, Middleware: cl}
+}
+
+func (s *BoltSuite) collectChanges(c *C, expected int) []interface{} {
+	changes := make([]interface{}, expected)
+	for i := range changes {
+		select {
+		case changes[i] = <-s.changesC:
+		case <-time.After(2 * time.Second):
+			c.Fatalf("timeout waiting for change %d of %d", i+1, expected)
+		}
+	}
+	return changes
+}
+
+func mustKeyString() string {
+	key, err := secret.NewKeyString()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
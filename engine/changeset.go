@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Change is a single upsert or delete of the change set. Event is one of the upsert or delete events
+// from events.go, e.g. &FrontendUpserted{} or &ServerDeleted{}. TTL is used by the frontend, middleware
+// and server upserts and is 0 for the objects that should not expire.
+type Change struct {
+	Event interface{}
+	TTL   time.Duration
+}
+
+func (c Change) String() string {
+	if c.TTL != 0 {
+		return fmt.Sprintf("Change(%v, ttl=%v)", c.Event, c.TTL)
+	}
+	return fmt.Sprintf("Change(%v)", c.Event)
+}
+
+// ChangeSet is a list of changes applied by Engine.Apply as one unit, in the given order
+type ChangeSet struct {
+	Changes []Change
+}
+
+func (c *ChangeSet) String() string {
+	return fmt.Sprintf("ChangeSet(changes=%v)", c.Changes)
+}
+
+// Check makes sure the change set is not empty and that every change is supported and refers to
+// the objects by non empty ids. It does not check the changes against the stored configuration.
+func (c *ChangeSet) Check() error {
+	if len(c.Changes) == 0 {
+		return &InvalidFormatError{Message: "change set is empty"}
+	}
+	for i, ch := range c.Changes {
+		if err := ch.check(); err != nil {
+			return &InvalidFormatError{Message: fmt.Sprintf("change %d: %s", i, err)}
+		}
+	}
+	return nil
+}
+
+func (c Change) check() error {
+	ttl := false
+	switch ch := c.Event.(type) {
+	case *HostUpserted:
+		if ch.Host.Name == "" {
+			return fmt.Errorf("hostname can not be empty")
+		}
+	case *HostDeleted:
+		if ch.HostKey.Name == "" {
+			return fmt.Errorf("hostname can not be empty")
+		}
+	case *ListenerUpserted:
+		if ch.Listener.Id == "" {
+			return fmt.Errorf("listener id can not be empty")
+		}
+	case *ListenerDeleted:
+		if ch.ListenerKey.Id == "" {
+			return fmt.Errorf("listener id can not be empty")
+		}
+	case *BackendUpserted:
+		if ch.Backend.Id == "" {
+			return fmt.Errorf("backend id can not be empty")
+		}
+	case *BackendDeleted:
+		if ch.BackendKey.Id == "" {
+			return fmt.Errorf("backend id can not be empty")
+		}
+	case *ServerUpserted:
+		if ch.BackendKey.Id == "" || ch.Server.Id == "" {
+			return fmt.Errorf("backend id and server id can not be empty")
+		}
+		ttl = true
+	case *ServerDeleted:
+		if ch.ServerKey.BackendKey.Id == "" || ch.ServerKey.Id == "" {
+			return fmt.Errorf("backend id and server id can not be empty")
+		}
+	case *FrontendUpserted:
+		if ch.Frontend.Id == "" {
+			return fmt.Errorf("frontend id can not be empty")
+		}
+		ttl = true
+	case *FrontendDeleted:
+		if ch.FrontendKey.Id == "" {
+			return fmt.Errorf("frontend id can not be empty")
+		}
+	case *MiddlewareUpserted:
+		if ch.FrontendKey.Id == "" || ch.Middleware.Id == "" {
+			return fmt.Errorf("frontend id and middleware id can not be empty")
+		}
+		ttl = true
+	case *MiddlewareDeleted:
+		if ch.MiddlewareKey.FrontendKey.Id == "" || ch.MiddlewareKey.Id == "" {
+			return fmt.Errorf("frontend id and middleware id can not be empty")
+		}
+	default:
+		return fmt.Errorf("unsupported change: %#v", c.Event)
+	}
+	if c.TTL < 0 || (c.TTL != 0 && !ttl) {
+		return fmt.Errorf("TTL %v is not supported by %v", c.TTL, c.Event)
+	}
+	return nil
+}
+
+// ApplyChange applies the change with the corresponding Upsert or Delete method of the engine.
+// Engines that can not apply the change set atomically use it to apply the changes one by one.
+func ApplyChange(ng Engine, c Change) error {
+	switch ch := c.Event.(type) {
+	case *HostUpserted:
+		return ng.UpsertHost(ch.Host)
+	case *HostDeleted:
+		return ng.DeleteHost(ch.HostKey)
+	case *ListenerUpserted:
+		return ng.UpsertListener(ch.Listener)
+	case *ListenerDeleted:
+		return ng.DeleteListener(ch.ListenerKey)
+	case *BackendUpserted:
+		return ng.UpsertBackend(ch.Backend)
+	case *BackendDeleted:
+		return ng.DeleteBackend(ch.BackendKey)
+	case *ServerUpserted:
+		return ng.UpsertServer(ch.BackendKey, ch.Server, c.TTL)
+	case *ServerDeleted:
+		return ng.DeleteServer(ch.ServerKey)
+	case *FrontendUpserted:
+		return ng.UpsertFrontend(ch.Frontend, c.TTL)
+	case *FrontendDeleted:
+		return ng.DeleteFrontend(ch.FrontendKey)
+	case *MiddlewareUpserted:
+		return ng.UpsertMiddleware(ch.FrontendKey, ch.Middleware, c.TTL)
+	case *MiddlewareDeleted:
+		return ng.DeleteMiddleware(ch.MiddlewareKey)
+	}
+	return &InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", c.Event)}
+}
+
+// ChangeError returns the error of the failed change annotated with the change position in the change set,
+// keeping the engine error types, so the API can tell the missing objects from the invalid and the modified ones
+func ChangeError(i int, c Change, err error) error {
+	msg := fmt.Sprintf("change %d %v failed: %s", i, c.Event, err)
+	switch err.(type) {
+	case *NotFoundError:
+		return &NotFoundError{Message: msg}
+	case *InvalidFormatError:
+		return &InvalidFormatError{Message: msg}
+	case *AlreadyExistsError:
+		return &AlreadyExistsError{Message: msg}
+	case *RevisionConflictError:
+		return &RevisionConflictError{Message: msg}
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -13,6 +13,10 @@ type NewEngineFn func() (Engine, error)
 // Simple in memory implementation is available at engine/memng package
 // Engines should pass the following acceptance suite to be compatible:
 // engine/test/suite.go, see engine/etcdng/etcd_test.go and engine/memng/mem_test.go for details
+//
+// Getters return the objects with Revision of the stored object. Upserts of the objects with non zero Revision
+// fail with engine.RevisionConflictError if the stored object has a different revision, so the concurrent
+// read-modify-write updates do not overwrite each other.
 type Engine interface {
 	// GetHosts returns list of hosts registered in the storage engine
 	// Returns empty list in case if there are no hosts.
@@ -77,6 +81,32 @@ type Engine interface {
 	// Returns engine.NotFoundError if server not found
 	DeleteServer(ServerKey) error
 
+	// GetACMEAccountKey returns the PEM encoded private key of the ACME account shared by vulcand instances.
+	// Returns engine.NotFoundError if the key has not been created yet
+	GetACMEAccountKey() ([]byte, error)
+	// CreateACMEAccountKey stores the PEM encoded private key of the ACME account, sealed the same way as the key pairs.
+	// Returns engine.AlreadyExistsError if the key has been created already, e.g. by another vulcand instance
+	CreateACMEAccountKey([]byte) error
+	// UpsertACMEChallenge stores the pending ACME HTTP-01 challenge, so that any vulcand instance can answer it.
+	// TTL provides time to expire, the challenge is deleted once the authorization is complete.
+	UpsertACMEChallenge(ACMEChallenge, time.Duration) error
+	// GetACMEChallenge returns the pending challenge by its token, returns engine.NotFoundError if not found
+	GetACMEChallenge(token string) (*ACMEChallenge, error)
+	// DeleteACMEChallenge deletes the challenge by its token, returns engine.NotFoundError if not found
+	DeleteACMEChallenge(token string) error
+	// CreateACMEOrderLock takes the lock on ordering the certificate for the domain, so only one vulcand instance
+	// orders it. TTL provides time to expire, so the lock of the failed instance is released eventually.
+	// Returns engine.AlreadyExistsError if the lock is held, e.g. by another vulcand instance
+	CreateACMEOrderLock(domain string, ttl time.Duration) error
+	// DeleteACMEOrderLock releases the lock on ordering the certificate for the domain, returns engine.NotFoundError if not found
+	DeleteACMEOrderLock(domain string) error
+
+	// Apply validates the change set against the current configuration and applies either all of its changes
+	// or none of them. Engines that support transactions write the changes atomically and emit them as a single
+	// engine.ChangeSetApplied event, so the proxy never sees the half-applied change set. Engines that can not
+	// do that implement PartialApplier.
+	Apply(ChangeSet) error
+
 	// Subscribe is an entry point for getting the configuration changes as well as the initial configuration.
 	// It should be a blocking function generating events from change.go to the changes channel.
 	// Each change should be an instance of the struct provided in events.go
@@ -94,3 +124,11 @@ type Engine interface {
 	// Close should close all underlying resources such as connections, files, etc.
 	Close()
 }
+
+// PartialApplier is implemented by the engines that check the change set up front, but write and emit its changes
+// one by one. The proxies see the change set applied partially, and a concurrent update can make one of the changes
+// fail after the check, leaving the rest of the change set unapplied.
+type PartialApplier interface {
+	// AppliesPartially returns true if the engine does not apply the change sets as one unit
+	AppliesPartially() bool
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/secret"
 )
@@ -113,11 +114,14 @@ func (n *ng) GetHosts() ([]engine.Host, error) {
 func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 	hostKey := n.path("hosts", key.Name, "host")
 
-	var host *host
-	err := n.getJSONVal(hostKey, &host)
+	node, err := n.getNode(hostKey)
 	if err != nil {
 		return nil, err
 	}
+	var host *host
+	if err := json.Unmarshal([]byte(node.Value), &host); err != nil {
+		return nil, err
+	}
 
 	var keyPair *engine.KeyPair
 	if len(host.Settings.KeyPair) != 0 {
@@ -126,7 +130,19 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 		}
 	}
 
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+	h, err := engine.NewHost(key.Name, engine.HostSettings{
+		Default:       host.Settings.Default,
+		KeyPair:       keyPair,
+		OCSP:          host.Settings.OCSP,
+		HTTPSRedirect: host.Settings.HTTPSRedirect,
+		HSTS:          host.Settings.HSTS,
+		AutoCert:      host.Settings.AutoCert,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.Revision = int64(node.ModifiedIndex)
+	return h, nil
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
@@ -138,8 +154,11 @@ func (n *ng) UpsertHost(h engine.Host) error {
 	val := host{
 		Name: h.Name,
 		Settings: hostSettings{
-			Default: h.Settings.Default,
-			OCSP:    h.Settings.OCSP,
+			Default:       h.Settings.Default,
+			OCSP:          h.Settings.OCSP,
+			HTTPSRedirect: h.Settings.HTTPSRedirect,
+			HSTS:          h.Settings.HSTS,
+			AutoCert:      h.Settings.AutoCert,
 		},
 	}
 
@@ -151,7 +170,11 @@ func (n *ng) UpsertHost(h engine.Host) error {
 		val.Settings.KeyPair = bytes
 	}
 
-	return n.setJSONVal(hostKey, val, noTTL)
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return n.setRevisedVal(hostKey, bytes, noTTL, h.Revision)
 }
 
 func (n *ng) DeleteHost(key engine.HostKey) error {
@@ -178,14 +201,15 @@ func (n *ng) GetListeners() ([]engine.Listener, error) {
 }
 
 func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
-	bytes, err := n.getVal(n.path("listeners", key.Id))
+	node, err := n.getNode(n.path("listeners", key.Id))
 	if err != nil {
 		return nil, err
 	}
-	l, err := engine.ListenerFromJSON([]byte(bytes), key.Id)
+	l, err := engine.ListenerFromJSON([]byte(node.Value), key.Id)
 	if err != nil {
 		return nil, err
 	}
+	l.Revision = int64(node.ModifiedIndex)
 	return l, nil
 }
 
@@ -193,7 +217,9 @@ func (n *ng) UpsertListener(listener engine.Listener) error {
 	if listener.Id == "" {
 		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	revision := listener.Revision
+	listener.Revision = 0
+	return n.setRevisedJSONVal(n.path("listeners", listener.Id), listener, noTTL, revision)
 }
 
 func (s *ng) DeleteListener(key engine.ListenerKey) error {
@@ -207,10 +233,14 @@ func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, b := range f.BackendRefs() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: b.Id}); err != nil {
+			return err
+		}
 	}
-	if err := n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL); err != nil {
+	revision := f.Revision
+	f.Revision = 0
+	if err := n.setRevisedJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL, revision); err != nil {
 		return err
 	}
 	if ttl == 0 {
@@ -239,11 +269,16 @@ func (n *ng) GetFrontends() ([]engine.Frontend, error) {
 func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
 	frontendKey := n.path("frontends", key.Id, "frontend")
 
-	bytes, err := n.getVal(frontendKey)
+	node, err := n.getNode(frontendKey)
 	if err != nil {
 		return nil, err
 	}
-	return engine.FrontendFromJSON(n.registry.GetRouter(), []byte(bytes), key.Id)
+	f, err := engine.FrontendFromJSON(n.registry.GetRouter(), []byte(node.Value), key.Id)
+	if err != nil {
+		return nil, err
+	}
+	f.Revision = int64(node.ModifiedIndex)
+	return f, nil
 }
 
 func (n *ng) DeleteFrontend(fk engine.FrontendKey) error {
@@ -272,18 +307,100 @@ func (n *ng) GetBackends() ([]engine.Backend, error) {
 func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	backendKey := n.path("backends", key.Id, "backend")
 
-	bytes, err := n.getVal(backendKey)
+	node, err := n.getNode(backendKey)
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	b, err := engine.BackendFromJSON([]byte(node.Value), key.Id)
+	if err != nil {
+		return nil, err
+	}
+	b.Revision = int64(node.ModifiedIndex)
+	// Client key pair is sealed and stored separately from the backend
+	s := b.HTTPSettings()
+	if s.TLS == nil {
+		return b, nil
+	}
+	sealed, err := n.getVal(n.path("backends", key.Id, "keypair"))
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return b, nil
+		}
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal([]byte(sealed), &keyPair); err != nil {
+		return nil, err
+	}
+	s.TLS.KeyPair = keyPair
+	b.Settings = s
+	return b, nil
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	revision := b.Revision
+	b.Revision = 0
+	backendKey := n.path("backends", b.Id, "backend")
+	keyPairKey := n.path("backends", b.Id, "keypair")
+
+	var sealed *string
+	s := b.HTTPSettings()
+	if s.TLS != nil && s.TLS.KeyPair != nil {
+		bytes, err := n.sealJSONVal(s.TLS.KeyPair)
+		if err != nil {
+			return err
+		}
+		val := string(bytes)
+		sealed = &val
+		tlsSettings := *s.TLS
+		tlsSettings.KeyPair = nil
+		s.TLS = &tlsSettings
+		b.Settings = s
+	}
+
+	if revision == 0 {
+		if sealed != nil {
+			if err := n.setVal(keyPairKey, []byte(*sealed), noTTL); err != nil {
+				return err
+			}
+		} else if err := n.deleteKey(keyPairKey); err != nil && !isNotFoundError(err) {
+			return err
+		}
+		return n.setJSONVal(backendKey, b, noTTL)
+	}
+
+	// The v2 API has no multi-key transactions, so the key pair is written before the backend. The revision is
+	// checked first to leave the key pair intact on the apparent conflict, and the key pair is swapped with the one
+	// that has been read, so it can be swapped back if the backend turns out to be changed in between.
+	if err := n.checkRevision(backendKey, revision); err != nil {
+		return err
+	}
+	prev, err := n.getNode(keyPairKey)
+	if err != nil {
+		if !isNotFoundError(err) {
+			return err
+		}
+		prev = nil
+	}
+	written, err := n.swapNode(keyPairKey, sealed, prev)
+	if err != nil {
+		return err
+	}
+	err = n.setRevisedJSONVal(backendKey, b, noTTL, revision)
+	if _, ok := err.(*engine.RevisionConflictError); ok {
+		var prevVal *string
+		if prev != nil {
+			prevVal = &prev.Value
+		}
+		// the key pair is not restored if it has been written again, e.g. by the writer that has won
+		if _, err := n.swapNode(keyPairKey, prevVal, written); err != nil && !isRevisionConflictError(err) {
+			log.Errorf("failed to restore the key pair of backend %s: %s", b.Id, err)
+		}
+	}
+	return err
 }
 
 func (n *ng) DeleteBackend(bk engine.BackendKey) error {
@@ -319,11 +436,16 @@ func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error)
 
 func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
 	mKey := n.path("frontends", key.FrontendKey.Id, "middlewares", key.Id)
-	bytes, err := n.getVal(mKey)
+	node, err := n.getNode(mKey)
 	if err != nil {
 		return nil, err
 	}
-	return engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
+	m, err := engine.MiddlewareFromJSON([]byte(node.Value), n.registry.GetSpec, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	m.Revision = int64(node.ModifiedIndex)
+	return m, nil
 }
 
 func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
@@ -333,7 +455,9 @@ func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl ti
 	if _, err := n.GetFrontend(fk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
+	revision := m.Revision
+	m.Revision = 0
+	return n.setRevisedJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl, revision)
 }
 
 func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
@@ -350,7 +474,9 @@ func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Durati
 	if _, err := n.GetBackend(bk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl)
+	revision := s.Revision
+	s.Revision = 0
+	return n.setRevisedJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl, revision)
 }
 
 func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
@@ -370,11 +496,17 @@ func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 }
 
 func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
-	bytes, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	node, err := n.getNode(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	if err != nil {
+		return nil, err
+	}
+	srv, err := engine.ServerFromJSON([]byte(node.Value), sk.Id)
 	if err != nil {
 		return nil, err
 	}
-	return engine.ServerFromJSON([]byte(bytes), sk.Id)
+	srv.Revision = int64(node.ModifiedIndex)
+	srv.Expires = node.Expiration
+	return srv, nil
 }
 
 func (n *ng) DeleteServer(sk engine.ServerKey) error {
@@ -421,13 +553,112 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk.Id) {
 			usedFs = append(usedFs, f)
 		}
 	}
 	return usedFs, nil
 }
 
+func (n *ng) GetACMEAccountKey() ([]byte, error) {
+	sealed, err := n.getVal(n.path("acme", "account"))
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if err := n.openSealedJSONVal([]byte(sealed), &key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (n *ng) CreateACMEAccountKey(key []byte) error {
+	sealed, err := n.sealJSONVal(key)
+	if err != nil {
+		return err
+	}
+	_, err = n.client.Create(n.path("acme", "account"), string(sealed), noTTL)
+	return convertErr(err)
+}
+
+func (n *ng) UpsertACMEChallenge(ch engine.ACMEChallenge, ttl time.Duration) error {
+	if err := engine.CheckACMEToken(ch.Token); err != nil {
+		return err
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return n.setJSONVal(n.path("acme", "challenges", ch.Token), ch, ttl)
+}
+
+func (n *ng) GetACMEChallenge(token string) (*engine.ACMEChallenge, error) {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return nil, err
+	}
+	val, err := n.getVal(n.path("acme", "challenges", token))
+	if err != nil {
+		return nil, err
+	}
+	var ch *engine.ACMEChallenge
+	if err := json.Unmarshal([]byte(val), &ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (n *ng) DeleteACMEChallenge(token string) error {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return err
+	}
+	return n.deleteKey(n.path("acme", "challenges", token))
+}
+
+// CreateACMEOrderLock creates the lock key with TTL, etcd fails to create the key that exists
+func (n *ng) CreateACMEOrderLock(domain string, ttl time.Duration) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	if ttl != 0 && ttl < time.Second {
+		ttl = time.Second
+	}
+	_, err := n.client.Create(n.path("acme", "orders", domain), "", uint64(ttl/time.Second))
+	return convertErr(err)
+}
+
+func (n *ng) DeleteACMEOrderLock(domain string) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	return n.deleteKey(n.path("acme", "orders", domain))
+}
+
+// Apply checks the change set against the copy of the configuration and applies the changes one by one.
+// The v2 API has no multi-key transactions, so the changes are written and watched as separate changes, and
+// a concurrent update can still make one of the changes fail after the check, leaving the rest unapplied.
+func (n *ng) Apply(cs engine.ChangeSet) error {
+	if err := cs.Check(); err != nil {
+		return err
+	}
+	m, err := memng.Copy(n)
+	if err != nil {
+		return err
+	}
+	if err := m.Apply(cs); err != nil {
+		return err
+	}
+	for i, ch := range cs.Changes {
+		if err := engine.ApplyChange(n, ch); err != nil {
+			return engine.ChangeError(i, ch, err)
+		}
+	}
+	return nil
+}
+
+// AppliesPartially returns true, the changes of the change set are written and watched one by one
+func (n *ng) AppliesPartially() bool {
+	return true
+}
+
 // Subscribe watches etcd changes and generates structured events telling vulcand to add or delete frontends, hosts etc.
 // It is a blocking function.
 func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
@@ -500,11 +731,12 @@ func (n *ng) parseHostChange(r *etcd.Response) (interface{}, error) {
 	hostname := out[1]
 
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		host, err := n.GetHost(engine.HostKey{hostname})
 		if err != nil {
 			return nil, err
 		}
+		host.Revision = 0
 		return &engine.HostUpserted{
 			Host: *host,
 		}, nil
@@ -525,11 +757,12 @@ func (n *ng) parseListenerChange(r *etcd.Response) (interface{}, error) {
 	key := engine.ListenerKey{Id: out[1]}
 
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		l, err := n.GetListener(key)
 		if err != nil {
 			return nil, err
 		}
+		l.Revision = 0
 		return &engine.ListenerUpserted{
 			Listener: *l,
 		}, nil
@@ -548,11 +781,12 @@ func (n *ng) parseFrontendChange(r *etcd.Response) (interface{}, error) {
 	}
 	key := engine.FrontendKey{Id: out[1]}
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		f, err := n.GetFrontend(key)
 		if err != nil {
 			return nil, err
 		}
+		f.Revision = 0
 		return &engine.FrontendUpserted{
 			Frontend: *f,
 		}, nil
@@ -576,11 +810,12 @@ func (s *ng) parseFrontendMiddlewareChange(r *etcd.Response) (interface{}, error
 	mk := engine.MiddlewareKey{FrontendKey: fk, Id: out[2]}
 
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		m, err := s.GetMiddleware(mk)
 		if err != nil {
 			return nil, err
 		}
+		m.Revision = 0
 		return &engine.MiddlewareUpserted{
 			FrontendKey: fk,
 			Middleware:  *m,
@@ -600,11 +835,12 @@ func (n *ng) parseBackendChange(r *etcd.Response) (interface{}, error) {
 	}
 	bk := engine.BackendKey{Id: out[1]}
 	switch r.Action {
-	case createA, setA:
+	case createA, setA, cswapA:
 		b, err := n.GetBackend(bk)
 		if err != nil {
 			return nil, err
 		}
+		b.Revision = 0
 		return &engine.BackendUpserted{
 			Backend: *b,
 		}, nil
@@ -625,11 +861,12 @@ func (n *ng) parseBackendServerChange(r *etcd.Response) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: out[1]}, Id: out[2]}
 
 	switch r.Action {
-	case setA, createA:
+	case setA, createA, cswapA: // compare and swap is the upsert with the expected revision
 		srv, err := n.GetServer(sk)
 		if err != nil {
 			return nil, err
 		}
+		srv.Revision = 0
 		return &engine.ServerUpserted{
 			BackendKey: sk.BackendKey,
 			Server:     *srv,
@@ -638,8 +875,6 @@ func (n *ng) parseBackendServerChange(r *etcd.Response) (interface{}, error) {
 		return &engine.ServerDeleted{
 			ServerKey: sk,
 		}, nil
-	case cswapA: // ignore compare and swap attempts
-		return nil, nil
 	}
 	return nil, fmt.Errorf("unsupported action on the server: %s", r.Action)
 }
@@ -661,24 +896,87 @@ func (n *ng) setVal(key string, val []byte, ttl time.Duration) error {
 	return convertErr(err)
 }
 
-func (n *ng) getJSONVal(key string, in interface{}) error {
-	val, err := n.getVal(key)
+// setRevisedJSONVal is setRevisedVal for the JSON encoded value
+func (n *ng) setRevisedJSONVal(key string, v interface{}, ttl time.Duration, revision int64) error {
+	bytes, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal([]byte(val), in)
+	return n.setRevisedVal(key, bytes, ttl, revision)
+}
+
+// setRevisedVal writes the value if the ModifiedIndex of the key matches the expected revision,
+// or unconditionally if the revision is 0
+func (n *ng) setRevisedVal(key string, val []byte, ttl time.Duration, revision int64) error {
+	if revision == 0 {
+		return n.setVal(key, val, ttl)
+	}
+	_, err := n.client.CompareAndSwap(key, string(val), uint64(ttl/time.Second), "", uint64(revision))
+	if e, ok := err.(*etcd.EtcdError); ok && (e.ErrorCode == 100 || e.ErrorCode == 101) {
+		if err := n.checkRevision(key, revision); err != nil {
+			return err
+		}
+		// the key has been modified back and forth after the failed comparison
+		return &engine.RevisionConflictError{Message: fmt.Sprintf("%v has been modified concurrently", key)}
+	}
+	return convertErr(err)
+}
+
+// checkRevision returns engine.RevisionConflictError if the ModifiedIndex of the key does not match the expected revision
+// swapNode writes the value, or deletes the key if the value is nil, only if the key has not been changed since
+// the prev node has been read, prev is nil if the key was missing. Returns the written node, nil if the key is deleted.
+func (n *ng) swapNode(key string, val *string, prev *etcd.Node) (*etcd.Node, error) {
+	var r *etcd.Response
+	var err error
+	switch {
+	case val == nil && prev == nil:
+		return nil, nil
+	case val == nil:
+		_, err = n.client.CompareAndDelete(key, "", prev.ModifiedIndex)
+	case prev == nil:
+		r, err = n.client.Create(key, *val, 0)
+	default:
+		r, err = n.client.CompareAndSwap(key, *val, 0, "", prev.ModifiedIndex)
+	}
+	if e, ok := err.(*etcd.EtcdError); ok && (e.ErrorCode == 100 || e.ErrorCode == 101 || e.ErrorCode == 105) {
+		return nil, &engine.RevisionConflictError{Message: fmt.Sprintf("%v has been modified concurrently", key)}
+	}
+	if err != nil || r == nil {
+		return nil, err
+	}
+	return r.Node, nil
+}
+
+func (n *ng) checkRevision(key string, expected int64) error {
+	var stored int64
+	node, err := n.getNode(key)
+	if err == nil {
+		stored = int64(node.ModifiedIndex)
+	} else if !isNotFoundError(err) {
+		return err
+	}
+	return engine.CheckRevision(key, expected, stored)
 }
 
 func (n *ng) getVal(key string) (string, error) {
+	node, err := n.getNode(key)
+	if err != nil {
+		return "", err
+	}
+	return node.Value, nil
+}
+
+// getNode returns the node of the key, its ModifiedIndex is the revision of the object stored in the key
+func (n *ng) getNode(key string) (*etcd.Node, error) {
 	response, err := n.client.Get(key, false, false)
 	if err != nil {
-		return "", convertErr(err)
+		return nil, convertErr(err)
 	}
 
 	if isDir(response.Node) {
-		return "", &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
 	}
-	return response.Node.Value, nil
+	return response.Node, nil
 }
 
 func (n *ng) getDirs(keys ...string) ([]string, error) {
@@ -790,6 +1088,11 @@ func isNotFoundError(err error) bool {
 	return ok
 }
 
+func isRevisionConflictError(err error) bool {
+	_, ok := err.(*engine.RevisionConflictError)
+	return ok
+}
+
 const encryptionSecretBox = "secretbox.v1"
 
 func responseToString(r *etcd.Response) string {
@@ -819,7 +1122,10 @@ type host struct {
 }
 
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default       bool
+	KeyPair       []byte
+	OCSP          engine.OCSPSettings
+	HTTPSRedirect *engine.HTTPSRedirectSettings `json:",omitempty"`
+	HSTS          *engine.HSTSSettings          `json:",omitempty"`
+	AutoCert      bool                          `json:",omitempty"`
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/test"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/secret"
@@ -119,6 +120,14 @@ func (s *EtcdSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *EtcdSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *EtcdSuite) TestHostWithAutoCert(c *C) {
+	s.suite.HostWithAutoCert(c)
+}
+
 func (s *EtcdSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -131,10 +140,18 @@ func (s *EtcdSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
 
+func (s *EtcdSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
 func (s *EtcdSuite) TestBackendDeleteUsed(c *C) {
 	s.suite.BackendDeleteUsed(c)
 }
 
+func (s *EtcdSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
 func (s *EtcdSuite) TestBackendDeleteUnused(c *C) {
 	s.suite.BackendDeleteUnused(c)
 }
@@ -143,10 +160,38 @@ func (s *EtcdSuite) TestServerCRUD(c *C) {
 	s.suite.ServerCRUD(c)
 }
 
+func (s *EtcdSuite) TestServerWeight(c *C) {
+	s.suite.ServerWeight(c)
+}
+
 func (s *EtcdSuite) TestServerExpire(c *C) {
 	s.suite.ServerExpire(c)
 }
 
+func (s *EtcdSuite) TestServerExpires(c *C) {
+	s.suite.ServerExpires(c)
+}
+
+func (s *EtcdSuite) TestACMEAccountKey(c *C) {
+	s.suite.ACMEAccountKey(c)
+}
+
+func (s *EtcdSuite) TestACMEChallengeCRUD(c *C) {
+	s.suite.ACMEChallengeCRUD(c)
+}
+
+func (s *EtcdSuite) TestACMEOrderLock(c *C) {
+	s.suite.ACMEOrderLock(c)
+}
+
+func (s *EtcdSuite) TestACMEOrderLockExpire(c *C) {
+	s.suite.ACMEOrderLockExpire(c)
+}
+
+func (s *EtcdSuite) TestACMEChallengeExpire(c *C) {
+	s.suite.ACMEChallengeExpire(c)
+}
+
 func (s *EtcdSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -175,3 +220,41 @@ func (s *EtcdSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *EtcdSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *EtcdSuite) TestChangeSetFailed(c *C) {
+	s.suite.ChangeSetFailed(c)
+}
+
+func (s *EtcdSuite) TestRevisionConflict(c *C) {
+	s.suite.RevisionConflict(c)
+}
+
+func (s *EtcdSuite) TestSwapNode(c *C) {
+	key := s.ng.path("backends", "b1", "keypair")
+	v1, v2 := "v1", "v2"
+
+	n1, err := s.ng.swapNode(key, &v1, nil)
+	c.Assert(err, IsNil)
+	_, err = s.ng.swapNode(key, &v2, nil)
+	c.Assert(err, FitsTypeOf, &engine.RevisionConflictError{})
+
+	n2, err := s.ng.swapNode(key, &v2, n1)
+	c.Assert(err, IsNil)
+
+	// The value written after the node has been read is not swapped back
+	_, err = s.ng.swapNode(key, &v1, n1)
+	c.Assert(err, FitsTypeOf, &engine.RevisionConflictError{})
+	val, err := s.ng.getVal(key)
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, v2)
+
+	// Deleted key is restored only if it is still missing
+	deleted, err := s.ng.swapNode(key, nil, n2)
+	c.Assert(err, IsNil)
+	c.Assert(deleted, IsNil)
+	_, err = s.ng.swapNode(key, &v2, deleted)
+	c.Assert(err, IsNil)
+	val, err = s.ng.getVal(key)
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, v2)
+}
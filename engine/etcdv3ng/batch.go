@@ -0,0 +1,256 @@
+package etcdv3ng
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+)
+
+// Apply writes the whole change set in one transaction, so the watchers get all changes at the same revision
+// and deliver them as a single engine.ChangeSetApplied. The change set is checked against the copy of the
+// configuration read after the snapshot revision, including the expected revisions of the upserted objects,
+// and the transaction fails and is retried if any key has been modified since then, or if any object
+// the changes depend on has been deleted.
+//
+// Etcd limits the number of operations in a transaction (--max-txn-ops, 128 by default), so large
+// change sets may be rejected by etcd.
+func (n *ng) Apply(cs engine.ChangeSet) error {
+	if err := cs.Check(); err != nil {
+		return err
+	}
+	leases := make([]int64, len(cs.Changes))
+	for i, ch := range cs.Changes {
+		lease, err := n.grant(ch.TTL)
+		if err != nil {
+			return err
+		}
+		leases[i] = lease
+	}
+	prefix := []byte(n.etcdKey + "/")
+	return n.retry(func() (bool, error) {
+		r, err := n.client.rangeKeys(rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+		if err != nil {
+			return false, err
+		}
+		m, err := memng.Copy(n)
+		if err != nil {
+			return false, err
+		}
+		if err := m.Apply(cs); err != nil {
+			return false, err
+		}
+		b := newBatch(r.Kvs)
+		for i, ch := range cs.Changes {
+			if err := n.batchChange(b, ch, leases[i]); err != nil {
+				return false, engine.ChangeError(i, ch, err)
+			}
+		}
+		tr, err := n.client.txn(txnRequest{
+			Compare: append(b.compares, modifiedBefore(prefix, prefixEnd(prefix), r.Header.Revision+1)),
+			Success: b.ops(),
+		})
+		if err != nil {
+			return false, err
+		}
+		return tr.Succeeded, nil
+	})
+}
+
+// batchChange adds the writes of the change to the batch, mirroring the corresponding Upsert and Delete methods
+func (n *ng) batchChange(b *batch, c engine.Change, lease int64) error {
+	switch ch := c.Event.(type) {
+	case *engine.HostUpserted:
+		bytes, err := n.hostToJSON(ch.Host)
+		if err != nil {
+			return err
+		}
+		b.put(n.path("hosts", ch.Host.Name, "host"), bytes, noLease)
+	case *engine.HostDeleted:
+		b.deletePrefix(n.path("hosts", ch.HostKey.Name) + "/")
+	case *engine.ListenerUpserted:
+		l := ch.Listener
+		l.Revision = 0
+		bytes, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		b.put(n.path("listeners", ch.Listener.Id), bytes, noLease)
+	case *engine.ListenerDeleted:
+		b.delete(n.path("listeners", ch.ListenerKey.Id))
+	case *engine.BackendUpserted:
+		ops, err := n.backendOps(ch.Backend)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if op.RequestPut != nil {
+				b.put(string(op.RequestPut.Key), op.RequestPut.Value, noLease)
+			} else {
+				b.delete(string(op.RequestDeleteRange.Key))
+			}
+		}
+	case *engine.BackendDeleted:
+		b.deletePrefix(n.path("backends", ch.BackendKey.Id) + "/")
+	case *engine.ServerUpserted:
+		srv := ch.Server
+		srv.Revision = 0
+		bytes, err := json.Marshal(srv)
+		if err != nil {
+			return err
+		}
+		if err := b.requires(n.path("backends", ch.BackendKey.Id, "backend")); err != nil {
+			return err
+		}
+		b.put(n.path("backends", ch.BackendKey.Id, "servers", ch.Server.Id), bytes, lease)
+	case *engine.ServerDeleted:
+		b.delete(n.path("backends", ch.ServerKey.BackendKey.Id, "servers", ch.ServerKey.Id))
+	case *engine.FrontendUpserted:
+		f := ch.Frontend
+		f.Revision = 0
+		bytes, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		for _, ref := range ch.Frontend.BackendRefs() {
+			if err := b.requires(n.path("backends", ref.Id, "backend")); err != nil {
+				return err
+			}
+		}
+		fkey := n.path("frontends", ch.Frontend.Id, "frontend")
+		var oldLease int64
+		if kv := b.kvs[fkey]; kv != nil {
+			oldLease = kv.Lease
+		}
+		b.put(fkey, bytes, lease)
+		// middlewares without the lease of their own share the lease of the frontend
+		for _, kv := range b.prefix(n.path("frontends", ch.Frontend.Id, "middlewares") + "/") {
+			if kv.Lease == lease || (kv.Lease != noLease && kv.Lease != oldLease) {
+				continue
+			}
+			b.put(string(kv.Key), kv.Value, lease)
+		}
+	case *engine.FrontendDeleted:
+		b.deletePrefix(n.path("frontends", ch.FrontendKey.Id) + "/")
+	case *engine.MiddlewareUpserted:
+		m := ch.Middleware
+		m.Revision = 0
+		bytes, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		fkey := n.path("frontends", ch.FrontendKey.Id, "frontend")
+		if err := b.requires(fkey); err != nil {
+			return err
+		}
+		if lease == noLease {
+			lease = b.kvs[fkey].Lease
+		}
+		b.put(n.path("frontends", ch.FrontendKey.Id, "middlewares", ch.Middleware.Id), bytes, lease)
+	case *engine.MiddlewareDeleted:
+		mk := ch.MiddlewareKey
+		b.delete(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+	default:
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", c.Event)}
+	}
+	return nil
+}
+
+// batch collects the writes of the change set on top of the snapshot of the keys. Etcd rejects transactions
+// writing the same key twice, so only the last write of every key is kept.
+type batch struct {
+	// kvs are the keys as they are after the writes collected so far
+	kvs map[string]*keyValue
+	// existed are the keys present in the snapshot
+	existed map[string]bool
+	// keys are the written keys in the order they were first written
+	keys    []string
+	written map[string]bool
+	// compares make sure the keys the changes depend on still exist when the transaction is committed
+	compares []compare
+	required map[string]bool
+}
+
+func newBatch(snapshot []*keyValue) *batch {
+	b := &batch{
+		kvs:      make(map[string]*keyValue, len(snapshot)),
+		existed:  make(map[string]bool, len(snapshot)),
+		written:  make(map[string]bool),
+		required: make(map[string]bool),
+	}
+	for _, kv := range snapshot {
+		b.kvs[string(kv.Key)] = kv
+		b.existed[string(kv.Key)] = true
+	}
+	return b
+}
+
+func (b *batch) touch(key string) {
+	if !b.written[key] {
+		b.written[key] = true
+		b.keys = append(b.keys, key)
+	}
+}
+
+func (b *batch) put(key string, value []byte, lease int64) {
+	b.touch(key)
+	b.kvs[key] = &keyValue{Key: []byte(key), Value: value, Lease: lease}
+}
+
+func (b *batch) delete(key string) {
+	if _, ok := b.kvs[key]; !ok {
+		return
+	}
+	b.touch(key)
+	delete(b.kvs, key)
+}
+
+func (b *batch) deletePrefix(prefix string) {
+	for _, kv := range b.prefix(prefix) {
+		b.delete(string(kv.Key))
+	}
+}
+
+// prefix returns the keys with the given prefix, sorted by key
+func (b *batch) prefix(prefix string) []*keyValue {
+	var keys []string
+	for key := range b.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := make([]*keyValue, len(keys))
+	for i, key := range keys {
+		out[i] = b.kvs[key]
+	}
+	return out
+}
+
+// requires checks that the key exists, adding the comparison for the keys that are not written by the batch
+func (b *batch) requires(key string) error {
+	if _, ok := b.kvs[key]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+	}
+	if !b.written[key] && !b.required[key] {
+		b.required[key] = true
+		b.compares = append(b.compares, exists(key))
+	}
+	return nil
+}
+
+// ops returns the writes in the order the keys were first written
+func (b *batch) ops() []requestOp {
+	var ops []requestOp
+	for _, key := range b.keys {
+		if kv, ok := b.kvs[key]; ok {
+			ops = append(ops, requestOp{RequestPut: &putRequest{Key: kv.Key, Value: kv.Value, Lease: kv.Lease}})
+		} else if b.existed[key] {
+			ops = append(ops, requestOp{RequestDeleteRange: &deleteRangeRequest{Key: []byte(key)}})
+		}
+	}
+	return ops
+}
@@ -0,0 +1,422 @@
+package etcdv3ng
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// client talks to etcd v3 using the JSON gateway that every etcd server exposes next to the gRPC API,
+// so vulcand does not need the gRPC client stack. Keys and values are base64 encoded by the gateway,
+// which is what encoding/json does with []byte, and 64 bit integers are sent as strings.
+type client struct {
+	mtx       sync.Mutex
+	endpoints []string
+	current   int
+	http      *http.Client
+	watchHTTP *http.Client
+}
+
+func newClient(endpoints []string, o Options) (*client, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("provide at least one etcd endpoint")
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if o.EtcdCertFile != "" || o.EtcdKeyFile != "" || o.EtcdCaFile != "" {
+		config, err := tlsConfig(o)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	eps := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		eps[i] = strings.TrimSuffix(e, "/")
+	}
+	return &client{
+		endpoints: eps,
+		http:      &http.Client{Transport: transport, Timeout: o.EtcdRequestTimeout},
+		// watches are long running requests and are only limited by the cancel channel
+		watchHTTP: &http.Client{Transport: transport},
+	}, nil
+}
+
+func tlsConfig(o Options) (*tls.Config, error) {
+	config := &tls.Config{}
+	if o.EtcdCertFile != "" || o.EtcdKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.EtcdCertFile, o.EtcdKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if o.EtcdCaFile != "" {
+		pem, err := ioutil.ReadFile(o.EtcdCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to read CA certificates from %s", o.EtcdCaFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (c *client) close() {
+	if t, ok := c.http.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+func (c *client) rangeKeys(r rangeRequest) (*rangeResponse, error) {
+	var out *rangeResponse
+	if err := c.call("/v3/kv/range", r, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *client) put(r putRequest) (*putResponse, error) {
+	var out *putResponse
+	if err := c.call("/v3/kv/put", r, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *client) deleteRange(r deleteRangeRequest) (*deleteRangeResponse, error) {
+	var out *deleteRangeResponse
+	if err := c.call("/v3/kv/deleterange", r, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *client) txn(r txnRequest) (*txnResponse, error) {
+	var out *txnResponse
+	if err := c.call("/v3/kv/txn", r, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *client) grant(ttl time.Duration) (int64, error) {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	var out *leaseGrantResponse
+	if err := c.call("/v3/lease/grant", leaseGrantRequest{TTL: seconds}, &out); err != nil {
+		return 0, err
+	}
+	if out.Error != "" {
+		return 0, fmt.Errorf("failed to grant lease: %s", out.Error)
+	}
+	return out.ID, nil
+}
+
+// timeToLive returns the time left until the lease expires, 0 if the lease has expired
+func (c *client) timeToLive(lease int64) (time.Duration, error) {
+	var out *leaseTimeToLiveResponse
+	if err := c.call("/v3/lease/timetolive", leaseTimeToLiveRequest{ID: lease}, &out); err != nil {
+		return 0, err
+	}
+	if out.Error != "" {
+		return 0, fmt.Errorf("failed to get lease ttl: %s", out.Error)
+	}
+	if out.TTL < 0 {
+		return 0, nil
+	}
+	return time.Duration(out.TTL) * time.Second, nil
+}
+
+// call sends the request to the current endpoint and fails over to the next one on transport errors
+func (c *client) call(path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for i := 0; i < len(c.endpoints); i++ {
+		endpoint := c.endpoint()
+		re, err := c.http.Post(endpoint+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			c.next(endpoint)
+			continue
+		}
+		data, err := ioutil.ReadAll(re.Body)
+		re.Body.Close()
+		if err != nil {
+			lastErr = err
+			c.next(endpoint)
+			continue
+		}
+		if re.StatusCode != http.StatusOK {
+			return responseError(re.StatusCode, data)
+		}
+		return json.Unmarshal(data, out)
+	}
+	return lastErr
+}
+
+// watch opens a watch stream and calls fn for every watch response until the stream ends or fn returns an error.
+func (c *client) watch(r watchCreateRequest, cancelC chan bool, fn func(*watchResponse) error) error {
+	body, err := json.Marshal(watchRequest{CreateRequest: &r})
+	if err != nil {
+		return err
+	}
+	endpoint := c.endpoint()
+	req, err := http.NewRequest("POST", endpoint+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// cancel the request when the watch is cancelled by the caller
+	doneC := make(chan bool)
+	defer close(doneC)
+	cancelRequest := make(chan struct{})
+	req.Cancel = cancelRequest
+	go func() {
+		select {
+		case <-cancelC:
+			close(cancelRequest)
+		case <-doneC:
+		}
+	}()
+
+	re, err := c.watchHTTP.Do(req)
+	if err != nil {
+		c.next(endpoint)
+		return err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(re.Body)
+		return responseError(re.StatusCode, data)
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(re.Body))
+	for {
+		var m watchMessage
+		if err := decoder.Decode(&m); err != nil {
+			return err
+		}
+		if m.Error != nil {
+			return fmt.Errorf("watch failed: %s", m.Error.Message)
+		}
+		if m.Result == nil {
+			continue
+		}
+		if err := fn(m.Result); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) endpoint() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.endpoints[c.current]
+}
+
+func (c *client) next(failed string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.endpoints[c.current] == failed {
+		c.current = (c.current + 1) % len(c.endpoints)
+	}
+}
+
+func responseError(code int, data []byte) error {
+	var e gatewayError
+	if err := json.Unmarshal(data, &e); err == nil && (e.Message != "" || e.Error != "") {
+		if e.Message == "" {
+			e.Message = e.Error
+		}
+		return fmt.Errorf("etcd error (%d): %s", code, e.Message)
+	}
+	return fmt.Errorf("etcd error (%d): %s", code, strings.TrimSpace(string(data)))
+}
+
+// prefixEnd returns the range end that selects all keys starting with the prefix
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] = end[i] + 1
+			return end[:i+1]
+		}
+	}
+	// the prefix is all 0xff, select everything after it
+	return []byte{0}
+}
+
+type responseHeader struct {
+	Revision int64 `json:"revision,string,omitempty"`
+}
+
+type keyValue struct {
+	Key            []byte `json:"key,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	Version        int64  `json:"version,string,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+	Lease          int64  `json:"lease,string,omitempty"`
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key,omitempty"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	Revision int64  `json:"revision,string,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type rangeResponse struct {
+	Header *responseHeader `json:"header,omitempty"`
+	Kvs    []*keyValue     `json:"kvs,omitempty"`
+	Count  int64           `json:"count,string,omitempty"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type putResponse struct {
+	Header *responseHeader `json:"header,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key      []byte `json:"key,omitempty"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type deleteRangeResponse struct {
+	Header  *responseHeader `json:"header,omitempty"`
+	Deleted int64           `json:"deleted,string,omitempty"`
+}
+
+const (
+	compareEqual    = "EQUAL"
+	compareGreater  = "GREATER"
+	compareLess     = "LESS"
+	compareNotEqual = "NOT_EQUAL"
+
+	targetVersion = "VERSION"
+	targetCreate  = "CREATE"
+	targetMod     = "MOD"
+)
+
+type compare struct {
+	Result   string `json:"result,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Key      []byte `json:"key,omitempty"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	// only one of the targets is set, the gateway accepts 64 bit integers as JSON numbers
+	Version        *int64 `json:"version,omitempty"`
+	CreateRevision *int64 `json:"create_revision,omitempty"`
+	ModRevision    *int64 `json:"mod_revision,omitempty"`
+}
+
+type requestOp struct {
+	RequestRange       *rangeRequest       `json:"request_range,omitempty"`
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type responseOp struct {
+	ResponseRange       *rangeResponse       `json:"response_range,omitempty"`
+	ResponsePut         *putResponse         `json:"response_put,omitempty"`
+	ResponseDeleteRange *deleteRangeResponse `json:"response_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare,omitempty"`
+	Success []requestOp `json:"success,omitempty"`
+	Failure []requestOp `json:"failure,omitempty"`
+}
+
+type txnResponse struct {
+	Header    *responseHeader `json:"header,omitempty"`
+	Succeeded bool            `json:"succeeded,omitempty"`
+	Responses []responseOp    `json:"responses,omitempty"`
+}
+
+type leaseGrantRequest struct {
+	TTL int64 `json:"TTL,string,omitempty"`
+	ID  int64 `json:"ID,string,omitempty"`
+}
+
+type leaseGrantResponse struct {
+	Header *responseHeader `json:"header,omitempty"`
+	ID     int64           `json:"ID,string,omitempty"`
+	TTL    int64           `json:"TTL,string,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type leaseTimeToLiveRequest struct {
+	ID int64 `json:"ID,string,omitempty"`
+}
+
+type leaseTimeToLiveResponse struct {
+	Header     *responseHeader `json:"header,omitempty"`
+	ID         int64           `json:"ID,string,omitempty"`
+	TTL        int64           `json:"TTL,string,omitempty"`
+	GrantedTTL int64           `json:"grantedTTL,string,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type watchRequest struct {
+	CreateRequest *watchCreateRequest `json:"create_request,omitempty"`
+}
+
+type watchCreateRequest struct {
+	Key           []byte `json:"key,omitempty"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+}
+
+const (
+	eventPut    = "PUT"
+	eventDelete = "DELETE"
+)
+
+type event struct {
+	// Type is omitted by the gateway for PUT events, as it is the zero value of the enum
+	Type string    `json:"type,omitempty"`
+	Kv   *keyValue `json:"kv,omitempty"`
+}
+
+type watchResponse struct {
+	Header          *responseHeader `json:"header,omitempty"`
+	Created         bool            `json:"created,omitempty"`
+	Canceled        bool            `json:"canceled,omitempty"`
+	CompactRevision int64           `json:"compact_revision,string,omitempty"`
+	CancelReason    string          `json:"cancel_reason,omitempty"`
+	Events          []*event        `json:"events,omitempty"`
+}
+
+type watchMessage struct {
+	Result *watchResponse `json:"result,omitempty"`
+	Error  *gatewayError  `json:"error,omitempty"`
+}
+
+type gatewayError struct {
+	Error   string `json:"error,omitempty"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,1203 @@
+// package etcdv3ng contains the implementation of the engine backed by the etcd v3 API.
+//
+// The engine keeps the key layout of the v2 engine (etcdng), so a v2 tree can be copied over key by key
+// (see MigrateV2). All keys live under the configured prefix, "/vulcand" by default:
+//
+//	<prefix>/hosts/<name>/host                 host, the key pair is sealed with the box and stored inline
+//	<prefix>/listeners/<id>                    listener
+//	<prefix>/backends/<id>/backend             backend without the client key pair
+//	<prefix>/backends/<id>/keypair             sealed client key pair of the backend
+//	<prefix>/backends/<id>/servers/<id>        server
+//	<prefix>/frontends/<id>/frontend           frontend
+//	<prefix>/frontends/<id>/middlewares/<id>   middleware
+//	<prefix>/acme/account                      sealed ACME account key
+//	<prefix>/acme/challenges/<token>           pending ACME HTTP-01 challenge
+//	<prefix>/acme/orders/<domain>              lock on ordering the certificate for the domain
+//
+// Values are JSON documents in the same format the v2 engine uses. Servers, frontends and middlewares
+// upserted with a TTL are attached to a lease, and etcd deletes them when the lease expires. Middlewares
+// upserted without a TTL share the lease of their frontend, so they expire along with it, as they did
+// with directory TTLs in v2.
+//
+// Changes are delivered by a revision based watch on the prefix. When the watch stream breaks, it is
+// re-established from the revision following the last delivered one, so no changes are lost as long
+// as etcd has not compacted them. Changes written by one transaction share the revision and are delivered
+// as a single engine.ChangeSetApplied.
+package etcdv3ng
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+)
+
+type ng struct {
+	nodes    []string
+	registry *plugin.Registry
+	etcdKey  string
+	client   *client
+	logsev   log.Severity
+	options  Options
+}
+
+type Options struct {
+	EtcdCaFile         string
+	EtcdCertFile       string
+	EtcdKeyFile        string
+	EtcdRequestTimeout time.Duration
+	// RetryPeriod is the pause before the broken watch is re-established
+	RetryPeriod time.Duration
+	Box         *secret.Box
+}
+
+func New(nodes []string, etcdKey string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	options = setDefaults(options)
+	c, err := newClient(nodes, options)
+	if err != nil {
+		return nil, err
+	}
+	return &ng{
+		nodes:    nodes,
+		registry: registry,
+		etcdKey:  strings.TrimSuffix(etcdKey, "/"),
+		client:   c,
+		options:  options,
+	}, nil
+}
+
+func (n *ng) Close() {
+	n.client.close()
+}
+
+func (n *ng) GetLogSeverity() log.Severity {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Severity) {
+	n.logsev = sev
+	log.SetSeverity(n.logsev)
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	hosts := []engine.Host{}
+	kvs, err := n.getPrefix(n.path("hosts"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		m := hostRe.FindStringSubmatch(n.relative(kv.Key))
+		if len(m) != 2 {
+			continue
+		}
+		h, err := n.hostFromJSON(m[1], kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		h.Revision = kv.ModRevision
+		hosts = append(hosts, *h)
+	}
+	return hosts, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	kv, err := n.getVal(n.path("hosts", key.Name, "host"))
+	if err != nil {
+		return nil, err
+	}
+	h, err := n.hostFromJSON(key.Name, kv.Value)
+	if err != nil {
+		return nil, err
+	}
+	h.Revision = kv.ModRevision
+	return h, nil
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	bytes, err := n.hostToJSON(h)
+	if err != nil {
+		return err
+	}
+	return n.put(n.path("hosts", h.Name, "host"), bytes, h.Revision)
+}
+
+// hostToJSON returns the stored host value, with the key pair sealed by the box
+func (n *ng) hostToJSON(h engine.Host) ([]byte, error) {
+	val := host{
+		Name: h.Name,
+		Settings: hostSettings{
+			Default:       h.Settings.Default,
+			OCSP:          h.Settings.OCSP,
+			HTTPSRedirect: h.Settings.HTTPSRedirect,
+			HSTS:          h.Settings.HSTS,
+			AutoCert:      h.Settings.AutoCert,
+		},
+	}
+	if h.Settings.KeyPair != nil {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		val.Settings.KeyPair = bytes
+	}
+	return json.Marshal(val)
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	return n.deletePrefix(n.path("hosts", key.Name))
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	ls := []engine.Listener{}
+	kvs, err := n.getPrefix(n.path("listeners"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		m := listenerRe.FindStringSubmatch(n.relative(kv.Key))
+		if len(m) != 2 {
+			continue
+		}
+		l, err := engine.ListenerFromJSON(kv.Value, m[1])
+		if err != nil {
+			return nil, err
+		}
+		l.Revision = kv.ModRevision
+		ls = append(ls, *l)
+	}
+	return ls, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	kv, err := n.getVal(n.path("listeners", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	l, err := engine.ListenerFromJSON(kv.Value, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	l.Revision = kv.ModRevision
+	return l, nil
+}
+
+func (n *ng) UpsertListener(listener engine.Listener) error {
+	if listener.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	revision := listener.Revision
+	listener.Revision = 0
+	bytes, err := json.Marshal(listener)
+	if err != nil {
+		return err
+	}
+	return n.put(n.path("listeners", listener.Id), bytes, revision)
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	return n.deleteKey(n.path("listeners", key.Id))
+}
+
+// UpsertFrontend checks that the backends exist and writes the frontend in the same transaction.
+// The frontend lease is shared by the middlewares that have no lease of their own.
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	expected := f.Revision
+	f.Revision = 0
+	bytes, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	lease, err := n.grant(ttl)
+	if err != nil {
+		return err
+	}
+	return n.retry(func() (bool, error) {
+		fkey := n.path("frontends", f.Id, "frontend")
+		mprefix := n.path("frontends", f.Id, "middlewares") + "/"
+		r, err := n.client.txn(txnRequest{
+			Success: []requestOp{
+				{RequestRange: &rangeRequest{Key: []byte(fkey)}},
+				{RequestRange: &rangeRequest{Key: []byte(mprefix), RangeEnd: prefixEnd([]byte(mprefix))}},
+			},
+		})
+		if err != nil {
+			return false, err
+		}
+		revision := r.Header.Revision
+		var oldLease, stored int64
+		if kvs := r.Responses[0].ResponseRange.Kvs; len(kvs) != 0 {
+			oldLease, stored = kvs[0].Lease, kvs[0].ModRevision
+		}
+		if err := engine.CheckRevision(engine.FrontendKey{Id: f.Id}, expected, stored); err != nil {
+			return false, err
+		}
+
+		cmps := []compare{
+			modifiedBefore([]byte(fkey), nil, revision+1),
+			modifiedBefore([]byte(mprefix), prefixEnd([]byte(mprefix)), revision+1),
+		}
+		for _, b := range f.BackendRefs() {
+			cmps = append(cmps, exists(n.path("backends", b.Id, "backend")))
+		}
+		ops := []requestOp{{RequestPut: &putRequest{Key: []byte(fkey), Value: bytes, Lease: lease}}}
+		for _, kv := range r.Responses[1].ResponseRange.Kvs {
+			if kv.Lease == lease || (kv.Lease != noLease && kv.Lease != oldLease) {
+				continue
+			}
+			ops = append(ops, requestOp{RequestPut: &putRequest{Key: kv.Key, Value: kv.Value, Lease: lease}})
+		}
+
+		tr, err := n.client.txn(txnRequest{Compare: cmps, Success: ops})
+		if err != nil {
+			return false, err
+		}
+		if tr.Succeeded {
+			return true, nil
+		}
+		for _, b := range f.BackendRefs() {
+			if _, err := n.GetBackend(engine.BackendKey{Id: b.Id}); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	})
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	fs := []engine.Frontend{}
+	kvs, err := n.getPrefix(n.path("frontends"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		m := frontendRe.FindStringSubmatch(n.relative(kv.Key))
+		if len(m) != 2 {
+			continue
+		}
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), kv.Value, m[1])
+		if err != nil {
+			return nil, err
+		}
+		f.Revision = kv.ModRevision
+		fs = append(fs, *f)
+	}
+	return fs, nil
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	kv, err := n.getVal(n.path("frontends", key.Id, "frontend"))
+	if err != nil {
+		return nil, err
+	}
+	f, err := engine.FrontendFromJSON(n.registry.GetRouter(), kv.Value, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	f.Revision = kv.ModRevision
+	return f, nil
+}
+
+func (n *ng) DeleteFrontend(fk engine.FrontendKey) error {
+	if fk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	return n.deletePrefix(n.path("frontends", fk.Id))
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	backends := []engine.Backend{}
+	kvs, err := n.getPrefix(n.path("backends"))
+	if err != nil {
+		return nil, err
+	}
+	keyPairs := make(map[string][]byte)
+	for _, kv := range kvs {
+		if m := backendKeyPairRe.FindStringSubmatch(n.relative(kv.Key)); len(m) == 2 {
+			keyPairs[m[1]] = kv.Value
+		}
+	}
+	for _, kv := range kvs {
+		m := backendRe.FindStringSubmatch(n.relative(kv.Key))
+		if len(m) != 2 {
+			continue
+		}
+		b, err := n.backendFromJSON(m[1], kv.Value, keyPairs[m[1]])
+		if err != nil {
+			return nil, err
+		}
+		b.Revision = kv.ModRevision
+		backends = append(backends, *b)
+	}
+	return backends, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	return n.getBackend(key, 0)
+}
+
+// getBackend reads the backend and its key pair at the given revision, or at the latest one if the revision is 0
+func (n *ng) getBackend(key engine.BackendKey, revision int64) (*engine.Backend, error) {
+	r, err := n.client.txn(txnRequest{
+		Success: []requestOp{
+			{RequestRange: &rangeRequest{Key: []byte(n.path("backends", key.Id, "backend")), Revision: revision}},
+			{RequestRange: &rangeRequest{Key: []byte(n.path("backends", key.Id, "keypair")), Revision: revision}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	kvs := r.Responses[0].ResponseRange.Kvs
+	if len(kvs) == 0 {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", key.Id)}
+	}
+	var keyPair []byte
+	if kps := r.Responses[1].ResponseRange.Kvs; len(kps) != 0 {
+		keyPair = kps[0].Value
+	}
+	b, err := n.backendFromJSON(key.Id, kvs[0].Value, keyPair)
+	if err != nil {
+		return nil, err
+	}
+	b.Revision = kvs[0].ModRevision
+	return b, nil
+}
+
+// UpsertBackend writes the backend along with its sealed client key pair in one transaction
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if b.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	ops, err := n.backendOps(b)
+	if err != nil {
+		return err
+	}
+	key := n.path("backends", b.Id, "backend")
+	r, err := n.client.txn(txnRequest{Compare: revised(key, b.Revision), Success: ops})
+	if err != nil {
+		return err
+	}
+	if !r.Succeeded {
+		return n.checkRevision(key, b.Revision)
+	}
+	return nil
+}
+
+// backendOps returns the operations writing the backend and its sealed client key pair, or deleting
+// the key pair if the backend has none
+func (n *ng) backendOps(b engine.Backend) ([]requestOp, error) {
+	keyPairKey := []byte(n.path("backends", b.Id, "keypair"))
+	var op requestOp
+	s := b.HTTPSettings()
+	if s.TLS != nil && s.TLS.KeyPair != nil {
+		sealed, err := n.sealJSONVal(s.TLS.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		op = requestOp{RequestPut: &putRequest{Key: keyPairKey, Value: sealed}}
+		tlsSettings := *s.TLS
+		tlsSettings.KeyPair = nil
+		s.TLS = &tlsSettings
+		b.Settings = s
+	} else {
+		op = requestOp{RequestDeleteRange: &deleteRangeRequest{Key: keyPairKey}}
+	}
+	b.Revision = 0
+	bytes, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return []requestOp{op, {RequestPut: &putRequest{Key: []byte(n.path("backends", b.Id, "backend")), Value: bytes}}}, nil
+}
+
+// DeleteBackend deletes the backend only if no frontend uses it. The check and the delete are done
+// in one transaction that fails if any frontend has changed since the frontends were read.
+func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+	if bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	return n.retry(func() (bool, error) {
+		fs, revision, err := n.backendUsedBy(bk)
+		if err != nil {
+			return false, err
+		}
+		if len(fs) != 0 {
+			ids := make([]string, len(fs))
+			for i, f := range fs {
+				ids[i] = f.Id
+			}
+			return false, fmt.Errorf("can not delete backend '%v', it is in use by %v", bk, ids)
+		}
+		fprefix := []byte(n.path("frontends") + "/")
+		bprefix := []byte(n.path("backends", bk.Id) + "/")
+		r, err := n.client.txn(txnRequest{
+			Compare: []compare{
+				exists(n.path("backends", bk.Id, "backend")),
+				modifiedBefore(fprefix, prefixEnd(fprefix), revision+1),
+			},
+			Success: []requestOp{{RequestDeleteRange: &deleteRangeRequest{Key: bprefix, RangeEnd: prefixEnd(bprefix)}}},
+		})
+		if err != nil {
+			return false, err
+		}
+		if r.Succeeded {
+			return true, nil
+		}
+		if _, err := n.GetBackend(bk); err != nil {
+			return false, err
+		}
+		return false, nil
+	})
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	ms := []engine.Middleware{}
+	kvs, err := n.getPrefix(n.path("frontends", fk.Id, "middlewares"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		m, err := engine.MiddlewareFromJSON(kv.Value, n.registry.GetSpec, suffix(string(kv.Key)))
+		if err != nil {
+			return nil, err
+		}
+		m.Revision = kv.ModRevision
+		ms = append(ms, *m)
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	kv, err := n.getVal(n.path("frontends", key.FrontendKey.Id, "middlewares", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	m, err := engine.MiddlewareFromJSON(kv.Value, n.registry.GetSpec, key.Id)
+	if err != nil {
+		return nil, err
+	}
+	m.Revision = kv.ModRevision
+	return m, nil
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	if n.registry.GetSpec(m.Type) == nil {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("middleware of type %s is not supported", m.Type)}
+	}
+	expected := m.Revision
+	m.Revision = 0
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	lease, err := n.grant(ttl)
+	if err != nil {
+		return err
+	}
+	fkey := n.path("frontends", fk.Id, "frontend")
+	mkey := n.path("frontends", fk.Id, "middlewares", m.Id)
+	return n.retry(func() (bool, error) {
+		f, err := n.getVal(fkey)
+		if err != nil {
+			return false, err
+		}
+		l := lease
+		if l == noLease {
+			l = f.Lease
+		}
+		r, err := n.client.txn(txnRequest{
+			Compare: append(revised(mkey, expected), modifiedAt(fkey, f.ModRevision)),
+			Success: []requestOp{{RequestPut: &putRequest{Key: []byte(mkey), Value: bytes, Lease: l}}},
+		})
+		if err != nil {
+			return false, err
+		}
+		if !r.Succeeded && expected != 0 {
+			// the transaction is retried if it failed because of the frontend change
+			return false, n.checkRevision(mkey, expected)
+		}
+		return r.Succeeded, nil
+	})
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	if mk.FrontendKey.Id == "" || mk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+}
+
+// UpsertServer writes the server only if the backend exists
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	expected := s.Revision
+	s.Revision = 0
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	lease, err := n.grant(ttl)
+	if err != nil {
+		return err
+	}
+	key := n.path("backends", bk.Id, "servers", s.Id)
+	r, err := n.client.txn(txnRequest{
+		Compare: append(revised(key, expected), exists(n.path("backends", bk.Id, "backend"))),
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(key), Value: bytes, Lease: lease}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !r.Succeeded {
+		if _, err := n.GetBackend(bk); err != nil {
+			return err
+		}
+		return n.checkRevision(key, expected)
+	}
+	return nil
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	svs := []engine.Server{}
+	kvs, err := n.getPrefix(n.path("backends", bk.Id, "servers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		srv, err := engine.ServerFromJSON(kv.Value, suffix(string(kv.Key)))
+		if err != nil {
+			return nil, err
+		}
+		srv.Revision = kv.ModRevision
+		svs = append(svs, *srv)
+	}
+	return svs, nil
+}
+
+func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	kv, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	if err != nil {
+		return nil, err
+	}
+	srv, err := engine.ServerFromJSON(kv.Value, sk.Id)
+	if err != nil {
+		return nil, err
+	}
+	srv.Revision = kv.ModRevision
+	if kv.Lease != noLease {
+		ttl, err := n.client.timeToLive(kv.Lease)
+		if err != nil {
+			return nil, err
+		}
+		expires := time.Now().UTC().Add(ttl)
+		srv.Expires = &expires
+	}
+	return srv, nil
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+}
+
+func (n *ng) GetACMEAccountKey() ([]byte, error) {
+	kv, err := n.getVal(n.path("acme", "account"))
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if err := n.openSealedJSONVal(kv.Value, &key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateACMEAccountKey writes the sealed key only if there is no key yet
+func (n *ng) CreateACMEAccountKey(key []byte) error {
+	sealed, err := n.sealJSONVal(key)
+	if err != nil {
+		return err
+	}
+	k := n.path("acme", "account")
+	r, err := n.client.txn(txnRequest{
+		Compare: []compare{missing(k)},
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(k), Value: sealed}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !r.Succeeded {
+		return &engine.AlreadyExistsError{Message: "ACME account key already exists"}
+	}
+	return nil
+}
+
+func (n *ng) UpsertACMEChallenge(ch engine.ACMEChallenge, ttl time.Duration) error {
+	if err := engine.CheckACMEToken(ch.Token); err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	lease, err := n.grant(ttl)
+	if err != nil {
+		return err
+	}
+	_, err = n.client.put(putRequest{Key: []byte(n.path("acme", "challenges", ch.Token)), Value: bytes, Lease: lease})
+	return err
+}
+
+func (n *ng) GetACMEChallenge(token string) (*engine.ACMEChallenge, error) {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return nil, err
+	}
+	kv, err := n.getVal(n.path("acme", "challenges", token))
+	if err != nil {
+		return nil, err
+	}
+	var ch *engine.ACMEChallenge
+	if err := json.Unmarshal(kv.Value, &ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (n *ng) DeleteACMEChallenge(token string) error {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return err
+	}
+	return n.deleteKey(n.path("acme", "challenges", token))
+}
+
+// CreateACMEOrderLock writes the lock attached to the lease only if there is no lock yet
+func (n *ng) CreateACMEOrderLock(domain string, ttl time.Duration) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	lease, err := n.grant(ttl)
+	if err != nil {
+		return err
+	}
+	k := n.path("acme", "orders", domain)
+	r, err := n.client.txn(txnRequest{
+		Compare: []compare{missing(k)},
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(k), Lease: lease}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !r.Succeeded {
+		return &engine.AlreadyExistsError{Message: fmt.Sprintf("ACME order lock '%s' already exists", domain)}
+	}
+	return nil
+}
+
+func (n *ng) DeleteACMEOrderLock(domain string) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	return n.deleteKey(n.path("acme", "orders", domain))
+}
+
+// backendUsedBy returns the frontends using the backend and the revision they were read at
+func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, int64, error) {
+	prefix := []byte(n.path("frontends") + "/")
+	r, err := n.client.rangeKeys(rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	if err != nil {
+		return nil, 0, err
+	}
+	usedFs := []engine.Frontend{}
+	for _, kv := range r.Kvs {
+		m := frontendRe.FindStringSubmatch(n.relative(kv.Key))
+		if len(m) != 2 {
+			continue
+		}
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), kv.Value, m[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		if f.UsesBackend(bk.Id) {
+			usedFs = append(usedFs, *f)
+		}
+	}
+	return usedFs, r.Header.Revision, nil
+}
+
+// Subscribe watches etcd changes and generates structured events telling vulcand to add or delete frontends, hosts etc.
+// It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	// The revision of the last seen change, the watch is resumed right after it when the stream breaks
+	r, err := n.client.rangeKeys(rangeRequest{Key: []byte(n.etcdKey), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	revision := r.Header.Revision
+	prefix := []byte(n.etcdKey + "/")
+	for {
+		err := n.client.watch(watchCreateRequest{Key: prefix, RangeEnd: prefixEnd(prefix), StartRevision: revision + 1}, cancelC,
+			func(w *watchResponse) error {
+				if w.CompactRevision != 0 {
+					return &compactedError{revision: revision + 1, compacted: w.CompactRevision}
+				}
+				if w.Canceled {
+					return fmt.Errorf("watch canceled: %s", w.CancelReason)
+				}
+				for _, change := range n.groupChanges(w.Events) {
+					log.Infof("%v", change)
+					select {
+					case changes <- change:
+					case <-cancelC:
+						return errStopped
+					}
+				}
+				if len(w.Events) != 0 {
+					revision = w.Events[len(w.Events)-1].Kv.ModRevision
+				}
+				return nil
+			})
+		select {
+		case <-cancelC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		default:
+		}
+		if _, ok := err.(*compactedError); ok {
+			log.Errorf("unexpected error: %s, stop watching", err)
+			return err
+		}
+		log.Warningf("watch interrupted: %v, resuming from revision %d", err, revision+1)
+		select {
+		case <-time.After(n.options.RetryPeriod):
+		case <-cancelC:
+			log.Infof("Stop watching: graceful shutdown")
+			return nil
+		}
+	}
+}
+
+// groupChanges converts the events of a watch response to vulcand changes. The changes made by the same
+// transaction, e.g. by Apply, are delivered as a single engine.ChangeSetApplied.
+func (n *ng) groupChanges(events []*event) []interface{} {
+	var out []interface{}
+	for len(events) != 0 {
+		i := 1
+		for i < len(events) && events[i].Kv.ModRevision == events[0].Kv.ModRevision {
+			i++
+		}
+		changes := n.parseChanges(events[:i])
+		if len(changes) > 1 {
+			out = append(out, &engine.ChangeSetApplied{Changes: changes})
+		} else {
+			out = append(out, changes...)
+		}
+		events = events[i:]
+	}
+	return out
+}
+
+// parseChanges converts the events of a watch response to vulcand changes. Deleting a host, backend or
+// frontend deletes all keys under it, so deletes of the nested keys are dropped when the parent is deleted
+// at the same revision.
+func (n *ng) parseChanges(events []*event) []interface{} {
+	deleted := make(map[string]int64)
+	for _, e := range events {
+		if e.Type != eventDelete {
+			continue
+		}
+		rel := n.relative(e.Kv.Key)
+		if m := frontendRe.FindStringSubmatch(rel); len(m) == 2 {
+			deleted["frontends/"+m[1]] = e.Kv.ModRevision
+		} else if m := backendRe.FindStringSubmatch(rel); len(m) == 2 {
+			deleted["backends/"+m[1]] = e.Kv.ModRevision
+		}
+	}
+	var out []interface{}
+	for _, e := range events {
+		change, err := n.parseChange(e, deleted)
+		if err != nil {
+			log.Warningf("Ignore '%s %s %d', error: %s", eventType(e), e.Kv.Key, e.Kv.ModRevision, err)
+			continue
+		}
+		if change != nil {
+			out = append(out, change)
+		}
+	}
+	return out
+}
+
+func (n *ng) parseChange(e *event, deleted map[string]int64) (interface{}, error) {
+	rel := n.relative(e.Kv.Key)
+	put := e.Type != eventDelete
+	if m := hostRe.FindStringSubmatch(rel); len(m) == 2 {
+		if !put {
+			return &engine.HostDeleted{HostKey: engine.HostKey{Name: m[1]}}, nil
+		}
+		h, err := n.hostFromJSON(m[1], e.Kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	}
+	if m := listenerRe.FindStringSubmatch(rel); len(m) == 2 {
+		key := engine.ListenerKey{Id: m[1]}
+		if !put {
+			return &engine.ListenerDeleted{ListenerKey: key}, nil
+		}
+		l, err := engine.ListenerFromJSON(e.Kv.Value, key.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	}
+	if m := frontendRe.FindStringSubmatch(rel); len(m) == 2 {
+		key := engine.FrontendKey{Id: m[1]}
+		if !put {
+			return &engine.FrontendDeleted{FrontendKey: key}, nil
+		}
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), e.Kv.Value, key.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	}
+	if m := middlewareRe.FindStringSubmatch(rel); len(m) == 3 {
+		fk := engine.FrontendKey{Id: m[1]}
+		mk := engine.MiddlewareKey{FrontendKey: fk, Id: m[2]}
+		if !put {
+			if deleted["frontends/"+m[1]] == e.Kv.ModRevision {
+				return nil, nil
+			}
+			return &engine.MiddlewareDeleted{MiddlewareKey: mk}, nil
+		}
+		mw, err := engine.MiddlewareFromJSON(e.Kv.Value, n.registry.GetSpec, mk.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: *mw}, nil
+	}
+	if m := backendRe.FindStringSubmatch(rel); len(m) == 2 {
+		key := engine.BackendKey{Id: m[1]}
+		if !put {
+			return &engine.BackendDeleted{BackendKey: key}, nil
+		}
+		// the key pair is written in the same transaction, read the backend as of this change
+		b, err := n.getBackend(key, e.Kv.ModRevision)
+		if err != nil {
+			return nil, err
+		}
+		b.Revision = 0
+		return &engine.BackendUpserted{Backend: *b}, nil
+	}
+	if m := serverRe.FindStringSubmatch(rel); len(m) == 3 {
+		sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: m[1]}, Id: m[2]}
+		if !put {
+			if deleted["backends/"+m[1]] == e.Kv.ModRevision {
+				return nil, nil
+			}
+			return &engine.ServerDeleted{ServerKey: sk}, nil
+		}
+		srv, err := engine.ServerFromJSON(e.Kv.Value, sk.Id)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: sk.BackendKey, Server: *srv}, nil
+	}
+	return nil, nil
+}
+
+func (n *ng) hostFromJSON(name string, bytes []byte) (*engine.Host, error) {
+	var h *host
+	if err := json.Unmarshal(bytes, &h); err != nil {
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewHost(name, engine.HostSettings{
+		Default:       h.Settings.Default,
+		KeyPair:       keyPair,
+		OCSP:          h.Settings.OCSP,
+		HTTPSRedirect: h.Settings.HTTPSRedirect,
+		HSTS:          h.Settings.HSTS,
+		AutoCert:      h.Settings.AutoCert,
+	})
+}
+
+func (n *ng) backendFromJSON(id string, bytes, sealedKeyPair []byte) (*engine.Backend, error) {
+	b, err := engine.BackendFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	// Client key pair is sealed and stored separately from the backend
+	s := b.HTTPSettings()
+	if s.TLS == nil || len(sealedKeyPair) == 0 {
+		return b, nil
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealedKeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s.TLS.KeyPair = keyPair
+	b.Settings = s
+	return b, nil
+}
+
+func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
+	if n.options.Box == nil {
+		return fmt.Errorf("need secretbox to open sealed data")
+	}
+	sv, err := secret.SealedValueFromJSON(bytes)
+	if err != nil {
+		return err
+	}
+	unsealed, err := n.options.Box.Open(sv)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(unsealed, val)
+}
+
+func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
+	if n.options.Box == nil {
+		return nil, fmt.Errorf("this backend does not support encryption")
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+// retry runs the transaction until it succeeds, fails with error or runs out of attempts
+// because of concurrent changes to the keys it depends on
+func (n *ng) retry(fn func() (bool, error)) error {
+	for i := 0; i < maxTxnAttempts; i++ {
+		ok, err := fn()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("transaction failed after %d attempts because of concurrent changes", maxTxnAttempts)
+}
+
+func (n *ng) grant(ttl time.Duration) (int64, error) {
+	if ttl == 0 {
+		return noLease, nil
+	}
+	return n.client.grant(ttl)
+}
+
+func (n *ng) path(keys ...string) string {
+	return strings.Join(append([]string{n.etcdKey}, keys...), "/")
+}
+
+// relative returns the key relative to the engine prefix
+func (n *ng) relative(key []byte) string {
+	return strings.TrimPrefix(string(key), n.etcdKey+"/")
+}
+
+// put writes the value of the key, making sure the key has the expected revision if it is not 0
+func (n *ng) put(key string, value []byte, revision int64) error {
+	r, err := n.client.txn(txnRequest{
+		Compare: revised(key, revision),
+		Success: []requestOp{{RequestPut: &putRequest{Key: []byte(key), Value: value}}},
+	})
+	if err != nil {
+		return err
+	}
+	if !r.Succeeded {
+		return n.checkRevision(key, revision)
+	}
+	return nil
+}
+
+// checkRevision returns engine.RevisionConflictError if the key does not have the expected revision, the objects
+// are revised by the revision of their last modification, e.g. the Revision of the frontend is the ModRevision of its key
+func (n *ng) checkRevision(key string, expected int64) error {
+	var stored int64
+	kv, err := n.getVal(key)
+	if err == nil {
+		stored = kv.ModRevision
+	} else if _, ok := err.(*engine.NotFoundError); !ok {
+		return err
+	}
+	return engine.CheckRevision(n.relative([]byte(key)), expected, stored)
+}
+
+func (n *ng) getVal(key string) (*keyValue, error) {
+	r, err := n.client.rangeKeys(rangeRequest{Key: []byte(key)})
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+	}
+	return r.Kvs[0], nil
+}
+
+// getPrefix returns all keys nested under the given key, sorted by key
+func (n *ng) getPrefix(key string) ([]*keyValue, error) {
+	prefix := []byte(key + "/")
+	r, err := n.client.rangeKeys(rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	if err != nil {
+		return nil, err
+	}
+	return r.Kvs, nil
+}
+
+func (n *ng) deleteKey(key string) error {
+	r, err := n.client.deleteRange(deleteRangeRequest{Key: []byte(key)})
+	if err != nil {
+		return err
+	}
+	if r.Deleted == 0 {
+		return &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+	}
+	return nil
+}
+
+func (n *ng) deletePrefix(key string) error {
+	prefix := []byte(key + "/")
+	r, err := n.client.deleteRange(deleteRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	if err != nil {
+		return err
+	}
+	if r.Deleted == 0 {
+		return &engine.NotFoundError{Message: fmt.Sprintf("missing key: %s", key)}
+	}
+	return nil
+}
+
+// exists compares true if the key exists
+func exists(key string) compare {
+	var zero int64
+	return compare{Result: compareGreater, Target: targetVersion, Key: []byte(key), Version: &zero}
+}
+
+// missing compares true if the key does not exist
+func missing(key string) compare {
+	var zero int64
+	return compare{Result: compareEqual, Target: targetVersion, Key: []byte(key), Version: &zero}
+}
+
+// modifiedAt compares true if the key was last modified at the revision, missing keys have revision 0
+func modifiedAt(key string, revision int64) compare {
+	return compare{Result: compareEqual, Target: targetMod, Key: []byte(key), ModRevision: &revision}
+}
+
+// revised returns the comparison of the key revision with the expected revision of the upserted object,
+// or no comparisons if the revision is 0
+func revised(key string, revision int64) []compare {
+	if revision == 0 {
+		return nil
+	}
+	return []compare{modifiedAt(key, revision)}
+}
+
+// modifiedBefore compares true if all keys in the range were last modified before the revision
+func modifiedBefore(key, rangeEnd []byte, revision int64) compare {
+	return compare{Result: compareLess, Target: targetMod, Key: key, RangeEnd: rangeEnd, ModRevision: &revision}
+}
+
+func eventType(e *event) string {
+	if e.Type == "" {
+		return eventPut
+	}
+	return e.Type
+}
+
+func suffix(key string) string {
+	vals := strings.Split(key, "/")
+	return vals[len(vals)-1]
+}
+
+type compactedError struct {
+	revision  int64
+	compacted int64
+}
+
+func (e *compactedError) Error() string {
+	return fmt.Sprintf("changes since revision %d are lost, etcd has compacted revisions up to %d", e.revision, e.compacted)
+}
+
+var errStopped = fmt.Errorf("watch stopped")
+
+var (
+	hostRe           = regexp.MustCompile("^hosts/([^/]+)/host$")
+	listenerRe       = regexp.MustCompile("^listeners/([^/]+)$")
+	frontendRe       = regexp.MustCompile("^frontends/([^/]+)/frontend$")
+	middlewareRe     = regexp.MustCompile("^frontends/([^/]+)/middlewares/([^/]+)$")
+	backendRe        = regexp.MustCompile("^backends/([^/]+)/backend$")
+	backendKeyPairRe = regexp.MustCompile("^backends/([^/]+)/keypair$")
+	serverRe         = regexp.MustCompile("^backends/([^/]+)/servers/([^/]+)$")
+)
+
+const (
+	noLease        = 0
+	maxTxnAttempts = 10
+	defaultRetry   = time.Second
+	defaultTimeout = 10 * time.Second
+)
+
+func setDefaults(o Options) Options {
+	if o.EtcdRequestTimeout == 0 {
+		o.EtcdRequestTimeout = defaultTimeout
+	}
+	if o.RetryPeriod == 0 {
+		o.RetryPeriod = defaultRetry
+	}
+	return o
+}
+
+type host struct {
+	Name     string
+	Settings hostSettings
+}
+
+type hostSettings struct {
+	Default       bool
+	KeyPair       []byte
+	OCSP          engine.OCSPSettings
+	HTTPSRedirect *engine.HTTPSRedirectSettings `json:",omitempty"`
+	HSTS          *engine.HSTSSettings          `json:",omitempty"`
+	AutoCert      bool                          `json:",omitempty"`
+}
@@ -0,0 +1,443 @@
+package etcdv3ng
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestEtcdV3(t *testing.T) { TestingT(t) }
+
+// EtcdV3Suite runs against etcd if the nodes are set in VULCAND_TEST_ETCD3_NODES,
+// and against the fake JSON gateway otherwise
+type EtcdV3Suite struct {
+	ng         *ng
+	suite      test.EngineSuite
+	nodes      []string
+	fake       *fakeEtcd
+	etcdPrefix string
+	changesC   chan interface{}
+	key        string
+	stopC      chan bool
+}
+
+var _ = Suite(&EtcdV3Suite{
+	etcdPrefix: "/vulcandtest",
+})
+
+func (s *EtcdV3Suite) SetUpSuite(c *C) {
+	log.InitWithConfig(log.Config{Name: "console"})
+
+	key, err := secret.NewKeyString()
+	if err != nil {
+		panic(err)
+	}
+	s.key = key
+
+	if nodes := os.Getenv("VULCAND_TEST_ETCD3_NODES"); nodes != "" {
+		s.nodes = strings.Split(nodes, ",")
+	}
+}
+
+func (s *EtcdV3Suite) SetUpTest(c *C) {
+	nodes := s.nodes
+	if len(nodes) == 0 {
+		s.fake = newFakeEtcd()
+		nodes = []string{s.fake.server.URL}
+	}
+
+	box, err := secret.NewBoxFromKeyString(s.key)
+	c.Assert(err, IsNil)
+
+	e, err := New(nodes, s.etcdPrefix, registry.GetRegistry(), Options{Box: box, RetryPeriod: 50 * time.Millisecond})
+	c.Assert(err, IsNil)
+	s.ng = e.(*ng)
+
+	// Delete all values under the given prefix
+	prefix := []byte(s.etcdPrefix + "/")
+	_, err = s.ng.client.deleteRange(deleteRangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	c.Assert(err, IsNil)
+
+	s.changesC = make(chan interface{})
+	s.stopC = make(chan bool)
+	go s.ng.Subscribe(s.changesC, s.stopC)
+
+	s.suite.ChangesC = s.changesC
+	s.suite.Engine = s.ng
+
+	s.waitForWatch(c)
+}
+
+// waitForWatch makes sure the watch is established before the test makes changes,
+// by upserting a listener until the change is seen and deleting it afterwards
+func (s *EtcdV3Suite) waitForWatch(c *C) {
+	l := engine.Listener{Id: "sync", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "localhost:31000"}}
+	for i := 0; ; i++ {
+		c.Assert(s.ng.UpsertListener(l), IsNil)
+		select {
+		case <-s.changesC:
+		case <-time.After(100 * time.Millisecond):
+			if i == 20 {
+				c.Fatalf("timeout waiting for the watch")
+			}
+			continue
+		}
+		break
+	}
+	c.Assert(s.ng.DeleteListener(engine.ListenerKey{Id: l.Id}), IsNil)
+	for {
+		if _, ok := s.collectChanges(c, 1)[0].(*engine.ListenerDeleted); ok {
+			return
+		}
+	}
+}
+
+func (s *EtcdV3Suite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+	if s.fake != nil {
+		s.fake.close()
+		s.fake = nil
+	}
+}
+
+func (s *EtcdV3Suite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *EtcdV3Suite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *EtcdV3Suite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *EtcdV3Suite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *EtcdV3Suite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *EtcdV3Suite) TestHostWithAutoCert(c *C) {
+	s.suite.HostWithAutoCert(c)
+}
+
+func (s *EtcdV3Suite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
+func (s *EtcdV3Suite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *EtcdV3Suite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *EtcdV3Suite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *EtcdV3Suite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestServerWeight(c *C) {
+	s.suite.ServerWeight(c)
+}
+
+func (s *EtcdV3Suite) TestServerExpire(c *C) {
+	s.suite.ServerExpire(c)
+}
+
+func (s *EtcdV3Suite) TestServerExpires(c *C) {
+	s.suite.ServerExpires(c)
+}
+
+func (s *EtcdV3Suite) TestACMEAccountKey(c *C) {
+	s.suite.ACMEAccountKey(c)
+}
+
+func (s *EtcdV3Suite) TestACMEChallengeCRUD(c *C) {
+	s.suite.ACMEChallengeCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestACMEOrderLock(c *C) {
+	s.suite.ACMEOrderLock(c)
+}
+
+func (s *EtcdV3Suite) TestACMEOrderLockExpire(c *C) {
+	s.suite.ACMEOrderLockExpire(c)
+}
+
+func (s *EtcdV3Suite) TestACMEChallengeExpire(c *C) {
+	s.suite.ACMEChallengeExpire(c)
+}
+
+func (s *EtcdV3Suite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestFrontendExpire(c *C) {
+	s.suite.FrontendExpire(c)
+}
+
+func (s *EtcdV3Suite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *EtcdV3Suite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *EtcdV3Suite) TestMiddlewareExpire(c *C) {
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *EtcdV3Suite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *EtcdV3Suite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *EtcdV3Suite) TestChangeSetApply(c *C) {
+	s.suite.ChangeSetApply(c)
+}
+
+func (s *EtcdV3Suite) TestChangeSetFailed(c *C) {
+	s.suite.ChangeSetFailed(c)
+}
+
+func (s *EtcdV3Suite) TestRevisionConflict(c *C) {
+	s.suite.RevisionConflict(c)
+}
+
+// Middlewares without TTL share the lease of the frontend and expire along with it
+func (s *EtcdV3Suite) TestMiddlewaresExpireWithFrontend(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	f := engine.Frontend{Id: "f1", Route: `Path("/hello")`, BackendId: b.Id, Type: engine.HTTP, Settings: engine.HTTPFrontendSettings{}}
+	fk := engine.FrontendKey{Id: f.Id}
+	m := s.makeConnLimit(c, "cl1", 10)
+
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+	c.Assert(s.ng.UpsertMiddleware(fk, m, 0), IsNil)
+	s.collectChanges(c, 3)
+
+	// setting the TTL on the frontend moves the middleware to the frontend lease in the same transaction
+	c.Assert(s.ng.UpsertFrontend(f, time.Second), IsNil)
+	c.Assert(s.collectChanges(c, 2), DeepEquals, []interface{}{
+		&engine.ChangeSetApplied{Changes: []interface{}{
+			&engine.FrontendUpserted{Frontend: f},
+			&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: m},
+		}},
+		&engine.FrontendDeleted{FrontendKey: fk},
+	})
+
+	ms, err := s.ng.GetMiddlewares(fk)
+	c.Assert(err, IsNil)
+	c.Assert(ms, DeepEquals, []engine.Middleware{})
+}
+
+// Deleting the backend deletes its servers without generating the server events
+func (s *EtcdV3Suite) TestDeleteBackendWithServers(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	bk := engine.BackendKey{Id: b.Id}
+
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(bk, engine.Server{Id: "srv1", URL: "http://localhost:5000"}, 0), IsNil)
+	s.collectChanges(c, 2)
+
+	c.Assert(s.ng.DeleteBackend(bk), IsNil)
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{&engine.BackendDeleted{BackendKey: bk}})
+
+	srvs, err := s.ng.GetServers(bk)
+	c.Assert(err, IsNil)
+	c.Assert(srvs, DeepEquals, []engine.Server{})
+
+	c.Assert(s.ng.DeleteBackend(bk), FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(s.ng.UpsertServer(bk, engine.Server{Id: "srv1", URL: "http://localhost:5000"}, 0), FitsTypeOf, &engine.NotFoundError{})
+}
+
+// The watch is resumed from the last seen revision, changes made while it was down are delivered
+func (s *EtcdV3Suite) TestWatchResumes(c *C) {
+	if s.fake == nil {
+		c.Skip("requires the fake gateway")
+	}
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "localhost:31000"}}
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+	s.collectChanges(c, 1)
+
+	s.breakConnections()
+	c.Assert(s.ng.DeleteListener(engine.ListenerKey{Id: l.Id}), IsNil)
+
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{
+		&engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: l.Id}},
+	})
+}
+
+// The watch stops with error if the changes it has to resume from are compacted
+func (s *EtcdV3Suite) TestWatchCompacted(c *C) {
+	if s.fake == nil {
+		c.Skip("requires the fake gateway")
+	}
+	changesC := make(chan interface{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.ng.Subscribe(changesC, make(chan bool))
+	}()
+	// wait for the second watch to be established
+	time.Sleep(100 * time.Millisecond)
+
+	// the second watcher is blocked on the first change, while the next changes are made and compacted
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "localhost:31000"}}
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+	s.collectChanges(c, 1)
+	s.breakConnections()
+
+	c.Assert(s.ng.DeleteListener(engine.ListenerKey{Id: l.Id}), IsNil)
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+	s.collectChanges(c, 2)
+	s.fake.compact()
+
+	<-changesC
+	select {
+	case err := <-errC:
+		c.Assert(err, FitsTypeOf, &compactedError{})
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timeout waiting for the watch to stop")
+	}
+}
+
+// The frontends check in DeleteBackend fails if a frontend starts using the backend after the check
+func (s *EtcdV3Suite) TestDeleteBackendConcurrentFrontend(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	bk := engine.BackendKey{Id: b.Id}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	s.collectChanges(c, 1)
+
+	_, revision, err := s.ng.backendUsedBy(bk)
+	c.Assert(err, IsNil)
+
+	f := engine.Frontend{Id: "f1", Route: `Path("/hello")`, BackendId: b.Id, Type: engine.HTTP, Settings: engine.HTTPFrontendSettings{}}
+	c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+	s.collectChanges(c, 1)
+
+	fprefix := []byte(s.ng.path("frontends") + "/")
+	r, err := s.ng.client.txn(txnRequest{
+		Compare: []compare{modifiedBefore(fprefix, prefixEnd(fprefix), revision+1)},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(r.Succeeded, Equals, false)
+
+	c.Assert(s.ng.DeleteBackend(bk), NotNil)
+}
+
+func (s *EtcdV3Suite) TestMigrateV2(c *C) {
+	if s.fake == nil {
+		c.Skip("requires the fake gateway")
+	}
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/v2/keys/vulcand")
+		c.Assert(r.URL.Query().Get("recursive"), Equals, "true")
+		json.NewEncoder(w).Encode(v2Response{Node: &v2Node{Key: "/vulcand", Dir: true, Nodes: []*v2Node{
+			{Key: "/vulcand/backends", Dir: true, Nodes: []*v2Node{
+				{Key: "/vulcand/backends/b1", Dir: true, Nodes: []*v2Node{
+					{Key: "/vulcand/backends/b1/backend", Value: `{"Type":"http"}`},
+					{Key: "/vulcand/backends/b1/servers", Dir: true, Nodes: []*v2Node{
+						{Key: "/vulcand/backends/b1/servers/srv1", Value: `{"URL":"http://localhost:5000"}`, TTL: 10},
+					}},
+				}},
+			}},
+			{Key: "/vulcand/frontends", Dir: true, Nodes: []*v2Node{
+				{Key: "/vulcand/frontends/f1", Dir: true, TTL: 10, Nodes: []*v2Node{
+					{Key: "/vulcand/frontends/f1/frontend", Value: `{"Type":"http","BackendId":"b1","Route":"Path(\"/hello\")"}`},
+				}},
+			}},
+		}}})
+	}))
+	defer v2.Close()
+
+	copied, err := MigrateV2([]string{v2.URL}, "vulcand", []string{s.fake.server.URL}, s.etcdPrefix, Options{})
+	c.Assert(err, IsNil)
+	c.Assert(copied, Equals, 3)
+
+	b, err := s.ng.GetBackend(engine.BackendKey{Id: "b1"})
+	c.Assert(err, IsNil)
+	c.Assert(b.Type, Equals, engine.HTTP)
+
+	srvKV, err := s.ng.getVal(s.ng.path("backends", "b1", "servers", "srv1"))
+	c.Assert(err, IsNil)
+	c.Assert(srvKV.Lease, Not(Equals), int64(noLease))
+
+	f, err := s.ng.GetFrontend(engine.FrontendKey{Id: "f1"})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendId, Equals, "b1")
+
+	// keys copied in one transaction arrive as a single change
+	changes := s.collectChanges(c, 1)
+	c.Assert(changes[0], FitsTypeOf, &engine.ChangeSetApplied{})
+	c.Assert(changes[0].(*engine.ChangeSetApplied).Changes, HasLen, 3)
+
+	// the destination is not empty anymore
+	_, err = MigrateV2([]string{v2.URL}, "vulcand", []string{s.fake.server.URL}, s.etcdPrefix, Options{})
+	c.Assert(err, NotNil)
+}
+
+// breakConnections closes the watch streams and the idle connections of the engine client
+func (s *EtcdV3Suite) breakConnections() {
+	s.fake.server.CloseClientConnections()
+	s.ng.client.close()
+}
+
+func (s *EtcdV3Suite) makeConnLimit(c *C, id string, conns int64) engine.Middleware {
+	cl, err := connlimit.NewConnLimit(conns, "client.ip")
+	c.Assert(err, IsNil)
+	return engine.Middleware{Id: id, Type: "connlimit", Priority: 1, Middleware: cl}
+}
+
+func (s *EtcdV3Suite) collectChanges(c *C, expected int) []interface{} {
+	changes := make([]interface{}, expected)
+	for i := range changes {
+		select {
+		case changes[i] = <-s.changesC:
+		case <-time.After(2 * time.Second):
+			c.Fatalf("timeout waiting for change %d of %d", i+1, expected)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,430 @@
+package etcdv3ng
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fakeEtcd implements the subset of the etcd v3 JSON gateway used by the engine: revisioned key-value
+// storage with history, transactions, leases and watches. It lets the engine suite run without etcd.
+type fakeEtcd struct {
+	mtx       sync.Mutex
+	revision  int64
+	history   []*event
+	leases    map[int64]time.Time
+	lastLease int64
+	compacted int64
+	changedC  chan struct{}
+	stopC     chan struct{}
+	server    *httptest.Server
+}
+
+func newFakeEtcd() *fakeEtcd {
+	f := &fakeEtcd{
+		revision: 1,
+		leases:   make(map[int64]time.Time),
+		changedC: make(chan struct{}),
+		stopC:    make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/kv/range", f.handle(f.rangeKeys))
+	mux.HandleFunc("/v3/kv/put", f.handle(f.put))
+	mux.HandleFunc("/v3/kv/deleterange", f.handle(f.deleteRange))
+	mux.HandleFunc("/v3/kv/txn", f.handle(f.txn))
+	mux.HandleFunc("/v3/lease/grant", f.handle(f.grant))
+	mux.HandleFunc("/v3/lease/timetolive", f.handle(f.timeToLive))
+	mux.HandleFunc("/v3/watch", f.watch)
+	f.server = httptest.NewServer(mux)
+	go f.expireLeases()
+	return f
+}
+
+func (f *fakeEtcd) close() {
+	close(f.stopC)
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+// compact drops the history before the current revision, watches can not start before it
+func (f *fakeEtcd) compact() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.compacted = f.revision
+}
+
+func (f *fakeEtcd) handle(fn func(data []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data bytes.Buffer
+		if _, err := data.ReadFrom(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mtx.Lock()
+		out, err := fn(data.Bytes())
+		f.mtx.Unlock()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(gatewayError{Error: err.Error(), Code: 3, Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// state replays the history up to the revision
+func (f *fakeEtcd) state(revision int64) map[string]*keyValue {
+	kvs := make(map[string]*keyValue)
+	for _, e := range f.history {
+		if e.Kv.ModRevision > revision {
+			break
+		}
+		if e.Type == eventDelete {
+			delete(kvs, string(e.Kv.Key))
+		} else {
+			kvs[string(e.Kv.Key)] = e.Kv
+		}
+	}
+	return kvs
+}
+
+func (f *fakeEtcd) header() *responseHeader {
+	return &responseHeader{Revision: f.revision}
+}
+
+func (f *fakeEtcd) rangeKeys(data []byte) (interface{}, error) {
+	var r rangeRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return f.doRange(r, f.revision)
+}
+
+// doRange reads the keys at the requested revision, or at the given one if the request has none
+func (f *fakeEtcd) doRange(r rangeRequest, revision int64) (*rangeResponse, error) {
+	if r.Revision != 0 {
+		if r.Revision < f.compacted {
+			return nil, fmt.Errorf("mvcc: required revision has been compacted")
+		}
+		revision = r.Revision
+	}
+	out := &rangeResponse{Header: f.header()}
+	for _, kv := range sorted(f.state(revision)) {
+		if inRange(kv.Key, r.Key, r.RangeEnd) {
+			if r.KeysOnly {
+				kv = &keyValue{Key: kv.Key, CreateRevision: kv.CreateRevision, ModRevision: kv.ModRevision, Version: kv.Version, Lease: kv.Lease}
+			}
+			out.Kvs = append(out.Kvs, kv)
+		}
+	}
+	out.Count = int64(len(out.Kvs))
+	return out, nil
+}
+
+func (f *fakeEtcd) put(data []byte) (interface{}, error) {
+	var r putRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if err := f.checkLease(r.Lease); err != nil {
+		return nil, err
+	}
+	f.revision++
+	f.doPut(r)
+	f.notify()
+	return &putResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) doPut(r putRequest) {
+	kv := &keyValue{Key: r.Key, Value: r.Value, Lease: r.Lease, CreateRevision: f.revision, ModRevision: f.revision, Version: 1}
+	if prev, ok := f.state(f.revision)[string(r.Key)]; ok {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+	}
+	f.history = append(f.history, &event{Kv: kv})
+}
+
+func (f *fakeEtcd) deleteRange(data []byte) (interface{}, error) {
+	var r deleteRangeRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	f.revision++
+	deleted := f.doDeleteRange(r)
+	if deleted == 0 {
+		f.revision--
+	} else {
+		f.notify()
+	}
+	return &deleteRangeResponse{Header: f.header(), Deleted: deleted}, nil
+}
+
+func (f *fakeEtcd) doDeleteRange(r deleteRangeRequest) int64 {
+	var deleted int64
+	for _, kv := range sorted(f.state(f.revision)) {
+		if inRange(kv.Key, r.Key, r.RangeEnd) {
+			f.history = append(f.history, &event{Type: eventDelete, Kv: &keyValue{Key: kv.Key, ModRevision: f.revision}})
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (f *fakeEtcd) txn(data []byte) (interface{}, error) {
+	var r txnRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	succeeded := true
+	for _, c := range r.Compare {
+		if !f.compare(c) {
+			succeeded = false
+			break
+		}
+	}
+	ops := r.Success
+	if !succeeded {
+		ops = r.Failure
+	}
+	for _, op := range ops {
+		if op.RequestPut != nil {
+			if err := f.checkLease(op.RequestPut.Lease); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// all writes of the transaction happen at the same revision
+	f.revision++
+	written := false
+	out := &txnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		switch {
+		case op.RequestRange != nil:
+			re, err := f.doRange(*op.RequestRange, f.revision-1)
+			if err != nil {
+				return nil, err
+			}
+			out.Responses = append(out.Responses, responseOp{ResponseRange: re})
+		case op.RequestPut != nil:
+			f.doPut(*op.RequestPut)
+			written = true
+			out.Responses = append(out.Responses, responseOp{ResponsePut: &putResponse{}})
+		case op.RequestDeleteRange != nil:
+			deleted := f.doDeleteRange(*op.RequestDeleteRange)
+			written = written || deleted != 0
+			out.Responses = append(out.Responses, responseOp{ResponseDeleteRange: &deleteRangeResponse{Deleted: deleted}})
+		}
+	}
+	if !written {
+		f.revision--
+	} else {
+		f.notify()
+	}
+	out.Header = f.header()
+	for _, re := range out.Responses {
+		if re.ResponseRange != nil {
+			re.ResponseRange.Header = out.Header
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEtcd) compare(c compare) bool {
+	var kvs []*keyValue
+	for _, kv := range sorted(f.state(f.revision)) {
+		if inRange(kv.Key, c.Key, c.RangeEnd) {
+			kvs = append(kvs, kv)
+		}
+	}
+	if len(kvs) == 0 {
+		kvs = []*keyValue{{}}
+	}
+	for _, kv := range kvs {
+		var actual, expected int64
+		switch c.Target {
+		case targetVersion, "":
+			actual, expected = kv.Version, value(c.Version)
+		case targetCreate:
+			actual, expected = kv.CreateRevision, value(c.CreateRevision)
+		case targetMod:
+			actual, expected = kv.ModRevision, value(c.ModRevision)
+		default:
+			return false
+		}
+		var ok bool
+		switch c.Result {
+		case compareEqual, "":
+			ok = actual == expected
+		case compareNotEqual:
+			ok = actual != expected
+		case compareGreater:
+			ok = actual > expected
+		case compareLess:
+			ok = actual < expected
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeEtcd) grant(data []byte) (interface{}, error) {
+	var r leaseGrantRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	f.lastLease++
+	f.leases[f.lastLease] = time.Now().Add(time.Duration(r.TTL) * time.Second)
+	return &leaseGrantResponse{Header: f.header(), ID: f.lastLease, TTL: r.TTL}, nil
+}
+
+func (f *fakeEtcd) timeToLive(data []byte) (interface{}, error) {
+	var r leaseTimeToLiveRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	expires, ok := f.leases[r.ID]
+	if !ok {
+		return &leaseTimeToLiveResponse{Header: f.header(), ID: r.ID, TTL: -1}, nil
+	}
+	return &leaseTimeToLiveResponse{Header: f.header(), ID: r.ID, TTL: int64(expires.Sub(time.Now()) / time.Second)}, nil
+}
+
+func (f *fakeEtcd) checkLease(lease int64) error {
+	if lease == noLease {
+		return nil
+	}
+	if _, ok := f.leases[lease]; !ok {
+		return fmt.Errorf("etcdserver: requested lease not found")
+	}
+	return nil
+}
+
+// expireLeases revokes expired leases and deletes their keys at one revision per lease
+func (f *fakeEtcd) expireLeases() {
+	for {
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-f.stopC:
+			return
+		}
+		f.mtx.Lock()
+		for id, expires := range f.leases {
+			if time.Now().Before(expires) {
+				continue
+			}
+			delete(f.leases, id)
+			f.revision++
+			var deleted int64
+			for _, kv := range sorted(f.state(f.revision)) {
+				if kv.Lease == id {
+					deleted += f.doDeleteRange(deleteRangeRequest{Key: kv.Key})
+				}
+			}
+			if deleted == 0 {
+				f.revision--
+			} else {
+				f.notify()
+			}
+		}
+		f.mtx.Unlock()
+	}
+}
+
+func (f *fakeEtcd) notify() {
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+}
+
+func (f *fakeEtcd) watch(w http.ResponseWriter, r *http.Request) {
+	var req watchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CreateRequest == nil {
+		http.Error(w, "bad watch request", http.StatusBadRequest)
+		return
+	}
+	c := req.CreateRequest
+	flusher := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	f.mtx.Lock()
+	next := c.StartRevision
+	if next == 0 {
+		next = f.revision + 1
+	}
+	if next < f.compacted {
+		encoder.Encode(watchMessage{Result: &watchResponse{
+			Header: f.header(), Canceled: true, CompactRevision: f.compacted, CancelReason: "mvcc: required revision has been compacted"}})
+		f.mtx.Unlock()
+		return
+	}
+	encoder.Encode(watchMessage{Result: &watchResponse{Header: f.header(), Created: true}})
+	flusher.Flush()
+	f.mtx.Unlock()
+
+	for {
+		f.mtx.Lock()
+		var responses []*watchResponse
+		var current *watchResponse
+		for _, e := range f.history {
+			if e.Kv.ModRevision < next || !inRange(e.Kv.Key, c.Key, c.RangeEnd) {
+				continue
+			}
+			if current == nil || current.Header.Revision != e.Kv.ModRevision {
+				current = &watchResponse{Header: &responseHeader{Revision: e.Kv.ModRevision}}
+				responses = append(responses, current)
+			}
+			current.Events = append(current.Events, e)
+		}
+		next = f.revision + 1
+		changedC := f.changedC
+		f.mtx.Unlock()
+
+		for _, re := range responses {
+			if err := encoder.Encode(watchMessage{Result: re}); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-changedC:
+		case <-r.Context().Done():
+			return
+		case <-f.stopC:
+			return
+		}
+	}
+}
+
+func inRange(key, start, end []byte) bool {
+	if len(end) == 0 {
+		return bytes.Equal(key, start)
+	}
+	if len(end) == 1 && end[0] == 0 {
+		return bytes.Compare(key, start) >= 0
+	}
+	return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+}
+
+func sorted(kvs map[string]*keyValue) []*keyValue {
+	out := make([]*keyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		out = append(out, kv)
+	}
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare(out[i].Key, out[j].Key) < 0 })
+	return out
+}
+
+func value(v *int64) int64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
@@ -0,0 +1,137 @@
+package etcdv3ng
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MigrateV2 copies the vulcand configuration stored by the v2 engine under srcKey to dstKey in etcd v3.
+// The key layout of both engines is the same, so every value is copied as it is and sealed key pairs
+// stay sealed with the same key. Keys and directories with a TTL are attached to a lease with the
+// remaining TTL. The destination has to be empty. It returns the number of copied keys.
+func MigrateV2(srcNodes []string, srcKey string, dstNodes []string, dstKey string, options Options) (int, error) {
+	options = setDefaults(options)
+	src, err := newClient(srcNodes, options)
+	if err != nil {
+		return 0, err
+	}
+	defer src.close()
+	dst, err := newClient(dstNodes, options)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.close()
+
+	dstKey = strings.TrimSuffix(dstKey, "/")
+	prefix := []byte(dstKey + "/")
+	r, err := dst.rangeKeys(rangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	if len(r.Kvs) != 0 {
+		return 0, fmt.Errorf("destination '%s' is not empty", dstKey)
+	}
+
+	srcKey = "/" + strings.Trim(srcKey, "/")
+	root, err := getV2Tree(src, srcKey)
+	if err != nil {
+		return 0, err
+	}
+	m := &migration{
+		dst:    dst,
+		srcKey: srcKey + "/",
+		dstKey: dstKey + "/",
+	}
+	if err := m.copyNode(root, noLease); err != nil {
+		return m.copied, err
+	}
+	return m.copied, m.flush()
+}
+
+type migration struct {
+	dst    *client
+	srcKey string
+	dstKey string
+	ops    []requestOp
+	copied int
+}
+
+// copyNode copies the key or the directory tree, keys inherit the lease of the closest directory with a TTL
+func (m *migration) copyNode(n *v2Node, lease int64) error {
+	if n.TTL > 0 {
+		l, err := m.dst.grant(time.Duration(n.TTL) * time.Second)
+		if err != nil {
+			return err
+		}
+		lease = l
+	}
+	if n.Dir {
+		for _, child := range n.Nodes {
+			if err := m.copyNode(child, lease); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	key := m.dstKey + strings.TrimPrefix(n.Key, m.srcKey)
+	m.ops = append(m.ops, requestOp{RequestPut: &putRequest{Key: []byte(key), Value: []byte(n.Value), Lease: lease}})
+	if len(m.ops) == migrateBatchSize {
+		return m.flush()
+	}
+	return nil
+}
+
+// flush writes the pending keys in one transaction, etcd limits the number of operations in a transaction
+func (m *migration) flush() error {
+	if len(m.ops) == 0 {
+		return nil
+	}
+	if _, err := m.dst.txn(txnRequest{Success: m.ops}); err != nil {
+		return err
+	}
+	m.copied += len(m.ops)
+	m.ops = nil
+	return nil
+}
+
+// getV2Tree reads the whole tree under the key with the etcd v2 keys API
+func getV2Tree(c *client, key string) (*v2Node, error) {
+	re, err := c.http.Get(c.endpoint() + "/v2/keys" + key + "?recursive=true&sorted=true")
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	data, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return nil, err
+	}
+	if re.StatusCode != http.StatusOK {
+		return nil, responseError(re.StatusCode, data)
+	}
+	var r v2Response
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if r.Node == nil {
+		return nil, fmt.Errorf("missing node in response for %s", key)
+	}
+	return r.Node, nil
+}
+
+type v2Response struct {
+	Node *v2Node `json:"node"`
+}
+
+type v2Node struct {
+	Key   string    `json:"key"`
+	Value string    `json:"value,omitempty"`
+	Dir   bool      `json:"dir,omitempty"`
+	TTL   int64     `json:"ttl,omitempty"`
+	Nodes []*v2Node `json:"nodes,omitempty"`
+}
+
+const migrateBatchSize = 100
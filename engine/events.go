@@ -100,3 +100,13 @@ type ServerDeleted struct {
 func (s *ServerDeleted) String() string {
 	return fmt.Sprintf("ServerDeleted(serverKey=%v)", &s.ServerKey)
 }
+
+// ChangeSetApplied is emitted for the change set applied by Engine.Apply. Changes are the events of the
+// individual changes in the order they were applied, the proxy should apply all of them or none.
+type ChangeSetApplied struct {
+	Changes []interface{}
+}
+
+func (c *ChangeSetApplied) String() string {
+	return fmt.Sprintf("ChangeSetApplied(changes=%v)", c.Changes)
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+)
+
+// ChangeFeed queues the changes emitted by the engines that generate the events themselves, e.g. for the
+// objects written through the engine, and delivers them to the subscriber. Emit never blocks the writer.
+// In case if the subscriber falls behind by more than the limit, the pending changes are discarded and
+// Subscribe returns ChangesLostError, so the supervisor reloads the whole configuration from the engine.
+type ChangeFeed struct {
+	limit int
+
+	mtx     *sync.Mutex
+	pending []interface{}
+	lost    int
+	notifyC chan bool
+}
+
+// NewChangeFeed returns the feed that keeps up to limit changes not yet delivered to the subscriber
+func NewChangeFeed(limit int) *ChangeFeed {
+	return &ChangeFeed{
+		limit:   limit,
+		mtx:     &sync.Mutex{},
+		notifyC: make(chan bool, 1),
+	}
+}
+
+// Emit queues the change for the delivery
+func (f *ChangeFeed) Emit(change interface{}) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	switch {
+	case f.lost != 0:
+		// the configuration is going to be reloaded anyway, the change is part of it
+		f.lost++
+	case len(f.pending) >= f.limit:
+		f.lost = len(f.pending) + 1
+		f.pending = nil
+	default:
+		f.pending = append(f.pending, change)
+	}
+	select {
+	case f.notifyC <- true:
+	default:
+	}
+}
+
+// Subscribe delivers the queued changes to the channel until cancelC is closed. It is a blocking function.
+// It returns ChangesLostError once the changes have been discarded, the changes emitted after that
+// are delivered to the next subscriber.
+func (f *ChangeFeed) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	for {
+		change, err := f.next()
+		if err != nil {
+			log.Errorf("%s, stop watching", err)
+			return err
+		}
+		if change == nil {
+			select {
+			case <-f.notifyC:
+				continue
+			case <-cancelC:
+				return nil
+			}
+		}
+		log.Infof("%v", change)
+		select {
+		case changes <- change:
+		case <-cancelC:
+			return nil
+		}
+	}
+}
+
+func (f *ChangeFeed) next() (interface{}, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.lost != 0 {
+		err := &ChangesLostError{Count: f.lost}
+		f.lost = 0
+		return nil, err
+	}
+	if len(f.pending) == 0 {
+		return nil, nil
+	}
+	change := f.pending[0]
+	f.pending[0] = nil
+	f.pending = f.pending[1:]
+	return change, nil
+}
+
+// ChangesLostError is returned by ChangeFeed.Subscribe when the subscriber has fallen behind and the changes
+// have been discarded
+type ChangesLostError struct {
+	Count int
+}
+
+func (e *ChangesLostError) Error() string {
+	return fmt.Sprintf("%d changes were not delivered in time and are lost", e.Count)
+}
@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"time"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type FeedSuite struct {
+}
+
+var _ = Suite(&FeedSuite{})
+
+func (s *FeedSuite) TestDeliversInOrder(c *C) {
+	f := NewChangeFeed(10)
+	for i := 0; i < 3; i++ {
+		f.Emit(i)
+	}
+	changesC, cancelC := make(chan interface{}), make(chan bool)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- f.Subscribe(changesC, cancelC)
+	}()
+	c.Assert(collect(c, changesC, 3), DeepEquals, []interface{}{0, 1, 2})
+
+	f.Emit(3)
+	c.Assert(collect(c, changesC, 1), DeepEquals, []interface{}{3})
+
+	close(cancelC)
+	c.Assert(<-errC, IsNil)
+}
+
+// Once the subscriber falls behind, the pending changes are discarded and the subscriber is told to reload
+// the configuration, the changes emitted after that are delivered to the next subscriber
+func (s *FeedSuite) TestOverflow(c *C) {
+	f := NewChangeFeed(2)
+	for i := 0; i < 5; i++ {
+		f.Emit(i)
+	}
+	changesC, cancelC := make(chan interface{}), make(chan bool)
+	defer close(cancelC)
+	c.Assert(f.Subscribe(changesC, cancelC), DeepEquals, &ChangesLostError{Count: 5})
+
+	f.Emit(5)
+	go f.Subscribe(changesC, cancelC)
+	c.Assert(collect(c, changesC, 1), DeepEquals, []interface{}{5})
+}
+
+func collect(c *C, changesC chan interface{}, expected int) []interface{} {
+	changes := make([]interface{}, expected)
+	for i := range changes {
+		select {
+		case changes[i] = <-changesC:
+		case <-time.After(2 * time.Second):
+			c.Fatalf("timeout waiting for change %d of %d", i+1, expected)
+		}
+	}
+	return changes
+}
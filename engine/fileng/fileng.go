@@ -0,0 +1,1463 @@
+// package fileng contains the implementation of the engine backed by a directory of JSON or YAML files,
+// one file per object, laid out the same way as the keys of the Etcd-backed engine:
+//
+//	hosts/<name>.json
+//	listeners/<id>.json
+//	backends/<id>/backend.json
+//	backends/<id>/servers/<id>.json
+//	frontends/<id>/frontend.json
+//	frontends/<id>/middlewares/<id>.json
+//
+// The ACME account key, the pending ACME challenges and the locks on ordering the certificates are kept in acme/account.json,
+// acme/challenges/<token>.json and acme/orders/<domain>.json, they are not the part of the configuration and changes
+// of these files generate no events.
+//
+// If the box is set, key pairs of the hosts and backends written through the engine are sealed and stored in
+// the SealedKeyPair field of the file instead of the settings, and the ACME account key is sealed as well.
+// Key pairs set in the settings by hand are read as is.
+//
+// Files have the same format as the objects accepted by the API, files with .yaml and .yml extension are read as YAML.
+// Object ids are taken from the file names. Hidden files, files with other extensions or in other locations are ignored.
+// In case if there are several files for the same object, e.g. backend.json and backend.yaml, the first one
+// in lexical order is used.
+//
+// The engine polls the directory and generates events for the files that were created, modified or removed.
+// Changes made through the engine are written to disk atomically and keep the format of the existing files.
+//
+// Revisions of the objects are not stored in the files, they are assigned in memory every time the file is
+// read or written and start from the current time when the engine is created, so the revisions read before
+// the restart do not match.
+package fileng
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+)
+
+const DefaultPollPeriod = time.Second
+
+type Options struct {
+	// PollPeriod is the period between the checks of the directory for the changes
+	PollPeriod time.Duration
+	// Box seals the key pairs of hosts and backends and the ACME account key, they are stored as is if not set
+	Box *secret.Box
+}
+
+// kinds of the objects, in the order the objects depend on each other
+const (
+	hostKind = iota
+	listenerKind
+	backendKind
+	serverKind
+	frontendKind
+	middlewareKind
+)
+
+// kindPaths match the file paths (relative to the directory and without extension) to the kinds of objects,
+// capturing the ids of the parent object and the object itself
+var kindPaths = []struct {
+	kind int
+	re   *regexp.Regexp
+}{
+	{hostKind, regexp.MustCompile("^hosts/([^/]+)$")},
+	{listenerKind, regexp.MustCompile("^listeners/([^/]+)$")},
+	{backendKind, regexp.MustCompile("^backends/([^/]+)/backend$")},
+	{serverKind, regexp.MustCompile("^backends/([^/]+)/servers/([^/]+)$")},
+	{frontendKind, regexp.MustCompile("^frontends/([^/]+)/frontend$")},
+	{middlewareKind, regexp.MustCompile("^frontends/([^/]+)/middlewares/([^/]+)$")},
+}
+
+// entry is the object read from or written to the file
+type entry struct {
+	kind int
+	// parent is the id of the backend for servers and of the frontend for middlewares
+	parent string
+	id     string
+	// file is the path of the file relative to the directory, with extension
+	file string
+	// data is the contents of the file as it was last read or written
+	data []byte
+	// val is the object, e.g. engine.Host, it is nil if the file could not be parsed
+	val     interface{}
+	expires time.Time
+}
+
+type ng struct {
+	dir      string
+	registry *plugin.Registry
+	options  Options
+	logsev   log.Severity
+
+	mtx *sync.Mutex
+	// entries are indexed by the path of the file relative to the directory, without extension
+	entries map[string]*entry
+	// batch collects the changes emitted while the change set is applied
+	batch []interface{}
+	// revision is the last revision assigned to the object read from or written to the file
+	revision int64
+
+	changes   *engine.ChangeFeed
+	wakeC     chan bool
+	stopC     chan bool
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
+}
+
+// New reads the configuration from the directory, creating it if necessary, and starts watching the changes
+func New(dir string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// directory walk does not follow the symlinks
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &ng{
+		dir:       dir,
+		registry:  registry,
+		options:   setDefaults(options),
+		mtx:       &sync.Mutex{},
+		entries:   make(map[string]*entry),
+		revision:  time.Now().UnixNano(),
+		changes:   engine.NewChangeFeed(1000),
+		wakeC:     make(chan bool, 1),
+		stopC:     make(chan bool),
+		closeOnce: &sync.Once{},
+		wg:        &sync.WaitGroup{},
+	}
+	// Initial configuration is read by the getters, so the changes found by the first scan are not emitted
+	changes, err := n.scan(time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%s loaded %d objects", n, len(changes))
+
+	n.wg.Add(1)
+	go n.watch()
+	return n, nil
+}
+
+func setDefaults(o Options) Options {
+	if o.PollPeriod == 0 {
+		o.PollPeriod = DefaultPollPeriod
+	}
+	return o
+}
+
+func (n *ng) String() string {
+	return fmt.Sprintf("fileng(dir=%s)", n.dir)
+}
+
+func (n *ng) Close() {
+	n.closeOnce.Do(func() {
+		close(n.stopC)
+		n.wg.Wait()
+	})
+}
+
+func (n *ng) GetLogSeverity() log.Severity {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Severity) {
+	n.logsev = sev
+	log.SetSeverity(n.logsev)
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Host{}
+	for _, e := range n.list(hostKind, "") {
+		out = append(out, e.val.(engine.Host))
+	}
+	return out, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(hostPath(key.Name))
+	if err != nil {
+		return nil, err
+	}
+	h := e.val.(engine.Host)
+	return &h, nil
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if err := checkIds(h.Name); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsert(&entry{kind: hostKind, id: h.Name, val: h}, hostPath(h.Name), 0)
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if err := checkIds(key.Name); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.delete(hostPath(key.Name))
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Listener{}
+	for _, e := range n.list(listenerKind, "") {
+		out = append(out, e.val.(engine.Listener))
+	}
+	return out, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(listenerPath(key.Id))
+	if err != nil {
+		return nil, err
+	}
+	l := e.val.(engine.Listener)
+	return &l, nil
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	if err := checkIds(l.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsert(&entry{kind: listenerKind, id: l.Id, val: l}, listenerPath(l.Id), 0)
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if err := checkIds(key.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.delete(listenerPath(key.Id))
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Frontend{}
+	for _, e := range n.list(frontendKind, "") {
+		out = append(out, e.val.(engine.Frontend))
+	}
+	return out, nil
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(frontendPath(key.Id))
+	if err != nil {
+		return nil, err
+	}
+	f := e.val.(engine.Frontend)
+	return &f, nil
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if err := checkIds(f.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsertFrontend(f, ttl)
+}
+
+func (n *ng) upsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	for _, b := range f.BackendRefs() {
+		if _, err := n.get(backendPath(b.Id)); err != nil {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend '%s' not found", b.Id)}
+		}
+	}
+	return n.upsert(&entry{kind: frontendKind, id: f.Id, val: f}, frontendPath(f.Id), ttl)
+}
+
+func (n *ng) DeleteFrontend(key engine.FrontendKey) error {
+	if err := checkIds(key.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.delete(frontendPath(key.Id))
+}
+
+func (n *ng) GetMiddlewares(key engine.FrontendKey) ([]engine.Middleware, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Middleware{}
+	for _, e := range n.list(middlewareKind, key.Id) {
+		out = append(out, e.val.(engine.Middleware))
+	}
+	return out, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(middlewarePath(key.FrontendKey.Id, key.Id))
+	if err != nil {
+		return nil, err
+	}
+	m := e.val.(engine.Middleware)
+	return &m, nil
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if err := checkIds(fk.Id, m.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsertMiddleware(fk, m, ttl)
+}
+
+func (n *ng) upsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if n.registry.GetSpec(m.Type) == nil {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("middleware of type %s is not supported", m.Type)}
+	}
+	if _, err := n.get(frontendPath(fk.Id)); err != nil {
+		return err
+	}
+	return n.upsert(&entry{kind: middlewareKind, parent: fk.Id, id: m.Id, val: m}, middlewarePath(fk.Id, m.Id), ttl)
+}
+
+func (n *ng) DeleteMiddleware(key engine.MiddlewareKey) error {
+	if err := checkIds(key.FrontendKey.Id, key.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.delete(middlewarePath(key.FrontendKey.Id, key.Id))
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Backend{}
+	for _, e := range n.list(backendKind, "") {
+		out = append(out, e.val.(engine.Backend))
+	}
+	return out, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(backendPath(key.Id))
+	if err != nil {
+		return nil, err
+	}
+	b := e.val.(engine.Backend)
+	return &b, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	if err := checkIds(b.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsert(&entry{kind: backendKind, id: b.Id, val: b}, backendPath(b.Id), 0)
+}
+
+func (n *ng) DeleteBackend(key engine.BackendKey) error {
+	if err := checkIds(key.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.deleteBackend(key)
+}
+
+func (n *ng) deleteBackend(key engine.BackendKey) error {
+	var usedBy []string
+	for _, e := range n.list(frontendKind, "") {
+		if f := e.val.(engine.Frontend); f.UsesBackend(key.Id) {
+			usedBy = append(usedBy, e.id)
+		}
+	}
+	if len(usedBy) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by frontends %v", key, usedBy)
+	}
+	return n.delete(backendPath(key.Id))
+}
+
+func (n *ng) GetServers(key engine.BackendKey) ([]engine.Server, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	out := []engine.Server{}
+	for _, e := range n.list(serverKind, key.Id) {
+		out = append(out, e.val.(engine.Server))
+	}
+	return out, nil
+}
+
+func (n *ng) GetServer(key engine.ServerKey) (*engine.Server, error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	e, err := n.get(serverPath(key.BackendKey.Id, key.Id))
+	if err != nil {
+		return nil, err
+	}
+	s := e.val.(engine.Server)
+	if !e.expires.IsZero() {
+		expires := e.expires
+		s.Expires = &expires
+	}
+	return &s, nil
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if err := checkIds(bk.Id, s.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.upsertServer(bk, s, ttl)
+}
+
+func (n *ng) upsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if _, err := n.get(backendPath(bk.Id)); err != nil {
+		return err
+	}
+	s.Expires = nil
+	return n.upsert(&entry{kind: serverKind, parent: bk.Id, id: s.Id, val: s}, serverPath(bk.Id, s.Id), ttl)
+}
+
+func (n *ng) DeleteServer(key engine.ServerKey) error {
+	if err := checkIds(key.BackendKey.Id, key.Id); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	return n.delete(serverPath(key.BackendKey.Id, key.Id))
+}
+
+func (n *ng) GetACMEAccountKey() ([]byte, error) {
+	data, err := ioutil.ReadFile(n.acmePath("account"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &engine.NotFoundError{Message: "ACME account key not found"}
+		}
+		return nil, err
+	}
+	if data, err = n.open(data); err != nil {
+		return nil, err
+	}
+	var key []byte
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (n *ng) CreateACMEAccountKey(key []byte) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	path := n.acmePath("account")
+	if _, err := os.Stat(path); err == nil {
+		return &engine.AlreadyExistsError{Message: "ACME account key already exists"}
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if data, err = n.seal(data); err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+func (n *ng) UpsertACMEChallenge(ch engine.ACMEChallenge, ttl time.Duration) error {
+	if err := engine.CheckACMEToken(ch.Token); err != nil {
+		return err
+	}
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().UTC().Add(ttl)
+	}
+	data, err := marshal(".json", ch, expires, nil)
+	if err != nil {
+		return err
+	}
+	return writeFile(n.acmePath("challenges", ch.Token), data)
+}
+
+// GetACMEChallenge reads the challenge, expired challenges are removed and not found
+func (n *ng) GetACMEChallenge(token string) (*engine.ACMEChallenge, error) {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return nil, err
+	}
+	path := n.acmePath("challenges", token)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+		}
+		return nil, err
+	}
+	var ch struct {
+		engine.ACMEChallenge
+		Expires time.Time
+	}
+	if err := json.Unmarshal(data, &ch); err != nil {
+		return nil, err
+	}
+	if !ch.Expires.IsZero() && !time.Now().UTC().Before(ch.Expires) {
+		os.Remove(path)
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+	}
+	return &ch.ACMEChallenge, nil
+}
+
+func (n *ng) DeleteACMEChallenge(token string) error {
+	if err := engine.CheckACMEToken(token); err != nil {
+		return err
+	}
+	if err := os.Remove(n.acmePath("challenges", token)); err != nil {
+		if os.IsNotExist(err) {
+			return &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+		}
+		return err
+	}
+	return nil
+}
+
+// CreateACMEOrderLock creates the lock file unless it exists, the expired lock is removed and taken over
+func (n *ng) CreateACMEOrderLock(domain string, ttl time.Duration) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().UTC().Add(ttl)
+	}
+	data, err := marshal(".json", struct{}{}, expires, nil)
+	if err != nil {
+		return err
+	}
+	path := n.acmePath("orders", domain)
+	for i := 0; i < 2; i++ {
+		err := createFile(path, data)
+		if !os.IsExist(err) {
+			return err
+		}
+		expired, err := orderLockExpired(path)
+		if err != nil {
+			return err
+		}
+		if !expired {
+			break
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return &engine.AlreadyExistsError{Message: fmt.Sprintf("ACME order lock '%s' already exists", domain)}
+}
+
+func (n *ng) DeleteACMEOrderLock(domain string) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	if err := os.Remove(n.acmePath("orders", domain)); err != nil {
+		if os.IsNotExist(err) {
+			return &engine.NotFoundError{Message: fmt.Sprintf("ACME order lock '%s' not found", domain)}
+		}
+		return err
+	}
+	return nil
+}
+
+// orderLockExpired returns true if the lock file has expired or has been removed in between
+func orderLockExpired(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	var lock struct {
+		Expires time.Time
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return false, err
+	}
+	return !lock.Expires.IsZero() && !time.Now().UTC().Before(lock.Expires), nil
+}
+
+// acmePath returns the path of the ACME file, the names are the path elements without the extension
+func (n *ng) acmePath(names ...string) string {
+	return filepath.Join(append([]string{n.dir, "acme"}, names...)...) + ".json"
+}
+
+// Apply checks the change set against the copy of the configuration and writes the files one by one.
+// Files are not written atomically as a whole, but the changes are emitted as a single change once all
+// files are written. In case if writing a file fails, the changes written so far are emitted.
+func (n *ng) Apply(cs engine.ChangeSet) error {
+	if err := cs.Check(); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	if err := n.copy().Apply(cs); err != nil {
+		return err
+	}
+	n.batch = []interface{}{}
+	defer func() {
+		changes := n.batch
+		n.batch = nil
+		if len(changes) != 0 {
+			n.emit(&engine.ChangeSetApplied{Changes: changes})
+		}
+	}()
+	for i, ch := range cs.Changes {
+		if err := n.apply(ch); err != nil {
+			return engine.ChangeError(i, ch, err)
+		}
+	}
+	return nil
+}
+
+func (n *ng) apply(c engine.Change) error {
+	switch ch := c.Event.(type) {
+	case *engine.HostUpserted:
+		return n.upsert(&entry{kind: hostKind, id: ch.Host.Name, val: ch.Host}, hostPath(ch.Host.Name), 0)
+	case *engine.HostDeleted:
+		return n.delete(hostPath(ch.HostKey.Name))
+	case *engine.ListenerUpserted:
+		return n.upsert(&entry{kind: listenerKind, id: ch.Listener.Id, val: ch.Listener}, listenerPath(ch.Listener.Id), 0)
+	case *engine.ListenerDeleted:
+		return n.delete(listenerPath(ch.ListenerKey.Id))
+	case *engine.BackendUpserted:
+		return n.upsert(&entry{kind: backendKind, id: ch.Backend.Id, val: ch.Backend}, backendPath(ch.Backend.Id), 0)
+	case *engine.BackendDeleted:
+		return n.deleteBackend(ch.BackendKey)
+	case *engine.ServerUpserted:
+		return n.upsertServer(ch.BackendKey, ch.Server, c.TTL)
+	case *engine.ServerDeleted:
+		return n.delete(serverPath(ch.ServerKey.BackendKey.Id, ch.ServerKey.Id))
+	case *engine.FrontendUpserted:
+		return n.upsertFrontend(ch.Frontend, c.TTL)
+	case *engine.FrontendDeleted:
+		return n.delete(frontendPath(ch.FrontendKey.Id))
+	case *engine.MiddlewareUpserted:
+		return n.upsertMiddleware(ch.FrontendKey, ch.Middleware, c.TTL)
+	case *engine.MiddlewareDeleted:
+		return n.delete(middlewarePath(ch.MiddlewareKey.FrontendKey.Id, ch.MiddlewareKey.Id))
+	}
+	return &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported change: %#v", c.Event)}
+}
+
+// copy returns the in-memory copy of the configuration, used to check the change sets before writing the files
+func (n *ng) copy() *memng.Mem {
+	m := memng.New(n.registry).(*memng.Mem)
+	for _, e := range n.entries {
+		switch val := e.val.(type) {
+		case engine.Host:
+			m.Hosts[engine.HostKey{Name: e.id}] = val
+		case engine.Listener:
+			m.Listeners[engine.ListenerKey{Id: e.id}] = val
+		case engine.Backend:
+			m.Backends[engine.BackendKey{Id: e.id}] = val
+		case engine.Server:
+			bk := engine.BackendKey{Id: e.parent}
+			m.Servers[bk] = append(m.Servers[bk], val)
+		case engine.Frontend:
+			m.Frontends[engine.FrontendKey{Id: e.id}] = val
+		case engine.Middleware:
+			fk := engine.FrontendKey{Id: e.parent}
+			m.Middlewares[fk] = append(m.Middlewares[fk], val)
+		}
+	}
+	return m
+}
+
+// Subscribe generates the events for the changes made through the engine, for the files changed on disk
+// and for the expired objects. It is a blocking function.
+func (n *ng) Subscribe(changes chan interface{}, cancelC chan bool) error {
+	return n.changes.Subscribe(changes, cancelC)
+}
+
+func (n *ng) emit(change interface{}) {
+	if n.batch != nil {
+		n.batch = append(n.batch, change)
+		return
+	}
+	n.changes.Emit(change)
+}
+
+// watch scans the directory periodically and deletes the expired objects until the engine is closed
+func (n *ng) watch() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-time.After(n.nextCheck()):
+		case <-n.wakeC:
+			continue
+		case <-n.stopC:
+			return
+		}
+		n.mtx.Lock()
+		now := time.Now().UTC()
+		n.expire(now)
+		changes, err := n.scan(now)
+		if err != nil {
+			log.Errorf("%s failed to scan: %s", n, err)
+		}
+		for _, change := range changes {
+			n.emit(change)
+		}
+		n.mtx.Unlock()
+	}
+}
+
+// nextCheck returns the time until the next scan of the directory or the next expiry, whatever comes first
+func (n *ng) nextCheck() time.Duration {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	d := n.options.PollPeriod
+	now := time.Now().UTC()
+	for _, e := range n.entries {
+		if !e.expires.IsZero() && e.expires.Sub(now) < d {
+			d = e.expires.Sub(now)
+		}
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (n *ng) nextRevision() int64 {
+	n.revision++
+	return n.revision
+}
+
+func (n *ng) wake() {
+	select {
+	case n.wakeC <- true:
+	default:
+	}
+}
+
+func (n *ng) get(path string) (*entry, error) {
+	e, ok := n.entries[path]
+	if !ok || e.val == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("'%s' not found", path)}
+	}
+	return e, nil
+}
+
+// list returns the valid entries of the given kind, sorted by id. Parent limits the servers and middlewares
+// to the ones of the given backend or frontend.
+func (n *ng) list(kind int, parent string) []*entry {
+	var out []*entry
+	for _, e := range n.entries {
+		if e.kind == kind && e.parent == parent && e.val != nil {
+			out = append(out, e)
+		}
+	}
+	sort.Sort(entriesById(out))
+	return out
+}
+
+// upsert writes the object to the file, keeping the format of the existing file, and emits the change
+func (n *ng) upsert(e *entry, path string, ttl time.Duration) error {
+	val, expected := setRevision(e.val, 0)
+	var stored int64
+	e.file = path + ".json"
+	if prev, ok := n.entries[path]; ok {
+		e.file = prev.file
+		if prev.val != nil {
+			_, stored = setRevision(prev.val, 0)
+		}
+	}
+	if err := engine.CheckRevision(path, expected, stored); err != nil {
+		return err
+	}
+	if ttl != 0 {
+		e.expires = time.Now().UTC().Add(ttl)
+	}
+	fileVal, sealed, err := n.sealKeyPair(val)
+	if err != nil {
+		return err
+	}
+	data, err := marshal(e.file, fileVal, e.expires, sealed)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(n.dir, filepath.FromSlash(e.file)), data); err != nil {
+		return err
+	}
+	e.data = data
+	e.val, _ = setRevision(val, n.nextRevision())
+	n.entries[path] = e
+	n.emit(upserted(e))
+	if ttl != 0 {
+		n.wake()
+	}
+	return nil
+}
+
+// delete removes the object file, frontends and backends are removed along with their middlewares and servers
+func (n *ng) delete(path string) error {
+	e, err := n.get(path)
+	if err != nil {
+		return err
+	}
+	if err := n.remove(e); err != nil {
+		return err
+	}
+	n.emit(deleted(e))
+	return nil
+}
+
+func (n *ng) remove(e *entry) error {
+	path := filepath.Join(n.dir, filepath.FromSlash(e.file))
+	switch e.kind {
+	case backendKind, frontendKind:
+		path = filepath.Dir(path)
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	default:
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for key, c := range n.entries {
+		if c == e || isChild(e, c) {
+			delete(n.entries, key)
+		}
+	}
+	return nil
+}
+
+// expire removes the expired objects and emits the changes
+func (n *ng) expire(now time.Time) {
+	for _, e := range n.entries {
+		if e.expires.IsZero() || now.Before(e.expires) {
+			continue
+		}
+		if _, ok := n.entries[strings.TrimSuffix(e.file, filepath.Ext(e.file))]; !ok {
+			// removed along with the parent
+			continue
+		}
+		if err := n.remove(e); err != nil {
+			log.Errorf("%s failed to remove expired %s: %s", n, e.file, err)
+			continue
+		}
+		n.emit(deleted(e))
+	}
+}
+
+// scan reads the directory and updates the entries, returning the changes for the files that were
+// created, modified or removed since the last scan
+func (n *ng) scan(now time.Time) ([]interface{}, error) {
+	found := make(map[string]*entry)
+	err := filepath.Walk(n.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == n.dir {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !isConfigFile(file) {
+			return nil
+		}
+		rel, err := filepath.Rel(n.dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		path := strings.TrimSuffix(rel, filepath.Ext(rel))
+		e := newEntry(path)
+		if e == nil {
+			return nil
+		}
+		if _, ok := found[path]; ok {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		e.file, e.data = rel, data
+		found[path] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var updated, expired, upserts, deletes []*entry
+	for path, e := range n.entries {
+		if _, ok := found[path]; ok {
+			continue
+		}
+		delete(n.entries, path)
+		if e.val != nil {
+			deletes = append(deletes, e)
+		}
+	}
+	for path, e := range found {
+		prev, ok := n.entries[path]
+		if ok && prev.file == e.file && bytes.Equal(prev.data, e.data) {
+			continue
+		}
+		if err := n.parse(e); err != nil {
+			log.Warningf("%s failed to read %s: %s", n, e.file, err)
+			if ok {
+				// keep the last valid object until the file is fixed
+				prev.file, prev.data = e.file, e.data
+				continue
+			}
+		}
+		n.entries[path] = e
+		if e.val == nil {
+			continue
+		}
+		e.val, _ = setRevision(e.val, n.nextRevision())
+		// objects could have expired while the engine was not running
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			if ok && prev.val != nil {
+				deletes = append(deletes, prev)
+			}
+			expired = append(expired, e)
+			continue
+		}
+		updated = append(updated, e)
+	}
+	for _, e := range expired {
+		if err := n.remove(e); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range updated {
+		if n.entries[strings.TrimSuffix(e.file, filepath.Ext(e.file))] == e {
+			upserts = append(upserts, e)
+		}
+	}
+
+	// upserts go in the order of dependencies and deletes in reverse order, so that e.g. frontends are
+	// upserted after their backends and deleted before them
+	sort.Sort(entriesByKind(upserts))
+	sort.Sort(sort.Reverse(entriesByKind(deletes)))
+	changes := make([]interface{}, 0, len(upserts)+len(deletes))
+	for _, e := range upserts {
+		changes = append(changes, upserted(e))
+	}
+	for _, e := range deletes {
+		changes = append(changes, deleted(e))
+	}
+	return changes, nil
+}
+
+// parse reads the object from the file data
+func (n *ng) parse(e *entry) error {
+	data := e.data
+	if isYAML(e.file) {
+		var err error
+		if data, err = yamlToJSON(data); err != nil {
+			return err
+		}
+	}
+	var meta struct {
+		Expires       time.Time
+		SealedKeyPair json.RawMessage
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	e.expires = meta.Expires
+
+	var val interface{}
+	switch e.kind {
+	case hostKind:
+		h, err := engine.HostFromJSON(data, e.id)
+		if err != nil {
+			return err
+		}
+		val = *h
+	case listenerKind:
+		l, err := engine.ListenerFromJSON(data, e.id)
+		if err != nil {
+			return err
+		}
+		val = *l
+	case backendKind:
+		b, err := engine.BackendFromJSON(data, e.id)
+		if err != nil {
+			return err
+		}
+		val = *b
+	case serverKind:
+		s, err := engine.ServerFromJSON(data, e.id)
+		if err != nil {
+			return err
+		}
+		val = *s
+	case frontendKind:
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), data, e.id)
+		if err != nil {
+			return err
+		}
+		val = *f
+	case middlewareKind:
+		m, err := engine.MiddlewareFromJSON(data, n.registry.GetSpec, e.id)
+		if err != nil {
+			return err
+		}
+		val = *m
+	}
+	if len(meta.SealedKeyPair) != 0 {
+		var err error
+		if val, err = n.openKeyPair(val, meta.SealedKeyPair); err != nil {
+			return err
+		}
+	}
+	e.val = val
+	return nil
+}
+
+// sealKeyPair returns the copy of the host or the backend without the key pair and the key pair sealed with the box.
+// Objects are returned as is if the box is not set or there is no key pair.
+func (n *ng) sealKeyPair(val interface{}) (interface{}, []byte, error) {
+	if n.options.Box == nil {
+		return val, nil, nil
+	}
+	var keyPair *engine.KeyPair
+	switch v := val.(type) {
+	case engine.Host:
+		keyPair, v.Settings.KeyPair = v.Settings.KeyPair, nil
+		val = v
+	case engine.Backend:
+		s := v.HTTPSettings()
+		if s.TLS != nil && s.TLS.KeyPair != nil {
+			keyPair = s.TLS.KeyPair
+			tlsSettings := *s.TLS
+			tlsSettings.KeyPair = nil
+			s.TLS = &tlsSettings
+			v.Settings = s
+			val = v
+		}
+	}
+	if keyPair == nil {
+		return val, nil, nil
+	}
+	data, err := json.Marshal(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := n.seal(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, sealed, nil
+}
+
+// openKeyPair sets the key pair sealed by sealKeyPair back to the host or the backend
+func (n *ng) openKeyPair(val interface{}, sealed []byte) (interface{}, error) {
+	if n.options.Box == nil {
+		return nil, fmt.Errorf("need secretbox to open sealed key pair")
+	}
+	data, err := n.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	var keyPair *engine.KeyPair
+	if err := json.Unmarshal(data, &keyPair); err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case engine.Host:
+		v.Settings.KeyPair = keyPair
+		return v, nil
+	case engine.Backend:
+		s := v.HTTPSettings()
+		if s.TLS == nil {
+			return nil, fmt.Errorf("sealed key pair of backend '%s' without TLS settings", v.Id)
+		}
+		s.TLS.KeyPair = keyPair
+		v.Settings = s
+		return v, nil
+	}
+	return nil, fmt.Errorf("unexpected sealed key pair")
+}
+
+// seal seals the data if the box is set
+func (n *ng) seal(data []byte) ([]byte, error) {
+	if n.options.Box == nil {
+		return data, nil
+	}
+	sv, err := n.options.Box.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(sv)
+}
+
+// open opens the data sealed by seal
+func (n *ng) open(val []byte) ([]byte, error) {
+	if n.options.Box == nil {
+		return val, nil
+	}
+	sv, err := secret.SealedValueFromJSON(val)
+	if err != nil {
+		return nil, err
+	}
+	return n.options.Box.Open(sv)
+}
+
+// newEntry returns the entry of the kind matching the path, or nil if the path does not match any kind
+func newEntry(path string) *entry {
+	for _, k := range kindPaths {
+		m := k.re.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		e := &entry{kind: k.kind, id: m[len(m)-1]}
+		if len(m) == 3 {
+			e.parent = m[1]
+		}
+		return e
+	}
+	return nil
+}
+
+func isChild(parent, e *entry) bool {
+	switch {
+	case parent.kind == backendKind && e.kind == serverKind:
+		return e.parent == parent.id
+	case parent.kind == frontendKind && e.kind == middlewareKind:
+		return e.parent == parent.id
+	}
+	return false
+}
+
+// setRevision returns the copy of the object with the given revision and the revision the object had
+func setRevision(val interface{}, revision int64) (interface{}, int64) {
+	var prev int64
+	switch v := val.(type) {
+	case engine.Host:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	case engine.Listener:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	case engine.Backend:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	case engine.Server:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	case engine.Frontend:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	case engine.Middleware:
+		prev, v.Revision = v.Revision, revision
+		return v, prev
+	}
+	return val, prev
+}
+
+// upserted returns the change for the object, changes have no revisions
+func upserted(e *entry) interface{} {
+	val, _ := setRevision(e.val, 0)
+	switch v := val.(type) {
+	case engine.Host:
+		return &engine.HostUpserted{Host: v}
+	case engine.Listener:
+		return &engine.ListenerUpserted{Listener: v}
+	case engine.Backend:
+		return &engine.BackendUpserted{Backend: v}
+	case engine.Server:
+		return &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: e.parent}, Server: v}
+	case engine.Frontend:
+		return &engine.FrontendUpserted{Frontend: v}
+	case engine.Middleware:
+		return &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: e.parent}, Middleware: v}
+	}
+	return nil
+}
+
+func deleted(e *entry) interface{} {
+	switch e.kind {
+	case hostKind:
+		return &engine.HostDeleted{HostKey: engine.HostKey{Name: e.id}}
+	case listenerKind:
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: e.id}}
+	case backendKind:
+		return &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: e.id}}
+	case serverKind:
+		return &engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: e.parent}, Id: e.id}}
+	case frontendKind:
+		return &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: e.id}}
+	case middlewareKind:
+		return &engine.MiddlewareDeleted{MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: e.parent}, Id: e.id}}
+	}
+	return nil
+}
+
+func hostPath(name string) string {
+	return "hosts/" + name
+}
+
+func listenerPath(id string) string {
+	return "listeners/" + id
+}
+
+func backendPath(id string) string {
+	return "backends/" + id + "/backend"
+}
+
+func serverPath(backendId, id string) string {
+	return "backends/" + backendId + "/servers/" + id
+}
+
+func frontendPath(id string) string {
+	return "frontends/" + id + "/frontend"
+}
+
+func middlewarePath(frontendId, id string) string {
+	return "frontends/" + frontendId + "/middlewares/" + id
+}
+
+// checkIds makes sure the ids can be used as file names
+func checkIds(ids ...string) error {
+	for _, id := range ids {
+		if id == "" {
+			return &engine.InvalidFormatError{Message: "id can not be empty"}
+		}
+		if strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("id '%s' can not start with '.' or contain path separators", id)}
+		}
+	}
+	return nil
+}
+
+func isConfigFile(file string) bool {
+	return filepath.Ext(file) == ".json" || isYAML(file)
+}
+
+func isYAML(file string) bool {
+	ext := filepath.Ext(file)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// marshal encodes the object in the format of the file, adding the expiry time for the objects with TTL
+// and the sealed key pair, if any
+func marshal(file string, val interface{}, expires time.Time, sealedKeyPair []byte) ([]byte, error) {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	if !expires.IsZero() || sealedKeyPair != nil {
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		if !expires.IsZero() {
+			m["Expires"] = expires
+		}
+		if sealedKeyPair != nil {
+			m["SealedKeyPair"] = json.RawMessage(sealedKeyPair)
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+	if isYAML(file) {
+		var v yaml.MapSlice
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(v)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// writeFile writes the data to the temporary file in the same directory and renames it, so the readers
+// never see partially written files
+func writeFile(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// createFile writes the file like writeFile, but fails with the error satisfying os.IsExist if the file exists,
+// so only one of the concurrent writers creates it
+func createFile(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(f.Name(), path)
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v, err := convertYAML(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// convertYAML converts the maps decoded from YAML to the maps with string keys, as expected by JSON encoder
+func convertYAML(in interface{}) (interface{}, error) {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported key %v, keys should be strings", key)
+			}
+			c, err := convertYAML(val)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = c
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			c, err := convertYAML(val)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = c
+		}
+		return out, nil
+	}
+	return in, nil
+}
+
+type entriesById []*entry
+
+func (e entriesById) Len() int           { return len(e) }
+func (e entriesById) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e entriesById) Less(i, j int) bool { return e[i].id < e[j].id }
+
+type entriesByKind []*entry
+
+func (e entriesByKind) Len() int      { return len(e) }
+func (e entriesByKind) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entriesByKind) Less(i, j int) bool {
+	if e[i].kind != e[j].kind {
+		return e[i].kind < e[j].kind
+	}
+	return e[i].file < e[j].file
+}
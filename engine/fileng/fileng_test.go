@@ -0,0 +1,459 @@
+package fileng
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+func TestFile(t *testing.T) { TestingT(t) }
+
+type FileSuite struct {
+	ng       *ng
+	dir      string
+	box      *secret.Box
+	suite    test.EngineSuite
+	changesC chan interface{}
+	stopC    chan bool
+}
+
+var _ = Suite(&FileSuite{})
+
+func (s *FileSuite) SetUpSuite(c *C) {
+	log.InitWithConfig(log.Config{Name: "console"})
+}
+
+func (s *FileSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	box, err := secret.NewBoxFromKeyString(mustKeyString())
+	c.Assert(err, IsNil)
+	s.box = box
+	s.ng = s.newEngine(c)
+
+	s.changesC = make(chan interface{})
+	s.stopC = make(chan bool)
+	go s.ng.Subscribe(s.changesC, s.stopC)
+
+	s.suite.ChangesC = s.changesC
+	s.suite.Engine = s.ng
+}
+
+func (s *FileSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+}
+
+func (s *FileSuite) newEngine(c *C) *ng {
+	e, err := New(s.dir, registry.GetRegistry(), Options{PollPeriod: 50 * time.Millisecond, Box: s.box})
+	c.Assert(err, IsNil)
+	return e.(*ng)
+}
+
+func (s *FileSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *FileSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *FileSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *FileSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *FileSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *FileSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *FileSuite) TestHostWithAutoCert(c *C) {
+	s.suite.HostWithAutoCert(c)
+}
+
+func (s *FileSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *FileSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *FileSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *FileSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
+func (s *FileSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *FileSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
+func (s *FileSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *FileSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *FileSuite) TestServerWeight(c *C) {
+	s.suite.ServerWeight(c)
+}
+
+func (s *FileSuite) TestServerExpire(c *C) {
+	s.suite.ServerExpire(c)
+}
+
+func (s *FileSuite) TestServerExpires(c *C) {
+	s.suite.ServerExpires(c)
+}
+
+func (s *FileSuite) TestACMEAccountKey(c *C) {
+	s.suite.ACMEAccountKey(c)
+}
+
+func (s *FileSuite) TestACMEChallengeCRUD(c *C) {
+	s.suite.ACMEChallengeCRUD(c)
+}
+
+func (s *FileSuite) TestACMEOrderLock(c *C) {
+	s.suite.ACMEOrderLock(c)
+}
+
+func (s *FileSuite) TestACMEOrderLockExpire(c *C) {
+	s.suite.ACMEOrderLockExpire(c)
+}
+
+func (s *FileSuite) TestACMEChallengeExpire(c *C) {
+	s.suite.ACMEChallengeExpire(c)
+}
+
+func (s *FileSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *FileSuite) TestFrontendExpire(c *C) {
+	s.suite.FrontendExpire(c)
+}
+
+func (s *FileSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *FileSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *FileSuite) TestMiddlewareExpire(c *C) {
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *FileSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *FileSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+func (s *FileSuite) TestChangeSetApply(c *C) {
+	s.suite.ChangeSetApply(c)
+}
+
+func (s *FileSuite) TestChangeSetFailed(c *C) {
+	s.suite.ChangeSetFailed(c)
+}
+
+func (s *FileSuite) TestRevisionConflict(c *C) {
+	s.suite.RevisionConflict(c)
+}
+
+// Objects written by one engine are read by the engine started on the same directory
+func (s *FileSuite) TestPersistence(c *C) {
+	h := engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}
+	l, err := engine.NewListener("l1", engine.HTTP, engine.TCP, "localhost:31000", "", nil)
+	c.Assert(err, IsNil)
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		Timeouts: engine.HTTPBackendTimeouts{Read: "1s"},
+	}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	f := engine.Frontend{Id: "f1", Type: engine.HTTP, BackendId: b.Id, Route: `Path("/hello")`, Settings: engine.HTTPFrontendSettings{}}
+	m := s.makeConnLimit(c, "cl1", 10)
+
+	c.Assert(s.ng.UpsertHost(h), IsNil)
+	c.Assert(s.ng.UpsertListener(*l), IsNil)
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.UpsertServer(engine.BackendKey{Id: b.Id}, srv, 0), IsNil)
+	c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+	c.Assert(s.ng.UpsertMiddleware(engine.FrontendKey{Id: f.Id}, m, time.Hour), IsNil)
+
+	before, err := s.ng.GetHost(engine.HostKey{Name: h.Name})
+	c.Assert(err, IsNil)
+
+	ng := s.newEngine(c)
+	defer ng.Close()
+
+	// Revisions are not stored in the files and do not match after the restart
+	hs, err := ng.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(len(hs), Equals, 1)
+	c.Assert(hs[0].Revision, Not(Equals), before.Revision)
+	hs[0].Revision = 0
+	c.Assert(hs, DeepEquals, []engine.Host{h})
+
+	ls, err := ng.GetListeners()
+	c.Assert(err, IsNil)
+	c.Assert(len(ls), Equals, 1)
+	ls[0].Revision = 0
+	c.Assert(ls, DeepEquals, []engine.Listener{*l})
+
+	bs, err := ng.GetBackends()
+	c.Assert(err, IsNil)
+	c.Assert(len(bs), Equals, 1)
+	bs[0].Revision = 0
+	c.Assert(bs, DeepEquals, []engine.Backend{b})
+
+	srvs, err := ng.GetServers(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(len(srvs), Equals, 1)
+	srvs[0].Revision = 0
+	c.Assert(srvs, DeepEquals, []engine.Server{srv})
+
+	fs, err := ng.GetFrontends()
+	c.Assert(err, IsNil)
+	c.Assert(len(fs), Equals, 1)
+	fs[0].Revision = 0
+	c.Assert(fs, DeepEquals, []engine.Frontend{f})
+
+	ms, err := ng.GetMiddlewares(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+	c.Assert(len(ms), Equals, 1)
+	ms[0].Revision = 0
+	c.Assert(ms, DeepEquals, []engine.Middleware{m})
+}
+
+// Key pairs and the ACME account key are sealed with the box, so the engine without the box can not read them
+func (s *FileSuite) TestKeyPairSealed(c *C) {
+	keyPair := &engine.KeyPair{Key: []byte("hello"), Cert: []byte("world")}
+	h := engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: keyPair}}
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		TLS: &engine.TLSSettings{KeyPair: keyPair},
+	}}
+	c.Assert(s.ng.UpsertHost(h), IsNil)
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.ng.CreateACMEAccountKey([]byte("account")), IsNil)
+
+	for _, path := range []string{"hosts/localhost.json", "backends/b1/backend.json"} {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, path))
+		c.Assert(err, IsNil)
+		var file struct {
+			SealedKeyPair json.RawMessage
+		}
+		c.Assert(json.Unmarshal(data, &file), IsNil)
+		_, err = secret.SealedValueFromJSON(file.SealedKeyPair)
+		c.Assert(err, IsNil)
+		c.Assert(strings.Contains(string(data), base64.StdEncoding.EncodeToString(keyPair.Key)), Equals, false)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, "acme/account.json"))
+	c.Assert(err, IsNil)
+	_, err = secret.SealedValueFromJSON(data)
+	c.Assert(err, IsNil)
+
+	// The key pairs are opened by the engine with the box
+	ng := s.newEngine(c)
+	out, err := ng.GetHost(engine.HostKey{Name: h.Name})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.KeyPair, DeepEquals, keyPair)
+	ob, err := ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(ob.HTTPSettings().TLS.KeyPair, DeepEquals, keyPair)
+	ng.Close()
+
+	e, err := New(s.dir, registry.GetRegistry(), Options{})
+	c.Assert(err, IsNil)
+	defer e.Close()
+	_, err = e.GetHost(engine.HostKey{Name: h.Name})
+	c.Assert(err, NotNil)
+	key, err := e.GetACMEAccountKey()
+	c.Assert(err, NotNil)
+	c.Assert(key, IsNil)
+}
+
+func (s *FileSuite) TestExternalChanges(c *C) {
+	s.writeFile(c, "backends/b1/backend.json", `{"Type": "http"}`)
+	s.writeFile(c, "backends/b1/servers/srv1.yaml", "URL: http://localhost:5000\n")
+	s.writeFile(c, "frontends/f1/frontend.yml", "Type: http\nBackendId: b1\nRoute: Path(\"/hello\")\n")
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	f := engine.Frontend{Id: "f1", Type: engine.HTTP, BackendId: "b1", Route: `Path("/hello")`, Settings: engine.HTTPFrontendSettings{}}
+	bk := engine.BackendKey{Id: b.Id}
+
+	changes := s.collectChanges(c, 3)
+	c.Assert(changes[0], DeepEquals, &engine.BackendUpserted{Backend: b})
+	c.Assert(changes[1], DeepEquals, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+	c.Assert(changes[2], FitsTypeOf, &engine.FrontendUpserted{})
+	c.Assert(changes[2].(*engine.FrontendUpserted).Frontend.Id, Equals, f.Id)
+
+	before, err := s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+
+	srv.URL = "http://localhost:5001"
+	s.writeFile(c, "backends/b1/servers/srv1.yaml", "URL: http://localhost:5001\n")
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{&engine.ServerUpserted{BackendKey: bk, Server: srv}})
+
+	// Changes of the files change the revisions, so the server read before the change can not be upserted
+	out, err := s.ng.GetServer(engine.ServerKey{BackendKey: bk, Id: srv.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.Revision, Not(Equals), before.Revision)
+	c.Assert(s.ng.UpsertServer(bk, *before, 0), FitsTypeOf, &engine.RevisionConflictError{})
+	out.Revision = 0
+	c.Assert(out, DeepEquals, &srv)
+
+	c.Assert(os.RemoveAll(filepath.Join(s.dir, "frontends")), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(s.dir, "backends")), IsNil)
+	c.Assert(s.collectChanges(c, 3), DeepEquals, []interface{}{
+		&engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: f.Id}},
+		&engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: bk, Id: srv.Id}},
+		&engine.BackendDeleted{BackendKey: bk},
+	})
+}
+
+// Bad files are ignored until they are fixed, and the last valid object is kept
+func (s *FileSuite) TestBadFile(c *C) {
+	s.writeFile(c, "backends/b1/backend.json", `{"Type": "http"`)
+	s.writeFile(c, "hosts/localhost.json", `{}`)
+
+	h := engine.Host{Name: "localhost"}
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{&engine.HostUpserted{Host: h}})
+
+	_, err := s.ng.GetBackend(engine.BackendKey{Id: "b1"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	s.writeFile(c, "hosts/localhost.json", `{"Settings": `)
+	s.writeFile(c, "backends/b1/backend.json", `{"Type": "http"}`)
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{&engine.BackendUpserted{Backend: b}})
+
+	out, err := s.ng.GetHost(engine.HostKey{Name: h.Name})
+	c.Assert(err, IsNil)
+	out.Revision = 0
+	c.Assert(out, DeepEquals, &h)
+}
+
+// Changes made through the engine keep the format of the existing files
+func (s *FileSuite) TestKeepsFormat(c *C) {
+	s.writeFile(c, "backends/b1/backend.yaml", "Type: http\n")
+	s.collectChanges(c, 1)
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{
+		Timeouts: engine.HTTPBackendTimeouts{Read: "1s"},
+	}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	c.Assert(s.collectChanges(c, 1), DeepEquals, []interface{}{&engine.BackendUpserted{Backend: b}})
+
+	_, err := os.Stat(filepath.Join(s.dir, "backends", "b1", "backend.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	ng := s.newEngine(c)
+	defer ng.Close()
+	out, err := ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	out.Revision = 0
+	c.Assert(out, DeepEquals, &b)
+
+	// no events are generated for the changes written by the engine itself
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case change := <-s.changesC:
+		c.Fatalf("unexpected change: %v", change)
+	default:
+	}
+}
+
+// Objects that expired while the engine was not running are removed on start
+func (s *FileSuite) TestExpiredOnStart(c *C) {
+	s.writeFile(c, "backends/b1/backend.json", `{"Type": "http"}`)
+	s.writeFile(c, "backends/b1/servers/srv1.json", `{"URL": "http://localhost:5000", "Expires": "2015-01-01T00:00:00Z"}`)
+	s.writeFile(c, "backends/b1/servers/srv2.json", `{"URL": "http://localhost:5001", "Expires": "2115-01-01T00:00:00Z"}`)
+
+	ng := s.newEngine(c)
+	defer ng.Close()
+
+	srvs, err := ng.GetServers(engine.BackendKey{Id: "b1"})
+	c.Assert(err, IsNil)
+	c.Assert(len(srvs), Equals, 1)
+	c.Assert(srvs[0].Id, Equals, "srv2")
+
+	_, err = os.Stat(filepath.Join(s.dir, "backends", "b1", "servers", "srv1.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *FileSuite) TestBadIds(c *C) {
+	b := engine.Backend{Id: "../b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), FitsTypeOf, &engine.InvalidFormatError{})
+
+	b.Id = ".b1"
+	c.Assert(s.ng.UpsertBackend(b), FitsTypeOf, &engine.InvalidFormatError{})
+}
+
+func (s *FileSuite) makeConnLimit(c *C, id string, conns int64) engine.Middleware {
+	cl, err := connlimit.NewConnLimit(conns, "client.ip")
+	c.Assert(err, IsNil)
+	return engine.Middleware{Id: id, Type: "connlimit", Priority: 1, Middleware: cl}
+}
+
+// writeFile writes the file the same way the editors do, without renaming the temporary file
+func (s *FileSuite) writeFile(c *C, path, data string) {
+	path = filepath.Join(s.dir, filepath.FromSlash(path))
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+}
+
+func (s *FileSuite) collectChanges(c *C, expected int) []interface{} {
+	changes := make([]interface{}, expected)
+	for i := range changes {
+		select {
+		case changes[i] = <-s.changesC:
+		case <-time.After(2 * time.Second):
+			c.Fatalf("timeout waiting for change %d of %d", i+1, expected)
+		}
+	}
+	return changes
+}
+
+func mustKeyString() string {
+	key, err := secret.NewKeyString()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
@@ -37,8 +38,10 @@ type rawFrontend struct {
 	Route     string
 	Type      string
 	BackendId string
+	Backends  []WeightedBackend
 	Settings  json.RawMessage
 	Stats     *RoundTripStats
+	Revision  int64
 }
 
 type rawBackend struct {
@@ -46,6 +49,7 @@ type rawBackend struct {
 	Type     string
 	Settings json.RawMessage
 	Stats    *RoundTripStats
+	Revision int64
 }
 
 type RawMiddleware struct {
@@ -53,6 +57,7 @@ type RawMiddleware struct {
 	Type       string
 	Priority   int
 	Middleware json.RawMessage
+	Revision   int64
 }
 
 func HostsFromJSON(in []byte) ([]Host, error) {
@@ -100,7 +105,13 @@ func HostFromJSON(in []byte, name ...string) (*Host, error) {
 	if len(name) != 0 {
 		h.Name = name[0]
 	}
-	return NewHost(h.Name, h.Settings)
+	out, err := NewHost(h.Name, h.Settings)
+	if err != nil {
+		return nil, err
+	}
+	out.Certificate = h.Certificate
+	out.Revision = h.Revision
+	return out, nil
 }
 
 func ListenerFromJSON(in []byte, id ...string) (*Listener, error) {
@@ -112,12 +123,29 @@ func ListenerFromJSON(in []byte, id ...string) (*Listener, error) {
 	if len(id) != 0 {
 		rl.Id = id[0]
 	}
-	if rl.Protocol == HTTPS && rl.Settings != nil {
-		if _, err = NewTLSConfig(&rl.Settings.TLS); err != nil {
-			return nil, err
+	if _, err := rl.ProxyProtocolNetworks(); err != nil {
+		return nil, err
+	}
+	var l *Listener
+	if strings.ToLower(rl.Protocol) == TCP {
+		if rl.TCP == nil {
+			return nil, fmt.Errorf("tcp listener needs settings")
 		}
+		l, err = NewTCPListener(rl.Id, rl.Address.Network, rl.Address.Address, *rl.TCP)
+	} else {
+		if rl.Protocol == HTTPS && rl.Settings != nil {
+			if _, err = NewTLSConfig(&rl.Settings.TLS); err != nil {
+				return nil, err
+			}
+		}
+		l, err = NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.Settings)
+	}
+	if err != nil {
+		return nil, err
 	}
-	return NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.Settings)
+	l.ProxyProtocol = rl.ProxyProtocol
+	l.Revision = rl.Revision
+	return l, nil
 }
 
 func ListenersFromJSON(in []byte) ([]Listener, error) {
@@ -165,11 +193,25 @@ func FrontendFromJSON(router router.Router, in []byte, id ...string) (*Frontend,
 	if len(id) != 0 {
 		rf.Id = id[0]
 	}
+	if len(rf.Backends) != 0 {
+		if rf.BackendId == "" {
+			rf.BackendId = rf.Backends[0].Id
+		}
+		if rf.BackendId != rf.Backends[0].Id {
+			return nil, fmt.Errorf("BackendId should match the first backend in Backends")
+		}
+	}
 	f, err := NewHTTPFrontend(router, rf.Id, rf.BackendId, rf.Route, s)
 	if err != nil {
 		return nil, err
 	}
+	if len(rf.Backends) != 0 {
+		if err := f.SetBackends(rf.Backends); err != nil {
+			return nil, err
+		}
+	}
 	f.Stats = rf.Stats
+	f.Revision = rf.Revision
 	return f, nil
 }
 
@@ -195,6 +237,7 @@ func MiddlewareFromJSON(in []byte, getter plugin.SpecGetter, id ...string) (*Mid
 		Type:       ms.Type,
 		Middleware: m,
 		Priority:   ms.Priority,
+		Revision:   ms.Revision,
 	}, nil
 }
 
@@ -246,6 +289,7 @@ func BackendFromJSON(in []byte, id ...string) (*Backend, error) {
 		return nil, err
 	}
 	b.Stats = rb.Stats
+	b.Revision = rb.Revision
 	return b, nil
 }
 
@@ -296,5 +340,20 @@ func ServerFromJSON(in []byte, id ...string) (*Server, error) {
 	if len(id) != 0 {
 		e.Id = id[0]
 	}
-	return NewServer(e.Id, e.URL)
+	s, err := NewServer(e.Id, e.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetWeight(e.Weight); err != nil {
+		return nil, err
+	}
+	if err := s.SetState(e.State); err != nil {
+		return nil, err
+	}
+	s.Stats = e.Stats
+	s.Health = e.Health
+	s.Ejection = e.Ejection
+	s.RampUp = e.RampUp
+	s.Revision = e.Revision
+	return s, nil
 }
@@ -3,6 +3,7 @@ package memng
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/vulcand/vulcand/engine"
@@ -21,10 +22,21 @@ type Mem struct {
 	Middlewares map[engine.FrontendKey][]engine.Middleware
 	Servers     map[engine.BackendKey][]engine.Server
 
+	// ACMEAccountKey, ACMEChallenges and ACMEOrderLocks are guarded by the mutex, as the challenges
+	// are answered by the proxy while the ACME manager orders the certificates
+	ACMEAccountKey []byte
+	ACMEChallenges map[string]engine.ACMEChallenge
+	// ACMEOrderLocks holds the expiry times of the order locks, zero time if the lock does not expire
+	ACMEOrderLocks map[string]time.Time
+	acmeMtx        *sync.Mutex
+
 	Registry    *plugin.Registry
 	ChangesC    chan interface{}
 	ErrorsC     chan error
 	LogSeverity log.Severity
+
+	// revision is the last revision assigned to the upserted object
+	revision int64
 }
 
 func New(r *plugin.Registry) engine.Engine {
@@ -36,9 +48,14 @@ func New(r *plugin.Registry) engine.Engine {
 		Listeners:   map[engine.ListenerKey]engine.Listener{},
 		Middlewares: map[engine.FrontendKey][]engine.Middleware{},
 		Servers:     map[engine.BackendKey][]engine.Server{},
-		Registry:    r,
-		ChangesC:    make(chan interface{}, 1000),
-		ErrorsC:     make(chan error),
+
+		ACMEChallenges: map[string]engine.ACMEChallenge{},
+		ACMEOrderLocks: map[string]time.Time{},
+		acmeMtx:        &sync.Mutex{},
+
+		Registry: r,
+		ChangesC: make(chan interface{}, 1000),
+		ErrorsC:  make(chan error),
 	}
 }
 
@@ -49,6 +66,12 @@ func (m *Mem) emit(val interface{}) {
 	}
 }
 
+// nextRevision returns the revision of the upserted object
+func (m *Mem) nextRevision() int64 {
+	m.revision++
+	return m.revision
+}
+
 func (m *Mem) Close() {
 }
 
@@ -82,8 +105,14 @@ func (m *Mem) GetHost(k engine.HostKey) (*engine.Host, error) {
 }
 
 func (m *Mem) UpsertHost(h engine.Host) error {
-	m.Hosts[engine.HostKey{Name: h.Name}] = h
+	k := engine.HostKey{Name: h.Name}
+	if err := engine.CheckRevision(k, h.Revision, m.Hosts[k].Revision); err != nil {
+		return err
+	}
+	h.Revision = 0
 	m.emit(&engine.HostUpserted{Host: h})
+	h.Revision = m.nextRevision()
+	m.Hosts[k] = h
 	return nil
 }
 
@@ -113,10 +142,13 @@ func (m *Mem) GetListener(lk engine.ListenerKey) (*engine.Listener, error) {
 }
 
 func (m *Mem) UpsertListener(l engine.Listener) error {
-	defer func() {
-		m.emit(&engine.ListenerUpserted{Listener: l})
-	}()
 	lk := engine.ListenerKey{l.Id}
+	if err := engine.CheckRevision(lk, l.Revision, m.Listeners[lk].Revision); err != nil {
+		return err
+	}
+	l.Revision = 0
+	m.emit(&engine.ListenerUpserted{Listener: l})
+	l.Revision = m.nextRevision()
 	m.Listeners[lk] = l
 	return nil
 }
@@ -147,11 +179,19 @@ func (m *Mem) GetFrontend(k engine.FrontendKey) (*engine.Frontend, error) {
 }
 
 func (m *Mem) UpsertFrontend(f engine.Frontend, d time.Duration) error {
-	if _, ok := m.Backends[engine.BackendKey{Id: f.BackendId}]; !ok {
-		return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", f.BackendId)}
+	for _, b := range f.BackendRefs() {
+		if _, ok := m.Backends[engine.BackendKey{Id: b.Id}]; !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", b.Id)}
+		}
 	}
-	m.Frontends[engine.FrontendKey{Id: f.Id}] = f
+	fk := engine.FrontendKey{Id: f.Id}
+	if err := engine.CheckRevision(fk, f.Revision, m.Frontends[fk].Revision); err != nil {
+		return err
+	}
+	f.Revision = 0
 	m.emit(&engine.FrontendUpserted{Frontend: f})
+	f.Revision = m.nextRevision()
+	m.Frontends[fk] = f
 	return nil
 }
 
@@ -161,6 +201,7 @@ func (m *Mem) DeleteFrontend(fk engine.FrontendKey) error {
 	}
 	m.emit(&engine.FrontendDeleted{FrontendKey: fk})
 	delete(m.Frontends, fk)
+	delete(m.Middlewares, fk)
 	return nil
 }
 
@@ -189,22 +230,30 @@ func (m *Mem) UpsertMiddleware(fk engine.FrontendKey, md engine.Middleware, d ti
 	if _, ok := m.Frontends[fk]; !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("'%v' not found", fk)}
 	}
-	defer func() {
-		m.emit(&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: md})
-	}()
-	vals, ok := m.Middlewares[fk]
-	if !ok {
-		m.Middlewares[fk] = []engine.Middleware{md}
-		return nil
+	if m.Registry.GetSpec(md.Type) == nil {
+		return &engine.InvalidFormatError{Message: fmt.Sprintf("middleware of type %s is not supported", md.Type)}
 	}
-	for i, v := range vals {
-		if v.Id == md.Id {
-			vals[i] = md
-			return nil
-		}
+	vals := m.Middlewares[fk]
+	i := 0
+	for i < len(vals) && vals[i].Id != md.Id {
+		i++
+	}
+	var stored int64
+	if i < len(vals) {
+		stored = vals[i].Revision
+	}
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: md.Id}
+	if err := engine.CheckRevision(mk, md.Revision, stored); err != nil {
+		return err
+	}
+	md.Revision = 0
+	m.emit(&engine.MiddlewareUpserted{FrontendKey: fk, Middleware: md})
+	md.Revision = m.nextRevision()
+	if i < len(vals) {
+		vals[i] = md
+	} else {
+		m.Middlewares[fk] = append(vals, md)
 	}
-	vals = append(vals, md)
-	m.Middlewares[fk] = vals
 	return nil
 }
 
@@ -241,14 +290,20 @@ func (m *Mem) GetBackend(bk engine.BackendKey) (*engine.Backend, error) {
 }
 
 func (m *Mem) UpsertBackend(b engine.Backend) error {
+	bk := engine.BackendKey{Id: b.Id}
+	if err := engine.CheckRevision(bk, b.Revision, m.Backends[bk].Revision); err != nil {
+		return err
+	}
+	b.Revision = 0
 	m.emit(&engine.BackendUpserted{Backend: b})
-	m.Backends[engine.BackendKey{Id: b.Id}] = b
+	b.Revision = m.nextRevision()
+	m.Backends[bk] = b
 	return nil
 }
 
 func (m *Mem) DeleteBackend(bk engine.BackendKey) error {
 	for _, f := range m.Frontends {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk.Id) {
 			return fmt.Errorf("Backend is in use by %v", f)
 		}
 	}
@@ -257,6 +312,7 @@ func (m *Mem) DeleteBackend(bk engine.BackendKey) error {
 	}
 	m.emit(&engine.BackendDeleted{BackendKey: bk})
 	delete(m.Backends, bk)
+	delete(m.Servers, bk)
 	return nil
 }
 
@@ -282,21 +338,29 @@ func (m *Mem) GetServer(sk engine.ServerKey) (*engine.Server, error) {
 }
 
 func (m *Mem) UpsertServer(bk engine.BackendKey, srv engine.Server, d time.Duration) error {
-	defer func() {
-		m.emit(&engine.ServerUpserted{BackendKey: bk, Server: srv})
-	}()
-	vals, ok := m.Servers[bk]
-	if !ok {
-		m.Servers[bk] = []engine.Server{srv}
-		return nil
+	if _, ok := m.Backends[bk]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("'%v' not found", bk)}
 	}
-	for i, v := range vals {
-		if v.Id == srv.Id {
-			m.Servers[bk][i] = srv
-			return nil
-		}
+	vals := m.Servers[bk]
+	i := 0
+	for i < len(vals) && vals[i].Id != srv.Id {
+		i++
+	}
+	var stored int64
+	if i < len(vals) {
+		stored = vals[i].Revision
+	}
+	if err := engine.CheckRevision(engine.ServerKey{BackendKey: bk, Id: srv.Id}, srv.Revision, stored); err != nil {
+		return err
+	}
+	srv.Revision, srv.Expires = 0, nil
+	m.emit(&engine.ServerUpserted{BackendKey: bk, Server: srv})
+	srv.Revision = m.nextRevision()
+	if i < len(vals) {
+		vals[i] = srv
+	} else {
+		m.Servers[bk] = append(vals, srv)
 	}
-	m.Servers[bk] = append(vals, srv)
 	return nil
 }
 
@@ -316,6 +380,185 @@ func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	return &engine.NotFoundError{}
 }
 
+// Apply applies the changes to the copy of the configuration and replaces the configuration with the copy
+// only if all changes succeed
+func (m *Mem) Apply(cs engine.ChangeSet) error {
+	if err := cs.Check(); err != nil {
+		return err
+	}
+	c := m.copy()
+	c.ChangesC = make(chan interface{}, len(cs.Changes))
+	for i, ch := range cs.Changes {
+		if err := engine.ApplyChange(c, ch); err != nil {
+			return engine.ChangeError(i, ch, err)
+		}
+	}
+	changes := make([]interface{}, 0, len(c.ChangesC))
+	for len(c.ChangesC) != 0 {
+		changes = append(changes, <-c.ChangesC)
+	}
+	m.Hosts, m.Frontends, m.Backends, m.Listeners = c.Hosts, c.Frontends, c.Backends, c.Listeners
+	m.Middlewares, m.Servers = c.Middlewares, c.Servers
+	m.revision = c.revision
+	m.emit(&engine.ChangeSetApplied{Changes: changes})
+	return nil
+}
+
+// copy returns the deep copy of the configuration collecting its own changes
+func (m *Mem) copy() *Mem {
+	c := New(m.Registry).(*Mem)
+	c.revision = m.revision
+	for k, v := range m.Hosts {
+		c.Hosts[k] = v
+	}
+	for k, v := range m.Frontends {
+		c.Frontends[k] = v
+	}
+	for k, v := range m.Backends {
+		c.Backends[k] = v
+	}
+	for k, v := range m.Listeners {
+		c.Listeners[k] = v
+	}
+	for k, v := range m.Middlewares {
+		c.Middlewares[k] = append([]engine.Middleware{}, v...)
+	}
+	for k, v := range m.Servers {
+		c.Servers[k] = append([]engine.Server{}, v...)
+	}
+	return c
+}
+
+func (m *Mem) GetACMEAccountKey() ([]byte, error) {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	if m.ACMEAccountKey == nil {
+		return nil, &engine.NotFoundError{Message: "ACME account key not found"}
+	}
+	return m.ACMEAccountKey, nil
+}
+
+func (m *Mem) CreateACMEAccountKey(key []byte) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	if m.ACMEAccountKey != nil {
+		return &engine.AlreadyExistsError{Message: "ACME account key already exists"}
+	}
+	m.ACMEAccountKey = key
+	return nil
+}
+
+// UpsertACMEChallenge stores the challenge, challenges do not expire in memory
+func (m *Mem) UpsertACMEChallenge(ch engine.ACMEChallenge, ttl time.Duration) error {
+	if err := engine.CheckACMEToken(ch.Token); err != nil {
+		return err
+	}
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	m.ACMEChallenges[ch.Token] = ch
+	return nil
+}
+
+func (m *Mem) GetACMEChallenge(token string) (*engine.ACMEChallenge, error) {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	ch, ok := m.ACMEChallenges[token]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+	}
+	return &ch, nil
+}
+
+func (m *Mem) DeleteACMEChallenge(token string) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	if _, ok := m.ACMEChallenges[token]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("ACME challenge '%s' not found", token)}
+	}
+	delete(m.ACMEChallenges, token)
+	return nil
+}
+
+// CreateACMEOrderLock takes the lock unless it is held and has not expired yet
+func (m *Mem) CreateACMEOrderLock(domain string, ttl time.Duration) error {
+	if err := engine.CheckACMEDomain(domain); err != nil {
+		return err
+	}
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	now := time.Now().UTC()
+	if expires, ok := m.ACMEOrderLocks[domain]; ok && (expires.IsZero() || now.Before(expires)) {
+		return &engine.AlreadyExistsError{Message: fmt.Sprintf("ACME order lock '%s' already exists", domain)}
+	}
+	var expires time.Time
+	if ttl != 0 {
+		expires = now.Add(ttl)
+	}
+	m.ACMEOrderLocks[domain] = expires
+	return nil
+}
+
+func (m *Mem) DeleteACMEOrderLock(domain string) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+
+	if _, ok := m.ACMEOrderLocks[domain]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("ACME order lock '%s' not found", domain)}
+	}
+	delete(m.ACMEOrderLocks, domain)
+	return nil
+}
+
+// Copy reads the configuration from the engine into memory. Engines that can not apply the change set
+// atomically use the copy to check the whole change set before applying the changes one by one.
+// The objects keep the revisions of the engine, so the copy checks the expected revisions of the changes.
+func Copy(ng engine.Engine) (*Mem, error) {
+	m := New(ng.GetRegistry()).(*Mem)
+	hosts, err := ng.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		m.Hosts[engine.HostKey{Name: h.Name}] = h
+	}
+	ls, err := ng.GetListeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		m.Listeners[engine.ListenerKey{Id: l.Id}] = l
+	}
+	bs, err := ng.GetBackends()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bs {
+		bk := engine.BackendKey{Id: b.Id}
+		m.Backends[bk] = b
+		if m.Servers[bk], err = ng.GetServers(bk); err != nil {
+			return nil, err
+		}
+	}
+	fs, err := ng.GetFrontends()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		fk := engine.FrontendKey{Id: f.Id}
+		m.Frontends[fk] = f
+		if m.Middlewares[fk], err = ng.GetMiddlewares(fk); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
 func (m *Mem) Subscribe(changes chan interface{}, cancelC chan bool) error {
 	for {
 		select {
@@ -53,6 +53,14 @@ func (s *MemSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *MemSuite) TestHostWithHTTPSRedirect(c *C) {
+	s.suite.HostWithHTTPSRedirect(c)
+}
+
+func (s *MemSuite) TestHostWithAutoCert(c *C) {
+	s.suite.HostWithAutoCert(c)
+}
+
 func (s *MemSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -65,14 +73,42 @@ func (s *MemSuite) TestBackendCRUD(c *C) {
 	s.suite.BackendCRUD(c)
 }
 
+func (s *MemSuite) TestBackendWithTLSKeyPair(c *C) {
+	s.suite.BackendWithTLSKeyPair(c)
+}
+
 func (s *MemSuite) TestBackendDeleteUsed(c *C) {
 	s.suite.BackendDeleteUsed(c)
 }
 
+func (s *MemSuite) TestFrontendSplitBackends(c *C) {
+	s.suite.FrontendSplitBackends(c)
+}
+
 func (s *MemSuite) TestServerCRUD(c *C) {
 	s.suite.ServerCRUD(c)
 }
 
+func (s *MemSuite) TestServerWeight(c *C) {
+	s.suite.ServerWeight(c)
+}
+
+func (s *MemSuite) TestACMEAccountKey(c *C) {
+	s.suite.ACMEAccountKey(c)
+}
+
+func (s *MemSuite) TestACMEChallengeCRUD(c *C) {
+	s.suite.ACMEChallengeCRUD(c)
+}
+
+func (s *MemSuite) TestACMEOrderLock(c *C) {
+	s.suite.ACMEOrderLock(c)
+}
+
+func (s *MemSuite) TestACMEOrderLockExpire(c *C) {
+	s.suite.ACMEOrderLockExpire(c)
+}
+
 func (s *MemSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -92,3 +128,15 @@ func (s *MemSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *MemSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *MemSuite) TestChangeSetApply(c *C) {
+	s.suite.ChangeSetApply(c)
+}
+
+func (s *MemSuite) TestChangeSetFailed(c *C) {
+	s.suite.ChangeSetFailed(c)
+}
+
+func (s *MemSuite) TestRevisionConflict(c *C) {
+	s.suite.RevisionConflict(c)
+}
@@ -4,7 +4,10 @@ package engine
 import (
 	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -12,6 +15,7 @@ import (
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/stream"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/route"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
@@ -30,6 +34,18 @@ type StatsProvider interface {
 	// TopServers returns endpoints sorted by criteria (faulty, slow, mos used)
 	// if backendId is not empty, will filter out endpoints for that backendId
 	TopServers(*BackendKey) ([]Server, error)
+
+	// ServerHealth returns the result of active health checking of the server,
+	// returns nil if health checks are not enabled for the server's backend
+	ServerHealth(ServerKey) (*ServerHealth, error)
+
+	// ServerEjection returns the state of passive outlier ejection of the server,
+	// returns nil if the server has never been ejected or outlier detection is not enabled
+	ServerEjection(ServerKey) (*ServerEjection, error)
+
+	// ServerRampUp returns the state of the slow start of the server,
+	// returns nil if the server is at its full weight or slow start is not enabled
+	ServerRampUp(ServerKey) (*ServerRampUp, error)
 }
 
 type KeyPair struct {
@@ -54,6 +70,85 @@ func (c *KeyPair) Equals(o *KeyPair) bool {
 		subtle.ConstantTimeCompare(c.Key, o.Key) == 1
 }
 
+// CertificateInfo describes the certificate of the key pair
+type CertificateInfo struct {
+	Subject string
+	Issuer  string
+	// SANs are the subject alternative names: DNS names, IP addresses and emails
+	SANs      []string `json:",omitempty"`
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Certificates returns the parsed certificate chain, the certificate of the key pair goes first
+func (c *KeyPair) Certificates() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := c.Cert
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificates found")
+	}
+	return certs, nil
+}
+
+// Info returns the subject, issuer, alternative names and validity period of the certificate
+func (c *KeyPair) Info() (*CertificateInfo, error) {
+	certs, err := c.Certificates()
+	if err != nil {
+		return nil, err
+	}
+	cert := certs[0]
+	i := &CertificateInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	i.SANs = append(i.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		i.SANs = append(i.SANs, ip.String())
+	}
+	i.SANs = append(i.SANs, cert.EmailAddresses...)
+	return i, nil
+}
+
+// Check makes sure the private key matches the certificate, none of the certificates in the chain
+// has expired at the given time, and every certificate is signed by the next one in the chain
+func (c *KeyPair) Check(now time.Time) error {
+	if _, err := tls.X509KeyPair(c.Cert, c.Key); err != nil {
+		return err
+	}
+	certs, err := c.Certificates()
+	if err != nil {
+		return err
+	}
+	for i, cert := range certs {
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("certificate '%s' expired on %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+		}
+		if i+1 < len(certs) {
+			if err := cert.CheckSignatureFrom(certs[i+1]); err != nil {
+				return fmt.Errorf("certificate '%s' is not signed by '%s': %s", cert.Subject, certs[i+1].Subject, err)
+			}
+		}
+	}
+	return nil
+}
+
 type Address struct {
 	Network string
 	Address string
@@ -78,16 +173,32 @@ type Listener struct {
 	Scope string
 	// Settings provides listener-type specific settings, e.g. TLS settings for HTTPS listener
 	Settings *HTTPSListenerSettings `json:",omitempty"`
+	// TCP provides settings of the TCP listener
+	TCP *TCPListenerSettings `json:",omitempty"`
+	// ProxyProtocol accepts PROXY protocol headers from the load balancers in front of the listener
+	ProxyProtocol *ProxyProtocolSettings `json:",omitempty"`
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
 }
 
 func (l *Listener) TLSConfig() (*tls.Config, error) {
-	if l.Protocol != HTTPS {
-		return nil, fmt.Errorf("wrong listener proto: %v", l.Protocol)
-	}
-	if l.Settings == nil {
-		return NewTLSConfig(&TLSSettings{})
+	switch l.Protocol {
+	case HTTPS:
+		if l.Settings == nil {
+			return NewTLSConfig(&TLSSettings{})
+		}
+		return NewTLSConfig(&l.Settings.TLS)
+	case TCP:
+		if l.TCP != nil && l.TCP.TLS != nil {
+			return NewTLSConfig(l.TCP.TLS)
+		}
 	}
-	return NewTLSConfig(&l.Settings.TLS)
+	return nil, fmt.Errorf("%v does not terminate TLS", l)
+}
+
+// TerminatesTLS returns true if the listener accepts TLS connections
+func (l *Listener) TerminatesTLS() bool {
+	return l.Protocol == HTTPS || (l.Protocol == TCP && l.TCP != nil && l.TCP.TLS != nil)
 }
 
 func (l *Listener) String() string {
@@ -99,6 +210,9 @@ func (a *Address) Equals(o Address) bool {
 }
 
 func (l *Listener) SettingsEquals(o *Listener) bool {
+	if !l.TCP.Equals(o.TCP) || !l.ProxyProtocol.Equals(o.ProxyProtocol) {
+		return false
+	}
 	if l.Settings == nil && o.Settings == nil {
 		return true
 	}
@@ -106,11 +220,84 @@ func (l *Listener) SettingsEquals(o *Listener) bool {
 	if (ls == nil && os != nil) || (ls != nil && os == nil) {
 		return false
 	}
-	return (&os.TLS).Equals(&ls.TLS)
+	return (&os.TLS).Equals(&ls.TLS) &&
+		ls.HTTP2 == os.HTTP2 &&
+		ls.MaxConcurrentStreams == os.MaxConcurrentStreams &&
+		ls.ForwardClientCert == os.ForwardClientCert
 }
 
 type HTTPSListenerSettings struct {
 	TLS TLSSettings
+	// HTTP2 advertises h2 over ALPN and serves HTTP/2 clients
+	HTTP2 bool `json:",omitempty"`
+	// MaxConcurrentStreams limits the concurrent streams of a HTTP/2 connection, 0 means the default of 250
+	MaxConcurrentStreams int `json:",omitempty"`
+	// ForwardClientCert passes the subject and SANs of the verified client certificate to the servers
+	// in X-Client-Cert-Subject and X-Client-Cert-San headers
+	ForwardClientCert bool `json:",omitempty"`
+}
+
+// TCPListenerSettings are settings of the TCP listener. TCP listener forwards connections to the servers
+// of the backend, and optionally terminates TLS using key pairs of the hosts picked by SNI.
+type TCPListenerSettings struct {
+	BackendId string
+	// TLS terminates TLS connections if set
+	TLS *TLSSettings `json:",omitempty"`
+}
+
+func (s *TCPListenerSettings) Equals(o *TCPListenerSettings) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	if s.BackendId != o.BackendId {
+		return false
+	}
+	if s.TLS == nil || o.TLS == nil {
+		return s.TLS == o.TLS
+	}
+	return s.TLS.Equals(o.TLS)
+}
+
+// ProxyProtocolSettings turn on PROXY protocol v1 and v2, see http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+// Connections from the trusted sources have to start with the header, and the client address from the header is used
+// as the remote address. Connections from other sources are served as is.
+type ProxyProtocolSettings struct {
+	// TrustedCIDRs lists the networks allowed to send the header, e.g. 10.0.0.0/8
+	TrustedCIDRs []string
+}
+
+func (p *ProxyProtocolSettings) Equals(o *ProxyProtocolSettings) bool {
+	if p == nil || o == nil {
+		return p == o
+	}
+	if len(p.TrustedCIDRs) != len(o.TrustedCIDRs) {
+		return false
+	}
+	for i := range p.TrustedCIDRs {
+		if p.TrustedCIDRs[i] != o.TrustedCIDRs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ProxyProtocolNetworks returns the networks trusted to send PROXY protocol headers, or nil if PROXY protocol is turned off
+func (l *Listener) ProxyProtocolNetworks() ([]*net.IPNet, error) {
+	if l.ProxyProtocol == nil {
+		return nil, nil
+	}
+	if len(l.ProxyProtocol.TrustedCIDRs) == 0 {
+		return nil, fmt.Errorf("PROXY protocol needs at least one trusted CIDR")
+	}
+	nets := make([]*net.IPNet, len(l.ProxyProtocol.TrustedCIDRs))
+	for i, cidr := range l.ProxyProtocol.TrustedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CIDR: %s", err)
+		}
+		nets[i] = n
+	}
+	return nets, nil
 }
 
 // Sets up OCSP stapling, see http://en.wikipedia.org/wiki/OCSP_stapling
@@ -163,6 +350,68 @@ type HostSettings struct {
 	Default bool
 	KeyPair *KeyPair
 	OCSP    OCSPSettings
+	// HTTPSRedirect redirects requests to the host coming to http listeners to https
+	HTTPSRedirect *HTTPSRedirectSettings `json:",omitempty"`
+	// HSTS adds Strict-Transport-Security header to the responses served by https listeners
+	HSTS *HSTSSettings `json:",omitempty"`
+	// AutoCert obtains and renews the key pair of the host from the ACME certificate authority
+	AutoCert bool `json:",omitempty"`
+}
+
+// HTTPSRedirectSettings sets up redirects from http to https, e.g. http://example.com/a -> https://example.com/a
+type HTTPSRedirectSettings struct {
+	// Code is 301 (Moved Permanently) by default, or 308 (Permanent Redirect) that keeps the request method and body
+	Code int
+	// Port is the port of https listener, omitted in the redirect location if not set
+	Port int
+}
+
+func (r *HTTPSRedirectSettings) StatusCode() int {
+	if r.Code == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.Code
+}
+
+func (r *HTTPSRedirectSettings) validate() error {
+	if c := r.StatusCode(); c != http.StatusMovedPermanently && c != http.StatusPermanentRedirect {
+		return fmt.Errorf("unsupported redirect code %d, use 301 or 308", c)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid redirect port %d", r.Port)
+	}
+	return nil
+}
+
+// HSTSSettings is a Strict-Transport-Security policy, see https://tools.ietf.org/html/rfc6797
+type HSTSSettings struct {
+	// MaxAge is the time in seconds the browsers should access the host over https only
+	MaxAge            int
+	IncludeSubdomains bool
+	Preload           bool
+}
+
+// HeaderValue returns the value of Strict-Transport-Security header
+func (h *HSTSSettings) HeaderValue() string {
+	v := fmt.Sprintf("max-age=%d", h.MaxAge)
+	if h.IncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+func (h *HSTSSettings) validate() error {
+	if h.MaxAge <= 0 {
+		return fmt.Errorf("HSTS max age should be positive, got %d", h.MaxAge)
+	}
+	// Preload lists require the policy to cover subdomains
+	if h.Preload && !h.IncludeSubdomains {
+		return fmt.Errorf("HSTS preload requires subdomains to be included")
+	}
+	return nil
 }
 
 type HostKey struct {
@@ -178,12 +427,26 @@ func (h HostKey) String() string {
 type Host struct {
 	Name     string
 	Settings HostSettings
+	// Certificate describes the certificate of the host key pair, it is filled in by the API and is not stored
+	Certificate *CertificateInfo `json:",omitempty"`
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
 }
 
 func NewHost(name string, settings HostSettings) (*Host, error) {
 	if name == "" {
 		return nil, fmt.Errorf("Hostname can not be empty")
 	}
+	if settings.HTTPSRedirect != nil {
+		if err := settings.HTTPSRedirect.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.HSTS != nil {
+		if err := settings.HSTS.validate(); err != nil {
+			return nil, err
+		}
+	}
 	return &Host{
 		Name:     name,
 		Settings: settings,
@@ -204,9 +467,66 @@ type Frontend struct {
 	Route     string
 	Type      string
 	BackendId string
+	// Backends optionally splits the traffic across several backends, BackendId is set to the first backend in the list
+	Backends []WeightedBackend `json:",omitempty"`
 
 	Stats    *RoundTripStats `json:",omitempty"`
 	Settings interface{}     `json:",omitempty"`
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
+}
+
+// WeightedBackend is a backend that receives a percentage of the frontend's traffic
+type WeightedBackend struct {
+	Id string
+	// Weight is a percentage of the traffic in range 0-100
+	Weight int
+}
+
+// SetBackends splits the frontend's traffic across several backends, weights should add up to 100
+func (f *Frontend) SetBackends(bs []WeightedBackend) error {
+	if len(bs) == 0 {
+		return fmt.Errorf("supply at least one backend")
+	}
+	total := 0
+	seen := make(map[string]bool, len(bs))
+	for _, b := range bs {
+		if b.Id == "" {
+			return fmt.Errorf("backend id can not be empty")
+		}
+		if seen[b.Id] {
+			return fmt.Errorf("duplicate backend %s", b.Id)
+		}
+		seen[b.Id] = true
+		if b.Weight < 0 || b.Weight > 100 {
+			return fmt.Errorf("backend %s weight should be in range 0-100, got %d", b.Id, b.Weight)
+		}
+		total += b.Weight
+	}
+	if total != 100 {
+		return fmt.Errorf("backend weights should add up to 100, got %d", total)
+	}
+	f.BackendId = bs[0].Id
+	f.Backends = bs
+	return nil
+}
+
+// BackendRefs returns all backends used by the frontend with their weights
+func (f *Frontend) BackendRefs() []WeightedBackend {
+	if len(f.Backends) == 0 {
+		return []WeightedBackend{{Id: f.BackendId, Weight: 100}}
+	}
+	return f.Backends
+}
+
+// UsesBackend returns true if the frontend sends traffic to the backend
+func (f *Frontend) UsesBackend(id string) bool {
+	for _, b := range f.BackendRefs() {
+		if b.Id == id {
+			return true
+		}
+	}
+	return false
 }
 
 // Limits contains various limits one can supply for a location.
@@ -215,10 +535,24 @@ type HTTPFrontendLimits struct {
 	MaxBodyBytes    int64 // Maximum size of a request body in bytes
 }
 
+// HTTPFrontendTimeouts limit the time the frontend spends on the request, timed out requests
+// get 504 response, while other network errors get 502, so the failover predicate can tell
+// them apart with ResponseCode() == 504
+type HTTPFrontendTimeouts struct {
+	// Request is the total deadline of the request including failover attempts, e.g. '30s'
+	Request string `json:",omitempty"`
+	// ResponseHeader is the time to wait for the server response headers in every attempt
+	ResponseHeader string `json:",omitempty"`
+	// Body of the 504 response sent on timeout, status text by default
+	Body string `json:",omitempty"`
+}
+
 // Additional options to control this location, such as timeouts
 type HTTPFrontendSettings struct {
 	// Limits contains various limits one can supply for a location.
 	Limits HTTPFrontendLimits
+	// Timeouts override the backend timeouts for this frontend
+	Timeouts HTTPFrontendTimeouts
 	// Predicate that defines when requests are allowed to failover
 	FailoverPredicate string
 	// Used in forwarding headers
@@ -244,8 +578,11 @@ func NewAddress(network, address string) (*Address, error) {
 
 func NewListener(id, protocol, network, address, scope string, settings *HTTPSListenerSettings) (*Listener, error) {
 	protocol = strings.ToLower(protocol)
+	if protocol == TCP {
+		return nil, fmt.Errorf("tcp listener needs a backend, use NewTCPListener")
+	}
 	if protocol != HTTP && protocol != HTTPS {
-		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http and https", protocol)
+		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http, https and tcp", protocol)
 	}
 
 	if scope != "" {
@@ -259,6 +596,10 @@ func NewListener(id, protocol, network, address, scope string, settings *HTTPSLi
 		return nil, err
 	}
 
+	if settings != nil && settings.MaxConcurrentStreams < 0 {
+		return nil, fmt.Errorf("max concurrent streams should be >= 0, got %d", settings.MaxConcurrentStreams)
+	}
+
 	return &Listener{
 		Scope:    scope,
 		Id:       id,
@@ -268,6 +609,30 @@ func NewListener(id, protocol, network, address, scope string, settings *HTTPSLi
 	}, nil
 }
 
+// NewTCPListener returns a listener that forwards connections to the servers of the backend
+func NewTCPListener(id, network, address string, settings TCPListenerSettings) (*Listener, error) {
+	if settings.BackendId == "" {
+		return nil, fmt.Errorf("supply valid backendId")
+	}
+	if settings.TLS != nil {
+		if _, err := NewTLSConfig(settings.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	a, err := NewAddress(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{
+		Id:       id,
+		Address:  *a,
+		Protocol: TCP,
+		TCP:      &settings,
+	}, nil
+}
+
 func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr string, settings HTTPFrontendSettings) (*Frontend, error) {
 	if len(id) == 0 || len(backendId) == 0 {
 		return nil, fmt.Errorf("supply valid  route, id, and backendId")
@@ -282,6 +647,10 @@ func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr strin
 		return nil, fmt.Errorf("invalid failover predicate: %s", settings.FailoverPredicate)
 	}
 
+	if _, err := frontendTimeoutSettings(settings); err != nil {
+		return nil, err
+	}
+
 	return &Frontend{
 		Id:        id,
 		BackendId: backendId,
@@ -298,11 +667,36 @@ func (f *Frontend) HTTPSettings() HTTPFrontendSettings {
 func (l HTTPFrontendSettings) Equals(o HTTPFrontendSettings) bool {
 	return (l.Limits.MaxMemBodyBytes == o.Limits.MaxMemBodyBytes &&
 		l.Limits.MaxBodyBytes == o.Limits.MaxBodyBytes &&
+		l.Timeouts == o.Timeouts &&
 		l.FailoverPredicate == o.FailoverPredicate &&
 		l.Hostname == o.Hostname &&
 		l.TrustForwardHeader == o.TrustForwardHeader)
 }
 
+// TimeoutSettings returns parsed frontend timeouts, zero timeouts are not enforced
+func (f *Frontend) TimeoutSettings() (*FrontendTimeoutSettings, error) {
+	return frontendTimeoutSettings(f.HTTPSettings())
+}
+
+func frontendTimeoutSettings(s HTTPFrontendSettings) (*FrontendTimeoutSettings, error) {
+	t := &FrontendTimeoutSettings{Body: s.Timeouts.Body}
+	var err error
+	if s.Timeouts.Request != "" {
+		if t.Request, err = time.ParseDuration(s.Timeouts.Request); err != nil {
+			return nil, fmt.Errorf("invalid request timeout: %s", err)
+		}
+	}
+	if s.Timeouts.ResponseHeader != "" {
+		if t.ResponseHeader, err = time.ParseDuration(s.Timeouts.ResponseHeader); err != nil {
+			return nil, fmt.Errorf("invalid response header timeout: %s", err)
+		}
+	}
+	if t.Request < 0 || t.ResponseHeader < 0 {
+		return nil, fmt.Errorf("timeouts should be >= 0, got request %v, response header %v", t.Request, t.ResponseHeader)
+	}
+	return t, nil
+}
+
 func (f *Frontend) String() string {
 	return fmt.Sprintf("Frontend(%v, %v, %v)", f.Type, f.Id, f.BackendId)
 }
@@ -331,6 +725,41 @@ type HTTPBackendKeepAlive struct {
 	MaxIdleConnsPerHost int
 }
 
+// HTTPBackendHealthCheck sets up active health checking of the backend servers
+type HTTPBackendHealthCheck struct {
+	// Path that will be requested on every server, e.g. "/health"
+	Path string
+	// Interval between the checks, 10 seconds by default
+	Interval string
+	// Timeout of a single check, 2 seconds by default
+	Timeout string
+	// Response codes that mark the check as passed, 200 by default
+	ExpectedCodes []int
+	// How many consecutive passed checks will bring the server back into rotation
+	HealthyThreshold int
+	// How many consecutive failed checks will take the server out of rotation
+	UnhealthyThreshold int
+}
+
+func (h *HTTPBackendHealthCheck) Equals(o *HTTPBackendHealthCheck) bool {
+	if h.Path != o.Path ||
+		h.Interval != o.Interval ||
+		h.Timeout != o.Timeout ||
+		h.HealthyThreshold != o.HealthyThreshold ||
+		h.UnhealthyThreshold != o.UnhealthyThreshold {
+		return false
+	}
+	if len(h.ExpectedCodes) != len(o.ExpectedCodes) {
+		return false
+	}
+	for i := range h.ExpectedCodes {
+		if h.ExpectedCodes[i] != o.ExpectedCodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type HTTPBackendSettings struct {
 	// Timeouts provides timeout settings for backend servers
 	Timeouts HTTPBackendTimeouts
@@ -338,6 +767,22 @@ type HTTPBackendSettings struct {
 	KeepAlive HTTPBackendKeepAlive
 	// TLS provides optional TLS settings for HTTP backend
 	TLS *TLSSettings `json:",omitempty"`
+	// HTTP2 allows HTTP/2 to the servers that support it, requires TLS
+	HTTP2 bool `json:",omitempty"`
+	// HealthCheck turns on optional active health checking of the backend servers
+	HealthCheck *HTTPBackendHealthCheck `json:",omitempty"`
+	// LoadBalancer selects the algorithm distributing requests across the backend servers, round robin by default
+	LoadBalancer *HTTPBackendLoadBalancer `json:",omitempty"`
+	// StickySession turns on optional cookie based session affinity
+	StickySession *HTTPBackendStickySession `json:",omitempty"`
+	// OutlierDetection turns on optional passive ejection of the servers that stand out by errors or latency
+	OutlierDetection *HTTPBackendOutlierDetection `json:",omitempty"`
+	// SlowStart is a duration, e.g. '30s', during which new servers and servers returning into rotation
+	// ramp up linearly to their full weight, empty value turns slow start off
+	SlowStart string `json:",omitempty"`
+	// ProxyProtocol sends PROXY protocol header of the version, either 'v1' or 'v2', to the servers
+	// on every connection forwarded by TCP listeners, empty value turns it off
+	ProxyProtocol string `json:",omitempty"`
 }
 
 func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
@@ -347,7 +792,18 @@ func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
 		s.KeepAlive.Period == o.KeepAlive.Period &&
 		s.KeepAlive.MaxIdleConnsPerHost == o.KeepAlive.MaxIdleConnsPerHost &&
 		((s.TLS == nil && o.TLS == nil) ||
-			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS))))
+			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS))) &&
+		s.HTTP2 == o.HTTP2 &&
+		((s.HealthCheck == nil && o.HealthCheck == nil) ||
+			((s.HealthCheck != nil && o.HealthCheck != nil) && s.HealthCheck.Equals(o.HealthCheck))) &&
+		((s.LoadBalancer == nil && o.LoadBalancer == nil) ||
+			((s.LoadBalancer != nil && o.LoadBalancer != nil) && *s.LoadBalancer == *o.LoadBalancer)) &&
+		((s.StickySession == nil && o.StickySession == nil) ||
+			((s.StickySession != nil && o.StickySession != nil) && *s.StickySession == *o.StickySession)) &&
+		((s.OutlierDetection == nil && o.OutlierDetection == nil) ||
+			((s.OutlierDetection != nil && o.OutlierDetection != nil) && *s.OutlierDetection == *o.OutlierDetection)) &&
+		s.SlowStart == o.SlowStart &&
+		s.ProxyProtocol == o.ProxyProtocol)
 }
 
 type MiddlewareKey struct {
@@ -365,6 +821,40 @@ type Middleware struct {
 	Priority   int
 	Type       string
 	Middleware plugin.Middleware
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
+}
+
+// HTTPBackendLoadBalancer selects the load balancing algorithm of the backend
+type HTTPBackendLoadBalancer struct {
+	// Algorithm is one of "roundrobin", "leastconn" or "consistenthash"
+	Algorithm string
+	// HashVariable is used by consistent hashing to pick the server, e.g. 'client.ip' or 'request.header.X-User'
+	HashVariable string `json:",omitempty"`
+}
+
+// HTTPBackendStickySession pins clients to servers using a cookie naming the backend and the server
+type HTTPBackendStickySession struct {
+	// CookieName is the name of the cookie, "vulcand_server" by default
+	CookieName string
+	// TTL sets cookie max age, if empty the cookie lasts until the browser session ends
+	TTL string `json:",omitempty"`
+	// Secure and HTTPOnly set the corresponding cookie flags
+	Secure   bool
+	HTTPOnly bool
+}
+
+// HTTPBackendOutlierDetection sets up passive outlier detection, servers marked bad by the anomaly detector
+// are temporarily ejected from load balancers
+type HTTPBackendOutlierDetection struct {
+	// Interval between the detections, 10 seconds by default
+	Interval string
+	// BaseEjectionTime is doubled for every consecutive ejection of the server, 30 seconds by default
+	BaseEjectionTime string
+	// MaxEjectionTime caps the ejection time, 5 minutes by default
+	MaxEjectionTime string
+	// MaxEjectionPercent caps the share of the backend servers ejected at once, 50 by default
+	MaxEjectionPercent int
 }
 
 // Backend is a collection of endpoints. Each location is assigned an backend. Changing assigned backend
@@ -374,6 +864,8 @@ type Backend struct {
 	Type     string
 	Stats    *RoundTripStats `json:",omitempty"`
 	Settings interface{}
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
 }
 
 // NewBackend creates a new instance of the backend object
@@ -381,6 +873,24 @@ func NewHTTPBackend(id string, s HTTPBackendSettings) (*Backend, error) {
 	if _, err := transportSettings(s); err != nil {
 		return nil, err
 	}
+	if _, err := healthCheckSettings(s); err != nil {
+		return nil, err
+	}
+	if _, err := loadBalancerSettings(s); err != nil {
+		return nil, err
+	}
+	if _, err := stickySessionSettings(s); err != nil {
+		return nil, err
+	}
+	if _, err := outlierDetectionSettings(s); err != nil {
+		return nil, err
+	}
+	if _, err := slowStart(s); err != nil {
+		return nil, err
+	}
+	if _, err := proxyProtocolVersion(s); err != nil {
+		return nil, err
+	}
 	return &Backend{
 		Id:       id,
 		Type:     HTTP,
@@ -443,14 +953,292 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 		}
 		t.TLS = config
 	}
+	if s.HTTP2 && s.TLS == nil {
+		return nil, fmt.Errorf("HTTP/2 to the servers requires TLS settings")
+	}
+	t.HTTP2 = s.HTTP2
 	return t, nil
 }
 
+// LoadBalancerSettings returns validated load balancer settings with defaults applied
+func (b *Backend) LoadBalancerSettings() (*LoadBalancerSettings, error) {
+	return loadBalancerSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func loadBalancerSettings(s HTTPBackendSettings) (*LoadBalancerSettings, error) {
+	if s.LoadBalancer == nil {
+		return &LoadBalancerSettings{Algorithm: LBRoundRobin}, nil
+	}
+	l := &LoadBalancerSettings{
+		Algorithm:    s.LoadBalancer.Algorithm,
+		HashVariable: s.LoadBalancer.HashVariable,
+	}
+	switch l.Algorithm {
+	case "":
+		l.Algorithm = LBRoundRobin
+	case LBRoundRobin, LBLeastConn:
+	case LBConsistentHash:
+		if _, err := utils.NewExtractor(l.HashVariable); err != nil {
+			return nil, fmt.Errorf("invalid hash variable: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported load balancing algorithm: '%s'", l.Algorithm)
+	}
+	if l.Algorithm != LBConsistentHash && l.HashVariable != "" {
+		return nil, fmt.Errorf("hash variable is only supported by %s", LBConsistentHash)
+	}
+	return l, nil
+}
+
+// StickySessionSettings returns parsed sticky session settings, or nil if sticky sessions are turned off
+func (b *Backend) StickySessionSettings() (*StickySessionSettings, error) {
+	return stickySessionSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func stickySessionSettings(s HTTPBackendSettings) (*StickySessionSettings, error) {
+	if s.StickySession == nil {
+		return nil, nil
+	}
+	ss := s.StickySession
+	st := &StickySessionSettings{
+		CookieName: ss.CookieName,
+		Secure:     ss.Secure,
+		HTTPOnly:   ss.HTTPOnly,
+	}
+	if st.CookieName == "" {
+		st.CookieName = DefaultStickyCookieName
+	}
+	if strings.ContainsAny(st.CookieName, " \t\r\n;,=\"") {
+		return nil, fmt.Errorf("invalid cookie name: '%s'", st.CookieName)
+	}
+	if ss.TTL != "" {
+		var err error
+		if st.TTL, err = time.ParseDuration(ss.TTL); err != nil {
+			return nil, fmt.Errorf("invalid sticky session ttl: %s", err)
+		}
+		if st.TTL < time.Second {
+			return nil, fmt.Errorf("sticky session ttl should be at least one second, got %v", st.TTL)
+		}
+	}
+	return st, nil
+}
+
+// SlowStart returns the duration of the servers ramp up, 0 if slow start is turned off
+func (b *Backend) SlowStart() (time.Duration, error) {
+	return slowStart(b.Settings.(HTTPBackendSettings))
+}
+
+func slowStart(s HTTPBackendSettings) (time.Duration, error) {
+	if s.SlowStart == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s.SlowStart)
+	if err != nil {
+		return 0, fmt.Errorf("invalid slow start: %s", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("slow start should be >= 0, got %v", d)
+	}
+	return d, nil
+}
+
+// ProxyProtocolVersion returns the version of PROXY protocol headers sent to the servers, 0 if it's turned off
+func (b *Backend) ProxyProtocolVersion() (int, error) {
+	return proxyProtocolVersion(b.Settings.(HTTPBackendSettings))
+}
+
+func proxyProtocolVersion(s HTTPBackendSettings) (int, error) {
+	switch s.ProxyProtocol {
+	case "":
+		return 0, nil
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unsupported PROXY protocol version '%s', supported versions are v1 and v2", s.ProxyProtocol)
+}
+
+// OutlierDetectionSettings returns parsed outlier detection settings, or nil if outlier detection is turned off
+func (b *Backend) OutlierDetectionSettings() (*OutlierDetectionSettings, error) {
+	return outlierDetectionSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func outlierDetectionSettings(s HTTPBackendSettings) (*OutlierDetectionSettings, error) {
+	if s.OutlierDetection == nil {
+		return nil, nil
+	}
+	od := s.OutlierDetection
+	o := &OutlierDetectionSettings{
+		Interval:           DefaultOutlierDetectionInterval,
+		BaseEjectionTime:   DefaultBaseEjectionTime,
+		MaxEjectionTime:    DefaultMaxEjectionTime,
+		MaxEjectionPercent: od.MaxEjectionPercent,
+	}
+	var err error
+	if od.Interval != "" {
+		if o.Interval, err = time.ParseDuration(od.Interval); err != nil {
+			return nil, fmt.Errorf("invalid outlier detection interval: %s", err)
+		}
+	}
+	if od.BaseEjectionTime != "" {
+		if o.BaseEjectionTime, err = time.ParseDuration(od.BaseEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid base ejection time: %s", err)
+		}
+	}
+	if od.MaxEjectionTime != "" {
+		if o.MaxEjectionTime, err = time.ParseDuration(od.MaxEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid max ejection time: %s", err)
+		}
+	}
+	if o.Interval <= 0 || o.BaseEjectionTime <= 0 {
+		return nil, fmt.Errorf("outlier detection interval and base ejection time should be > 0")
+	}
+	if o.MaxEjectionTime < o.BaseEjectionTime {
+		return nil, fmt.Errorf("max ejection time %v should be >= base ejection time %v", o.MaxEjectionTime, o.BaseEjectionTime)
+	}
+	if o.MaxEjectionPercent < 0 || o.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max ejection percent should be in range [0, 100], got %d", o.MaxEjectionPercent)
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+	return o, nil
+}
+
+// HealthCheckSettings returns parsed health check settings, or nil if health checks are turned off
+func (b *Backend) HealthCheckSettings() (*HealthCheckSettings, error) {
+	return healthCheckSettings(b.Settings.(HTTPBackendSettings))
+}
+
+func healthCheckSettings(s HTTPBackendSettings) (*HealthCheckSettings, error) {
+	if s.HealthCheck == nil {
+		return nil, nil
+	}
+	hc := s.HealthCheck
+	if !strings.HasPrefix(hc.Path, "/") {
+		return nil, fmt.Errorf("health check path should start with '/', got '%s'", hc.Path)
+	}
+	h := &HealthCheckSettings{
+		Path:               hc.Path,
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            DefaultHealthCheckTimeout,
+		ExpectedCodes:      hc.ExpectedCodes,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+	}
+	var err error
+	if len(hc.Interval) != 0 {
+		if h.Interval, err = time.ParseDuration(hc.Interval); err != nil {
+			return nil, fmt.Errorf("invalid health check interval: %s", err)
+		}
+	}
+	if len(hc.Timeout) != 0 {
+		if h.Timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid health check timeout: %s", err)
+		}
+	}
+	if h.Interval <= 0 || h.Timeout <= 0 {
+		return nil, fmt.Errorf("health check interval and timeout should be > 0")
+	}
+	if h.Timeout > h.Interval {
+		return nil, fmt.Errorf("health check timeout(%s) should not exceed interval(%s)", h.Timeout, h.Interval)
+	}
+	if len(h.ExpectedCodes) == 0 {
+		h.ExpectedCodes = []int{http.StatusOK}
+	}
+	for _, code := range h.ExpectedCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid expected health check code: %d", code)
+		}
+	}
+	if h.HealthyThreshold < 0 || h.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check thresholds should be >= 0")
+	}
+	if h.HealthyThreshold == 0 {
+		h.HealthyThreshold = DefaultHealthyThreshold
+	}
+	if h.UnhealthyThreshold == 0 {
+		h.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	return h, nil
+}
+
 // Server is a final destination of the request
 type Server struct {
-	Id    string
-	URL   string
-	Stats *RoundTripStats `json:",omitempty"`
+	Id  string
+	URL string
+	// Weight is a relative share of the traffic the server gets compared to other servers of the backend,
+	// 0 means default weight
+	Weight int `json:",omitempty"`
+	// State is an administrative state of the server, empty state means active
+	State    string          `json:",omitempty"`
+	Stats    *RoundTripStats `json:",omitempty"`
+	Health   *ServerHealth   `json:",omitempty"`
+	Ejection *ServerEjection `json:",omitempty"`
+	RampUp   *ServerRampUp   `json:",omitempty"`
+	// Revision is the revision of the stored object, see RevisionConflictError
+	Revision int64 `json:",omitempty"`
+	// Expires is the time the server upserted with TTL expires at, nil means the server is permanent.
+	// It is set by Engine.GetServer and is never stored.
+	Expires *time.Time `json:"-"`
+}
+
+const (
+	// ServerStateActive server receives requests
+	ServerStateActive = "active"
+	// ServerStateDraining server receives no new requests or sticky sessions, but in-flight requests, tunnels
+	// and the sticky sessions pinned to the server are allowed to finish
+	ServerStateDraining = "draining"
+	// ServerStateDisabled server is out of rotation, its sticky sessions are re-balanced and its tunnels are closed,
+	// in-flight requests are allowed to finish
+	ServerStateDisabled = "disabled"
+)
+
+// ServerHealth is the state of the server as seen by the active health checks
+type ServerHealth struct {
+	Healthy bool
+	// Last time the server has been checked
+	LastCheck time.Time
+	// Error returned by the last failed check
+	LastError string `json:",omitempty"`
+	// Consecutive passed checks
+	Successes int
+	// Consecutive failed checks
+	Failures int
+}
+
+func (h *ServerHealth) String() string {
+	if h.Healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// ServerEjection is the state of the server as seen by the passive outlier detection
+type ServerEjection struct {
+	Ejected bool
+	// Time when the ejected server returns into rotation
+	Until time.Time
+	// Recent ejections of the server, every consecutive ejection doubles ejection time
+	Ejections int
+	// Anomalies that caused the last ejection
+	Anomalies []Anomaly `json:",omitempty"`
+}
+
+func (e *ServerEjection) String() string {
+	if e.Ejected {
+		return "ejected"
+	}
+	return "admitted"
+}
+
+// ServerRampUp is the state of the server ramping up to its full weight after getting into rotation
+type ServerRampUp struct {
+	// Time when the server reaches its full weight
+	Until time.Time
+	// Weight the load balancer currently uses for the server, grows linearly up to the server weight
+	Weight float64
 }
 
 func NewServer(id, u string) (*Server, error) {
@@ -464,7 +1252,52 @@ func NewServer(id, u string) (*Server, error) {
 }
 
 func (e *Server) String() string {
-	return fmt.Sprintf("HTTPServer(%s, %s, %s)", e.Id, e.URL, e.Stats)
+	return fmt.Sprintf("HTTPServer(%s, %s, weight=%d, state=%s, %s)", e.Id, e.URL, e.Weight, e.GetState(), e.Stats)
+}
+
+// SetState sets the administrative state of the server
+func (e *Server) SetState(state string) error {
+	switch state {
+	case "", ServerStateActive, ServerStateDraining, ServerStateDisabled:
+		e.State = state
+		return nil
+	}
+	return fmt.Errorf("unsupported server state '%s', supported states are active, draining and disabled", state)
+}
+
+// GetState returns the administrative state of the server
+func (e *Server) GetState() string {
+	if e.State == "" {
+		return ServerStateActive
+	}
+	return e.State
+}
+
+// IsActive returns true if the server should receive new requests
+func (e *Server) IsActive() bool {
+	return e.GetState() == ServerStateActive
+}
+
+// ServesSessions returns true if the server should keep serving the sticky sessions pinned to it
+func (e *Server) ServesSessions() bool {
+	return e.GetState() != ServerStateDisabled
+}
+
+// SetWeight sets the relative weight of the server, 0 sets the default weight
+func (e *Server) SetWeight(w int) error {
+	if w < 0 {
+		return fmt.Errorf("server weight should be >= 0, got %d", w)
+	}
+	e.Weight = w
+	return nil
+}
+
+// EffectiveWeight returns the weight the load balancer should use for the server
+func (e *Server) EffectiveWeight() int {
+	if e.Weight == 0 {
+		return DefaultServerWeight
+	}
+	return e.Weight
 }
 
 func (e *Server) GetId() string {
@@ -491,6 +1324,8 @@ type RoundTripStats struct {
 	Verdict         Verdict
 	Counters        Counters
 	LatencyBrackets LatencyBrackets
+	// InFlight is the amount of requests that are currently in flight, reported for servers only
+	InFlight int64 `json:",omitempty"`
 }
 
 func NewRoundTripStats(m *memmetrics.RTMetrics) (*RoundTripStats, error) {
@@ -605,6 +1440,44 @@ func (n *InvalidFormatError) Error() string {
 	}
 }
 
+// ACMEChallenge is the key authorization of the pending ACME HTTP-01 challenge, served to the certificate
+// authority at /.well-known/acme-challenge/<token>
+type ACMEChallenge struct {
+	Token            string
+	KeyAuthorization string
+}
+
+// CheckACMEToken returns error if the challenge token is not URL safe base64, tokens are used in the keys and paths
+func CheckACMEToken(token string) error {
+	if token == "" {
+		return &InvalidFormatError{Message: "ACME challenge token can not be empty"}
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return &InvalidFormatError{Message: fmt.Sprintf("ACME challenge token '%s' is not URL safe base64", token)}
+		}
+	}
+	return nil
+}
+
+// CheckACMEDomain returns error if the domain is not a valid host name, domains are used in the keys and paths
+func CheckACMEDomain(domain string) error {
+	if domain == "" {
+		return &InvalidFormatError{Message: "ACME domain can not be empty"}
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return &InvalidFormatError{Message: fmt.Sprintf("ACME domain '%s' has empty label", domain)}
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return &InvalidFormatError{Message: fmt.Sprintf("ACME domain '%s' is not a valid host name", domain)}
+			}
+		}
+	}
+	return nil
+}
+
 type AlreadyExistsError struct {
 	Message string
 }
@@ -613,6 +1486,35 @@ func (n *AlreadyExistsError) Error() string {
 	return n.Message
 }
 
+// RevisionConflictError is returned by the upserts of the objects with non zero Revision, in case if the stored
+// object has a different revision or does not exist. Revisions are set by the engine getters and change with
+// every write of the object, so the object read, modified and upserted back is not written over the concurrent
+// changes. Objects with zero revision are written regardless of the stored revision. Revisions are only
+// comparable within the same engine and are not part of the change events.
+type RevisionConflictError struct {
+	Message string
+}
+
+func (n *RevisionConflictError) Error() string {
+	if n.Message != "" {
+		return n.Message
+	} else {
+		return "Revision conflict"
+	}
+}
+
+// CheckRevision returns RevisionConflictError if the expected revision is set and does not match the revision
+// of the stored object, stored revision is 0 if the object does not exist
+func CheckRevision(key interface{}, expected, stored int64) error {
+	switch {
+	case expected == 0 || expected == stored:
+		return nil
+	case stored == 0:
+		return &RevisionConflictError{Message: fmt.Sprintf("%v does not exist, expected revision %d", key, expected)}
+	}
+	return &RevisionConflictError{Message: fmt.Sprintf("%v has revision %d, expected revision %d", key, stored, expected)}
+}
+
 type Counters struct {
 	Period      time.Duration
 	NetErrors   int64
@@ -712,4 +1614,64 @@ type TransportSettings struct {
 	Timeouts  TransportTimeouts
 	KeepAlive TransportKeepAlive
 	TLS       *tls.Config
+	HTTP2     bool
+}
+
+type FrontendTimeoutSettings struct {
+	Request        time.Duration
+	ResponseHeader time.Duration
+	Body           string
 }
+
+type HealthCheckSettings struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedCodes      []int
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+const DefaultServerWeight = 1
+
+// Supported load balancing algorithms
+const (
+	LBRoundRobin     = "roundrobin"
+	LBLeastConn      = "leastconn"
+	LBConsistentHash = "consistenthash"
+)
+
+type LoadBalancerSettings struct {
+	Algorithm    string
+	HashVariable string
+}
+
+const DefaultStickyCookieName = "vulcand_server"
+
+const (
+	DefaultOutlierDetectionInterval = 10 * time.Second
+	DefaultBaseEjectionTime         = 30 * time.Second
+	DefaultMaxEjectionTime          = 5 * time.Minute
+	DefaultMaxEjectionPercent       = 50
+)
+
+type OutlierDetectionSettings struct {
+	Interval           time.Duration
+	BaseEjectionTime   time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+}
+
+type StickySessionSettings struct {
+	CookieName string
+	TTL        time.Duration
+	Secure     bool
+	HTTPOnly   bool
+}
+
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultHealthyThreshold    = 2
+	DefaultUnhealthyThreshold  = 3
+)
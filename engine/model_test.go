@@ -1,8 +1,17 @@
 package engine
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -33,6 +42,91 @@ func (s *BackendSuite) TestHostBad(c *C) {
 	c.Assert(h, IsNil)
 }
 
+func (s *BackendSuite) TestKeyPairInfo(c *C) {
+	ca := issueTestKeyPair(c, nil, "CA", time.Now().Add(time.Hour))
+	kp := issueTestKeyPair(c, ca, "server", time.Now().Add(time.Hour))
+
+	i, err := kp.Info()
+	c.Assert(err, IsNil)
+	c.Assert(i.Subject, Equals, "CN=server")
+	c.Assert(i.Issuer, Equals, "CN=CA")
+	c.Assert(i.SANs, DeepEquals, []string{"example.com", "127.0.0.1"})
+	c.Assert(i.NotAfter.After(time.Now()), Equals, true)
+
+	_, err = (&KeyPair{Cert: []byte("bad"), Key: kp.Key}).Info()
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestKeyPairCheck(c *C) {
+	ca := issueTestKeyPair(c, nil, "CA", time.Now().Add(time.Hour))
+	kp := issueTestKeyPair(c, ca, "server", time.Now().Add(time.Hour))
+	other := issueTestKeyPair(c, nil, "other CA", time.Now().Add(time.Hour))
+
+	c.Assert(kp.Check(time.Now()), IsNil)
+
+	chain := &KeyPair{Cert: append(append([]byte{}, kp.Cert...), ca.Cert...), Key: kp.Key}
+	c.Assert(chain.Check(time.Now()), IsNil)
+
+	// Expired certificate
+	c.Assert(kp.Check(time.Now().Add(2*time.Hour)), ErrorMatches, ".*expired.*")
+	expired := issueTestKeyPair(c, ca, "server", time.Now().Add(-time.Hour))
+	c.Assert(expired.Check(time.Now()), ErrorMatches, ".*CN=server.*expired.*")
+
+	// Expired certificate in the chain
+	expiredCA := issueTestKeyPair(c, nil, "CA", time.Now().Add(-time.Hour))
+	kp2 := issueTestKeyPair(c, expiredCA, "server", time.Now().Add(time.Hour))
+	chain = &KeyPair{Cert: append(append([]byte{}, kp2.Cert...), expiredCA.Cert...), Key: kp2.Key}
+	c.Assert(chain.Check(time.Now()), ErrorMatches, ".*CN=CA.*expired.*")
+
+	// Chain in the wrong order or with the wrong issuer
+	chain = &KeyPair{Cert: append(append([]byte{}, kp.Cert...), other.Cert...), Key: kp.Key}
+	c.Assert(chain.Check(time.Now()), ErrorMatches, ".*not signed by.*")
+
+	// Private key of the other certificate
+	c.Assert((&KeyPair{Cert: kp.Cert, Key: other.Key}).Check(time.Now()), NotNil)
+}
+
+func (s *BackendSuite) TestHostHTTPSRedirect(c *C) {
+	h, err := NewHost("localhost", HostSettings{HTTPSRedirect: &HTTPSRedirectSettings{}})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HTTPSRedirect.StatusCode(), Equals, http.StatusMovedPermanently)
+
+	h, err = NewHost("localhost", HostSettings{HTTPSRedirect: &HTTPSRedirectSettings{Code: 308, Port: 8443}})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HTTPSRedirect.StatusCode(), Equals, http.StatusPermanentRedirect)
+
+	bytes, err := json.Marshal(h)
+	c.Assert(err, IsNil)
+	out, err := HostFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, h)
+}
+
+func (s *BackendSuite) TestHostHSTS(c *C) {
+	h, err := NewHost("localhost", HostSettings{HSTS: &HSTSSettings{MaxAge: 300}})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HSTS.HeaderValue(), Equals, "max-age=300")
+
+	h, err = NewHost("localhost", HostSettings{HSTS: &HSTSSettings{MaxAge: 300, IncludeSubdomains: true, Preload: true}})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HSTS.HeaderValue(), Equals, "max-age=300; includeSubDomains; preload")
+}
+
+func (s *BackendSuite) TestHostBadPolicies(c *C) {
+	settings := []HostSettings{
+		{HTTPSRedirect: &HTTPSRedirectSettings{Code: 302}},
+		{HTTPSRedirect: &HTTPSRedirectSettings{Port: 70000}},
+		{HSTS: &HSTSSettings{}},
+		{HSTS: &HSTSSettings{MaxAge: -1}},
+		{HSTS: &HSTSSettings{MaxAge: 300, Preload: true}},
+	}
+	for _, st := range settings {
+		h, err := NewHost("localhost", st)
+		c.Assert(err, NotNil)
+		c.Assert(h, IsNil)
+	}
+}
+
 func (s *BackendSuite) TestFrontendDefaults(c *C) {
 	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
 	c.Assert(err, IsNil)
@@ -47,6 +141,11 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 			MaxMemBodyBytes: 12,
 			MaxBodyBytes:    400,
 		},
+		Timeouts: HTTPFrontendTimeouts{
+			Request:        "10s",
+			ResponseHeader: "2s",
+			Body:           "too slow",
+		},
 		FailoverPredicate:  "IsNetworkError() && Attempts() <= 1",
 		Hostname:           "host1",
 		TrustForwardHeader: true,
@@ -63,6 +162,10 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 	c.Assert(o.FailoverPredicate, NotNil)
 	c.Assert(o.TrustForwardHeader, Equals, true)
 	c.Assert(o.Hostname, Equals, "host1")
+
+	t, err := f.TimeoutSettings()
+	c.Assert(err, IsNil)
+	c.Assert(t, DeepEquals, &FrontendTimeoutSettings{Request: 10 * time.Second, ResponseHeader: 2 * time.Second, Body: "too slow"})
 }
 
 func (s *BackendSuite) TestFrontendBadParams(c *C) {
@@ -80,6 +183,12 @@ func (s *BackendSuite) TestFrontendBadOptions(c *C) {
 		HTTPFrontendSettings{
 			FailoverPredicate: "bad predicate",
 		},
+		HTTPFrontendSettings{
+			Timeouts: HTTPFrontendTimeouts{Request: "1what?"},
+		},
+		HTTPFrontendSettings{
+			Timeouts: HTTPFrontendTimeouts{ResponseHeader: "-1s"},
+		},
 	}
 	for _, s := range settings {
 		f, err := NewHTTPFrontend(route.NewMux(), "f1", "b", `Path("/home")`, s)
@@ -123,6 +232,144 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 	c.Assert(o.KeepAlive.MaxIdleConnsPerHost, Equals, 3)
 }
 
+func (s *BackendSuite) TestBackendHealthCheckSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	h, err := b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h, IsNil)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}})
+	c.Assert(err, IsNil)
+
+	h, err = b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h, DeepEquals, &HealthCheckSettings{
+		Path:               "/health",
+		Interval:           DefaultHealthCheckInterval,
+		Timeout:            DefaultHealthCheckTimeout,
+		ExpectedCodes:      []int{200},
+		HealthyThreshold:   DefaultHealthyThreshold,
+		UnhealthyThreshold: DefaultUnhealthyThreshold,
+	})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{
+		HealthCheck: &HTTPBackendHealthCheck{
+			Path:               "/status",
+			Interval:           "3s",
+			Timeout:            "1s",
+			ExpectedCodes:      []int{200, 204},
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 5,
+		}})
+	c.Assert(err, IsNil)
+
+	h, err = b.HealthCheckSettings()
+	c.Assert(err, IsNil)
+	c.Assert(h.Interval, Equals, 3*time.Second)
+	c.Assert(h.Timeout, Equals, time.Second)
+	c.Assert(h.ExpectedCodes, DeepEquals, []int{200, 204})
+	c.Assert(h.HealthyThreshold, Equals, 1)
+	c.Assert(h.UnhealthyThreshold, Equals, 5)
+}
+
+func (s *BackendSuite) TestBackendLoadBalancerSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	l, err := b.LoadBalancerSettings()
+	c.Assert(err, IsNil)
+	c.Assert(l, DeepEquals, &LoadBalancerSettings{Algorithm: LBRoundRobin})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{
+		LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBConsistentHash, HashVariable: "request.header.X-User"}})
+	c.Assert(err, IsNil)
+
+	l, err = b.LoadBalancerSettings()
+	c.Assert(err, IsNil)
+	c.Assert(l, DeepEquals, &LoadBalancerSettings{Algorithm: LBConsistentHash, HashVariable: "request.header.X-User"})
+}
+
+func (s *BackendSuite) TestBackendStickySessionSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	st, err := b.StickySessionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(st, IsNil)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{StickySession: &HTTPBackendStickySession{}})
+	c.Assert(err, IsNil)
+
+	st, err = b.StickySessionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(st, DeepEquals, &StickySessionSettings{CookieName: DefaultStickyCookieName})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{
+		StickySession: &HTTPBackendStickySession{CookieName: "srv", TTL: "1h", Secure: true, HTTPOnly: true}})
+	c.Assert(err, IsNil)
+
+	st, err = b.StickySessionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(st, DeepEquals, &StickySessionSettings{CookieName: "srv", TTL: time.Hour, Secure: true, HTTPOnly: true})
+}
+
+func (s *BackendSuite) TestBackendOutlierDetectionSettings(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	o, err := b.OutlierDetectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o, IsNil)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{}})
+	c.Assert(err, IsNil)
+
+	o, err = b.OutlierDetectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, &OutlierDetectionSettings{
+		Interval:           DefaultOutlierDetectionInterval,
+		BaseEjectionTime:   DefaultBaseEjectionTime,
+		MaxEjectionTime:    DefaultMaxEjectionTime,
+		MaxEjectionPercent: DefaultMaxEjectionPercent,
+	})
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{
+		OutlierDetection: &HTTPBackendOutlierDetection{
+			Interval:           "1s",
+			BaseEjectionTime:   "2s",
+			MaxEjectionTime:    "1m",
+			MaxEjectionPercent: 20,
+		}})
+	c.Assert(err, IsNil)
+
+	o, err = b.OutlierDetectionSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, &OutlierDetectionSettings{
+		Interval:           time.Second,
+		BaseEjectionTime:   2 * time.Second,
+		MaxEjectionTime:    time.Minute,
+		MaxEjectionPercent: 20,
+	})
+}
+
+func (s *BackendSuite) TestBackendSlowStart(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	d, err := b.SlowStart()
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, time.Duration(0))
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{SlowStart: "30s"})
+	c.Assert(err, IsNil)
+
+	d, err = b.SlowStart()
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, 30*time.Second)
+}
+
 func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 	options := []struct {
 		a HTTPBackendSettings
@@ -177,6 +424,76 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{TLS: &TLSSettings{SessionTicketsDisabled: true}},
 			e: false,
 		},
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			b: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health"}},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health", ExpectedCodes: []int{200}}},
+			b: HTTPBackendSettings{HealthCheck: &HTTPBackendHealthCheck{Path: "/health", ExpectedCodes: []int{204}}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBLeastConn}},
+			b: HTTPBackendSettings{LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBLeastConn}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBLeastConn}},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBConsistentHash, HashVariable: "client.ip"}},
+			b: HTTPBackendSettings{LoadBalancer: &HTTPBackendLoadBalancer{Algorithm: LBConsistentHash, HashVariable: "request.host"}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{StickySession: &HTTPBackendStickySession{CookieName: "srv"}},
+			b: HTTPBackendSettings{StickySession: &HTTPBackendStickySession{CookieName: "srv"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{StickySession: &HTTPBackendStickySession{CookieName: "srv"}},
+			b: HTTPBackendSettings{StickySession: &HTTPBackendStickySession{CookieName: "srv", Secure: true}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{Interval: "1s"}},
+			b: HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{Interval: "1s"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{Interval: "1s"}},
+			b: HTTPBackendSettings{OutlierDetection: &HTTPBackendOutlierDetection{Interval: "2s"}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{SlowStart: "30s"},
+			b: HTTPBackendSettings{SlowStart: "30s"},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{SlowStart: "30s"},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{HTTP2: true},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{ProxyProtocol: "v1"},
+			b: HTTPBackendSettings{ProxyProtocol: "v2"},
+			e: false,
+		},
 	}
 	for _, o := range options {
 		c.Assert(o.a.Equals(o.b), Equals, o.e)
@@ -253,6 +570,60 @@ func (s *BackendSuite) TestListenerSettingsEq(c *C) {
 			e: false,
 			c: "session tickets",
 		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{HTTP2: true}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "http2",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{HTTP2: true, MaxConcurrentStreams: 100}},
+			b: Listener{Settings: &HTTPSListenerSettings{HTTP2: true}},
+			e: false,
+			c: "concurrent streams",
+		},
+		{
+			a: Listener{Settings: &HTTPSListenerSettings{ForwardClientCert: true}},
+			b: Listener{Settings: &HTTPSListenerSettings{}},
+			e: false,
+			c: "forward client cert",
+		},
+		{
+			a: Listener{TCP: &TCPListenerSettings{BackendId: "b1"}},
+			b: Listener{TCP: &TCPListenerSettings{BackendId: "b1"}},
+			e: true,
+			c: "tcp",
+		},
+		{
+			a: Listener{TCP: &TCPListenerSettings{BackendId: "b1"}},
+			b: Listener{TCP: &TCPListenerSettings{BackendId: "b2"}},
+			e: false,
+			c: "tcp backend",
+		},
+		{
+			a: Listener{TCP: &TCPListenerSettings{BackendId: "b1", TLS: &TLSSettings{}}},
+			b: Listener{TCP: &TCPListenerSettings{BackendId: "b1"}},
+			e: false,
+			c: "tcp tls",
+		},
+		{
+			a: Listener{ProxyProtocol: &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{ProxyProtocol: &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			e: true,
+			c: "proxy protocol",
+		},
+		{
+			a: Listener{ProxyProtocol: &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{},
+			e: false,
+			c: "proxy protocol off",
+		},
+		{
+			a: Listener{ProxyProtocol: &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8"}}},
+			b: Listener{ProxyProtocol: &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/16"}}},
+			e: false,
+			c: "proxy protocol networks",
+		},
 	}
 	for _, o := range options {
 		c.Assert((&o.a).SettingsEquals(&o.b), Equals, o.e, Commentf("TC: %v", o.c))
@@ -281,6 +652,91 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 				Period: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			HealthCheck: &HTTPBackendHealthCheck{
+				Path: "health",
+			},
+		},
+		HTTPBackendSettings{
+			HealthCheck: &HTTPBackendHealthCheck{
+				Path:     "/health",
+				Interval: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			HealthCheck: &HTTPBackendHealthCheck{
+				Path:     "/health",
+				Interval: "1s",
+				Timeout:  "2s",
+			},
+		},
+		HTTPBackendSettings{
+			HealthCheck: &HTTPBackendHealthCheck{
+				Path:          "/health",
+				ExpectedCodes: []int{1000},
+			},
+		},
+		HTTPBackendSettings{
+			HealthCheck: &HTTPBackendHealthCheck{
+				Path:             "/health",
+				HealthyThreshold: -1,
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: &HTTPBackendLoadBalancer{
+				Algorithm: "random",
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: &HTTPBackendLoadBalancer{
+				Algorithm:    LBConsistentHash,
+				HashVariable: "client ip",
+			},
+		},
+		HTTPBackendSettings{
+			LoadBalancer: &HTTPBackendLoadBalancer{
+				Algorithm:    LBRoundRobin,
+				HashVariable: "client.ip",
+			},
+		},
+		HTTPBackendSettings{
+			StickySession: &HTTPBackendStickySession{
+				CookieName: "bad cookie",
+			},
+		},
+		HTTPBackendSettings{
+			StickySession: &HTTPBackendStickySession{
+				TTL: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			OutlierDetection: &HTTPBackendOutlierDetection{
+				Interval: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			OutlierDetection: &HTTPBackendOutlierDetection{
+				BaseEjectionTime: "1m",
+				MaxEjectionTime:  "1s",
+			},
+		},
+		HTTPBackendSettings{
+			OutlierDetection: &HTTPBackendOutlierDetection{
+				MaxEjectionPercent: 101,
+			},
+		},
+		HTTPBackendSettings{
+			SlowStart: "1what?",
+		},
+		HTTPBackendSettings{
+			SlowStart: "-1s",
+		},
+		HTTPBackendSettings{
+			HTTP2: true,
+		},
+		HTTPBackendSettings{
+			ProxyProtocol: "v3",
+		},
 	}
 	for _, o := range options {
 		b, err := NewHTTPBackend("b1", o)
@@ -306,6 +762,84 @@ func (s *BackendSuite) TestNewListener(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *BackendSuite) TestNewTCPListener(c *C) {
+	l, err := NewTCPListener("id", "tcp", "127.0.0.1:4000", TCPListenerSettings{BackendId: "b1"})
+	c.Assert(err, IsNil)
+	c.Assert(l.Protocol, Equals, TCP)
+	c.Assert(l.TerminatesTLS(), Equals, false)
+
+	l, err = NewTCPListener("id", "tcp", "127.0.0.1:4000", TCPListenerSettings{BackendId: "b1", TLS: &TLSSettings{}})
+	c.Assert(err, IsNil)
+	c.Assert(l.TerminatesTLS(), Equals, true)
+	_, err = l.TLSConfig()
+	c.Assert(err, IsNil)
+
+	bytes, err := json.Marshal(l)
+	c.Assert(err, IsNil)
+	out, err := ListenerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, l)
+}
+
+func (s *BackendSuite) TestNewTCPListenerBadParams(c *C) {
+	_, err := NewTCPListener("id", "tcp", "127.0.0.1:4000", TCPListenerSettings{})
+	c.Assert(err, NotNil)
+
+	_, err = NewTCPListener("id", "tcp", "127.0.0.1:4000", TCPListenerSettings{BackendId: "b1", TLS: &TLSSettings{MinVersion: "bla"}})
+	c.Assert(err, NotNil)
+
+	// TCP listeners need a backend
+	_, err = NewListener("id", "tcp", "tcp", "127.0.0.1:4000", "", nil)
+	c.Assert(err, NotNil)
+
+	_, err = ListenerFromJSON([]byte(`{"Id": "id", "Protocol": "tcp", "Address": {"Network": "tcp", "Address": "127.0.0.1:4000"}}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestListenerProxyProtocol(c *C) {
+	l, err := NewListener("id", "http", "tcp", "127.0.0.1:4000", "", nil)
+	c.Assert(err, IsNil)
+	nets, err := l.ProxyProtocolNetworks()
+	c.Assert(err, IsNil)
+	c.Assert(nets, IsNil)
+
+	l.ProxyProtocol = &ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8", "::1/128"}}
+	nets, err = l.ProxyProtocolNetworks()
+	c.Assert(err, IsNil)
+	c.Assert(len(nets), Equals, 2)
+
+	bytes, err := json.Marshal(l)
+	c.Assert(err, IsNil)
+	out, err := ListenerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, l)
+
+	for _, cidrs := range [][]string{nil, []string{"10.0.0.0"}, []string{"bla"}} {
+		l.ProxyProtocol = &ProxyProtocolSettings{TrustedCIDRs: cidrs}
+		_, err = l.ProxyProtocolNetworks()
+		c.Assert(err, NotNil)
+
+		bytes, err := json.Marshal(l)
+		c.Assert(err, IsNil)
+		_, err = ListenerFromJSON(bytes)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *BackendSuite) TestBackendProxyProtocolVersion(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	v, err := b.ProxyProtocolVersion()
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, 0)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{ProxyProtocol: "v2"})
+	c.Assert(err, IsNil)
+	v, err = b.ProxyProtocolVersion()
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, 2)
+}
+
 func (s *BackendSuite) TestNewListenerBadParams(c *C) {
 	_, err := NewListener("id", "http", "tcp", "", "", nil)
 	c.Assert(err, NotNil)
@@ -315,6 +849,9 @@ func (s *BackendSuite) TestNewListenerBadParams(c *C) {
 
 	_, err = NewListener("id", "http", "tcp", "127.0.0.1:4000", "blabla", nil)
 	c.Assert(err, NotNil)
+
+	_, err = NewListener("id", "https", "tcp", "127.0.0.1:4000", "", &HTTPSListenerSettings{MaxConcurrentStreams: -1})
+	c.Assert(err, NotNil)
 }
 
 func (s *BackendSuite) TestFrontendsFromJSON(c *C) {
@@ -336,6 +873,43 @@ func (s *BackendSuite) TestFrontendsFromJSON(c *C) {
 	c.Assert(out, DeepEquals, fs)
 }
 
+func (s *BackendSuite) TestFrontendBackends(c *C) {
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/path")`, HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendRefs(), DeepEquals, []WeightedBackend{{Id: "b1", Weight: 100}})
+	c.Assert(f.UsesBackend("b1"), Equals, true)
+	c.Assert(f.UsesBackend("b2"), Equals, false)
+
+	split := []WeightedBackend{{Id: "v1", Weight: 95}, {Id: "v2", Weight: 5}}
+	c.Assert(f.SetBackends(split), IsNil)
+	c.Assert(f.BackendId, Equals, "v1")
+	c.Assert(f.BackendRefs(), DeepEquals, split)
+	c.Assert(f.UsesBackend("v2"), Equals, true)
+	c.Assert(f.UsesBackend("b1"), Equals, false)
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	bad := [][]WeightedBackend{
+		{},
+		{{Id: "v1", Weight: 90}},
+		{{Id: "v1", Weight: 50}, {Id: "v1", Weight: 50}},
+		{{Id: "", Weight: 100}},
+		{{Id: "v1", Weight: 110}, {Id: "v2", Weight: -10}},
+	}
+	for _, b := range bad {
+		c.Assert(f.SetBackends(b), NotNil)
+	}
+
+	_, err = FrontendFromJSON(route.NewMux(),
+		[]byte(`{"Id": "f1", "Type": "http", "Route": "Path(\"/\")", "BackendId": "v2", "Backends": [{"Id": "v1", "Weight": 100}]}`))
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) MiddlewareFromJSON(c *C) {
 	cl, err := connlimit.NewConnLimit(10, "client.ip")
 	c.Assert(err, IsNil)
@@ -379,6 +953,52 @@ func (s *BackendSuite) TestServerFromJSON(c *C) {
 	c.Assert(out, DeepEquals, e)
 }
 
+func (s *BackendSuite) TestServerWeight(c *C) {
+	e, err := NewServer("sv1", "http://localhost")
+	c.Assert(err, IsNil)
+	c.Assert(e.EffectiveWeight(), Equals, DefaultServerWeight)
+
+	c.Assert(e.SetWeight(-1), NotNil)
+	c.Assert(e.SetWeight(5), IsNil)
+	c.Assert(e.EffectiveWeight(), Equals, 5)
+
+	bytes, err := json.Marshal(e)
+	c.Assert(err, IsNil)
+
+	out, err := ServerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, e)
+
+	_, err = ServerFromJSON([]byte(`{"Id": "sv1", "URL": "http://localhost", "Weight": -1}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestServerState(c *C) {
+	e, err := NewServer("sv1", "http://localhost")
+	c.Assert(err, IsNil)
+	c.Assert(e.GetState(), Equals, ServerStateActive)
+	c.Assert(e.IsActive(), Equals, true)
+
+	c.Assert(e.SetState(ServerStateDraining), IsNil)
+	c.Assert(e.IsActive(), Equals, false)
+
+	c.Assert(e.SetState(ServerStateDisabled), IsNil)
+	c.Assert(e.IsActive(), Equals, false)
+
+	c.Assert(e.SetState("sleeping"), NotNil)
+	c.Assert(e.GetState(), Equals, ServerStateDisabled)
+
+	bytes, err := json.Marshal(e)
+	c.Assert(err, IsNil)
+
+	out, err := ServerFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, e)
+
+	_, err = ServerFromJSON([]byte(`{"Id": "sv1", "URL": "http://localhost", "State": "sleeping"}`))
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestNewTLSSettings(c *C) {
 	tcs := []struct {
 		S TLSSettings
@@ -552,6 +1172,22 @@ func (s *BackendSuite) TestNewTLSSettingsBadParams(c *C) {
 				},
 			},
 		},
+		TLSSettings{
+			ClientAuth: "blabla",
+		},
+		TLSSettings{
+			ClientAuth: ClientAuthVerify,
+		},
+		TLSSettings{
+			ClientAuth: ClientAuthVerify,
+			ClientCAs:  []byte("blabla"),
+		},
+		TLSSettings{
+			RootCAs: []byte("blabla"),
+		},
+		TLSSettings{
+			KeyPair: &KeyPair{Cert: []byte("hello"), Key: []byte("world")},
+		},
 	}
 	for _, tc := range tcs {
 		cfg, err := NewTLSConfig(&tc)
@@ -560,7 +1196,60 @@ func (s *BackendSuite) TestNewTLSSettingsBadParams(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestTLSClientAuth(c *C) {
+	modes := map[string]tls.ClientAuthType{
+		"":                tls.NoClientCert,
+		ClientAuthNone:    tls.NoClientCert,
+		ClientAuthRequest: tls.RequestClientCert,
+		ClientAuthRequire: tls.RequireAnyClientCert,
+	}
+	for mode, expected := range modes {
+		cfg, err := NewTLSConfig(&TLSSettings{ClientAuth: mode})
+		c.Assert(err, IsNil)
+		c.Assert(cfg.ClientAuth, Equals, expected)
+		c.Assert(cfg.ClientCAs, IsNil)
+	}
+
+	cfg, err := NewTLSConfig(&TLSSettings{ClientAuth: ClientAuthVerify, ClientCAs: newTestCA(c)})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+	c.Assert(cfg.ClientCAs, NotNil)
+
+	// Requested certificate is verified when it is sent, if there are CAs to verify it with
+	cfg, err = NewTLSConfig(&TLSSettings{ClientAuth: ClientAuthRequest, ClientCAs: newTestCA(c)})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.ClientAuth, Equals, tls.VerifyClientCertIfGiven)
+	c.Assert(cfg.ClientCAs, NotNil)
+}
+
+func (s *BackendSuite) TestTLSBackendCertificates(c *C) {
+	keyPair := newTestKeyPair(c)
+	cfg, err := NewTLSConfig(&TLSSettings{RootCAs: newTestCA(c), KeyPair: keyPair})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.RootCAs, NotNil)
+	c.Assert(len(cfg.Certificates), Equals, 1)
+
+	cfg, err = NewTLSConfig(&TLSSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(cfg.RootCAs, IsNil)
+	c.Assert(cfg.Certificates, IsNil)
+
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{TLS: &TLSSettings{KeyPair: keyPair}})
+	c.Assert(err, IsNil)
+	bytes, err := json.Marshal(b)
+	c.Assert(err, IsNil)
+	out, err := BackendFromJSON(bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+
+	// Key pair has to be valid
+	_, err = NewHTTPBackend("b1", HTTPBackendSettings{TLS: &TLSSettings{KeyPair: &KeyPair{Cert: keyPair.Cert, Key: []byte("bla")}}})
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestTLSSettingsEq(c *C) {
+	ca := newTestCA(c)
+	keyPair := newTestKeyPair(c)
 	tcs := []struct {
 		A  TLSSettings
 		B  TLSSettings
@@ -667,6 +1356,60 @@ func (s *BackendSuite) TestTLSSettingsEq(c *C) {
 			R:  false,
 			TC: "prefer server csuites",
 		},
+		{
+			A: TLSSettings{
+				ClientAuth: ClientAuthRequest,
+			},
+			B:  TLSSettings{},
+			R:  false,
+			TC: "client auth",
+		},
+		{
+			A: TLSSettings{
+				ClientAuth: ClientAuthNone,
+			},
+			B:  TLSSettings{},
+			R:  true,
+			TC: "client auth defaults",
+		},
+		{
+			A: TLSSettings{
+				ClientAuth: ClientAuthVerify,
+				ClientCAs:  ca,
+			},
+			B: TLSSettings{
+				ClientAuth: ClientAuthVerify,
+				ClientCAs:  newTestCA(c),
+			},
+			R:  false,
+			TC: "client CAs",
+		},
+		{
+			A: TLSSettings{
+				RootCAs: ca,
+			},
+			B:  TLSSettings{},
+			R:  false,
+			TC: "root CAs",
+		},
+		{
+			A: TLSSettings{
+				KeyPair: keyPair,
+			},
+			B: TLSSettings{
+				KeyPair: keyPair,
+			},
+			R:  true,
+			TC: "key pair",
+		},
+		{
+			A: TLSSettings{
+				KeyPair: keyPair,
+			},
+			B:  TLSSettings{},
+			R:  false,
+			TC: "no key pair",
+		},
 		{
 			A: TLSSettings{
 				CipherSuites: []string{
@@ -698,3 +1441,46 @@ func (s *BackendSuite) TestTLSSettingsEq(c *C) {
 		c.Assert(tc.A.Equals(&tc.B), Equals, tc.R, Commentf("TC: %v", tc.TC))
 	}
 }
+
+// newTestCA returns PEM encoded self signed CA certificate
+func newTestCA(c *C) []byte {
+	return newTestKeyPair(c).Cert
+}
+
+// newTestKeyPair returns self signed certificate that can be used as CA, server or client certificate
+func newTestKeyPair(c *C) *KeyPair {
+	return issueTestKeyPair(c, nil, "test", time.Now().Add(time.Hour))
+}
+
+// issueTestKeyPair returns CA certificate for example.com and 127.0.0.1 signed by the issuer, or self signed if the issuer is nil
+func issueTestKeyPair(c *C, issuer *KeyPair, cn string, notAfter time.Time) *KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{"example.com"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := tmpl, interface{}(key)
+	if issuer != nil {
+		ic, err := tls.X509KeyPair(issuer.Cert, issuer.Key)
+		c.Assert(err, IsNil)
+		parent, err = x509.ParseCertificate(ic.Certificate[0])
+		c.Assert(err, IsNil)
+		signer = ic.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 )
 
@@ -36,6 +38,24 @@ type TLSSettings struct {
 	// TLS_RSA_WITH_AES_256_CBC_SHA
 	// TLS_RSA_WITH_AES_128_CBC_SHA
 	CipherSuites []string
+
+	// ClientAuth is the client certificate authentication mode of the listener, one of:
+	//
+	// none - client certificates are not requested, default
+	// request - client certificate is requested, but not required, the certificate is verified if ClientCAs are set
+	// require - client is required to send any certificate
+	// verify - client is required to send a certificate signed by one of the ClientCAs
+	ClientAuth string `json:",omitempty"`
+
+	// ClientCAs is PEM encoded bundle of certificate authorities used to verify client certificates
+	ClientCAs []byte `json:",omitempty"`
+
+	// RootCAs is PEM encoded bundle of certificate authorities used to verify server certificates,
+	// system roots are used by default. Applies to backends only.
+	RootCAs []byte `json:",omitempty"`
+
+	// KeyPair is the client certificate presented to the servers that require it. Applies to backends only.
+	KeyPair *KeyPair `json:",omitempty"`
 }
 
 // TLSSessionCache sets up parameters for TLS session cache
@@ -94,6 +114,41 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		}
 	}
 
+	clientAuth, err := ParseClientAuth(s.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	if len(s.ClientCAs) != 0 {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(s.ClientCAs) {
+			return nil, fmt.Errorf("failed to parse client CA certificates")
+		}
+	}
+	if clientAuth == tls.RequireAndVerifyClientCert && clientCAs == nil {
+		return nil, fmt.Errorf("client certificate verification needs client CA certificates")
+	}
+	// requested certificates are never verified otherwise, so the middlewares would never see the client identity
+	if clientAuth == tls.RequestClientCert && clientCAs != nil {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	var rootCAs *x509.CertPool
+	if len(s.RootCAs) != 0 {
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(s.RootCAs) {
+			return nil, fmt.Errorf("failed to parse root CA certificates")
+		}
+	}
+	var certs []tls.Certificate
+	if s.KeyPair != nil {
+		cert, err := tls.X509KeyPair(s.KeyPair.Cert, s.KeyPair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad client key pair: %s", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
 	var cache tls.ClientSessionCache
 	if !s.SessionTicketsDisabled {
 		cache, err = NewTLSSessionCache(&s.SessionCache)
@@ -113,6 +168,12 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		CipherSuites:             css,
 
 		InsecureSkipVerify: s.InsecureSkipVerify,
+
+		ClientAuth: clientAuth,
+		ClientCAs:  clientCAs,
+
+		RootCAs:      rootCAs,
+		Certificates: certs,
 	}, nil
 }
 
@@ -170,6 +231,20 @@ func ParseCipherSuite(cs string) (uint16, error) {
 	return 0, fmt.Errorf("unsupported cipher suite: %v", cs)
 }
 
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	case ClientAuthVerify:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("unsupported client auth mode: %v, use none, request, require or verify", mode)
+}
+
 func ParseTLSVersion(version string) (uint16, error) {
 	switch version {
 	case "VersionTLS10":
@@ -185,6 +260,13 @@ func ParseTLSVersion(version string) (uint16, error) {
 const DefaultLRUCapacity = 1024
 const LRUCacheType = "LRU"
 
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+	ClientAuthVerify  = "verify"
+)
+
 func (s *TLSSettings) Equals(other *TLSSettings) bool {
 	scfg, err := NewTLSConfig(s)
 	if err != nil {
@@ -200,7 +282,20 @@ func (s *TLSSettings) Equals(other *TLSSettings) bool {
 		scfg.InsecureSkipVerify != ocfg.InsecureSkipVerify ||
 		scfg.MinVersion != ocfg.MinVersion ||
 		scfg.MaxVersion != ocfg.MaxVersion ||
-		scfg.SessionTicketsDisabled != ocfg.SessionTicketsDisabled {
+		scfg.SessionTicketsDisabled != ocfg.SessionTicketsDisabled ||
+		scfg.ClientAuth != ocfg.ClientAuth {
+		return false
+	}
+
+	if !bytes.Equal(s.ClientCAs, other.ClientCAs) || !bytes.Equal(s.RootCAs, other.RootCAs) {
+		return false
+	}
+
+	if s.KeyPair == nil || other.KeyPair == nil {
+		if s.KeyPair != other.KeyPair {
+			return false
+		}
+	} else if !s.KeyPair.Equals(other.KeyPair) {
 		return false
 	}
 
@@ -6,7 +6,6 @@ import (
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/connlimit"
-	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/plugin"
 )
 
@@ -29,7 +28,7 @@ type ConnLimit struct {
 
 // Returns vulcan library compatible middleware
 func (c *ConnLimit) NewHandler(next http.Handler) (http.Handler, error) {
-	extract, err := utils.NewExtractor(c.Variable)
+	extract, err := plugin.NewExtractor(c.Variable)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +36,7 @@ func (c *ConnLimit) NewHandler(next http.Handler) (http.Handler, error) {
 }
 
 func NewConnLimit(connections int64, variable string) (*ConnLimit, error) {
-	if _, err := utils.NewExtractor(variable); err != nil {
+	if _, err := plugin.NewExtractor(variable); err != nil {
 		return nil, err
 	}
 	if connections < 0 {
@@ -64,7 +63,7 @@ func FromCli(c *cli.Context) (plugin.Middleware, error) {
 
 func CliFlags() []cli.Flag {
 	return []cli.Flag{
-		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to rate against, e.g. client.ip, request.host or request.header.X-Header"},
+		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to rate against, e.g. client.ip, request.host, request.header.X-Header or client.cert.subject"},
 		cli.IntFlag{Name: "connections, conns", Value: 1, Usage: "amount of simultaneous connections allowed per variable value"},
 	}
 }
@@ -33,6 +33,17 @@ func (s *ConnLimitSuite) TestNewConnLimitSuccess(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *ConnLimitSuite) TestNewConnLimitClientCert(c *C) {
+	for _, v := range []string{"client.cert.subject", "client.cert.san"} {
+		cl, err := NewConnLimit(10, v)
+		c.Assert(err, IsNil)
+
+		out, err := cl.NewHandler(nil)
+		c.Assert(out, NotNil)
+		c.Assert(err, IsNil)
+	}
+}
+
 func (s *ConnLimitSuite) TestNewConnLimitBadParams(c *C) {
 	// Unknown variable
 	_, err := NewConnLimit(10, "client ip")
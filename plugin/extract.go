@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+)
+
+const (
+	// ClientCertSubjectHeader carries the subject of the verified client certificate
+	ClientCertSubjectHeader = "X-Client-Cert-Subject"
+	// ClientCertSANHeader carries the subject alternative names of the verified client certificate
+	ClientCertSANHeader = "X-Client-Cert-San"
+)
+
+// NewExtractor supports the same variables as oxy extractors, e.g. client.ip, request.host or request.header.X-Header,
+// and the variables of client certificates verified by the listener: client.cert.subject and client.cert.san
+func NewExtractor(variable string) (utils.SourceExtractor, error) {
+	switch variable {
+	case "client.cert.subject":
+		return makeClientCertExtractor(ClientCertSubject), nil
+	case "client.cert.san":
+		return makeClientCertExtractor(ClientCertSAN), nil
+	}
+	return utils.NewExtractor(variable)
+}
+
+func makeClientCertExtractor(value func(*http.Request) (string, bool)) utils.SourceExtractor {
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		v, ok := value(req)
+		if !ok {
+			return "", 0, fmt.Errorf("no verified client certificate")
+		}
+		return v, 1, nil
+	})
+}
+
+// ClientCertSubject returns the subject of the client certificate verified by the listener, e.g. 'CN=client,O=Acme'
+func ClientCertSubject(req *http.Request) (string, bool) {
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return "", false
+	}
+	return cert.Subject.String(), true
+}
+
+// ClientCertSAN returns comma separated subject alternative names of the client certificate verified by the listener,
+// e.g. 'DNS:client.example.com,email:client@example.com,IP:10.0.0.1,URI:spiffe://example.com/client'
+func ClientCertSAN(req *http.Request) (string, bool) {
+	cert := verifiedClientCert(req)
+	if cert == nil {
+		return "", false
+	}
+	var names []string
+	for _, n := range cert.DNSNames {
+		names = append(names, "DNS:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		names = append(names, "email:"+e)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	return strings.Join(names, ","), true
+}
+
+func verifiedClientCert(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
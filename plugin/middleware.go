@@ -1,6 +1,7 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
@@ -46,6 +47,41 @@ type Middleware interface {
 	NewHandler(http.Handler) (http.Handler, error)
 }
 
+// BackendMiddleware is implemented by middlewares that send requests to backends
+// other than the ones frontend is bound to, e.g. to shadow the traffic
+type BackendMiddleware interface {
+	Middleware
+	// NewBackendHandler is called instead of NewHandler, getBackend returns handlers forwarding requests to backend servers
+	NewBackendHandler(next http.Handler, getBackend BackendGetter) (http.Handler, error)
+}
+
+// Function that returns handler forwarding requests to the servers of the backend by it's id
+type BackendGetter func(backendId string) (http.Handler, error)
+
+// Frontends retry the failed requests through the whole middleware chain, the marks let the middlewares
+// act once per client request, e.g. mirror the request on the first attempt only
+type requestMarksKey struct{}
+
+// WithRequestMarks returns the context shared by all attempts to serve the client request
+func WithRequestMarks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestMarksKey{}, make(map[interface{}]bool))
+}
+
+// MarkRequest marks the client request with the key, returns false if the request has already been marked,
+// e.g. by the previous attempt. Attempts are made one after another, so the marks are not locked.
+// Requests without the marks context are never marked.
+func MarkRequest(req *http.Request, key interface{}) bool {
+	marks, ok := req.Context().Value(requestMarksKey{}).(map[interface{}]bool)
+	if !ok {
+		return true
+	}
+	if marks[key] {
+		return false
+	}
+	marks[key] = true
+	return true
+}
+
 // Reader constructs the middleware from the CLI interface
 type CliReader func(c *cli.Context) (Middleware, error)
 
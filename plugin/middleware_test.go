@@ -104,6 +104,24 @@ func (s *MiddlewareSuite) TestRegistryNotFoundMiddlewareGetSet(c *C) {
 	c.Assert(r.GetNotFoundMiddleware(), Equals, correct)
 }
 
+func (s *MiddlewareSuite) TestMarkRequest(c *C) {
+	req, err := http.NewRequest("GET", "http://localhost", nil)
+	c.Assert(err, IsNil)
+
+	// Requests without the marks are never marked
+	c.Assert(MarkRequest(req, "a"), Equals, true)
+	c.Assert(MarkRequest(req, "a"), Equals, true)
+
+	req = req.WithContext(WithRequestMarks(req.Context()))
+	c.Assert(MarkRequest(req, "a"), Equals, true)
+	c.Assert(MarkRequest(req, "a"), Equals, false)
+	c.Assert(MarkRequest(req, "b"), Equals, true)
+
+	// Copies of the request made for the retries share the marks
+	out := *req
+	c.Assert(MarkRequest(&out, "b"), Equals, false)
+}
+
 type TestMiddleware struct {
 	Field string
 	next  http.Handler
@@ -20,7 +20,7 @@ func GetSpec() *plugin.MiddlewareSpec {
 		cli.IntFlag{Name: "period", Value: 1, Usage: "rate limit period in seconds"},
 		cli.IntFlag{Name: "requests", Value: 1, Usage: "amount of requests"},
 		cli.IntFlag{Name: "burst", Value: 1, Usage: "allowed burst"},
-		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to rate against, e.g. client.ip, request.host or request.header.X-Header"},
+		cli.StringFlag{Name: "variable, var", Value: "client.ip", Usage: "variable to rate against, e.g. client.ip, request.host, request.header.X-Header or client.cert.subject"},
 		cli.StringFlag{Name: "rateVar", Value: "", Usage: "variable to retrieve rates from, e.g. request.header.X-Rates"},
 	}
 	return &plugin.MiddlewareSpec{
@@ -41,7 +41,7 @@ func FromOther(o RateLimit) (plugin.Middleware, error) {
 	if o.PeriodSeconds <= 0 {
 		return nil, fmt.Errorf("period seconds should be > 0, got %d", o.PeriodSeconds)
 	}
-	extract, err := utils.NewExtractor(o.Variable)
+	extract, err := plugin.NewExtractor(o.Variable)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,217 @@
+package shadow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "shadow"
+
+// Limits the amount of mirrored requests in flight, requests exceeding the limit are not mirrored
+const maxInFlight = 1024
+
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// Shadow copies a share of the frontend's requests to another backend and discards the responses.
+// Mirrored requests are sent asynchronously, so they don't add latency to the client requests.
+type Shadow struct {
+	// BackendId is the id of the backend receiving the copies of requests
+	BackendId string
+	// Percent of requests to mirror, from 0 to 100
+	Percent float64
+	// Requests with bodies larger than MaxBodyBytes are not mirrored
+	MaxBodyBytes int64
+}
+
+func NewShadow(backendId string, percent float64, maxBodyBytes int64) (*Shadow, error) {
+	if backendId == "" {
+		return nil, fmt.Errorf("backend id can not be empty")
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("percent should be in range [0, 100], got %v", percent)
+	}
+	if maxBodyBytes < 0 {
+		return nil, fmt.Errorf("max body bytes should be >= 0, got %d", maxBodyBytes)
+	}
+	return &Shadow{
+		BackendId:    backendId,
+		Percent:      percent,
+		MaxBodyBytes: maxBodyBytes,
+	}, nil
+}
+
+// NewHandler is not supported, as shadow needs access to the backends
+func (s *Shadow) NewHandler(next http.Handler) (http.Handler, error) {
+	return nil, fmt.Errorf("%v requires access to backends", Type)
+}
+
+// Returns vulcan library compatible middleware
+func (s *Shadow) NewBackendHandler(next http.Handler, getBackend plugin.BackendGetter) (http.Handler, error) {
+	mirror, err := getBackend(s.BackendId)
+	if err != nil {
+		return nil, err
+	}
+	return &handler{
+		cfg:      *s,
+		next:     next,
+		mirror:   mirror,
+		inFlight: make(chan struct{}, maxInFlight),
+	}, nil
+}
+
+func (s *Shadow) String() string {
+	return fmt.Sprintf("backend=%v, percent=%v, maxBodyBytes=%d", s.BackendId, s.Percent, s.MaxBodyBytes)
+}
+
+func FromOther(s Shadow) (plugin.Middleware, error) {
+	return NewShadow(s.BackendId, s.Percent, s.MaxBodyBytes)
+}
+
+// Constructs the middleware from the command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return NewShadow(c.String("backend"), c.Float64("percent"), int64(c.Int("maxBodyBytes")))
+}
+
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "backend, b", Usage: "id of the backend receiving the copies of requests"},
+		cli.Float64Flag{Name: "percent", Value: 100, Usage: "percent of requests to mirror, from 0 to 100"},
+		cli.IntFlag{Name: "maxBodyBytes", Value: 1048576, Usage: "requests with larger bodies are not mirrored"},
+	}
+}
+
+type handler struct {
+	cfg    Shadow
+	next   http.Handler
+	mirror http.Handler
+	// inFlight limits the amount of mirrored requests in flight
+	inFlight chan struct{}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the request is sampled once, failover attempts are not mirrored again
+	if plugin.MarkRequest(req, h) && h.sample() {
+		h.send(req)
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+func (h *handler) sample() bool {
+	if h.cfg.Percent >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < h.cfg.Percent
+}
+
+// send mirrors the request. The body of the original request is read once into the buffer shared
+// with the mirrored request and replaced, so it can be read again by the next handler
+func (h *handler) send(req *http.Request) {
+	if req.ContentLength > h.cfg.MaxBodyBytes {
+		return
+	}
+	body, err := h.readBody(req)
+	req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+	if err != nil {
+		log.Warningf("%v failed to read request body: %v", Type, err)
+		return
+	}
+	if int64(len(body)) > h.cfg.MaxBodyBytes {
+		return
+	}
+
+	select {
+	case h.inFlight <- struct{}{}:
+	default:
+		log.Warningf("%v too many requests in flight, dropping mirror of %v", Type, req.URL)
+		return
+	}
+
+	out := copyRequest(req, body)
+	go func() {
+		defer func() { <-h.inFlight }()
+		pw := &utils.ProxyWriter{W: discardWriter{}}
+		h.mirror.ServeHTTP(pw, out)
+		if pw.Code >= http.StatusInternalServerError {
+			log.Warningf("%v mirror of %v to backend %v failed with code %d", Type, out.URL, h.cfg.BackendId, pw.Code)
+		}
+	}()
+}
+
+// readBody reads up to MaxBodyBytes+1 bytes of the body. Requests buffered by the frontend have the known
+// length, so the buffer is allocated once, otherwise it grows as the body is read.
+func (h *handler) readBody(req *http.Request) ([]byte, error) {
+	if req.ContentLength < 0 {
+		return ioutil.ReadAll(io.LimitReader(req.Body, h.cfg.MaxBodyBytes+1))
+	}
+	body := make([]byte, req.ContentLength)
+	n, err := io.ReadFull(req.Body, body)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return body[:n], err
+}
+
+// copyRequest detaches the copy from the client request, so it is not canceled when the client request completes
+func copyRequest(req *http.Request, body []byte) *http.Request {
+	out := req.WithContext(detachedContext{req.Context()})
+	out.URL = utils.CopyURL(req.URL)
+	out.Header = make(http.Header)
+	utils.CopyHeaders(out.Header, req.Header)
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	return out
+}
+
+// detachedContext keeps the values of the client request context, e.g. whether the client certificate
+// is forwarded to the servers, but is never canceled
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// discardWriter throws away mirrored responses
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header {
+	return make(http.Header)
+}
+
+func (discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardWriter) WriteHeader(int) {}
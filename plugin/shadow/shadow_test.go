@@ -0,0 +1,150 @@
+package shadow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+func TestShadow(t *testing.T) { TestingT(t) }
+
+type ShadowSuite struct {
+}
+
+var _ = Suite(&ShadowSuite{})
+
+// Make sure the Shadow spec is compatible and will be accepted by middleware registry
+func (s *ShadowSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *ShadowSuite) TestNewShadowSuccess(c *C) {
+	sh, err := NewShadow("b1", 10, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(sh, NotNil)
+
+	c.Assert(sh.String(), Not(Equals), "")
+
+	// Shadow can't work without backends
+	_, err = sh.NewHandler(nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *ShadowSuite) TestNewShadowBadParams(c *C) {
+	// Missing backend
+	_, err := NewShadow("", 10, 1024)
+	c.Assert(err, NotNil)
+
+	// Percent out of range
+	_, err = NewShadow("b1", -1, 1024)
+	c.Assert(err, NotNil)
+
+	_, err = NewShadow("b1", 101, 1024)
+	c.Assert(err, NotNil)
+
+	// Negative body size
+	_, err = NewShadow("b1", 10, -1)
+	c.Assert(err, NotNil)
+}
+
+func (s *ShadowSuite) TestNewShadowFromOther(c *C) {
+	sh, err := NewShadow("b1", 10, 1024)
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*sh)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, sh)
+}
+
+func (s *ShadowSuite) TestNewShadowFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(out, NotNil)
+		c.Assert(err, IsNil)
+
+		sh := out.(*Shadow)
+		c.Assert(sh.BackendId, Equals, "b1")
+		c.Assert(sh.Percent, Equals, 12.5)
+		c.Assert(sh.MaxBodyBytes, Equals, int64(2048))
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--backend=b1", "--percent=12.5", "--maxBodyBytes=2048"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *ShadowSuite) TestMirror(c *C) {
+	mirrored := make(chan string, 1)
+	mirror := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		mirrored <- fmt.Sprintf("%v %v", r.URL.Path, string(data))
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		w.Write(data)
+	})
+
+	h := s.newHandler(c, 100, 4, mirror, next)
+
+	// Both primary and mirror get the body
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(c, "/a", "ping"))
+	c.Assert(w.Body.String(), Equals, "ping")
+	c.Assert(waitMirror(mirrored), Equals, "/a ping")
+
+	// Body is too large to be mirrored, but the primary still gets it in full
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(c, "/b", "pingpong"))
+	c.Assert(w.Body.String(), Equals, "pingpong")
+	c.Assert(waitMirror(mirrored), Equals, "")
+}
+
+func (s *ShadowSuite) TestSampling(c *C) {
+	mirrored := make(chan string, 1)
+	mirror := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.Path
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	h := s.newHandler(c, 0, 1024, mirror, next)
+	h.ServeHTTP(httptest.NewRecorder(), newRequest(c, "/a", ""))
+	c.Assert(waitMirror(mirrored), Equals, "")
+}
+
+func (s *ShadowSuite) newHandler(c *C, percent float64, maxBodyBytes int64, mirror, next http.Handler) http.Handler {
+	sh, err := NewShadow("b1", percent, maxBodyBytes)
+	c.Assert(err, IsNil)
+
+	h, err := sh.NewBackendHandler(next, func(id string) (http.Handler, error) {
+		c.Assert(id, Equals, "b1")
+		return mirror, nil
+	})
+	c.Assert(err, IsNil)
+	return h
+}
+
+func newRequest(c *C, path, body string) *http.Request {
+	req, err := http.NewRequest("POST", "http://localhost"+path, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	return req
+}
+
+func waitMirror(mirrored chan string) string {
+	select {
+	case m := <-mirrored:
+		return m
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
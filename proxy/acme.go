@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acmeChallengePath is the path the ACME certificate authority requests to validate HTTP-01 challenges
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ChallengeResponder returns the key authorizations of the pending ACME HTTP-01 challenges
+type ChallengeResponder interface {
+	KeyAuthorization(token string) (string, bool)
+}
+
+// acmeChallengeHandler answers the HTTP-01 challenges on http listeners before the requests are
+// redirected or routed, the requests for unknown tokens are passed to the next handler
+type acmeChallengeHandler struct {
+	responder ChallengeResponder
+	next      http.Handler
+}
+
+func (h *acmeChallengeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	keyAuth, ok := h.responder.KeyAuthorization(strings.TrimPrefix(req.URL.Path, acmeChallengePath))
+	if !ok {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&ACMEChallengeSuite{})
+
+type ACMEChallengeSuite struct {
+}
+
+type testChallenges map[string]string
+
+func (t testChallenges) KeyAuthorization(token string) (string, bool) {
+	keyAuth, ok := t[token]
+	return keyAuth, ok
+}
+
+func (s *ACMEChallengeSuite) TestChallenge(c *C) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("next"))
+	})
+	h := &acmeChallengeHandler{responder: testChallenges{"token": "token.thumbprint"}, next: next}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("GET", "/.well-known/acme-challenge/token")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "token.thumbprint")
+	c.Assert(w.Header().Get("Content-Type"), Equals, "text/plain")
+
+	// Unknown tokens and other requests are passed through
+	c.Assert(serve("GET", "/.well-known/acme-challenge/other").Body.String(), Equals, "next")
+	c.Assert(serve("POST", "/.well-known/acme-challenge/token").Body.String(), Equals, "next")
+	c.Assert(serve("GET", "/token").Body.String(), Equals, "next")
+}
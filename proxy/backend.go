@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/vulcand/vulcand/engine"
 )
 
@@ -13,8 +14,20 @@ type backend struct {
 	backend engine.Backend
 
 	frontends map[engine.FrontendKey]*frontend
+	// listeners are TCP listeners forwarding connections to the backend
+	listeners map[engine.ListenerKey]*tcpServer
 	servers   []engine.Server
 	transport *http.Transport
+	// checker is set when active health checks are enabled for the backend
+	checker *healthChecker
+	// detector is set when outlier detection is enabled for the backend
+	detector *outlierDetector
+	// slowStart is set when slow start is enabled for the backend
+	slowStart *slowStart
+	// tunnels are the connection upgrades tunneled to the servers
+	tunnels *openTunnels
+	// conns are the connections to the servers counted by least-conn balancers
+	conns *serverConns
 }
 
 func newBackend(m *mux, b engine.Backend) (*backend, error) {
@@ -22,13 +35,29 @@ func newBackend(m *mux, b engine.Backend) (*backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &backend{
+	be := &backend{
 		mux:       m,
 		backend:   b,
 		transport: newTransport(s),
 		servers:   []engine.Server{},
 		frontends: make(map[engine.FrontendKey]*frontend),
-	}, nil
+		listeners: make(map[engine.ListenerKey]*tcpServer),
+		tunnels:   newOpenTunnels(),
+		conns:     newServerConns(),
+	}
+	if err := be.startHealthChecks(b, nil); err != nil {
+		return nil, err
+	}
+	if err := be.startOutlierDetection(b); err != nil {
+		be.stopHealthChecks()
+		return nil, err
+	}
+	if err := be.startSlowStart(b); err != nil {
+		be.stopHealthChecks()
+		be.stopOutlierDetection()
+		return nil, err
+	}
+	return be, nil
 }
 
 func (b *backend) String() string {
@@ -43,11 +72,168 @@ func (b *backend) unlinkFrontend(key engine.FrontendKey) {
 	delete(b.frontends, key)
 }
 
+func (b *backend) linkListener(key engine.ListenerKey, t *tcpServer) {
+	b.listeners[key] = t
+}
+
+func (b *backend) unlinkListener(key engine.ListenerKey) {
+	delete(b.listeners, key)
+}
+
 func (b *backend) Close() error {
+	b.stopHealthChecks()
+	b.stopOutlierDetection()
+	b.stopSlowStart()
 	b.transport.CloseIdleConnections()
 	return nil
 }
 
+// startHealthChecks starts the health checker, the servers known to the previous checker start with their last health
+func (b *backend) startHealthChecks(be engine.Backend, previous *healthChecker) error {
+	s, err := be.HealthCheckSettings()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+	b.checker = newHealthChecker(*s, b.transport, b.mux.options.TimeProvider, b.mux.wg, b.mux.stopC, b.onHealthChange)
+	if previous != nil {
+		b.checker.seedHealth(previous)
+	}
+	b.checker.syncServers(b.servers)
+	return nil
+}
+
+func (b *backend) stopHealthChecks() {
+	if b.checker != nil {
+		b.checker.stop()
+		b.checker = nil
+	}
+}
+
+func (b *backend) startOutlierDetection(be engine.Backend) error {
+	s, err := be.OutlierDetectionSettings()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return nil
+	}
+	b.detector = newOutlierDetector(*s, b.mux.options.TimeProvider, b.mux.wg, b.mux.stopC)
+	b.detector.start(b.detectOutliers)
+	return nil
+}
+
+func (b *backend) stopOutlierDetection() {
+	if b.detector != nil {
+		b.detector.stop()
+		b.detector = nil
+	}
+}
+
+func (b *backend) startSlowStart(be engine.Backend) error {
+	d, err := be.SlowStart()
+	if err != nil {
+		return err
+	}
+	if d == 0 {
+		return nil
+	}
+	b.slowStart = newSlowStart(d, b.mux.options.TimeProvider, b.mux.wg, b.mux.stopC, b.inRotation())
+	b.slowStart.start(b.updateSlowStart)
+	return nil
+}
+
+func (b *backend) stopSlowStart() {
+	if b.slowStart != nil {
+		b.slowStart.stop()
+		b.slowStart = nil
+	}
+}
+
+// onHealthChange is called by the health checker when server goes in or out of rotation
+func (b *backend) onHealthChange(c *healthChecker, srv engine.Server, h engine.ServerHealth) {
+	if h.Healthy {
+		log.Infof("%v %v is healthy, returning it into rotation", b, &srv)
+	} else {
+		log.Warningf("%v %v is unhealthy: %v, taking it out of rotation", b, &srv, h.LastError)
+	}
+
+	b.mux.mtx.Lock()
+	defer b.mux.mtx.Unlock()
+
+	// The checker could have been replaced or the backend deleted while we were waiting for the lock
+	if b.checker != c || b.mux.backends[engine.BackendKey{Id: b.backend.Id}] != b {
+		return
+	}
+	if err := b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", b, err)
+	}
+}
+
+// inRotation returns servers that can receive new requests. Servers that are
+// taken out of rotation are removed from load balancers, so in-flight requests are allowed to finish
+func (b *backend) inRotation() []engine.Server {
+	return b.available((*engine.Server).IsActive)
+}
+
+// sessionServers returns servers that keep serving the sticky sessions pinned to them. Draining
+// servers get no new sessions from the load balancers, but keep serving the sessions they have.
+func (b *backend) sessionServers() []engine.Server {
+	return b.available((*engine.Server).ServesSessions)
+}
+
+// available returns the healthy and admitted servers in the administrative state accepted by inState
+func (b *backend) available(inState func(*engine.Server) bool) []engine.Server {
+	out := make([]engine.Server, 0, len(b.servers))
+	for _, s := range b.servers {
+		if !inState(&s) {
+			continue
+		}
+		if b.checker != nil && !b.checker.isHealthy(s.Id) {
+			continue
+		}
+		if b.detector != nil && b.detector.isEjected(s.Id) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func (b *backend) serverHealth(sk engine.ServerKey) (*engine.ServerHealth, error) {
+	if _, ok := b.findServer(sk); !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk)}
+	}
+	if b.checker == nil {
+		return nil, nil
+	}
+	h, _ := b.checker.health(sk.Id)
+	return h, nil
+}
+
+func (b *backend) serverEjection(sk engine.ServerKey) (*engine.ServerEjection, error) {
+	if _, ok := b.findServer(sk); !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk)}
+	}
+	if b.detector == nil {
+		return nil, nil
+	}
+	return b.detector.ejection(sk.Id), nil
+}
+
+func (b *backend) serverRampUp(sk engine.ServerKey) (*engine.ServerRampUp, error) {
+	s, ok := b.findServer(sk)
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk)}
+	}
+	if b.slowStart == nil {
+		return nil, nil
+	}
+	return b.slowStart.rampUp(*s, b.slowStart.clock.UtcNow()), nil
+}
+
 func (b *backend) update(be engine.Backend) error {
 	if err := b.updateSettings(be); err != nil {
 		return err
@@ -68,15 +254,72 @@ func (b *backend) updateSettings(be engine.Backend) error {
 	if err != nil {
 		return err
 	}
+	if _, err := be.HealthCheckSettings(); err != nil {
+		return err
+	}
+	if _, err := be.LoadBalancerSettings(); err != nil {
+		return err
+	}
+	if _, err := be.StickySessionSettings(); err != nil {
+		return err
+	}
+	if _, err := be.OutlierDetectionSettings(); err != nil {
+		return err
+	}
+	if _, err := be.SlowStart(); err != nil {
+		return err
+	}
+	if _, err := be.ProxyProtocolVersion(); err != nil {
+		return err
+	}
 	t := newTransport(s)
 	b.transport.CloseIdleConnections()
 	b.transport = t
+	// Health, ejections and ramp ups are only reset when their own settings change,
+	// otherwise unhealthy and ejected servers would get back into rotation on any change
+	if !healthCheckEquals(olds.HealthCheck, news.HealthCheck) {
+		previous := b.checker
+		b.stopHealthChecks()
+		if err := b.startHealthChecks(be, previous); err != nil {
+			return err
+		}
+	} else if b.checker != nil {
+		b.checker.setTransport(t)
+	}
+	if !outlierDetectionEquals(olds.OutlierDetection, news.OutlierDetection) {
+		b.stopOutlierDetection()
+		if err := b.startOutlierDetection(be); err != nil {
+			return err
+		}
+	}
+	if olds.SlowStart != news.SlowStart {
+		b.stopSlowStart()
+		if err := b.startSlowStart(be); err != nil {
+			return err
+		}
+	}
+	// frontends and listeners rebuild load balancers using the new settings
+	b.backend = be
 	for _, f := range b.frontends {
 		f.updateTransport(t)
 	}
+	b.mux.syncMirrors(engine.BackendKey{Id: be.Id}, b)
+	for _, l := range b.listeners {
+		if err := l.rebuild(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func healthCheckEquals(a, b *engine.HTTPBackendHealthCheck) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Equals(b))
+}
+
+func outlierDetectionEquals(a, b *engine.HTTPBackendOutlierDetection) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
 func (b *backend) indexOfServer(id string) int {
 	for i := range b.servers {
 		if b.servers[i].Id == id {
@@ -96,10 +339,19 @@ func (b *backend) findServer(sk engine.ServerKey) (*engine.Server, bool) {
 
 func (b *backend) upsertServer(s engine.Server) error {
 	if i := b.indexOfServer(s.Id); i != -1 {
+		if b.servers[i].GetState() != s.GetState() {
+			log.Infof("%v %v changed state from %v to %v", b, &s, b.servers[i].GetState(), s.GetState())
+			if !s.ServesSessions() {
+				b.tunnels.closeServer(b.servers[i].URL)
+			}
+		}
 		b.servers[i] = s
 	} else {
 		b.servers = append(b.servers, s)
 	}
+	if b.checker != nil {
+		b.checker.syncServers(b.servers)
+	}
 	return b.updateFrontends()
 }
 
@@ -109,15 +361,30 @@ func (b *backend) deleteServer(sk engine.ServerKey) error {
 		return fmt.Errorf("%v not found %v", b, sk)
 	}
 	b.servers = append(b.servers[:i], b.servers[i+1:]...)
+	if b.checker != nil {
+		b.checker.syncServers(b.servers)
+	}
+	if b.detector != nil {
+		b.detector.syncServers(b.servers)
+	}
 	return b.updateFrontends()
 }
 
 func (b *backend) updateFrontends() error {
+	if b.slowStart != nil {
+		b.slowStart.syncServers(b.inRotation(), b.slowStart.clock.UtcNow())
+	}
 	for _, f := range b.frontends {
-		if err := f.updateBackend(b); err != nil {
+		if err := f.syncBackend(b); err != nil {
+			return err
+		}
+	}
+	for _, l := range b.listeners {
+		if err := l.syncBackend(); err != nil {
 			return err
 		}
 	}
+	b.mux.syncMirrors(engine.BackendKey{Id: b.backend.Id}, b)
 	return nil
 }
 
@@ -131,5 +398,7 @@ func newTransport(s *engine.TransportSettings) *http.Transport {
 		TLSHandshakeTimeout:   s.Timeouts.TLSHandshake,
 		MaxIdleConnsPerHost:   s.KeepAlive.MaxIdleConnsPerHost,
 		TLSClientConfig:       s.TLS,
+		// Custom dialer turns HTTP/2 off unless it's forced
+		ForceAttemptHTTP2: s.HTTP2,
 	}
 }
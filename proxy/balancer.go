@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// balancer distributes requests across the servers of the backend
+type balancer interface {
+	http.Handler
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, weight int) error
+	RemoveServer(u *url.URL) error
+}
+
+// newBalancer creates the balancer, conns are the connections to the servers of the backend counted by least-conn balancers
+func newBalancer(s engine.LoadBalancerSettings, next http.Handler, conns *serverConns, l utils.Logger) (balancer, error) {
+	switch s.Algorithm {
+	case engine.LBConsistentHash:
+		return newHashBalancer(next, s.HashVariable)
+	case engine.LBLeastConn:
+		return newLeastConnBalancer(next, conns), nil
+	}
+	rr, err := roundrobin.New(next)
+	if err != nil {
+		return nil, err
+	}
+	// Rebalancer will readjust load balancer weights based on error ratios
+	rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerLogger(l))
+	if err != nil {
+		return nil, err
+	}
+	return &rrBalancer{Rebalancer: rb}, nil
+}
+
+// rrBalancer is a weighted round robin with error ratio based rebalancing
+type rrBalancer struct {
+	*roundrobin.Rebalancer
+}
+
+func (b *rrBalancer) UpsertServer(u *url.URL, weight int) error {
+	return b.Rebalancer.UpsertServer(u, roundrobin.Weight(weight))
+}
+
+// hashReplicas is the amount of points every unit of server weight gets on the hash ring
+const hashReplicas = 64
+
+// hashBalancer picks servers using consistent hashing of the request variable, so requests with the
+// same value go to the same server. Every server owns a set of points on the ring that depend only
+// on the server itself, so adding or removing a server only moves the keys owned by that server.
+type hashBalancer struct {
+	mtx     *sync.RWMutex
+	next    http.Handler
+	extract utils.SourceExtractor
+	servers []*lbServer
+	points  []uint32
+	owners  map[uint32]*lbServer
+}
+
+type lbServer struct {
+	url    *url.URL
+	weight int
+}
+
+func newHashBalancer(next http.Handler, variable string) (*hashBalancer, error) {
+	extract, err := utils.NewExtractor(variable)
+	if err != nil {
+		return nil, err
+	}
+	return &hashBalancer{
+		mtx:     &sync.RWMutex{},
+		next:    next,
+		extract: extract,
+		owners:  make(map[uint32]*lbServer),
+	}, nil
+}
+
+func (b *hashBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key, _, err := b.extract.Extract(req)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u := b.nextServer(key)
+	if u == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	newReq := *req
+	newReq.URL = u
+	b.next.ServeHTTP(w, &newReq)
+}
+
+func (b *hashBalancer) nextServer(key string) *url.URL {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	if len(b.points) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(b.points), func(i int) bool { return b.points[i] >= h })
+	if i == len(b.points) {
+		i = 0
+	}
+	return b.owners[b.points[i]].url
+}
+
+func (b *hashBalancer) Servers() []*url.URL {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	out := make([]*url.URL, len(b.servers))
+	for i, s := range b.servers {
+		out[i] = s.url
+	}
+	return out
+}
+
+func (b *hashBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if weight < 0 {
+		return fmt.Errorf("weight should be >= 0, got %d", weight)
+	}
+	if i := indexOfServer(b.servers, u); i != -1 {
+		b.servers[i].weight = weight
+	} else {
+		b.servers = append(b.servers, &lbServer{url: utils.CopyURL(u), weight: weight})
+	}
+	b.buildRing()
+	return nil
+}
+
+func (b *hashBalancer) RemoveServer(u *url.URL) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	i := indexOfServer(b.servers, u)
+	if i == -1 {
+		return fmt.Errorf("server %v not found", u)
+	}
+	b.servers = append(b.servers[:i], b.servers[i+1:]...)
+	b.buildRing()
+	return nil
+}
+
+// buildRing places servers on the ring, points of a server are derived from it's URL
+func (b *hashBalancer) buildRing() {
+	owners := make(map[uint32]*lbServer)
+	points := []uint32{}
+	for _, s := range b.servers {
+		key := s.url.String()
+		for i := 0; i < s.weight*hashReplicas; i++ {
+			p := crc32.ChecksumIEEE([]byte(key + "-" + strconv.Itoa(i)))
+			// Collisions are resolved in favor of the smaller URL, so the ring does not depend on the order of servers
+			if o, ok := owners[p]; ok && o.url.String() < key {
+				continue
+			} else if !ok {
+				points = append(points, p)
+			}
+			owners[p] = s
+		}
+	}
+	sort.Sort(uint32Slice(points))
+	b.points = points
+	b.owners = owners
+}
+
+// leastConnBalancer picks the server with the fewest connections, ties are broken by weight.
+// Servers with the same amount of connections and weight are picked in turns. Connections are
+// counted by the backend, so the balancers of all frontends and listeners using it see the same load.
+type leastConnBalancer struct {
+	mtx     *sync.Mutex
+	next    http.Handler
+	conns   *serverConns
+	servers []*lbServer
+	// offset rotates the server the search starts from
+	offset int
+}
+
+func newLeastConnBalancer(next http.Handler, conns *serverConns) *leastConnBalancer {
+	return &leastConnBalancer{
+		mtx:   &sync.Mutex{},
+		next:  next,
+		conns: conns,
+	}
+}
+
+func (b *leastConnBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u := b.acquire()
+	if u == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer b.conns.release(u)
+
+	newReq := *req
+	newReq.URL = u
+	b.next.ServeHTTP(w, &newReq)
+}
+
+// acquire picks the server and counts the connection to it
+func (b *leastConnBalancer) acquire() *url.URL {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	s := b.conns.acquireLeast(b.servers, b.offset)
+	b.offset += 1
+	if s == nil {
+		return nil
+	}
+	return s.url
+}
+
+func (b *leastConnBalancer) Servers() []*url.URL {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	out := make([]*url.URL, len(b.servers))
+	for i, s := range b.servers {
+		out[i] = s.url
+	}
+	return out
+}
+
+func (b *leastConnBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if weight < 0 {
+		return fmt.Errorf("weight should be >= 0, got %d", weight)
+	}
+	for _, s := range b.servers {
+		if sameServer(s.url, u) {
+			s.weight = weight
+			return nil
+		}
+	}
+	b.servers = append(b.servers, &lbServer{url: utils.CopyURL(u), weight: weight})
+	return nil
+}
+
+func (b *leastConnBalancer) RemoveServer(u *url.URL) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for i, s := range b.servers {
+		if sameServer(s.url, u) {
+			b.servers = append(b.servers[:i], b.servers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("server %v not found", u)
+}
+
+// serverConns counts the connections to the servers of the backend: requests in flight picked by least-conn
+// balancers of all frontends and listeners, requests pinned by sticky sessions and open tunnels
+type serverConns struct {
+	mtx   *sync.Mutex
+	conns map[surl]int64
+}
+
+func newServerConns() *serverConns {
+	return &serverConns{
+		mtx:   &sync.Mutex{},
+		conns: make(map[surl]int64),
+	}
+}
+
+// acquireLeast picks the server with the fewest connections, starting the search from offset, and counts
+// the connection to it. Servers with zero weight are skipped.
+func (c *serverConns) acquireLeast(servers []*lbServer, offset int) *lbServer {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var best *lbServer
+	var bestConns int64
+	for i := range servers {
+		s := servers[(offset+i)%len(servers)]
+		if s.weight == 0 {
+			continue
+		}
+		n := c.conns[surl{scheme: s.url.Scheme, host: s.url.Host}]
+		if best == nil || n < bestConns || (n == bestConns && s.weight > best.weight) {
+			best, bestConns = s, n
+		}
+	}
+	if best != nil {
+		c.conns[surl{scheme: best.url.Scheme, host: best.url.Host}] += 1
+	}
+	return best
+}
+
+func (c *serverConns) acquire(u *url.URL) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.conns[surl{scheme: u.Scheme, host: u.Host}] += 1
+}
+
+func (c *serverConns) release(u *url.URL) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := surl{scheme: u.Scheme, host: u.Host}
+	c.conns[key] -= 1
+	if c.conns[key] <= 0 {
+		delete(c.conns, key)
+	}
+}
+
+func indexOfServer(servers []*lbServer, u *url.URL) int {
+	for i, s := range servers {
+		if sameServer(s.url, u) {
+			return i
+		}
+	}
+	return -1
+}
+
+func sameServer(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme && a.Host == b.Host && a.Path == b.Path
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&BalancerSuite{})
+
+type BalancerSuite struct {
+}
+
+func (s *BalancerSuite) TestHashRingMinimalMovement(c *C) {
+	b, err := newHashBalancer(http.NotFoundHandler(), "request.header.X-User")
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(b.UpsertServer(mustParseURL(fmt.Sprintf("http://localhost:%d", 5000+i)), 1), IsNil)
+	}
+	before := hashKeys(b, 1000)
+
+	// Adding a server moves keys only to the new server
+	added := mustParseURL("http://localhost:5003")
+	c.Assert(b.UpsertServer(added, 1), IsNil)
+	after := hashKeys(b, 1000)
+	moved := 0
+	for k, u := range after {
+		if before[k] != u {
+			c.Assert(u, Equals, added.String())
+			moved += 1
+		}
+	}
+	c.Assert(moved > 0, Equals, true)
+	c.Assert(moved < 500, Equals, true)
+
+	// Removing the server brings the keys back
+	c.Assert(b.RemoveServer(added), IsNil)
+	c.Assert(hashKeys(b, 1000), DeepEquals, before)
+
+	// Ring does not depend on the order servers were added in
+	b2, err := newHashBalancer(http.NotFoundHandler(), "request.header.X-User")
+	c.Assert(err, IsNil)
+	for i := 2; i >= 0; i-- {
+		c.Assert(b2.UpsertServer(mustParseURL(fmt.Sprintf("http://localhost:%d", 5000+i)), 1), IsNil)
+	}
+	c.Assert(hashKeys(b2, 1000), DeepEquals, before)
+}
+
+func (s *BalancerSuite) TestHashRingEmpty(c *C) {
+	b, err := newHashBalancer(http.NotFoundHandler(), "client.ip")
+	c.Assert(err, IsNil)
+	c.Assert(b.nextServer("a"), IsNil)
+
+	c.Assert(b.RemoveServer(mustParseURL("http://localhost:5000")), NotNil)
+}
+
+func (s *BalancerSuite) TestLeastConn(c *C) {
+	b := newLeastConnBalancer(http.NotFoundHandler(), newServerConns())
+
+	u1, u2 := mustParseURL("http://localhost:5000"), mustParseURL("http://localhost:5001")
+	c.Assert(b.UpsertServer(u1, 1), IsNil)
+	c.Assert(b.UpsertServer(u2, 1), IsNil)
+
+	s1 := b.acquire()
+	s2 := b.acquire()
+	c.Assert(s1, Not(DeepEquals), s2)
+
+	// Server that completes the request first gets the next one
+	b.conns.release(s2)
+	c.Assert(b.acquire(), DeepEquals, s2)
+
+	c.Assert(b.RemoveServer(u1), IsNil)
+	c.Assert(b.Servers(), DeepEquals, []*url.URL{u2})
+}
+
+// Balancers of the backend share the connection counts, including the connections that bypass the balancers
+func (s *BalancerSuite) TestLeastConnSharedConns(c *C) {
+	conns := newServerConns()
+	b1 := newLeastConnBalancer(http.NotFoundHandler(), conns)
+	b2 := newLeastConnBalancer(http.NotFoundHandler(), conns)
+
+	u1, u2 := mustParseURL("http://localhost:5000"), mustParseURL("http://localhost:5001")
+	for _, b := range []*leastConnBalancer{b1, b2} {
+		c.Assert(b.UpsertServer(u1, 1), IsNil)
+		c.Assert(b.UpsertServer(u2, 1), IsNil)
+	}
+
+	s1 := b1.acquire()
+	c.Assert(b2.acquire(), Not(DeepEquals), s1)
+
+	// Pinned request to the other server makes the first one the least loaded
+	conns.acquire(u2)
+	conns.acquire(u2)
+	c.Assert(b2.acquire(), DeepEquals, u1)
+
+	conns.release(u2)
+	conns.release(u2)
+	conns.release(u2)
+	c.Assert(b1.acquire(), DeepEquals, u2)
+}
+
+func (s *BalancerSuite) TestLeastConnTies(c *C) {
+	b := newLeastConnBalancer(http.NotFoundHandler(), newServerConns())
+
+	u1, u2, u3 := mustParseURL("http://localhost:5000"), mustParseURL("http://localhost:5001"), mustParseURL("http://localhost:5002")
+	c.Assert(b.UpsertServer(u1, 1), IsNil)
+	c.Assert(b.UpsertServer(u2, 3), IsNil)
+	c.Assert(b.UpsertServer(u3, 1), IsNil)
+
+	// Heavier server wins the tie
+	s2 := b.acquire()
+	c.Assert(s2, DeepEquals, u2)
+
+	// Servers with equal load and weight are picked in turns
+	picked := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		picked[b.acquire().String()] = true
+	}
+	c.Assert(picked, DeepEquals, map[string]bool{u1.String(): true, u3.String(): true})
+
+	// Idle servers are preferred regardless of weight
+	b.conns.release(s2)
+	c.Assert(b.acquire(), DeepEquals, s2)
+}
+
+func hashKeys(b *hashBalancer, count int) map[string]string {
+	out := make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		k := fmt.Sprintf("user-%d", i)
+		out[k] = b.nextServer(k).String()
+	}
+	return out
+}
+
+func mustParseURL(in string) *url.URL {
+	u, err := url.Parse(in)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// DefaultCertExpiryWarning is the period before the certificate expiry when the warnings are logged
+	DefaultCertExpiryWarning = 30 * 24 * time.Hour
+	// certCheckPeriod is the period between the checks of host certificates
+	certCheckPeriod = time.Hour
+)
+
+// updateCertExpiry remembers when the host certificate expires, so the expiry can be reported without parsing
+// the certificates every time, and warns if the certificate is about to expire. Should be called under the lock.
+func (mx *mux) updateCertExpiry(host engine.Host) {
+	hk := engine.HostKey{Name: host.Name}
+	if host.Settings.KeyPair == nil {
+		delete(mx.certExpiry, hk)
+		return
+	}
+	info, err := host.Settings.KeyPair.Info()
+	if err != nil {
+		log.Warningf("%s failed to parse certificate of %s: %s", mx, &host, err)
+		delete(mx.certExpiry, hk)
+		return
+	}
+	mx.certExpiry[hk] = info.NotAfter
+	mx.checkCertExpiry(hk, info.NotAfter)
+}
+
+// checkCertificates warns about the host certificates that are about to expire
+func (mx *mux) checkCertificates() {
+	mx.mtx.RLock()
+	defer mx.mtx.RUnlock()
+
+	for hk, notAfter := range mx.certExpiry {
+		mx.checkCertExpiry(hk, notAfter)
+	}
+}
+
+func (mx *mux) checkCertExpiry(hk engine.HostKey, notAfter time.Time) {
+	left := notAfter.Sub(mx.options.TimeProvider.UtcNow())
+	switch {
+	case left <= 0:
+		log.Errorf("%s certificate of %s expired on %s", mx, hk, notAfter.Format(time.RFC3339))
+	case left < mx.options.CertExpiryWarning:
+		log.Warningf("%s certificate of %s expires in %d days on %s", mx, hk, daysUntil(left), notAfter.Format(time.RFC3339))
+	}
+}
+
+// emitCertMetrics reports days until the host certificates expire, negative for expired certificates
+func (mx *mux) emitCertMetrics() {
+	c := mx.options.MetricsClient
+	now := mx.options.TimeProvider.UtcNow()
+
+	mx.mtx.RLock()
+	defer mx.mtx.RUnlock()
+
+	for hk, notAfter := range mx.certExpiry {
+		m := c.Metric("host", strings.Replace(hk.Name, ".", "_", -1), "cert", "days_until_expiry")
+		c.Gauge(m, daysUntil(notAfter.Sub(now)), 1)
+	}
+}
+
+func daysUntil(d time.Duration) int64 {
+	return int64(d / (24 * time.Hour))
+}
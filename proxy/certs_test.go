@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/metrics"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/stapler"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&CertExpirySuite{})
+
+type CertExpirySuite struct {
+}
+
+// gaugeRecorder remembers the last values of the gauges
+type gaugeRecorder struct {
+	metrics.Client
+	mtx    sync.Mutex
+	gauges map[string]int64
+}
+
+func (r *gaugeRecorder) Gauge(stat interface{}, value int64, rate float32) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.gauges[stat.(metrics.Metric).String()] = value
+	return nil
+}
+
+func (r *gaugeRecorder) get(name string) (int64, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	v, ok := r.gauges[name]
+	return v, ok
+}
+
+func (s *CertExpirySuite) TestMetrics(c *C) {
+	ca := newTestCA(c)
+	cert, key := ca.issuePEM(c, "example.com", []string{"example.com"})
+	host := engine.Host{Name: "example.com", Settings: engine.HostSettings{KeyPair: &engine.KeyPair{Cert: cert, Key: key}}}
+	info, err := host.Settings.KeyPair.Info()
+	c.Assert(err, IsNil)
+	notAfter := info.NotAfter
+
+	r := &gaugeRecorder{Client: metrics.NewNop(), gauges: make(map[string]int64)}
+	clock := &timetools.FreezedTime{CurrentTime: notAfter.Add(-10*24*time.Hour - time.Minute)}
+	m, err := New(1, stapler.New(), Options{MetricsClient: r, TimeProvider: clock})
+	c.Assert(err, IsNil)
+	defer m.Stop(true)
+
+	c.Assert(m.UpsertHost(host), IsNil)
+	c.Assert(m.UpsertHost(engine.Host{Name: "nocert.example.com"}), IsNil)
+
+	const gauge = "host.example_com.cert.days_until_expiry"
+	m.emitCertMetrics()
+	days, ok := r.get(gauge)
+	c.Assert(ok, Equals, true)
+	c.Assert(days, Equals, int64(10))
+	_, ok = r.get("host.nocert_example_com.cert.days_until_expiry")
+	c.Assert(ok, Equals, false)
+
+	// Expired certificates are reported with negative values
+	clock.CurrentTime = notAfter.Add(24*time.Hour + time.Minute)
+	m.checkCertificates()
+	m.emitCertMetrics()
+	days, _ = r.get(gauge)
+	c.Assert(days, Equals, int64(-1))
+
+	// Hosts that lost the certificates are not reported
+	c.Assert(m.UpsertHost(engine.Host{Name: "example.com"}), IsNil)
+	c.Assert(len(m.certExpiry), Equals, 0)
+
+	c.Assert(m.UpsertHost(host), IsNil)
+	c.Assert(m.DeleteHost(engine.HostKey{Name: host.Name}), IsNil)
+	c.Assert(len(m.certExpiry), Equals, 0)
+}
+
+func (s *CertExpirySuite) TestDaysUntil(c *C) {
+	c.Assert(daysUntil(30*24*time.Hour), Equals, int64(30))
+	c.Assert(daysUntil(47*time.Hour), Equals, int64(1))
+	c.Assert(daysUntil(time.Hour), Equals, int64(0))
+	c.Assert(daysUntil(-25*time.Hour), Equals, int64(-1))
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// ApplyChanges applies the engine change events as one unit, the requests never see the configuration
+// with only some of the changes applied, as they are not routed while the change set is applied. The changes are applied to the running configuration, so the
+// health, ejections, ramp ups and stats of the objects that are not deleted are kept. If any of the changes
+// fails, the changes applied before it are rolled back and the error is returned.
+func (m *mux) ApplyChanges(changes []interface{}) error {
+	log.Infof("%v ApplyChanges %d changes", m, len(changes))
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.changeMtx.Lock()
+	defer m.changeMtx.Unlock()
+
+	undos := make([]func() error, 0, len(changes))
+	for i, ch := range changes {
+		undo, err := m.undoChange(ch)
+		if err == nil {
+			err = m.applyChange(ch)
+		}
+		if err != nil {
+			for j := len(undos) - 1; j >= 0; j-- {
+				if err := undos[j](); err != nil {
+					log.Errorf("%v failed to roll back %v: %v", m, changes[j], err)
+				}
+			}
+			return fmt.Errorf("change %d %v failed: %v", i, ch, err)
+		}
+		undos = append(undos, undo)
+	}
+	return nil
+}
+
+type releaseRouteKey struct{}
+
+// changeGate routes the requests under the read lock of the change sets, so the requests are routed
+// either before or after the change set is applied. The lock is released by the frontend the request
+// is routed to, or once the request is served if no frontend matches it.
+type changeGate struct {
+	mtx  *sync.RWMutex
+	next http.Handler
+}
+
+func (g *changeGate) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.mtx.RLock()
+	once := &sync.Once{}
+	release := func() { once.Do(g.mtx.RUnlock) }
+	defer release()
+	g.next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), releaseRouteKey{}, release)))
+}
+
+// routedHandler releases the change set lock once the request has been routed to the frontend
+type routedHandler struct {
+	next http.Handler
+}
+
+func (h *routedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if release, ok := req.Context().Value(releaseRouteKey{}).(func()); ok {
+		release()
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+func (m *mux) applyChange(ch interface{}) error {
+	switch c := ch.(type) {
+	case *engine.HostUpserted:
+		return m.upsertHost(c.Host)
+	case *engine.HostDeleted:
+		return m.deleteHost(c.HostKey)
+	case *engine.ListenerUpserted:
+		return m.upsertListener(c.Listener)
+	case *engine.ListenerDeleted:
+		return m.deleteListener(c.ListenerKey)
+	case *engine.BackendUpserted:
+		_, err := m.upsertBackend(c.Backend)
+		return err
+	case *engine.BackendDeleted:
+		return m.deleteBackend(c.BackendKey)
+	case *engine.ServerUpserted:
+		return m.upsertServer(c.BackendKey, c.Server)
+	case *engine.ServerDeleted:
+		return m.deleteServer(c.ServerKey)
+	case *engine.FrontendUpserted:
+		_, err := m.upsertFrontend(c.Frontend)
+		return err
+	case *engine.FrontendDeleted:
+		return m.deleteFrontend(c.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		return m.upsertMiddleware(c.FrontendKey, c.Middleware)
+	case *engine.MiddlewareDeleted:
+		return m.deleteMiddleware(c.MiddlewareKey)
+	}
+	return fmt.Errorf("unsupported change: %#v", ch)
+}
+
+// undoChange returns the function that restores the current state of the object the change is about to modify.
+// Deleted objects are restored from their configuration, so their runtime state starts anew.
+func (m *mux) undoChange(ch interface{}) (func() error, error) {
+	switch c := ch.(type) {
+	case *engine.HostUpserted:
+		hk := engine.HostKey{Name: c.Host.Name}
+		if h, ok := m.hosts[hk]; ok {
+			return func() error { return m.upsertHost(h) }, nil
+		}
+		return func() error { return m.deleteHost(hk) }, nil
+	case *engine.HostDeleted:
+		if h, ok := m.hosts[c.HostKey]; ok {
+			return func() error { return m.upsertHost(h) }, nil
+		}
+	case *engine.ListenerUpserted:
+		lk := engine.ListenerKey{Id: c.Listener.Id}
+		if s, ok := m.servers[lk]; ok {
+			l := s.listener
+			return func() error { return m.upsertListener(l) }, nil
+		}
+		return func() error { return m.deleteListener(lk) }, nil
+	case *engine.ListenerDeleted:
+		if s, ok := m.servers[c.ListenerKey]; ok {
+			l := s.listener
+			return func() error { return m.upsertListener(l) }, nil
+		}
+	case *engine.BackendUpserted:
+		bk := engine.BackendKey{Id: c.Backend.Id}
+		if b, ok := m.backends[bk]; ok {
+			be := b.backend
+			return func() error {
+				_, err := m.upsertBackend(be)
+				return err
+			}, nil
+		}
+		return func() error { return m.deleteBackend(bk) }, nil
+	case *engine.BackendDeleted:
+		if b, ok := m.backends[c.BackendKey]; ok {
+			be, servers := b.backend, append([]engine.Server{}, b.servers...)
+			return func() error {
+				if _, err := m.upsertBackend(be); err != nil {
+					return err
+				}
+				for _, s := range servers {
+					if err := m.upsertServer(c.BackendKey, s); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, nil
+		}
+	case *engine.ServerUpserted:
+		sk := engine.ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id}
+		b, ok := m.backends[c.BackendKey]
+		if !ok {
+			// the server upsert creates the backend
+			return func() error { return m.deleteBackend(c.BackendKey) }, nil
+		}
+		if s, ok := b.findServer(sk); ok {
+			srv := *s
+			return func() error { return m.upsertServer(c.BackendKey, srv) }, nil
+		}
+		return func() error { return m.deleteServer(sk) }, nil
+	case *engine.ServerDeleted:
+		if b, ok := m.backends[c.ServerKey.BackendKey]; ok {
+			if s, ok := b.findServer(c.ServerKey); ok {
+				srv := *s
+				return func() error { return m.upsertServer(c.ServerKey.BackendKey, srv) }, nil
+			}
+		}
+	case *engine.FrontendUpserted:
+		fk := engine.FrontendKey{Id: c.Frontend.Id}
+		if f, ok := m.frontends[fk]; ok {
+			fe := f.frontend
+			return func() error {
+				_, err := m.upsertFrontend(fe)
+				return err
+			}, nil
+		}
+		return func() error { return m.deleteFrontend(fk) }, nil
+	case *engine.FrontendDeleted:
+		if f, ok := m.frontends[c.FrontendKey]; ok {
+			fe, ms := f.frontend, f.sortedMiddlewares()
+			return func() error {
+				if _, err := m.upsertFrontend(fe); err != nil {
+					return err
+				}
+				for _, mi := range ms {
+					if err := m.upsertMiddleware(c.FrontendKey, mi); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, nil
+		}
+	case *engine.MiddlewareUpserted:
+		mk := engine.MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id}
+		if f, ok := m.frontends[c.FrontendKey]; ok {
+			if mi, ok := f.middlewares[mk]; ok {
+				return func() error { return m.upsertMiddleware(c.FrontendKey, mi) }, nil
+			}
+		}
+		return func() error { return m.deleteMiddleware(mk) }, nil
+	case *engine.MiddlewareDeleted:
+		if f, ok := m.frontends[c.MiddlewareKey.FrontendKey]; ok {
+			if mi, ok := f.middlewares[c.MiddlewareKey]; ok {
+				return func() error { return m.upsertMiddleware(c.MiddlewareKey.FrontendKey, mi) }, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported change: %#v", ch)
+	}
+	// the change of the missing object fails and is not rolled back
+	return func() error { return nil }, nil
+}
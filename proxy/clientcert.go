@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+type forwardClientCertKey struct{}
+
+// clientCertHandler sets the headers with the verified client certificate, so frontends can be routed by
+// the certificate, and removes these headers sent by the clients, so the certificate can not be spoofed
+type clientCertHandler struct {
+	// forward passes the headers to the servers
+	forward bool
+	next    http.Handler
+}
+
+func (h *clientCertHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.Header.Del(plugin.ClientCertSubjectHeader)
+	req.Header.Del(plugin.ClientCertSANHeader)
+	if subject, ok := plugin.ClientCertSubject(req); ok {
+		san, _ := plugin.ClientCertSAN(req)
+		req.Header.Set(plugin.ClientCertSubjectHeader, subject)
+		req.Header.Set(plugin.ClientCertSANHeader, san)
+	}
+	if h.forward {
+		req = req.WithContext(context.WithValue(req.Context(), forwardClientCertKey{}, true))
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+// clientCertRewriter removes the client certificate headers from the requests to the servers,
+// unless the listener has been set up to forward them
+type clientCertRewriter struct {
+	next forward.ReqRewriter
+}
+
+func (r *clientCertRewriter) Rewrite(req *http.Request) {
+	r.next.Rewrite(req)
+	if fwd, _ := req.Context().Value(forwardClientCertKey{}).(bool); !fwd {
+		req.Header.Del(plugin.ClientCertSubjectHeader)
+		req.Header.Del(plugin.ClientCertSANHeader)
+	}
+}
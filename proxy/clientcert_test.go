@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/plugin"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&ClientCertSuite{})
+
+type ClientCertSuite struct {
+}
+
+func (s *ClientCertSuite) TestHeaders(c *C) {
+	ca := newTestCA(c)
+	cert := ca.issue(c, "client", []string{"client.example.com"}).Leaf
+
+	var got http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	})
+	h := &clientCertHandler{next: next}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(plugin.ClientCertSubjectHeader, "CN=spoofed")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.Get(plugin.ClientCertSubjectHeader), Equals, "CN=client")
+	c.Assert(got.Get(plugin.ClientCertSANHeader), Equals, "DNS:client.example.com")
+
+	// Headers sent by the clients are removed
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set(plugin.ClientCertSubjectHeader, "CN=spoofed")
+	req.Header.Set(plugin.ClientCertSANHeader, "DNS:spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.Get(plugin.ClientCertSubjectHeader), Equals, "")
+	c.Assert(got.Get(plugin.ClientCertSANHeader), Equals, "")
+
+	// Certificates that were not verified are not trusted
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.Get(plugin.ClientCertSubjectHeader), Equals, "")
+}
+
+func (s *ClientCertSuite) TestRewriter(c *C) {
+	r := &clientCertRewriter{next: &forward.HeaderRewriter{}}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set(plugin.ClientCertSubjectHeader, "CN=client")
+	req.Header.Set(plugin.ClientCertSANHeader, "DNS:client.example.com")
+	r.Rewrite(req)
+	c.Assert(req.Header.Get(plugin.ClientCertSubjectHeader), Equals, "")
+	c.Assert(req.Header.Get(plugin.ClientCertSANHeader), Equals, "")
+
+	// Listener forwards the headers
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set(plugin.ClientCertSubjectHeader, "CN=client")
+	req.Header.Set(plugin.ClientCertSANHeader, "DNS:client.example.com")
+	req = req.WithContext(context.WithValue(req.Context(), forwardClientCertKey{}, true))
+	r.Rewrite(req)
+	c.Assert(req.Header.Get(plugin.ClientCertSubjectHeader), Equals, "CN=client")
+	c.Assert(req.Header.Get(plugin.ClientCertSANHeader), Equals, "DNS:client.example.com")
+}
+
+func (s *ClientCertSuite) TestExtractor(c *C) {
+	ca := newTestCA(c)
+	cert := ca.issue(c, "client", []string{"client.example.com"}).Leaf
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, v := range []string{"client.cert.subject", "client.cert.san"} {
+		e, err := plugin.NewExtractor(v)
+		c.Assert(err, IsNil)
+		_, _, err = e.Extract(req)
+		c.Assert(err, NotNil)
+	}
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	e, err := plugin.NewExtractor("client.cert.subject")
+	c.Assert(err, IsNil)
+	token, amount, err := e.Extract(req)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "CN=client")
+	c.Assert(amount, Equals, int64(1))
+
+	e, err = plugin.NewExtractor("client.cert.san")
+	c.Assert(err, IsNil)
+	token, _, err = e.Extract(req)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "DNS:client.example.com")
+
+	// Other variables are supported as before
+	_, err = plugin.NewExtractor("client.ip")
+	c.Assert(err, IsNil)
+	_, err = plugin.NewExtractor("client.cert.bla")
+	c.Assert(err, NotNil)
+}
+
+// testCA issues certificates signed by self signed CA certificate
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(c *C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns the certificate valid for both server and client authentication, Leaf is set
+func (ca *testCA) issue(c *C, cn string, dnsNames []string) tls.Certificate {
+	certPEM, keyPEM := ca.issuePEM(c, cn, dnsNames)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	c.Assert(err, IsNil)
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, IsNil)
+	return cert
+}
+
+func (ca *testCA) issuePEM(c *C, cn string, dnsNames []string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -12,6 +12,9 @@ type connTracker struct {
 	new    map[string]int64
 	active map[string]int64
 	idle   map[string]int64
+	// tunnels counts upgraded client connections tunneled to the servers, these are hijacked
+	// from the http server, so they are reported by the tunnel rather than by the state changes
+	tunnels map[string]int64
 }
 
 func newConnTracker() *connTracker {
@@ -20,6 +23,8 @@ func newConnTracker() *connTracker {
 		new:    make(map[string]int64),
 		active: make(map[string]int64),
 		idle:   make(map[string]int64),
+
+		tunnels: make(map[string]int64),
 	}
 }
 
@@ -54,6 +59,20 @@ func (c *connTracker) inc(conn net.Conn, state http.ConnState, v int64) {
 	m[addr] += v
 }
 
+func (c *connTracker) onTunnelOpen(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.tunnels[conn.LocalAddr().String()] += 1
+}
+
+func (c *connTracker) onTunnelClose(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.tunnels[conn.LocalAddr().String()] -= 1
+}
+
 func (c *connTracker) counts() connStats {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -62,6 +81,8 @@ func (c *connTracker) counts() connStats {
 		http.StateNew:    c.copy(c.new),
 		http.StateActive: c.copy(c.active),
 		http.StateIdle:   c.copy(c.idle),
+
+		http.StateHijacked: c.copy(c.tunnels),
 	}
 }
 
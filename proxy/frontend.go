@@ -8,30 +8,35 @@ import (
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/forward"
-	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/stream"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
 )
 
 type frontend struct {
-	key         engine.FrontendKey
-	mux         *mux
-	frontend    engine.Frontend
-	lb          *roundrobin.Rebalancer
+	key      engine.FrontendKey
+	mux      *mux
+	frontend engine.Frontend
+	// backends are in the same order as frontend's backend refs
+	backends []*backend
+	// upstreams hold load balancers for each backend
+	upstreams []*upstream
+	splitter  *splitter
+	// mirrors forward requests sent by middlewares to other backends, by backend id
+	mirrors     map[string]*mirror
 	handler     http.Handler
-	watcher     *RTWatcher
-	backend     *backend
 	middlewares map[engine.MiddlewareKey]engine.Middleware
 	log         utils.Logger
 }
 
-func newFrontend(m *mux, f engine.Frontend, b *backend) (*frontend, error) {
+func newFrontend(m *mux, f engine.Frontend, bs []*backend) (*frontend, error) {
 	fr := &frontend{
 		key:         engine.FrontendKey{Id: f.Id},
 		frontend:    f,
 		mux:         m,
-		backend:     b,
+		backends:    bs,
 		middlewares: make(map[engine.MiddlewareKey]engine.Middleware),
 		log:         log.GetGlobalLogger(),
 	}
@@ -39,7 +44,9 @@ func newFrontend(m *mux, f engine.Frontend, b *backend) (*frontend, error) {
 	if err := fr.rebuild(); err != nil {
 		return nil, err
 	}
-	b.linkFrontend(engine.FrontendKey{f.Id}, fr)
+	for _, b := range bs {
+		b.linkFrontend(engine.FrontendKey{f.Id}, fr)
+	}
 	return fr, nil
 }
 
@@ -47,16 +54,18 @@ func (f *frontend) String() string {
 	return fmt.Sprintf("%v frontend(wrap=%v)", f.mux, &f.frontend)
 }
 
-// syncs backend servers and rebalancer state
-func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatcher) error {
+// syncs backend servers and balancer state, weights holds server weights currently set in the balancer
+func syncServers(m *mux, rb balancer, backend *backend, w *RTWatcher, weights map[string]int) error {
 	// First, collect and parse servers to add
 	newServers := map[string]*url.URL{}
-	for _, s := range backend.servers {
+	newWeights := map[string]int{}
+	for _, s := range backend.inRotation() {
 		u, err := url.Parse(s.URL)
 		if err != nil {
 			return fmt.Errorf("failed to parse url %v", s.URL)
 		}
 		newServers[s.URL] = u
+		newWeights[u.String()] = backend.serverWeight(s)
 	}
 
 	// Memorize what endpoints exist in load balancer at the moment
@@ -67,13 +76,29 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 
 	// First, add endpoints, that should be added and are not in lb
 	for _, s := range newServers {
+		weight := newWeights[s.String()]
 		if _, exists := existingServers[s.String()]; !exists {
-			if err := rb.UpsertServer(s); err != nil {
+			if err := rb.UpsertServer(s, weight); err != nil {
 				log.Errorf("%v failed to add %v, err: %s", m, s, err)
 			} else {
 				log.Infof("%v add %v", m, s)
+				weights[s.String()] = weight
 			}
 			w.upsertServer(s)
+		} else if weights[s.String()] != weight {
+			// Rebalancer does not support updating servers in place, so we re-add the server with the new weight
+			if err := rb.RemoveServer(s); err != nil {
+				log.Errorf("%v failed to remove %v, err: %s", m, s, err)
+				continue
+			}
+			if err := rb.UpsertServer(s, weight); err != nil {
+				log.Errorf("%v failed to update %v, err: %s", m, s, err)
+				delete(weights, s.String())
+				w.removeServer(s)
+			} else {
+				log.Infof("%v updated %v weight to %d", m, s, weight)
+				weights[s.String()] = weight
+			}
 		}
 	}
 
@@ -85,6 +110,7 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 			} else {
 				log.Infof("%v removed %v", m, v)
 			}
+			delete(weights, k)
 			w.removeServer(v)
 		}
 	}
@@ -106,34 +132,48 @@ func (f *frontend) sortedMiddlewares() []engine.Middleware {
 
 func (f *frontend) rebuild() error {
 	settings := f.frontend.HTTPSettings()
-
-	// set up forwarder
-	fwd, err := forward.New(
-		forward.Logger(f.log),
-		forward.RoundTripper(f.backend.transport),
-		forward.Rewriter(
-			&forward.HeaderRewriter{
-				Hostname:           settings.Hostname,
-				TrustForwardHeader: settings.TrustForwardHeader,
-			}),
-		forward.PassHostHeader(settings.PassHostHeader))
-
-	// rtwatcher will be observing and aggregating metrics
-	watcher, err := NewWatcher(fwd)
+	timeouts, err := f.frontend.TimeoutSettings()
 	if err != nil {
 		return err
 	}
 
-	// Create a load balancer
-	rr, err := roundrobin.New(watcher)
-	if err != nil {
-		return err
+	// set up load balancers for every backend
+	refs := f.frontend.BackendRefs()
+	upstreams := make([]*upstream, len(f.backends))
+	for i, b := range f.backends {
+		u, err := f.newUpstream(b, settings, timeouts)
+		if err != nil {
+			return err
+		}
+		upstreams[i] = u
 	}
 
-	// Rebalancer will readjust load balancer weights based on error ratios
-	rb, err := roundrobin.NewRebalancer(rr, roundrobin.RebalancerLogger(f.log))
-	if err != nil {
-		return err
+	// splitter distributes the traffic across backends
+	var lb http.Handler
+	var sp *splitter
+	if len(upstreams) == 1 {
+		lb = upstreams[0].handler
+	} else {
+		weights := make([]int, len(refs))
+		for i, r := range refs {
+			weights[i] = r.Weight
+		}
+		sp = newSplitter(upstreams, weights)
+		lb = sp
+	}
+
+	// middlewares can send requests to other backends via mirrors
+	mirrors := make(map[string]*mirror)
+	getBackend := func(id string) (http.Handler, error) {
+		if m, ok := mirrors[id]; ok {
+			return m, nil
+		}
+		m, err := newMirror(f.mux, f, id)
+		if err != nil {
+			return nil, err
+		}
+		mirrors[id] = m
+		return m, nil
 	}
 
 	// create middlewares sorted by priority and chain them
@@ -142,11 +182,17 @@ func (f *frontend) rebuild() error {
 	for i, m := range middlewares {
 		var prev http.Handler
 		if i == 0 {
-			prev = rb
+			prev = lb
 		} else {
 			prev = handlers[i-1]
 		}
-		h, err := m.Middleware.NewHandler(prev)
+		var h http.Handler
+		var err error
+		if bm, ok := m.Middleware.(plugin.BackendMiddleware); ok {
+			h, err = bm.NewBackendHandler(prev, getBackend)
+		} else {
+			h, err = m.Middleware.NewHandler(prev)
+		}
 		if err != nil {
 			return err
 		}
@@ -157,7 +203,7 @@ func (f *frontend) rebuild() error {
 	if len(handlers) != 0 {
 		next = handlers[len(handlers)-1]
 	} else {
-		next = rb
+		next = lb
 	}
 
 	// stream will retry and replay requests, fix encodings
@@ -173,21 +219,120 @@ func (f *frontend) rebuild() error {
 		return err
 	}
 
-	if err := syncServers(f.mux, rb, f.backend, watcher); err != nil {
-		return err
+	// deadline covers all failover attempts
+	var handler http.Handler = str
+	if timeouts.Request != 0 {
+		handler = &deadlineHandler{timeout: timeouts.Request, next: str}
 	}
 
+	// middlewares mark the requests to act once for all failover attempts
+	handler = &requestMarksHandler{next: handler}
+
+	// connection upgrades are tunneled by upstreams
+	handler = &upgradeSwitch{upgrade: next, next: handler}
+
+	// the change sets wait for the requests to be routed, but not served
+	handler = &routedHandler{next: handler}
+
 	// Add the frontend to the router
-	if err := f.mux.router.Handle(f.frontend.Route, str); err != nil {
+	if err := f.mux.router.Handle(f.frontend.Route, handler); err != nil {
 		return err
 	}
 
-	f.lb = rb
-	f.handler = str
-	f.watcher = watcher
+	f.upstreams = upstreams
+	f.splitter = sp
+	f.mirrors = mirrors
+	f.handler = handler
 	return nil
 }
 
+func (f *frontend) newUpstream(b *backend, settings engine.HTTPFrontendSettings, timeouts *engine.FrontendTimeoutSettings) (*upstream, error) {
+	var rt http.RoundTripper = b.transport
+	if timeouts.ResponseHeader != 0 {
+		rt = &headerTimeoutTransport{timeout: timeouts.ResponseHeader, next: rt}
+	}
+
+	// set up forwarder
+	rewriter := &clientCertRewriter{next: &forward.HeaderRewriter{
+		Hostname:           settings.Hostname,
+		TrustForwardHeader: settings.TrustForwardHeader,
+	}}
+	errHandler := &timeoutErrorHandler{body: timeouts.Body}
+	fwd, err := forward.New(
+		forward.Logger(f.log),
+		forward.RoundTripper(rt),
+		forward.ErrorHandler(errHandler),
+		forward.Rewriter(rewriter),
+		forward.PassHostHeader(settings.PassHostHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	// tunnel takes over connection upgrades, e.g. websockets
+	tun := &tunnel{
+		mux:        f.mux,
+		tunnels:    b.tunnels,
+		transport:  b.transport,
+		rewriter:   rewriter,
+		passHost:   settings.PassHostHeader,
+		timeout:    timeouts.ResponseHeader,
+		errHandler: errHandler,
+		next:       fwd,
+	}
+
+	// rtwatcher will be observing and aggregating metrics
+	watcher, err := NewWatcher(tun)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upstream{
+		backend: b,
+		watcher: watcher,
+		weights: make(map[string]int),
+	}
+
+	ls, err := b.backend.LoadBalancerSettings()
+	if err != nil {
+		return nil, err
+	}
+	// Least-conn balancers count the connections bypassing them as well, e.g. pinned requests and tunnels
+	var conns *serverConns
+	if ls.Algorithm == engine.LBLeastConn {
+		conns = b.conns
+		tun.conns = conns
+	}
+
+	// Sticky sessions route pinned requests directly and pin the rest to the servers picked by load balancer
+	ss, err := b.backend.StickySessionSettings()
+	if err != nil {
+		return nil, err
+	}
+	var next http.Handler = watcher
+	if ss != nil {
+		u.sticky = newStickySessions(b.backend.Id, *ss, watcher)
+		u.sticky.conns = conns
+		next = http.HandlerFunc(u.sticky.pin)
+	}
+
+	// Create a load balancer
+	lb, err := newBalancer(*ls, next, b.conns, f.log)
+	if err != nil {
+		return nil, err
+	}
+	u.lb = lb
+	u.handler = lb
+	if u.sticky != nil {
+		u.sticky.lb = lb
+		u.handler = u.sticky
+	}
+
+	if err := u.syncServers(f.mux); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
 func (f *frontend) upsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) error {
 	f.middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: mi.Id}] = mi
 	return f.rebuild()
@@ -198,26 +343,89 @@ func (f *frontend) deleteMiddleware(mk engine.MiddlewareKey) error {
 	return f.rebuild()
 }
 
-func (f *frontend) updateBackend(b *backend) error {
-	oldb := f.backend
-	f.backend = b
+// syncBackend syncs load balancer of the backend with the backend servers
+func (f *frontend) syncBackend(b *backend) error {
+	for _, u := range f.upstreams {
+		if u.backend == b {
+			if err := u.syncServers(f.mux); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	// Switching backends, set the new transport and perform switch
-	if b.backend.Id != oldb.backend.Id {
-		log.Infof("%v updating backend from %v to %v", f, &oldb, &f.backend)
-		oldb.unlinkFrontend(f.key)
-		b.linkFrontend(f.key, f)
+// rtStats returns stats aggregated across all backends of the frontend
+func (f *frontend) rtStats() (*engine.RoundTripStats, error) {
+	if len(f.upstreams) == 1 {
+		return f.upstreams[0].watcher.rtStats()
+	}
+	m, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range f.upstreams {
+		if err := u.watcher.collectMetrics(m); err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewRoundTripStats(m)
+}
+
+func (f *frontend) usesBackend(id string) bool {
+	for _, b := range f.backends {
+		if b.backend.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *frontend) updateBackends(bs []*backend) error {
+	oldbs := f.backends
+	f.backends = bs
+
+	same := len(oldbs) == len(bs)
+	for i := 0; same && i < len(bs); i++ {
+		same = oldbs[i] == bs[i]
+	}
+
+	// Switching backends, set the new transports and perform switch
+	if !same {
+		log.Infof("%v updating backends from %v to %v", f, oldbs, bs)
+		for _, b := range oldbs {
+			b.unlinkFrontend(f.key)
+		}
+		for _, b := range bs {
+			b.linkFrontend(f.key, f)
+		}
 		return f.rebuild()
 	}
-	return syncServers(f.mux, f.lb, f.backend, f.watcher)
+
+	// Weights are updated in place, so connections and load balancer state are preserved
+	if f.splitter != nil {
+		refs := f.frontend.BackendRefs()
+		weights := make([]int, len(refs))
+		for i, r := range refs {
+			weights[i] = r.Weight
+		}
+		f.splitter.setWeights(weights)
+	}
+
+	for _, b := range bs {
+		if err := f.syncBackend(b); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // TODO: implement rollback in case of suboperation failure
-func (f *frontend) update(ef engine.Frontend, b *backend) error {
+func (f *frontend) update(ef engine.Frontend, bs []*backend) error {
 	oldf := f.frontend
 	f.frontend = ef
 
-	if err := f.updateBackend(b); err != nil {
+	if err := f.updateBackends(bs); err != nil {
 		return err
 	}
 
@@ -243,10 +451,20 @@ func (f *frontend) update(ef engine.Frontend, b *backend) error {
 }
 
 func (f *frontend) remove() error {
-	f.backend.unlinkFrontend(f.key)
+	for _, b := range f.backends {
+		b.unlinkFrontend(f.key)
+	}
 	return f.mux.router.Remove(f.frontend.Route)
 }
 
+type requestMarksHandler struct {
+	next http.Handler
+}
+
+func (h *requestMarksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.next.ServeHTTP(w, req.WithContext(plugin.WithRequestMarks(req.Context())))
+}
+
 type middlewareSorter struct {
 	ms []engine.Middleware
 }
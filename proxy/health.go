@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// healthChecker actively probes backend servers and keeps track of their health.
+// Servers are considered healthy until proven otherwise, so adding health checks
+// to the backend does not take servers out of rotation before the first checks complete.
+type healthChecker struct {
+	mtx      *sync.Mutex
+	settings engine.HealthCheckSettings
+	client   *http.Client
+	clock    timetools.TimeProvider
+	wg       *sync.WaitGroup
+	stopC    chan struct{}
+	probes   map[string]*probe
+	stopped  bool
+	// seed holds the health the servers start with instead of being healthy, e.g. the health
+	// known to the checker this one replaces, so the servers do not get back into rotation
+	seed map[string]engine.ServerHealth
+	// onChange is called whenever server transitions between healthy and unhealthy states
+	onChange func(*healthChecker, engine.Server, engine.ServerHealth)
+}
+
+type probe struct {
+	srv    engine.Server
+	health engine.ServerHealth
+	stopC  chan struct{}
+}
+
+func newHealthChecker(
+	s engine.HealthCheckSettings, t http.RoundTripper, clock timetools.TimeProvider, wg *sync.WaitGroup, stopC chan struct{},
+	onChange func(*healthChecker, engine.Server, engine.ServerHealth)) *healthChecker {
+	return &healthChecker{
+		mtx:      &sync.Mutex{},
+		settings: s,
+		client:   newHealthClient(s, t),
+		clock:    clock,
+		wg:       wg,
+		stopC:    stopC,
+		probes:   make(map[string]*probe),
+		seed:     make(map[string]engine.ServerHealth),
+		onChange: onChange,
+	}
+}
+
+func newHealthClient(s engine.HealthCheckSettings, t http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: t,
+		Timeout:   s.Timeout,
+		// Redirects are reported as is and are checked against expected codes
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// setTransport makes the following checks use the transport, the checks in flight finish with the old one
+func (c *healthChecker) setTransport(t http.RoundTripper) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.client = newHealthClient(c.settings, t)
+}
+
+// seedHealth makes the servers start with the health known to the other checker, must be called before syncServers
+func (c *healthChecker) seedHealth(o *healthChecker) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for id, p := range o.probes {
+		c.seed[id] = p.health
+	}
+}
+
+// syncServers starts probing new servers and stops probing the servers that are gone
+func (c *healthChecker) syncServers(servers []engine.Server) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	ids := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		ids[s.Id] = true
+		p, ok := c.probes[s.Id]
+		if ok && p.srv.URL == s.URL {
+			p.srv = s
+			continue
+		}
+		if ok {
+			close(p.stopC)
+		}
+		health, seeded := c.seed[s.Id]
+		if !seeded || ok {
+			health = engine.ServerHealth{Healthy: true}
+		}
+		delete(c.seed, s.Id)
+		p = &probe{
+			srv:    s,
+			health: health,
+			stopC:  make(chan struct{}),
+		}
+		c.probes[s.Id] = p
+		c.wg.Add(1)
+		go c.run(p)
+	}
+	for id, p := range c.probes {
+		if !ids[id] {
+			close(p.stopC)
+			delete(c.probes, id)
+		}
+	}
+}
+
+// isHealthy returns false only if the server has been marked as unhealthy
+func (c *healthChecker) isHealthy(id string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	p, ok := c.probes[id]
+	if !ok {
+		return true
+	}
+	return p.health.Healthy
+}
+
+func (c *healthChecker) health(id string) (*engine.ServerHealth, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	p, ok := c.probes[id]
+	if !ok {
+		return nil, false
+	}
+	h := p.health
+	return &h, true
+}
+
+func (c *healthChecker) stop() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.stopped {
+		return
+	}
+	c.stopped = true
+	for id, p := range c.probes {
+		close(p.stopC)
+		delete(c.probes, id)
+	}
+}
+
+func (c *healthChecker) run(p *probe) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.settings.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.check(p)
+		select {
+		case <-ticker.C:
+		case <-p.stopC:
+			return
+		case <-c.stopC:
+			return
+		}
+	}
+}
+
+func (c *healthChecker) check(p *probe) {
+	c.mtx.Lock()
+	srv, client := p.srv, c.client
+	c.mtx.Unlock()
+
+	err := c.probe(client, srv)
+
+	c.mtx.Lock()
+	select {
+	case <-p.stopC:
+		// the probe has been stopped while the check was in flight
+		c.mtx.Unlock()
+		return
+	default:
+	}
+	h := &p.health
+	wasHealthy := h.Healthy
+	h.LastCheck = c.clock.UtcNow()
+	if err != nil {
+		h.LastError = err.Error()
+		h.Successes = 0
+		h.Failures += 1
+		if h.Failures >= c.settings.UnhealthyThreshold {
+			h.Healthy = false
+		}
+	} else {
+		h.LastError = ""
+		h.Failures = 0
+		h.Successes += 1
+		if h.Successes >= c.settings.HealthyThreshold {
+			h.Healthy = true
+		}
+	}
+	changed := wasHealthy != h.Healthy
+	health := *h
+	c.mtx.Unlock()
+
+	if changed {
+		c.onChange(c, srv, health)
+	}
+}
+
+func (c *healthChecker) probe(client *http.Client, srv engine.Server) error {
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = c.settings.Path
+	u.RawQuery = ""
+	re, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, re.Body)
+	re.Body.Close()
+	for _, code := range c.settings.ExpectedCodes {
+		if re.StatusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected response code: %d", re.StatusCode)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// mirror forwards requests to the servers of the backend on behalf of the frontend middlewares,
+// e.g. when shadowing the traffic. Mirrored requests bypass frontend load balancers
+// and are watched separately, so they don't affect frontend stats.
+//
+// Like upstreams, mirror keeps the snapshot of the backend transport and servers updated by the mux
+// when the backend syncs, so mirrored requests don't contend for the mux lock.
+type mirror struct {
+	key     engine.BackendKey
+	fwd     *forward.Forwarder
+	watcher *RTWatcher
+
+	mtx *sync.RWMutex
+	// transport is nil when the backend does not exist
+	transport *http.Transport
+	// servers are the servers of the backend in rotation
+	servers []*url.URL
+}
+
+// newMirror must be called under the mux lock
+func newMirror(m *mux, f *frontend, id string) (*mirror, error) {
+	mr := &mirror{
+		key: engine.BackendKey{Id: id},
+		mtx: &sync.RWMutex{},
+	}
+	settings := f.frontend.HTTPSettings()
+	fwd, err := forward.New(
+		forward.Logger(f.log),
+		forward.RoundTripper(mr),
+		forward.Rewriter(
+			&clientCertRewriter{next: &forward.HeaderRewriter{
+				Hostname:           settings.Hostname,
+				TrustForwardHeader: settings.TrustForwardHeader,
+			}}),
+		forward.PassHostHeader(settings.PassHostHeader))
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := NewWatcher(http.HandlerFunc(mr.forward))
+	if err != nil {
+		return nil, err
+	}
+	mr.fwd = fwd
+	mr.watcher = watcher
+	mr.sync(m.backends[mr.key])
+	return mr, nil
+}
+
+// sync takes the snapshot of the backend transport and servers in rotation, b is nil if the backend is deleted
+func (m *mirror) sync(b *backend) {
+	var t *http.Transport
+	var servers []*url.URL
+	if b != nil {
+		t = b.transport
+		for _, s := range b.inRotation() {
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				log.Warningf("%v failed to parse %v: %v", m, &s, err)
+				continue
+			}
+			servers = append(servers, u)
+		}
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.transport = t
+	m.servers = servers
+}
+
+func (m *mirror) String() string {
+	return fmt.Sprintf("mirror(%v)", m.key)
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.watcher.ServeHTTP(w, req)
+}
+
+func (m *mirror) forward(w http.ResponseWriter, req *http.Request) {
+	u, err := m.nextServer()
+	if err != nil {
+		log.Warningf("%v failed to pick server: %v", m, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	req.URL = u
+	m.fwd.ServeHTTP(w, req)
+}
+
+// RoundTrip uses the transport of the backend that is current at the moment of the request
+func (m *mirror) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.mtx.RLock()
+	t := m.transport
+	m.mtx.RUnlock()
+
+	if t == nil {
+		return nil, fmt.Errorf("%v not found", m.key)
+	}
+	return t.RoundTrip(req)
+}
+
+// nextServer picks a random server of the backend that is in rotation
+func (m *mirror) nextServer() (*url.URL, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.transport == nil {
+		return nil, fmt.Errorf("%v not found", m.key)
+	}
+	if len(m.servers) == 0 {
+		return nil, fmt.Errorf("%v has no servers in rotation", m.key)
+	}
+	return utils.CopyURL(m.servers[rand.Intn(len(m.servers))]), nil
+}
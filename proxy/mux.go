@@ -31,6 +31,12 @@ type mux struct {
 
 	hosts map[engine.HostKey]engine.Host
 
+	// HTTPS redirect and HSTS settings of the hosts, read by the listeners on every request
+	policies *hostPolicies
+
+	// Expiry of the host certificates, reported by metrics and checked periodically
+	certExpiry map[engine.HostKey]time.Time
+
 	// Options hold parameters that are used to initialize http servers
 	options Options
 
@@ -43,6 +49,12 @@ type mux struct {
 	// Router will be shared between mulitple listeners
 	router router.Router
 
+	// routes is the router the listeners serve, it routes the requests either before or after the change set
+	routes http.Handler
+
+	// changeMtx is held for writing while the change set is applied, and for reading while the requests are routed
+	changeMtx *sync.RWMutex
+
 	// Current server stats
 	state muxState
 
@@ -73,18 +85,24 @@ func New(id int, st stapler.Stapler, o Options) (*mux, error) {
 		options: o,
 
 		router:      o.Router,
+		changeMtx:   &sync.RWMutex{},
 		connTracker: newConnTracker(),
 
 		servers:   make(map[engine.ListenerKey]*srv),
 		backends:  make(map[engine.BackendKey]*backend),
 		frontends: make(map[engine.FrontendKey]*frontend),
 		hosts:     make(map[engine.HostKey]engine.Host),
+		policies:  newHostPolicies(),
+
+		certExpiry: make(map[engine.HostKey]time.Time),
 
 		stapleUpdatesC: make(chan *stapler.StapleUpdated),
 		stopC:          make(chan struct{}),
 		stapler:        st,
 	}
 
+	m.routes = &changeGate{mtx: m.changeMtx, next: m.router}
+
 	m.router.SetNotFound(&DefaultNotFound{})
 	if o.NotFoundMiddleware != nil {
 		if handler, err := o.NotFoundMiddleware.NewHandler(m.router.GetNotFound()); err == nil {
@@ -128,6 +146,20 @@ func New(id int, st stapler.Stapler, o Options) (*mux, error) {
 			}
 		}
 	}()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-m.stopC:
+				log.Infof("%v stop checking certificates", m)
+				return
+			case <-time.After(certCheckPeriod):
+				m.checkCertificates()
+			}
+		}
+	}()
 	return m, nil
 }
 
@@ -198,6 +230,51 @@ func (m *mux) TopServers(key *engine.BackendKey) ([]engine.Server, error) {
 	return m.topServers(key)
 }
 
+// ServerHealth returns the state of active health checks of the server,
+// returns nil if health checks are not enabled for the server's backend
+func (m *mux) ServerHealth(key engine.ServerKey) (*engine.ServerHealth, error) {
+	log.Infof("%s ServerHealth", m)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	b, ok := m.backends[key.BackendKey]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key.BackendKey)}
+	}
+	return b.serverHealth(key)
+}
+
+// ServerEjection returns the state of passive outlier ejection of the server,
+// returns nil if the server has never been ejected or outlier detection is not enabled
+func (m *mux) ServerEjection(key engine.ServerKey) (*engine.ServerEjection, error) {
+	log.Infof("%s ServerEjection", m)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	b, ok := m.backends[key.BackendKey]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key.BackendKey)}
+	}
+	return b.serverEjection(key)
+}
+
+// ServerRampUp returns the state of the slow start of the server,
+// returns nil if the server is at its full weight or slow start is not enabled
+func (m *mux) ServerRampUp(key engine.ServerKey) (*engine.ServerRampUp, error) {
+	log.Infof("%s ServerRampUp", m)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	b, ok := m.backends[key.BackendKey]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key.BackendKey)}
+	}
+	return b.serverRampUp(key)
+}
+
 func (m *mux) TakeFiles(files []*FileDescriptor) error {
 	log.Infof("%s TakeFiles %s", m, files)
 
@@ -286,7 +363,13 @@ func (m *mux) UpsertHost(host engine.Host) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertHost(host)
+}
+
+func (m *mux) upsertHost(host engine.Host) error {
 	m.hosts[engine.HostKey{Name: host.Name}] = host
+	m.policies.upsert(host)
+	m.updateCertExpiry(host)
 
 	for _, s := range m.servers {
 		if s.isTLS() {
@@ -302,6 +385,10 @@ func (m *mux) DeleteHost(hk engine.HostKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteHost(hk)
+}
+
+func (m *mux) deleteHost(hk engine.HostKey) error {
 	host, exists := m.hosts[hk]
 	if !exists {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", hk)}
@@ -309,6 +396,8 @@ func (m *mux) DeleteHost(hk engine.HostKey) error {
 
 	// delete host from the hosts list
 	delete(m.hosts, hk)
+	m.policies.remove(hk.Name)
+	delete(m.certExpiry, hk)
 
 	// delete staple from the cache
 	m.stapler.DeleteHost(hk)
@@ -336,6 +425,10 @@ func (m *mux) DeleteListener(lk engine.ListenerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteListener(lk)
+}
+
+func (m *mux) deleteListener(lk engine.ListenerKey) error {
 	s, exists := m.servers[lk]
 	if !exists {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", lk)}
@@ -343,6 +436,9 @@ func (m *mux) DeleteListener(lk engine.ListenerKey) error {
 
 	delete(m.servers, lk)
 	s.shutdown()
+	if s.tcp != nil {
+		s.tcp.unlink()
+	}
 	return nil
 }
 
@@ -396,6 +492,7 @@ func (m *mux) upsertBackend(be engine.Backend) (*backend, error) {
 		return nil, err
 	}
 	m.backends[bk] = b
+	m.syncMirrors(bk, b)
 	return b, nil
 }
 
@@ -404,24 +501,43 @@ func (m *mux) DeleteBackend(bk engine.BackendKey) error {
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
+
+	return m.deleteBackend(bk)
+}
+
+func (m *mux) deleteBackend(bk engine.BackendKey) error {
 	b, ok := m.backends[bk]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
 	}
 
+	if len(b.frontends) != 0 {
+		return fmt.Errorf("%v is used by frontends: %v", b, b.frontends)
+	}
+
+	if len(b.listeners) != 0 {
+		return fmt.Errorf("%v is used by listeners: %v", b, b.listeners)
+	}
+
 	//delete backend from being referenced - it is no longer in etcd
 	//and future frontend additions to etcd shouldn't see a
 	//magical backend just because vulcan is holding a reference to it.
 	delete(m.backends, bk)
-
-	if len(b.frontends) != 0 {
-		return fmt.Errorf("%v is used by frontends: %v", b, b.frontends)
-	}
+	m.syncMirrors(bk, nil)
 
 	b.Close()
 	return nil
 }
 
+// syncMirrors updates the mirrors forwarding requests to the backend, b is nil if the backend is deleted
+func (m *mux) syncMirrors(bk engine.BackendKey, b *backend) {
+	for _, f := range m.frontends {
+		if mr, ok := f.mirrors[bk.Id]; ok {
+			mr.sync(b)
+		}
+	}
+}
+
 func (m *mux) UpsertFrontend(f engine.Frontend) error {
 	log.Infof("%v UpsertFrontend %v", m, &f)
 
@@ -433,18 +549,23 @@ func (m *mux) UpsertFrontend(f engine.Frontend) error {
 }
 
 func (m *mux) upsertFrontend(fe engine.Frontend) (*frontend, error) {
-	bk := engine.BackendKey{Id: fe.BackendId}
-	b, ok := m.backends[bk]
-	if !ok {
-		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+	refs := fe.BackendRefs()
+	bs := make([]*backend, len(refs))
+	for i, r := range refs {
+		bk := engine.BackendKey{Id: r.Id}
+		b, ok := m.backends[bk]
+		if !ok {
+			return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+		}
+		bs[i] = b
 	}
 	fk := engine.FrontendKey{Id: fe.Id}
 	f, ok := m.frontends[fk]
 	if ok {
-		return f, f.update(fe, b)
+		return f, f.update(fe, bs)
 	}
 
-	f, err := newFrontend(m, fe, b)
+	f, err := newFrontend(m, fe, bs)
 	if err != nil {
 		return nil, err
 	}
@@ -497,6 +618,10 @@ func (m *mux) DeleteMiddleware(mk engine.MiddlewareKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteMiddleware(mk)
+}
+
+func (m *mux) deleteMiddleware(mk engine.MiddlewareKey) error {
 	f, ok := m.frontends[mk.FrontendKey]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", mk)}
@@ -511,6 +636,10 @@ func (m *mux) UpsertServer(bk engine.BackendKey, srv engine.Server) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.upsertServer(bk, srv)
+}
+
+func (m *mux) upsertServer(bk engine.BackendKey, srv engine.Server) error {
 	if _, err := url.ParseRequestURI(srv.URL); err != nil {
 		return fmt.Errorf("failed to parse %v, error: %v", srv, err)
 	}
@@ -532,6 +661,10 @@ func (m *mux) DeleteServer(sk engine.ServerKey) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	return m.deleteServer(sk)
+}
+
+func (m *mux) deleteServer(sk engine.ServerKey) error {
 	b, ok := m.backends[sk.BackendKey]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", sk.BackendKey)}
@@ -609,6 +742,9 @@ func setDefaults(o Options) Options {
 	if o.Router == nil {
 		o.Router = route.NewMux()
 	}
+	if o.CertExpiryWarning == 0 {
+		o.CertExpiryWarning = DefaultCertExpiryWarning
+	}
 	return o
 }
 
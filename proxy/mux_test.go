@@ -3,18 +3,29 @@ package proxy
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/route"
 	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin/shadow"
+	"github.com/vulcand/vulcand/router"
 	"github.com/vulcand/vulcand/stapler"
 	. "github.com/vulcand/vulcand/testutils"
 )
@@ -330,6 +341,52 @@ func (s *ServerSuite) TestServerUpdateHTTPS(c *C) {
 	conn.Close()
 }
 
+func (s *ServerSuite) TestServerHTTP2(c *C) {
+	e := testutils.NewResponder("hi h2")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: localhostKey, Cert: localhostCert},
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{HTTP2: true, MaxConcurrentStreams: 10}
+
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	get := func() (int, string) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		re, err := client.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return re.ProtoMajor, string(body)
+	}
+
+	proto, body := get()
+	c.Assert(proto, Equals, 2)
+	c.Assert(body, Equals, "hi h2")
+
+	// Turning HTTP/2 off reloads the listener, new connections use HTTP/1.1
+	b.L.Settings = &engine.HTTPSListenerSettings{}
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	proto, body = get()
+	c.Assert(proto, Equals, 1)
+	c.Assert(body, Equals, "hi h2")
+}
+
 func (s *ServerSuite) TestBackendHTTPS(c *C) {
 	e := httptest.NewUnstartedServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -673,275 +730,2101 @@ func (s *ServerSuite) TestFrontendOptionsCRUD(c *C) {
 	c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
 }
 
-func (s *ServerSuite) TestFrontendSwitchBackend(c *C) {
-	c.Assert(s.mux.Start(), IsNil)
-
-	e1 := testutils.NewResponder("1")
-	defer e1.Close()
-
-	e2 := testutils.NewResponder("2")
-	defer e2.Close()
+func (s *ServerSuite) TestFrontendResponseHeaderTimeout(c *C) {
+	var attempts int32
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("hi"))
+	})
+	defer e.Close()
 
-	e3 := testutils.NewResponder("3")
-	defer e3.Close()
+	c.Assert(s.mux.Start(), IsNil)
 
 	b := MakeBatch(Batch{
 		Addr:  "localhost:31000",
 		Route: `Path("/")`,
-		URL:   e1.URL,
+		URL:   e.URL,
 	})
+	b.F.Settings = engine.HTTPFrontendSettings{
+		Timeouts: engine.HTTPFrontendTimeouts{ResponseHeader: "20ms", Body: "too slow"},
+	}
 
-	s1, s2, s3 := MakeServer(e1.URL), MakeServer(e2.URL), MakeServer(e3.URL)
-
-	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
-	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
-
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	b2 := MakeBackend()
-	b2k := engine.BackendKey{Id: b2.Id}
-	c.Assert(s.mux.UpsertServer(b2k, s2), IsNil)
-	c.Assert(s.mux.UpsertServer(b2k, s3), IsNil)
-
-	responseSet := make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-
-	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+	// Timeouts are network errors, so the default predicate fails over
+	re, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(string(body), Equals, "too slow")
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(2))
 
-	b.F.BackendId = b2k.Id
+	// Predicate can tell timeouts apart from other network errors
+	b.F.Settings = engine.HTTPFrontendSettings{
+		Timeouts:          engine.HTTPFrontendTimeouts{ResponseHeader: "20ms"},
+		FailoverPredicate: `IsNetworkError() && ResponseCode() != 504 && Attempts() < 2`,
+	}
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 
-	responseSet = make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-
-	c.Assert(responseSet, DeepEquals, map[string]bool{"2": true, "3": true})
+	atomic.StoreInt32(&attempts, 0)
+	re, body, err = testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(string(body), Equals, http.StatusText(http.StatusGatewayTimeout))
+	c.Assert(atomic.LoadInt32(&attempts), Equals, int32(1))
 }
 
-func (s *ServerSuite) TestFrontendUpdateRoute(c *C) {
-	c.Assert(s.mux.Start(), IsNil)
-
-	e := testutils.NewResponder("hola")
+func (s *ServerSuite) TestFrontendRequestTimeout(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("hi"))
+	})
 	defer e.Close()
 
+	c.Assert(s.mux.Start(), IsNil)
+
 	b := MakeBatch(Batch{
 		Addr:  "localhost:31000",
 		Route: `Path("/")`,
 		URL:   e.URL,
 	})
+	b.F.Settings = engine.HTTPFrontendSettings{
+		Timeouts: engine.HTTPFrontendTimeouts{Request: "50ms", Body: "too slow"},
+	}
 
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hola")
-
-	b.F.Route = `Path("/new")`
-
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(GETResponse(c, b.FrontendURL("/new")), Equals, "hola")
-
-	response, _, err := testutils.Get(MakeURL(b.L, "/"))
+	start := time.Now()
+	re, body, err := testutils.Get(b.FrontendURL("/"))
 	c.Assert(err, IsNil)
-	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(string(body), Equals, "too slow")
+	c.Assert(time.Now().Sub(start) < time.Second, Equals, true)
 }
 
-func (s *ServerSuite) TestBackendUpdate(c *C) {
-	c.Assert(s.mux.Start(), IsNil)
-
-	e1 := testutils.NewResponder("1")
-	defer e1.Close()
+func (s *ServerSuite) TestFrontendUpgrade(c *C) {
+	// Server switches to a line echo protocol
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" || r.Header.Get("Connection") != "Upgrade" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("upgrade required"))
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, line)
+		}
+	})
+	defer e.Close()
 
-	e2 := testutils.NewResponder("2")
-	defer e2.Close()
+	c.Assert(s.mux.Start(), IsNil)
 
 	b := MakeBatch(Batch{
 		Addr:  "localhost:31000",
 		Route: `Path("/")`,
-		URL:   e1.URL,
+		URL:   e.URL,
 	})
-
-	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
-
-	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
-	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
-
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	responseSet := make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	conn, err := net.Dial("tcp", b.L.Address.Address)
+	c.Assert(err, IsNil)
+	defer conn.Close()
 
-	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	re, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(re.Header.Get("Upgrade"), Equals, "echo")
+
+	for _, msg := range []string{"hello\n", "world\n"} {
+		io.WriteString(conn, msg)
+		line, err := br.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, msg)
+	}
+	addr := conn.RemoteAddr().String()
+	c.Assert(s.mux.connTracker.counts()[http.StateHijacked][addr], Equals, int64(1))
 
-	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
-	c.Assert(s.mux.DeleteServer(sk2), IsNil)
+	// Tunnel goes away with the client connection
+	conn.Close()
+	for i := 0; i < 100 && s.mux.connTracker.counts()[http.StateHijacked][addr] != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.mux.connTracker.counts()[http.StateHijacked][addr], Equals, int64(0))
 
-	responseSet = make(map[string]bool)
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
-	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	// Server refusing to switch the protocol replies as usual
+	req, err := http.NewRequest("GET", b.FrontendURL("/"), nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "other")
+	re, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(string(body), Equals, "upgrade required")
 
-	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
+	// Regular requests are still proxied
+	re, body, err = testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(string(body), Equals, "upgrade required")
 }
 
-func (s *ServerSuite) TestServerAddBad(c *C) {
-	e := testutils.NewResponder("Hi, I'm endpoint")
-	defer e.Close()
+func (s *ServerSuite) TestTCPListener(c *C) {
+	e1 := newEchoServer(c, "1:")
+	defer e1.Close()
+	e2 := newEchoServer(c, "2:")
+	defer e2.Close()
 
 	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{Addr: "localhost:11500", Route: `Path("/")`, URL: e.URL})
-
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(s.mux.UpsertListener(b.L), IsNil)
-
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	bk := MakeBackend()
+	c.Assert(s.mux.UpsertBackend(bk), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: bk.Id}, MakeServer("tcp://"+e1.Addr().String())), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: bk.Id}, MakeServer("tcp://"+e2.Addr().String())), IsNil)
 
-	bad := engine.Server{Id: UID("srv"), URL: ""}
-	c.Assert(s.mux.UpsertServer(b.BK, bad), NotNil)
+	// Listener needs an existing backend
+	l, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: "missing"})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), FitsTypeOf, &engine.NotFoundError{})
+
+	l.TCP.BackendId = bk.Id
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+
+	// Connections are balanced across the servers
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Address.Address)
+		c.Assert(err, IsNil)
+		io.WriteString(conn, "hello\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		c.Assert(err, IsNil)
+		seen[line] = true
+
+		addr := conn.RemoteAddr().String()
+		c.Assert(s.mux.connTracker.counts()[http.StateActive][addr], Equals, int64(1))
+		conn.Close()
+		for j := 0; j < 100 && s.mux.connTracker.counts()[http.StateActive][addr] != 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(s.mux.connTracker.counts()[http.StateActive][addr], Equals, int64(0))
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{"1:hello\n": true, "2:hello\n": true})
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	// Backend used by the listener can not be deleted
+	c.Assert(s.mux.DeleteBackend(engine.BackendKey{Id: bk.Id}), NotNil)
 }
 
-func (s *ServerSuite) TestServerUpsertURL(c *C) {
-	c.Assert(s.mux.Start(), IsNil)
-
-	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
+func (s *ServerSuite) TestTCPListenerSwitchBackend(c *C) {
+	e1 := newEchoServer(c, "1:")
 	defer e1.Close()
-
-	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	e2 := newEchoServer(c, "2:")
 	defer e2.Close()
 
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+	c.Assert(s.mux.Start(), IsNil)
 
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	b1, b2 := MakeBackend(), MakeBackend()
+	for _, b := range []struct {
+		be engine.Backend
+		e  net.Listener
+	}{{b1, e1}, {b2, e2}} {
+		c.Assert(s.mux.UpsertBackend(b.be), IsNil)
+		c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b.be.Id}, MakeServer("tcp://"+b.e.Addr().String())), IsNil)
+	}
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+	l, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: b1.Id})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+	c.Assert(tcpEcho(c, l.Address.Address, nil), Equals, "1:hello\n")
 
-	b.S.URL = e2.URL
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	l.TCP = &engine.TCPListenerSettings{BackendId: b2.Id}
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+	c.Assert(tcpEcho(c, l.Address.Address, nil), Equals, "2:hello\n")
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
+	// Previous backend is not used anymore
+	c.Assert(s.mux.DeleteBackend(engine.BackendKey{Id: b1.Id}), IsNil)
+
+	// Listener has to be deleted before the backend
+	c.Assert(s.mux.DeleteListener(engine.ListenerKey{Id: l.Id}), IsNil)
+	c.Assert(s.mux.DeleteBackend(engine.BackendKey{Id: b2.Id}), IsNil)
 }
 
-func (s *ServerSuite) TestBackendUpdateOptions(c *C) {
-	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(10 * time.Millisecond)
-		w.Write([]byte("slow server"))
-	})
+func (s *ServerSuite) TestTCPListenerTLS(c *C) {
+	e := newEchoServer(c, "tls:")
 	defer e.Close()
 
 	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
-
-	settings := b.B.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
-	b.B.Settings = settings
-
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(s.mux.UpsertListener(b.L), IsNil)
-
-	re, _, err := testutils.Get(MakeURL(b.L, "/"))
+	h, err := engine.NewHost("localhost", engine.HostSettings{KeyPair: &engine.KeyPair{Key: localhostKey, Cert: localhostCert}})
 	c.Assert(err, IsNil)
-	c.Assert(re, NotNil)
-	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(s.mux.UpsertHost(*h), IsNil)
 
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
-	b.B.Settings = settings
+	bk := MakeBackend()
+	c.Assert(s.mux.UpsertBackend(bk), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: bk.Id}, MakeServer("tcp://"+e.Addr().String())), IsNil)
 
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	l, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: bk.Id, TLS: &engine.TLSSettings{}})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
+	// TLS is terminated by the listener, server gets plain text
+	c.Assert(tcpEcho(c, l.Address.Address, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}), Equals, "tls:hello\n")
 }
 
-func (s *ServerSuite) TestSwitchBackendOptions(c *C) {
+func (s *ServerSuite) TestListenerProxyProtocol(c *C) {
 	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(10 * time.Millisecond)
-		w.Write([]byte("slow server"))
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
 	})
 	defer e.Close()
 
 	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
-
-	settings := b.B.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
-	b.B.Settings = settings
-
-	b2 := MakeBackend()
-	settings = b2.HTTPSettings()
-	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
-	b2.Settings = settings
-
-	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	b := MakeBatch(Batch{
+		Addr:  "localhost:41000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+	b.L.ProxyProtocol = &engine.ProxyProtocolSettings{TrustedCIDRs: []string{"10.0.0.0/8"}}
 	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-
-	c.Assert(s.mux.UpsertBackend(b2), IsNil)
-	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, b.S), IsNil)
-
 	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
 	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-	re, _, err := testutils.Get(MakeURL(b.L, "/"))
-	c.Assert(err, IsNil)
-	c.Assert(re, NotNil)
-	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+	get := func(header string) (int, string) {
+		conn, err := net.Dial("tcp", b.L.Address.Address)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		re, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		c.Assert(err, IsNil)
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		c.Assert(err, IsNil)
+		return re.StatusCode, string(body)
+	}
 
-	b.F.BackendId = b2.Id
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	// Untrusted clients can not send the header
+	code, _ := get("PROXY TCP4 1.2.3.4 127.0.0.1 56324 41000\r\n")
+	c.Assert(code, Equals, http.StatusBadRequest)
+	code, body := get("")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "127.0.0.1")
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
-}
+	// Trusting the client reloads the listener
+	b.L.ProxyProtocol = &engine.ProxyProtocolSettings{TrustedCIDRs: []string{"127.0.0.0/8"}}
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
 
-func (s *ServerSuite) TestFilesNoFiles(c *C) {
+	code, body = get("PROXY TCP4 1.2.3.4 127.0.0.1 56324 41000\r\n")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, "1.2.3.4")
+
+	// Header is required from the trusted clients
+	code, _ = get("")
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	// Listener still can be passed to the other process
 	files, err := s.mux.GetFiles()
 	c.Assert(err, IsNil)
-	c.Assert(len(files), Equals, 0)
-	c.Assert(s.mux.Start(), IsNil)
+	c.Assert(len(files), Equals, 1)
+	files[0].File.Close()
 }
 
-func (s *ServerSuite) TestTakeFiles(c *C) {
-	e := testutils.NewResponder("Hi, I'm endpoint 1")
+func (s *ServerSuite) TestTCPListenerProxyProtocol(c *C) {
+	e := newEchoServer(c, "1:")
 	defer e.Close()
 
 	c.Assert(s.mux.Start(), IsNil)
 
-	b := MakeBatch(Batch{
-		Addr:     "localhost:41000",
-		Route:    `Path("/")`,
-		URL:      e.URL,
-		Protocol: engine.HTTPS,
-		KeyPair:  &engine.KeyPair{Key: localhostKey, Cert: localhostCert},
-	})
+	bk, err := engine.NewHTTPBackend(UID("backend"), engine.HTTPBackendSettings{ProxyProtocol: "v1"})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertBackend(*bk), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: bk.Id}, MakeServer("tcp://"+e.Addr().String())), IsNil)
 
-	c.Assert(s.mux.UpsertHost(b.H), IsNil)
-	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
-	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
-	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	l, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: bk.Id})
+	c.Assert(err, IsNil)
+	l.ProxyProtocol = &engine.ProxyProtocolSettings{TrustedCIDRs: []string{"127.0.0.0/8"}}
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
 
-	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+	// Client address from the incoming header is passed to the server
+	conn, err := net.Dial("tcp", l.Address.Address)
+	c.Assert(err, IsNil)
+	defer conn.Close()
 
-	mux2, err := New(s.lastId, s.st, Options{})
+	io.WriteString(conn, "PROXY TCP4 1.2.3.4 10.0.0.1 56324 5432\r\nhello\n")
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
 	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(line, "1:PROXY TCP4 1.2.3.4 127.0.0.1 56324 "), Equals, true, Commentf("line: %q", line))
+	line, err = br.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "1:hello\n")
+}
 
-	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
-	defer e2.Close()
+func (s *ServerSuite) TestACMEChallenge(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
 
-	b2 := MakeBatch(Batch{
-		Addr:     "localhost:41000",
-		Route:    `Path("/")`,
-		URL:      e2.URL,
+	m, err := New(s.lastId, s.st, Options{ACMEChallenges: testChallenges{"token": "token.thumbprint"}})
+	c.Assert(err, IsNil)
+	defer m.Stop(true)
+	c.Assert(m.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:41000", Route: `Path("/")`, URL: e.URL})
+	c.Assert(m.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(m.UpsertFrontend(b.F), IsNil)
+	c.Assert(m.UpsertListener(b.L), IsNil)
+
+	// Challenges are answered before the requests are redirected to https
+	host := engine.Host{Name: "example.com", Settings: engine.HostSettings{HTTPSRedirect: &engine.HTTPSRedirectSettings{}}}
+	c.Assert(m.UpsertHost(host), IsNil)
+
+	req, err := http.NewRequest("GET", b.FrontendURL("/.well-known/acme-challenge/token"), nil)
+	c.Assert(err, IsNil)
+	req.Host = "example.com"
+	re, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "token.thumbprint")
+
+	req.URL.Path = "/"
+	re, err = http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusMovedPermanently)
+}
+
+func (s *ServerSuite) TestHostHTTPSRedirect(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:41000", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	host := engine.Host{Name: "example.com", Settings: engine.HostSettings{
+		HTTPSRedirect: &engine.HTTPSRedirectSettings{},
+		HSTS:          &engine.HSTSSettings{MaxAge: 300},
+	}}
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+
+	get := func(host string) *http.Response {
+		req, err := http.NewRequest("GET", b.FrontendURL("/?a=b"), nil)
+		c.Assert(err, IsNil)
+		req.Host = host
+		re, err := http.DefaultTransport.RoundTrip(req)
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		return re
+	}
+
+	re := get("example.com:41000")
+	c.Assert(re.StatusCode, Equals, http.StatusMovedPermanently)
+	c.Assert(re.Header.Get("Location"), Equals, "https://example.com/?a=b")
+	// HSTS header is ignored by browsers over http
+	c.Assert(re.Header.Get("Strict-Transport-Security"), Equals, "")
+
+	// Other hosts are served as is
+	c.Assert(get("localhost").StatusCode, Equals, http.StatusOK)
+
+	host.Settings.HTTPSRedirect = &engine.HTTPSRedirectSettings{Code: http.StatusPermanentRedirect, Port: 8443}
+	c.Assert(s.mux.UpsertHost(host), IsNil)
+	re = get("example.com")
+	c.Assert(re.StatusCode, Equals, http.StatusPermanentRedirect)
+	c.Assert(re.Header.Get("Location"), Equals, "https://example.com:8443/?a=b")
+
+	c.Assert(s.mux.DeleteHost(engine.HostKey{Name: host.Name}), IsNil)
+	c.Assert(get("example.com").StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ServerSuite) TestListenerClientAuth(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Cert-Subject")))
+	})
+	defer e.Close()
+
+	ca := newTestCA(c)
+	certPEM, keyPEM := ca.issuePEM(c, "localhost", []string{"localhost"})
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: keyPEM, Cert: certPEM},
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		TLS:               engine.TLSSettings{ClientAuth: engine.ClientAuthVerify, ClientCAs: ca.pem},
+		ForwardClientCert: true,
+	}
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		re, err := client.Get(b.FrontendURL("/"))
+		if err != nil {
+			return "", err
+		}
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		return string(body), err
+	}
+
+	body, err := get(ca.issue(c, "client", nil))
+	c.Assert(err, IsNil)
+	c.Assert(body, Equals, "CN=client")
+
+	// Client has to send the certificate signed by the CA
+	_, err = get()
+	c.Assert(err, NotNil)
+	_, err = get(newTestCA(c).issue(c, "client", nil))
+	c.Assert(err, NotNil)
+
+	// Verified certificate is not passed to the servers unless the listener forwards it
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		TLS: engine.TLSSettings{ClientAuth: engine.ClientAuthVerify, ClientCAs: ca.pem},
+	}
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	body, err = get(ca.issue(c, "client", nil))
+	c.Assert(err, IsNil)
+	c.Assert(body, Equals, "")
+}
+
+func (s *ServerSuite) TestListenerClientAuthRequest(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Cert-Subject")))
+	})
+	defer e.Close()
+
+	ca := newTestCA(c)
+	certPEM, keyPEM := ca.issuePEM(c, "localhost", []string{"localhost"})
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: keyPEM, Cert: certPEM},
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		TLS:               engine.TLSSettings{ClientAuth: engine.ClientAuthRequest, ClientCAs: ca.pem},
+		ForwardClientCert: true,
+	}
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		re, err := client.Get(b.FrontendURL("/"))
+		if err != nil {
+			return "", err
+		}
+		defer re.Body.Close()
+		body, err := ioutil.ReadAll(re.Body)
+		return string(body), err
+	}
+
+	// The certificate that has been sent is verified, so the servers get the client identity
+	body, err := get(ca.issue(c, "client", nil))
+	c.Assert(err, IsNil)
+	c.Assert(body, Equals, "CN=client")
+
+	// The certificate is not required
+	body, err = get()
+	c.Assert(err, IsNil)
+	c.Assert(body, Equals, "")
+
+	// but has to be signed by the CA when sent
+	_, err = get(newTestCA(c).issue(c, "client", nil))
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestListenerClientAuthShadow(c *C) {
+	e := testutils.NewResponder("1")
+	defer e.Close()
+
+	mirrored := make(chan string, 1)
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header.Get("X-Client-Cert-Subject")
+	})
+	defer e2.Close()
+
+	ca := newTestCA(c)
+	certPEM, keyPEM := ca.issuePEM(c, "localhost", []string{"localhost"})
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: keyPEM, Cert: certPEM},
+	})
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		TLS: engine.TLSSettings{ClientAuth: engine.ClientAuthVerify, ClientCAs: ca.pem},
+	}
+	b2 := MakeBackend()
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, MakeServer(e2.URL)), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	sh, err := shadow.NewShadow(b2.Id, 100, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, engine.Middleware{Type: shadow.Type, Id: "sh1", Middleware: sh}), IsNil)
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{ca.issue(c, "client", nil)}},
+		DisableKeepAlives: true,
+	}}
+	expectMirrored := func(subject string) {
+		re, err := client.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		re.Body.Close()
+		select {
+		case got := <-mirrored:
+			c.Assert(got, Equals, subject)
+		case <-time.After(time.Second):
+			c.Fatalf("timeout waiting for mirrored request")
+		}
+	}
+
+	// Verified certificate is not passed to the shadow servers unless the listener forwards it
+	expectMirrored("")
+
+	b.L.Settings = &engine.HTTPSListenerSettings{
+		TLS:               engine.TLSSettings{ClientAuth: engine.ClientAuthVerify, ClientCAs: ca.pem},
+		ForwardClientCert: true,
+	}
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	expectMirrored("CN=client")
+}
+
+func (s *ServerSuite) TestBackendClientCert(c *C) {
+	ca := newTestCA(c)
+	e := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	e.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(c, "localhost", []string{"localhost"})},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	e.StartTLS()
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	certPEM, keyPEM := ca.issuePEM(c, "vulcand", nil)
+	b := MakeBatch(Batch{
+		Addr:  "localhost:41000",
+		Route: `Path("/")`,
+		URL:   strings.Replace(e.URL, "127.0.0.1", "localhost", 1),
+	})
+	b.B.Settings = engine.HTTPBackendSettings{TLS: &engine.TLSSettings{
+		RootCAs: ca.pem,
+		KeyPair: &engine.KeyPair{Cert: certPEM, Key: keyPEM},
+	}}
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "vulcand")
+
+	// Server rejects the connections without client certificate
+	b.B.Settings = engine.HTTPBackendSettings{TLS: &engine.TLSSettings{RootCAs: ca.pem}}
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	re, _, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadGateway)
+
+	// Server certificate is not trusted without the root CAs
+	b.B.Settings = engine.HTTPBackendSettings{TLS: &engine.TLSSettings{KeyPair: &engine.KeyPair{Cert: certPEM, Key: keyPEM}}}
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	re, _, err = testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusInternalServerError)
+}
+
+func (s *ServerSuite) TestFrontendSwitchBackend(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	e3 := testutils.NewResponder("3")
+	defer e3.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2, s3 := MakeServer(e1.URL), MakeServer(e2.URL), MakeServer(e3.URL)
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	b2 := MakeBackend()
+	b2k := engine.BackendKey{Id: b2.Id}
+	c.Assert(s.mux.UpsertServer(b2k, s2), IsNil)
+	c.Assert(s.mux.UpsertServer(b2k, s3), IsNil)
+
+	responseSet := make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	b.F.BackendId = b2k.Id
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	responseSet = make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"2": true, "3": true})
+}
+
+func (s *ServerSuite) TestFrontendUpdateRoute(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e := testutils.NewResponder("hola")
+	defer e.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e.URL,
+	})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "hola")
+
+	b.F.Route = `Path("/new")`
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/new")), Equals, "hola")
+
+	response, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestBackendUpdate(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	responseSet := make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+	c.Assert(s.mux.DeleteServer(sk2), IsNil)
+
+	responseSet = make(map[string]bool)
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
+}
+
+func (s *ServerSuite) TestBackendHealthChecks(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	healthy := make(chan bool, 1)
+	healthy <- false
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			h := <-healthy
+			healthy <- h
+			if !h {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	settings := b.B.HTTPSettings()
+	settings.HealthCheck = &engine.HTTPBackendHealthCheck{
+		Path:               "/health",
+		Interval:           "10ms",
+		Timeout:            "10ms",
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	b.B.Settings = settings
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	waitHealth := func(expected bool) {
+		for i := 0; i < 100; i++ {
+			h, err := s.mux.ServerHealth(sk2)
+			c.Assert(err, IsNil)
+			c.Assert(h, NotNil)
+			if h.Healthy == expected && !h.LastCheck.IsZero() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("%v has not become healthy=%t", sk2, expected)
+	}
+
+	// Unhealthy server is taken out of rotation
+	waitHealth(false)
+	h, err := s.mux.ServerHealth(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(h.LastError, Equals, "unexpected response code: 503")
+
+	responseSet := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
+
+	// Server recovers and is returned back into rotation
+	<-healthy
+	healthy <- true
+	waitHealth(true)
+
+	responseSet = make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+
+	// Health is not reported for backends without health checks
+	settings.HealthCheck = nil
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	h, err = s.mux.ServerHealth(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(h, IsNil)
+}
+
+func (s *ServerSuite) TestServerWeights(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	s1.Weight = 3
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	responses := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] += 1
+	}
+	c.Assert(responses, DeepEquals, map[string]int{"1": 6, "2": 2})
+
+	// Weight update takes effect without re-adding the server
+	s1.Weight = 1
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+
+	responses = make(map[string]int)
+	for i := 0; i < 8; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] += 1
+	}
+	c.Assert(responses, DeepEquals, map[string]int{"1": 4, "2": 4})
+}
+
+func (s *ServerSuite) TestServerDrain(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	release := make(chan bool)
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `PathRegexp("/.*")`,
+		URL:   e1.URL,
+	})
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	s1.State = engine.ServerStateDisabled
+
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// In-flight request to the server that will be drained
+	inflight := make(chan string)
+	go func() {
+		inflight <- GETResponse(c, b.FrontendURL("/slow"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	s1.State = engine.ServerStateActive
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	s2.State = engine.ServerStateDraining
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+	}
+
+	close(release)
+	c.Assert(<-inflight, Equals, "2")
+
+	s2.State = engine.ServerStateActive
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	responseSet := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true, "2": true})
+}
+
+func (s *ServerSuite) TestServerDrainKeepsSessions(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	// The first server switches to a line echo protocol on upgrades
+	e1 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.Write([]byte("1"))
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, line)
+		}
+	})
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		StickySession: &engine.HTTPBackendStickySession{CookieName: "srv"},
+	})
+	c.Assert(err, IsNil)
+
+	s2 := MakeServer(e2.URL)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// The session pinned to the first server opens a tunnel
+	conn, err := net.Dial("tcp", b.L.Address.Address)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nCookie: srv="+sessionCookieValue(b.BK.Id, b.S.Id)+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	re, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	echo := func() (string, error) {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(conn, "hello\n")
+		return br.ReadString('\n')
+	}
+
+	// Draining server takes no new sessions, but keeps serving its sessions and tunnels
+	drained := b.S
+	drained.State = engine.ServerStateDraining
+	c.Assert(s.mux.UpsertServer(b.BK, drained), IsNil)
+
+	pinned := testutils.Header("Cookie", "srv="+sessionCookieValue(b.BK.Id, b.S.Id))
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/"), pinned), Equals, "1")
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	}
+	line, err := echo()
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "hello\n")
+
+	// Disabled server loses its sessions and tunnels
+	disabled := b.S
+	disabled.State = engine.ServerStateDisabled
+	c.Assert(s.mux.UpsertServer(b.BK, disabled), IsNil)
+
+	re, body, err := testutils.Get(b.FrontendURL("/"), pinned)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "2")
+	c.Assert(re.Cookies()[0].Value, Equals, sessionCookieValue(b.BK.Id, s2.Id))
+
+	_, err = echo()
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestFrontendSplitBackends(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	b2 := MakeBackend()
+	bk2 := engine.BackendKey{Id: b2.Id}
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(bk2, MakeServer(e2.URL)), IsNil)
+
+	c.Assert(b.F.SetBackends([]engine.WeightedBackend{{Id: b.BK.Id, Weight: 100}, {Id: b2.Id, Weight: 0}}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+	}
+
+	// Weights are switched live
+	c.Assert(b.F.SetBackends([]engine.WeightedBackend{{Id: b.BK.Id, Weight: 0}, {Id: b2.Id, Weight: 100}}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	}
+
+	// Stats are collected across backends
+	stats, err := s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Counters.Total, Equals, int64(8))
+
+	frontends, err := s.mux.TopFrontends(&bk2)
+	c.Assert(err, IsNil)
+	c.Assert(len(frontends), Equals, 1)
+
+	// Switch back to the single backend
+	b.F.Backends = nil
+	b.F.BackendId = b2.Id
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	}
+}
+
+func (s *ServerSuite) TestFrontendSplitStickySessions(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	// Both backends set the same cookie and have the servers with the same id
+	settings := engine.HTTPBackendSettings{StickySession: &engine.HTTPBackendStickySession{CookieName: "srv"}}
+	be1, err := engine.NewHTTPBackend(b.BK.Id, settings)
+	c.Assert(err, IsNil)
+	be2, err := engine.NewHTTPBackend(UID("backend"), settings)
+	c.Assert(err, IsNil)
+	bk2 := engine.BackendKey{Id: be2.Id}
+	s2 := MakeServer(e2.URL)
+	s2.Id = b.S.Id
+
+	c.Assert(s.mux.UpsertBackend(*be1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertBackend(*be2), IsNil)
+	c.Assert(s.mux.UpsertServer(bk2, s2), IsNil)
+	c.Assert(b.F.SetBackends([]engine.WeightedBackend{{Id: b.BK.Id, Weight: 50}, {Id: be2.Id, Weight: 50}}), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Sessions get pinned to both backends
+	cookies := make(map[string]string)
+	for i := 0; i < 100 && len(cookies) < 2; i++ {
+		re, body, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		c.Assert(len(re.Cookies()), Equals, 1)
+		cookies[string(body)] = re.Cookies()[0].Value
+	}
+	c.Assert(cookies, DeepEquals, map[string]string{
+		"1": sessionCookieValue(b.BK.Id, b.S.Id),
+		"2": sessionCookieValue(be2.Id, s2.Id),
+	})
+
+	// Pinned sessions stay with their backend regardless of the split
+	for body, cookie := range cookies {
+		pinned := testutils.Header("Cookie", "srv="+cookie)
+		for i := 0; i < 10; i++ {
+			re, got, err := testutils.Get(b.FrontendURL("/"), pinned)
+			c.Assert(err, IsNil)
+			c.Assert(string(got), Equals, body)
+			c.Assert(len(re.Cookies()), Equals, 0)
+		}
+	}
+}
+
+func (s *ServerSuite) TestFrontendShadow(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	bodies := make(chan string, 1)
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(data)
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	b2 := MakeBackend()
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, MakeServer(e2.URL)), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	sh, err := shadow.NewShadow(b2.Id, 100, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, engine.Middleware{Type: shadow.Type, Id: "sh1", Middleware: sh}), IsNil)
+
+	// Client gets the response of the primary backend, shadow backend gets the copy of the request
+	re, body, err := testutils.MakeRequest(b.FrontendURL("/"), testutils.Method("POST"), testutils.Body("hello"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, "1")
+
+	select {
+	case data := <-bodies:
+		c.Assert(data, Equals, "hello")
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for mirrored request")
+	}
+
+	// Mirrored requests are not counted in frontend stats
+	stats, err := s.mux.FrontendStats(b.FK)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Counters.Total, Equals, int64(1))
+
+	// Requests with large bodies are not mirrored
+	re, body, err = testutils.MakeRequest(b.FrontendURL("/"), testutils.Method("POST"), testutils.Body(strings.Repeat("a", 2048)))
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "1")
+
+	select {
+	case <-bodies:
+		c.Fatalf("large request should not be mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Mirror errors do not affect the client requests
+	e2.Close()
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+}
+
+// Requests are mirrored once, failover attempts are not mirrored again
+func (s *ServerSuite) TestFrontendShadowFailover(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	dead := testutils.NewResponder("dead")
+	dead.Close()
+
+	var mirrored int32
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	b2 := MakeBackend()
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(dead.URL)), IsNil)
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, MakeServer(e2.URL)), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	sh, err := shadow.NewShadow(b2.Id, 100, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, engine.Middleware{Type: shadow.Type, Id: "sh1", Middleware: sh}), IsNil)
+
+	// Round robin sends every other request to the dead server first
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&mirrored) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&mirrored), Equals, int32(4))
+}
+
+// Mirrors follow the backend servers, including the backend created after the frontend
+func (s *ServerSuite) TestFrontendShadowFollowsBackend(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	mirrored := make(chan string, 1)
+	newMirrorTarget := func(name string) *httptest.Server {
+		return testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+			mirrored <- name
+		})
+	}
+	e2 := newMirrorTarget("2")
+	defer e2.Close()
+	e3 := newMirrorTarget("3")
+	defer e3.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	b2 := MakeBackend()
+	bk2 := engine.BackendKey{Id: b2.Id}
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	sh, err := shadow.NewShadow(b2.Id, 100, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertMiddleware(b.FK, engine.Middleware{Type: shadow.Type, Id: "sh1", Middleware: sh}), IsNil)
+
+	expectMirrored := func(name string) {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+		select {
+		case got := <-mirrored:
+			c.Assert(got, Equals, name)
+		case <-time.After(time.Second):
+			c.Fatalf("timeout waiting for mirrored request")
+		}
+	}
+
+	s2 := MakeServer(e2.URL)
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(bk2, s2), IsNil)
+	expectMirrored("2")
+
+	c.Assert(s.mux.UpsertServer(bk2, MakeServer(e3.URL)), IsNil)
+	c.Assert(s.mux.DeleteServer(engine.ServerKey{BackendKey: bk2, Id: s2.Id}), IsNil)
+	for i := 0; i < 4; i++ {
+		expectMirrored("3")
+	}
+}
+
+func (s *ServerSuite) TestBackendConsistentHash(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		LoadBalancer: &engine.HTTPBackendLoadBalancer{Algorithm: engine.LBConsistentHash, HashVariable: "request.header.X-User"},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(e2.URL)), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Requests of the same user always land on the same server
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		user := testutils.Header("X-User", fmt.Sprintf("user-%d", i))
+		first := GETResponse(c, b.FrontendURL("/"), user)
+		for j := 0; j < 3; j++ {
+			c.Assert(GETResponse(c, b.FrontendURL("/"), user), Equals, first)
+		}
+		seen[first] = true
+	}
+	c.Assert(len(seen), Equals, 2)
+
+	// Switch the algorithm back to round robin
+	be, err = engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+
+	user := testutils.Header("X-User", "user-1")
+	c.Assert(GETResponse(c, b.FrontendURL("/"), user), Not(Equals), GETResponse(c, b.FrontendURL("/"), user))
+}
+
+func (s *ServerSuite) TestApplyChanges(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:31000", Route: `Path("/")`, URL: e1.URL})
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+
+	// Move the frontend to the new backend and delete the old one
+	bk := MakeBackend()
+	bk2 := engine.BackendKey{Id: bk.Id}
+	f := b.F
+	f.BackendId = bk.Id
+	c.Assert(s.mux.ApplyChanges([]interface{}{
+		&engine.BackendUpserted{Backend: bk},
+		&engine.ServerUpserted{BackendKey: bk2, Server: MakeServer(e2.URL)},
+		&engine.FrontendUpserted{Frontend: f},
+		&engine.BackendDeleted{BackendKey: b.BK},
+	}), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	c.Assert(s.mux.backends[b.BK], IsNil)
+
+	// The changes applied before the failed one are rolled back
+	moved := f
+	moved.BackendId = "missing"
+	srv := MakeServer(e1.URL)
+	err := s.mux.ApplyChanges([]interface{}{
+		&engine.ServerUpserted{BackendKey: bk2, Server: srv},
+		&engine.MiddlewareUpserted{FrontendKey: b.FK, Middleware: MakeRateLimit("rl1", 1, "client.ip", 1, 1)},
+		&engine.FrontendUpserted{Frontend: moved},
+	})
+	c.Assert(err, NotNil)
+
+	_, ok := s.mux.backends[bk2].findServer(engine.ServerKey{BackendKey: bk2, Id: srv.Id})
+	c.Assert(ok, Equals, false)
+	c.Assert(len(s.mux.frontends[b.FK].middlewares), Equals, 0)
+	c.Assert(s.mux.frontends[b.FK].frontend.BackendId, Equals, bk.Id)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+}
+
+func (s *ServerSuite) TestApplyChangesRouting(c *C) {
+	r := &pausingRouter{Router: route.NewMux(), pausedC: make(chan struct{}), resumeC: make(chan struct{})}
+	m, err := New(s.lastId, s.st, Options{Router: r})
+	c.Assert(err, IsNil)
+	defer m.Stop(true)
+	c.Assert(m.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:31000", Route: `Path("/")`, URL: e1.URL})
+	c.Assert(m.UpsertBackend(b.B), IsNil)
+	c.Assert(m.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(m.UpsertFrontend(b.F), IsNil)
+	c.Assert(m.UpsertListener(b.L), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "1")
+
+	// The change set pauses after the frontend has been moved, but before its middleware is added
+	bk := MakeBackend()
+	bk2 := engine.BackendKey{Id: bk.Id}
+	f := b.F
+	f.BackendId = bk.Id
+	r.pauseAfter(1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- m.ApplyChanges([]interface{}{
+			&engine.BackendUpserted{Backend: bk},
+			&engine.ServerUpserted{BackendKey: bk2, Server: MakeServer(e2.URL)},
+			&engine.FrontendUpserted{Frontend: f},
+			&engine.MiddlewareUpserted{FrontendKey: b.FK, Middleware: MakeRateLimit("rl1", 1, "client.ip", 1, 1)},
+		})
+	}()
+	<-r.pausedC
+
+	bodyC := make(chan string, 1)
+	go func() {
+		_, body, _ := testutils.Get(b.FrontendURL("/"))
+		bodyC <- string(body)
+	}()
+
+	// The request waits for the change set instead of being served by the half applied configuration
+	var early string
+	select {
+	case early = <-bodyC:
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(r.resumeC)
+	c.Assert(early, Equals, "")
+
+	c.Assert(<-errC, IsNil)
+	c.Assert(<-bodyC, Equals, "2")
+	c.Assert(len(m.frontends[b.FK].middlewares), Equals, 1)
+}
+
+// pausingRouter pauses the route update once armed, until resumed
+type pausingRouter struct {
+	router.Router
+	mtx     sync.Mutex
+	armed   bool
+	skip    int
+	pausedC chan struct{}
+	resumeC chan struct{}
+}
+
+// pauseAfter pauses the route update that follows the given amount of updates
+func (r *pausingRouter) pauseAfter(updates int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.armed, r.skip = true, updates
+}
+
+func (r *pausingRouter) Handle(expr string, h http.Handler) error {
+	r.mtx.Lock()
+	pause := false
+	if r.armed {
+		if r.skip == 0 {
+			pause, r.armed = true, false
+		} else {
+			r.skip--
+		}
+	}
+	r.mtx.Unlock()
+	if pause {
+		close(r.pausedC)
+		<-r.resumeC
+	}
+	return r.Router.Handle(expr, h)
+}
+
+func (s *ServerSuite) TestBackendStickySessions(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		StickySession: &engine.HTTPBackendStickySession{CookieName: "srv", TTL: "1h"},
+	})
+	c.Assert(err, IsNil)
+
+	s2 := MakeServer(e2.URL)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Balancer picks the server and sets the cookie naming it
+	re, body, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	cookies := re.Cookies()
+	c.Assert(len(cookies), Equals, 1)
+	c.Assert(cookies[0].Name, Equals, "srv")
+	c.Assert(cookies[0].MaxAge, Equals, 3600)
+
+	pinned := testutils.Header("Cookie", "srv="+cookies[0].Value)
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/"), pinned), Equals, string(body))
+	}
+
+	// Cookie naming the server that is gone falls back to normal balancing
+	pinned = testutils.Header("Cookie", "srv="+sessionCookieValue(b.BK.Id, s2.Id))
+	c.Assert(GETResponse(c, b.FrontendURL("/"), pinned), Equals, "2")
+
+	c.Assert(s.mux.DeleteServer(engine.ServerKey{BackendKey: b.BK, Id: s2.Id}), IsNil)
+	re, body, err = testutils.Get(b.FrontendURL("/"), pinned)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "1")
+	c.Assert(re.Cookies()[0].Value, Equals, sessionCookieValue(b.BK.Id, b.S.Id))
+}
+
+func (s *ServerSuite) TestBackendLeastConn(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	// The first server is stuck serving long request
+	started, release := make(chan bool), make(chan bool)
+	e1 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("1"))
+	})
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `PathRegexp("/.*")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		LoadBalancer: &engine.HTTPBackendLoadBalancer{Algorithm: engine.LBLeastConn},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	done := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(b.FrontendURL("/slow"))
+		done <- string(body)
+	}()
+	<-started
+
+	stats, err := s.mux.ServerStats(engine.ServerKey{BackendKey: b.BK, Id: b.S.Id})
+	c.Assert(err, IsNil)
+	c.Assert(stats.InFlight, Equals, int64(1))
+
+	// All requests go to the idle server while the first one is busy
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(e2.URL)), IsNil)
+	for i := 0; i < 4; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "2")
+	}
+
+	close(release)
+	c.Assert(<-done, Equals, "1")
+}
+
+// Requests pinned by sticky sessions bypass the balancer, but count as the load of the server
+func (s *ServerSuite) TestBackendLeastConnCountsPinned(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	started, release := make(chan bool), make(chan bool)
+	e1 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- true
+			<-release
+		}
+		w.Write([]byte("1"))
+	})
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `PathRegexp("/.*")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		LoadBalancer:  &engine.HTTPBackendLoadBalancer{Algorithm: engine.LBLeastConn},
+		StickySession: &engine.HTTPBackendStickySession{CookieName: "srv"},
+	})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(e2.URL)), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	done := make(chan string)
+	go func() {
+		_, body, _ := testutils.Get(b.FrontendURL("/slow"), testutils.Header("Cookie", "srv="+sessionCookieValue(b.BK.Id, b.S.Id)))
+		done <- string(body)
+	}()
+	<-started
+
+	// New sessions go to the idle server while the pinned request is in flight
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		bodies = append(bodies, GETResponse(c, b.FrontendURL("/")))
+	}
+	close(release)
+	c.Assert(<-done, Equals, "1")
+	c.Assert(bodies, DeepEquals, []string{"2", "2", "2", "2"})
+}
+
+func (s *ServerSuite) TestBackendSettingsKeepHealth(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("1")
+	defer e1.Close()
+
+	// The first check fails, the following ones hang, so the restarted checker would put the server back into rotation
+	checks := make(chan bool, 1)
+	checks <- true
+	releaseC := make(chan bool)
+	e2 := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			select {
+			case <-checks:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case <-releaseC:
+			}
+			return
+		}
+		w.Write([]byte("2"))
+	})
+	defer e2.Close()
+	defer close(releaseC)
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	settings := b.B.HTTPSettings()
+	settings.HealthCheck = &engine.HTTPBackendHealthCheck{
+		Path:               "/health",
+		Interval:           "1h",
+		Timeout:            "10s",
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 1,
+	}
+	b.B.Settings = settings
+
+	s1, s2 := MakeServer(e1.URL), MakeServer(e2.URL)
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s1), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 100; i++ {
+		if h, err := s.mux.ServerHealth(sk2); err == nil && h != nil && !h.Healthy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Unrelated settings change keeps the failing server out of rotation
+	settings.Timeouts.Dial = "3s"
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	h, err := s.mux.ServerHealth(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(h.Healthy, Equals, false)
+
+	responseSet := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		responseSet[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responseSet, DeepEquals, map[string]bool{"1": true})
+
+	// Changed health check keeps the last known health until the servers are checked again
+	settings.HealthCheck.Path = "/health2"
+	b.B.Settings = settings
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	h, err = s.mux.ServerHealth(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(h.Healthy, Equals, false)
+}
+
+func (s *ServerSuite) TestBackendOutlierEjection(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.mux.options.TimeProvider = clock
+	c.Assert(s.mux.Start(), IsNil)
+
+	good1 := testutils.NewResponder("good")
+	defer good1.Close()
+
+	good2 := testutils.NewResponder("good")
+	defer good2.Close()
+
+	good3 := testutils.NewResponder("good")
+	defer good3.Close()
+
+	// Server fails 3 out of 4 requests
+	var count int32
+	bad := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1)%4 != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("bad"))
+	})
+	defer bad.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   good1.URL,
+	})
+	// Detection is triggered manually by the test
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		OutlierDetection: &engine.HTTPBackendOutlierDetection{Interval: "1h", BaseEjectionTime: "30s"},
+	})
+	c.Assert(err, IsNil)
+
+	sb := MakeServer(bad.URL)
+	skb := engine.ServerKey{BackendKey: b.BK, Id: sb.Id}
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(good2.URL)), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer(good3.URL)), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, sb), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	for i := 0; i < 40; i++ {
+		testutils.Get(b.FrontendURL("/"))
+	}
+
+	e, err := s.mux.ServerEjection(skb)
+	c.Assert(err, IsNil)
+	c.Assert(e, IsNil)
+
+	backend := s.mux.backends[b.BK]
+	backend.detectOutliers(backend.detector)
+
+	e, err = s.mux.ServerEjection(skb)
+	c.Assert(err, IsNil)
+	c.Assert(e.Ejected, Equals, true)
+	c.Assert(e.Ejections, Equals, 1)
+	c.Assert(e.Until, Equals, clock.CurrentTime.Add(30*time.Second))
+	c.Assert(len(e.Anomalies) > 0, Equals, true)
+
+	// Ejected server gets no requests
+	for i := 0; i < 8; i++ {
+		c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "good")
+	}
+
+	// Server returns into rotation when the ejection is over
+	clock.CurrentTime = clock.CurrentTime.Add(30 * time.Second)
+	backend.detectOutliers(backend.detector)
+
+	e, err = s.mux.ServerEjection(skb)
+	c.Assert(err, IsNil)
+	c.Assert(e.Ejected, Equals, false)
+
+	responses := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		_, body, err := testutils.Get(b.FrontendURL("/"))
+		c.Assert(err, IsNil)
+		responses[string(body)] = true
+	}
+	c.Assert(responses["bad"], Equals, true)
+}
+
+// Ejection cap applies to the servers that can receive requests
+func (s *ServerSuite) TestBackendEjectionPool(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   "http://localhost:5000",
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{
+		OutlierDetection: &engine.HTTPBackendOutlierDetection{Interval: "1h"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, MakeServer("http://localhost:5001")), IsNil)
+	for _, state := range []string{engine.ServerStateDisabled, engine.ServerStateDraining} {
+		srv := MakeServer("http://localhost:5002")
+		c.Assert(srv.SetState(state), IsNil)
+		c.Assert(s.mux.UpsertServer(b.BK, srv), IsNil)
+	}
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	c.Assert(s.mux.backends[b.BK].ejectionPool(), Equals, 2)
+}
+
+func (s *ServerSuite) TestBackendSlowStart(c *C) {
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.mux.options.TimeProvider = clock
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{
+		Addr:  "localhost:31000",
+		Route: `Path("/")`,
+		URL:   e1.URL,
+	})
+	be, err := engine.NewHTTPBackend(b.B.Id, engine.HTTPBackendSettings{SlowStart: "10s"})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.mux.UpsertBackend(*be), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	// Server added later starts with a small share of the traffic
+	clock.CurrentTime = clock.CurrentTime.Add(time.Minute)
+	s2 := MakeServer(e2.URL)
+	sk2 := engine.ServerKey{BackendKey: b.BK, Id: s2.Id}
+	c.Assert(s.mux.UpsertServer(b.BK, s2), IsNil)
+
+	weights := func() map[string]int {
+		s.mux.mtx.Lock()
+		defer s.mux.mtx.Unlock()
+		out := map[string]int{}
+		for k, v := range s.mux.frontends[b.FK].upstreams[0].weights {
+			out[k] = v
+		}
+		return out
+	}
+	c.Assert(weights(), DeepEquals, map[string]int{e1.URL: 10, e2.URL: 1})
+
+	r, err := s.mux.ServerRampUp(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, &engine.ServerRampUp{Until: clock.CurrentTime.Add(10 * time.Second), Weight: 0.1})
+
+	r, err = s.mux.ServerRampUp(engine.ServerKey{BackendKey: b.BK, Id: b.S.Id})
+	c.Assert(err, IsNil)
+	c.Assert(r, IsNil)
+
+	// Weight grows linearly
+	backend := s.mux.backends[b.BK]
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	backend.updateSlowStart(backend.slowStart)
+	c.Assert(weights(), DeepEquals, map[string]int{e1.URL: 10, e2.URL: 5})
+
+	// up to the full weight
+	clock.CurrentTime = clock.CurrentTime.Add(5 * time.Second)
+	backend.updateSlowStart(backend.slowStart)
+	c.Assert(weights(), DeepEquals, map[string]int{e1.URL: 10, e2.URL: 10})
+
+	r, err = s.mux.ServerRampUp(sk2)
+	c.Assert(err, IsNil)
+	c.Assert(r, IsNil)
+
+	responses := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		responses[GETResponse(c, b.FrontendURL("/"))] = true
+	}
+	c.Assert(responses, DeepEquals, map[string]bool{"Hi, I'm endpoint 1": true, "Hi, I'm endpoint 2": true})
+}
+
+func (s *ServerSuite) TestServerAddBad(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11500", Route: `Path("/")`, URL: e.URL})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	bad := engine.Server{Id: UID("srv"), URL: ""}
+	c.Assert(s.mux.UpsertServer(b.BK, bad), NotNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+}
+
+func (s *ServerSuite) TestServerUpsertURL(c *C) {
+	c.Assert(s.mux.Start(), IsNil)
+
+	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e1.Close()
+
+	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e1.URL})
+
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+
+	b.S.URL = e2.URL
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
+}
+
+func (s *ServerSuite) TestBackendUpdateOptions(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("slow server"))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	re, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
+	b.B.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
+}
+
+func (s *ServerSuite) TestSwitchBackendOptions(c *C) {
+	e := testutils.NewHandler(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("slow server"))
+	})
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11300", Route: `Path("/")`, URL: e.URL})
+
+	settings := b.B.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "1ms"}
+	b.B.Settings = settings
+
+	b2 := MakeBackend()
+	settings = b2.HTTPSettings()
+	settings.Timeouts = engine.HTTPBackendTimeouts{Read: "20ms"}
+	b2.Settings = settings
+
+	c.Assert(s.mux.UpsertBackend(b.B), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+
+	c.Assert(s.mux.UpsertBackend(b2), IsNil)
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: b2.Id}, b.S), IsNil)
+
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	re, _, err := testutils.Get(MakeURL(b.L, "/"))
+	c.Assert(err, IsNil)
+	c.Assert(re, NotNil)
+	c.Assert(re.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	b.F.BackendId = b2.Id
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "slow server")
+}
+
+func (s *ServerSuite) TestFilesNoFiles(c *C) {
+	files, err := s.mux.GetFiles()
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 0)
+	c.Assert(s.mux.Start(), IsNil)
+}
+
+func (s *ServerSuite) TestTakeFiles(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	b := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e.URL,
+		Protocol: engine.HTTPS,
+		KeyPair:  &engine.KeyPair{Key: localhostKey, Cert: localhostCert},
+	})
+
+	c.Assert(s.mux.UpsertHost(b.H), IsNil)
+	c.Assert(s.mux.UpsertServer(b.BK, b.S), IsNil)
+	c.Assert(s.mux.UpsertFrontend(b.F), IsNil)
+	c.Assert(s.mux.UpsertListener(b.L), IsNil)
+
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+
+	mux2, err := New(s.lastId, s.st, Options{})
+	c.Assert(err, IsNil)
+
+	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	defer e2.Close()
+
+	b2 := MakeBatch(Batch{
+		Addr:     "localhost:41000",
+		Route:    `Path("/")`,
+		URL:      e2.URL,
 		Protocol: engine.HTTPS,
 		KeyPair:  &engine.KeyPair{Key: localhostKey2, Cert: localhostCert2},
 	})
@@ -962,6 +2845,43 @@ func (s *ServerSuite) TestTakeFiles(c *C) {
 	c.Assert(GETResponse(c, b2.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
 }
 
+func (s *ServerSuite) TestTCPListenerTakeFiles(c *C) {
+	e1 := newEchoServer(c, "1:")
+	defer e1.Close()
+	e2 := newEchoServer(c, "2:")
+	defer e2.Close()
+
+	c.Assert(s.mux.Start(), IsNil)
+
+	bk := MakeBackend()
+	c.Assert(s.mux.UpsertServer(engine.BackendKey{Id: bk.Id}, MakeServer("tcp://"+e1.Addr().String())), IsNil)
+	l, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: bk.Id})
+	c.Assert(err, IsNil)
+	c.Assert(s.mux.UpsertListener(*l), IsNil)
+
+	c.Assert(tcpEcho(c, l.Address.Address, nil), Equals, "1:hello\n")
+
+	mux2, err := New(s.lastId, s.st, Options{})
+	c.Assert(err, IsNil)
+
+	bk2 := MakeBackend()
+	c.Assert(mux2.UpsertServer(engine.BackendKey{Id: bk2.Id}, MakeServer("tcp://"+e2.Addr().String())), IsNil)
+	l2, err := engine.NewTCPListener(UID("listener"), engine.TCP, "localhost:41000", engine.TCPListenerSettings{BackendId: bk2.Id})
+	c.Assert(err, IsNil)
+	c.Assert(mux2.UpsertListener(*l2), IsNil)
+
+	files, err := s.mux.GetFiles()
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 1)
+	c.Assert(mux2.TakeFiles(files), IsNil)
+
+	c.Assert(mux2.Start(), IsNil)
+	s.mux.Stop(true)
+	defer mux2.Stop(true)
+
+	c.Assert(tcpEcho(c, l2.Address.Address, nil), Equals, "2:hello\n")
+}
+
 func (s *ServerSuite) TestPerfMon(c *C) {
 	c.Assert(s.mux.Start(), IsNil)
 
@@ -980,7 +2900,7 @@ func (s *ServerSuite) TestPerfMon(c *C) {
 	c.Assert(err, IsNil)
 
 	// Make sure server has been added to the performance monitor
-	c.Assert(s.mux.frontends[b.FK].watcher.hasServer(sURL), Equals, true)
+	c.Assert(s.mux.frontends[b.FK].upstreams[0].watcher.hasServer(sURL), Equals, true)
 
 	c.Assert(s.mux.DeleteFrontend(b.FK), IsNil)
 
@@ -1053,6 +2973,50 @@ func (s *ServerSuite) TestCustomNotFound(c *C) {
 	c.Assert(t.String(), Equals, "*proxy.appender")
 }
 
+// newEchoServer starts the TCP server replying to every line with the line prepended by the prefix
+func newEchoServer(c *C, prefix string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, prefix+line)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// tcpEcho sends a line to the echo server and returns the reply, uses TLS if config is set
+func tcpEcho(c *C, addr string, config *tls.Config) string {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	io.WriteString(conn, "hello\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	c.Assert(err, IsNil)
+	return line
+}
+
 func GETResponse(c *C, url string, opts ...testutils.ReqOption) string {
 	response, body, err := testutils.Get(url, opts...)
 	c.Assert(err, IsNil)
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/vulcand/anomaly"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// outlierDetector periodically runs anomaly detection over the stats of the backend servers
+// and temporarily ejects the servers marked bad from the load balancers.
+// Ejection state is guarded by the mux lock, as it's updated together with the load balancers.
+type outlierDetector struct {
+	settings  engine.OutlierDetectionSettings
+	clock     timetools.TimeProvider
+	wg        *sync.WaitGroup
+	stopC     chan struct{}
+	muxStopC  chan struct{}
+	ejections map[string]*engine.ServerEjection
+}
+
+func newOutlierDetector(s engine.OutlierDetectionSettings, clock timetools.TimeProvider, wg *sync.WaitGroup, muxStopC chan struct{}) *outlierDetector {
+	return &outlierDetector{
+		settings:  s,
+		clock:     clock,
+		wg:        wg,
+		stopC:     make(chan struct{}),
+		muxStopC:  muxStopC,
+		ejections: make(map[string]*engine.ServerEjection),
+	}
+}
+
+func (d *outlierDetector) start(detect func(*outlierDetector)) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.settings.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				detect(d)
+			case <-d.stopC:
+				return
+			case <-d.muxStopC:
+				return
+			}
+		}
+	}()
+}
+
+func (d *outlierDetector) stop() {
+	close(d.stopC)
+}
+
+func (d *outlierDetector) isEjected(id string) bool {
+	e, ok := d.ejections[id]
+	return ok && e.Ejected
+}
+
+func (d *outlierDetector) ejection(id string) *engine.ServerEjection {
+	e, ok := d.ejections[id]
+	if !ok {
+		return nil
+	}
+	out := *e
+	return &out
+}
+
+// readmit returns the servers whose ejection time is over back into rotation
+func (d *outlierDetector) readmit(now time.Time) []string {
+	readmitted := []string{}
+	for id, e := range d.ejections {
+		if e.Ejected && !now.Before(e.Until) {
+			e.Ejected = false
+			readmitted = append(readmitted, id)
+		}
+	}
+	return readmitted
+}
+
+// eject ejects the bad servers without exceeding the ejection cap, total is the amount of
+// the backend servers that can receive requests, including the ejected ones. Servers that stay good for as long as they were ejected have
+// their ejection counts decayed, so the ejection time goes back down.
+func (d *outlierDetector) eject(now time.Time, bad map[string][]engine.Anomaly, total int) []string {
+	for id, e := range d.ejections {
+		if _, ok := bad[id]; ok || e.Ejected {
+			continue
+		}
+		if now.Before(e.Until.Add(d.ejectionTime(e.Ejections))) {
+			continue
+		}
+		e.Ejections -= 1
+		e.Until = now
+		if e.Ejections <= 0 {
+			delete(d.ejections, id)
+		}
+	}
+
+	ejected := 0
+	for _, e := range d.ejections {
+		if e.Ejected {
+			ejected += 1
+		}
+	}
+	max := total * d.settings.MaxEjectionPercent / 100
+
+	out := []string{}
+	for id, anomalies := range bad {
+		if ejected >= max {
+			break
+		}
+		e, ok := d.ejections[id]
+		if !ok {
+			e = &engine.ServerEjection{}
+			d.ejections[id] = e
+		}
+		e.Ejections += 1
+		e.Ejected = true
+		e.Until = now.Add(d.ejectionTime(e.Ejections))
+		e.Anomalies = anomalies
+		ejected += 1
+		out = append(out, id)
+	}
+	return out
+}
+
+// ejectionTime doubles with every consecutive ejection up to the max ejection time
+func (d *outlierDetector) ejectionTime(ejections int) time.Duration {
+	t := d.settings.BaseEjectionTime
+	for i := 1; i < ejections && t < d.settings.MaxEjectionTime; i++ {
+		t *= 2
+	}
+	if t > d.settings.MaxEjectionTime {
+		t = d.settings.MaxEjectionTime
+	}
+	return t
+}
+
+// syncServers drops the state of the servers that are gone
+func (d *outlierDetector) syncServers(servers []engine.Server) {
+	ids := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		ids[s.Id] = true
+	}
+	for id := range d.ejections {
+		if !ids[id] {
+			delete(d.ejections, id)
+		}
+	}
+}
+
+// serverStats collects stats of the servers across all frontends using the backend,
+// servers that got no requests are omitted
+func (b *backend) serverStats(servers []engine.Server) ([]engine.Server, error) {
+	out := []engine.Server{}
+	for _, s := range servers {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			return nil, err
+		}
+		m, err := memmetrics.NewRTMetrics()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range b.frontends {
+			for _, up := range f.upstreams {
+				if up.backend != b {
+					continue
+				}
+				if err := up.watcher.collectServerMetrics(m, u); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if m.TotalCount() == 0 {
+			continue
+		}
+		stats, err := engine.NewRoundTripStats(m)
+		if err != nil {
+			return nil, err
+		}
+		s.Stats = stats
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// findOutliers returns anomalies of the servers in rotation that are marked bad by the anomaly detector
+func (b *backend) findOutliers() (map[string][]engine.Anomaly, error) {
+	bad := make(map[string][]engine.Anomaly)
+	servers, err := b.serverStats(b.inRotation())
+	if err != nil {
+		return bad, err
+	}
+	if err := anomaly.MarkServerAnomalies(servers); err != nil {
+		return bad, err
+	}
+	for _, s := range servers {
+		if s.Stats.Verdict.IsBad {
+			bad[s.Id] = s.Stats.Verdict.Anomalies
+		}
+	}
+	return bad, nil
+}
+
+// ejectionPool returns the amount of servers the ejection cap applies to, the servers that would be in rotation
+// unless ejected. Disabled, draining and unhealthy servers get no requests, so they are not counted.
+func (b *backend) ejectionPool() int {
+	total := 0
+	for _, s := range b.servers {
+		if !s.IsActive() {
+			continue
+		}
+		if b.checker != nil && !b.checker.isHealthy(s.Id) {
+			continue
+		}
+		total += 1
+	}
+	return total
+}
+
+// detectOutliers is called by the outlier detector on every interval
+func (b *backend) detectOutliers(d *outlierDetector) {
+	b.mux.mtx.Lock()
+	defer b.mux.mtx.Unlock()
+
+	// The detector could have been replaced or the backend deleted while we were waiting for the lock
+	if b.detector != d || b.mux.backends[engine.BackendKey{Id: b.backend.Id}] != b {
+		return
+	}
+
+	now := d.clock.UtcNow()
+	readmitted := d.readmit(now)
+	for _, id := range readmitted {
+		log.Infof("%v server %v ejection is over, returning it into rotation", b, id)
+	}
+
+	bad, err := b.findOutliers()
+	if err != nil {
+		log.Errorf("%v failed to detect outliers: %v", b, err)
+	}
+
+	ejected := d.eject(now, bad, b.ejectionPool())
+	for _, id := range ejected {
+		e := d.ejections[id]
+		log.Warningf("%v server %v stands out: %v, ejecting it until %v", b, id, e.Anomalies, e.Until)
+	}
+
+	if len(readmitted) == 0 && len(ejected) == 0 {
+		return
+	}
+	if err := b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", b, err)
+	}
+}
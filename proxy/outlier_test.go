@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/vulcand/vulcand/engine"
+)
+
+var _ = Suite(&OutlierSuite{})
+
+type OutlierSuite struct {
+	d   *outlierDetector
+	now time.Time
+}
+
+func (s *OutlierSuite) SetUpTest(c *C) {
+	s.now = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.d = newOutlierDetector(engine.OutlierDetectionSettings{
+		Interval:           time.Second,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionTime:    35 * time.Second,
+		MaxEjectionPercent: 50,
+	}, &timetools.FreezedTime{CurrentTime: s.now}, &sync.WaitGroup{}, make(chan struct{}))
+}
+
+func (s *OutlierSuite) TestEjectionBackoff(c *C) {
+	c.Assert(s.d.ejectionTime(1), Equals, 10*time.Second)
+	c.Assert(s.d.ejectionTime(2), Equals, 20*time.Second)
+	c.Assert(s.d.ejectionTime(3), Equals, 35*time.Second)
+	c.Assert(s.d.ejectionTime(100), Equals, 35*time.Second)
+}
+
+func (s *OutlierSuite) TestEjectReadmit(c *C) {
+	bad := map[string][]engine.Anomaly{"s1": []engine.Anomaly{{Code: 1}}}
+
+	c.Assert(s.d.eject(s.now, bad, 4), DeepEquals, []string{"s1"})
+	c.Assert(s.d.isEjected("s1"), Equals, true)
+	c.Assert(s.d.ejection("s1").Until, Equals, s.now.Add(10*time.Second))
+
+	// Ejection is not over yet
+	c.Assert(s.d.readmit(s.now.Add(5*time.Second)), DeepEquals, []string{})
+
+	s.now = s.now.Add(10 * time.Second)
+	c.Assert(s.d.readmit(s.now), DeepEquals, []string{"s1"})
+	c.Assert(s.d.isEjected("s1"), Equals, false)
+
+	// Consecutive ejection doubles the ejection time
+	c.Assert(s.d.eject(s.now, bad, 4), DeepEquals, []string{"s1"})
+	e := s.d.ejection("s1")
+	c.Assert(e.Ejections, Equals, 2)
+	c.Assert(e.Until, Equals, s.now.Add(20*time.Second))
+
+	// Server that stays good long enough gets its ejection count decayed
+	s.now = e.Until
+	s.d.readmit(s.now)
+	c.Assert(s.d.eject(s.now.Add(5*time.Second), nil, 4), DeepEquals, []string{})
+	c.Assert(s.d.ejection("s1").Ejections, Equals, 2)
+
+	s.now = s.now.Add(20 * time.Second)
+	s.d.eject(s.now, nil, 4)
+	c.Assert(s.d.ejection("s1").Ejections, Equals, 1)
+
+	s.now = s.now.Add(10 * time.Second)
+	s.d.eject(s.now, nil, 4)
+	c.Assert(s.d.ejection("s1"), IsNil)
+}
+
+func (s *OutlierSuite) TestEjectionCap(c *C) {
+	bad := map[string][]engine.Anomaly{
+		"s1": []engine.Anomaly{{Code: 1}},
+		"s2": []engine.Anomaly{{Code: 1}},
+		"s3": []engine.Anomaly{{Code: 1}},
+	}
+	// Only half of the servers can be ejected at once
+	c.Assert(len(s.d.eject(s.now, bad, 4)), Equals, 2)
+	c.Assert(len(s.d.eject(s.now, bad, 4)), Equals, 0)
+
+	// Single server backend never gets its server ejected
+	d := newOutlierDetector(s.d.settings, s.d.clock, &sync.WaitGroup{}, make(chan struct{}))
+	c.Assert(len(d.eject(s.now, map[string][]engine.Anomaly{"s1": nil}, 1)), Equals, 0)
+}
+
+func (s *OutlierSuite) TestSyncServers(c *C) {
+	s.d.eject(s.now, map[string][]engine.Anomaly{"s1": nil}, 4)
+	c.Assert(s.d.isEjected("s1"), Equals, true)
+
+	s.d.syncServers([]engine.Server{{Id: "s2"}})
+	c.Assert(s.d.ejection("s1"), IsNil)
+}
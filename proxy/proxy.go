@@ -34,6 +34,10 @@ type Proxy interface {
 	UpsertServer(engine.BackendKey, engine.Server) error
 	DeleteServer(engine.ServerKey) error
 
+	// ApplyChanges applies the engine change events, e.g. the changes of engine.ChangeSetApplied,
+	// as one unit: either all of them are applied or none of them
+	ApplyChanges([]interface{}) error
+
 	// TakeFiles takes file descriptors representing sockets in listening state to start serving on them
 	// instead of binding. This is nessesary if the child process needs to inherit sockets from the parent
 	// (e.g. for graceful restarts)
@@ -58,6 +62,10 @@ type Options struct {
 	TimeProvider       timetools.TimeProvider
 	NotFoundMiddleware plugin.Middleware
 	Router             router.Router
+	// ACMEChallenges answers ACME HTTP-01 challenges on http listeners
+	ACMEChallenges ChallengeResponder
+	// CertExpiryWarning is the period before the host certificate expiry when the warnings are logged
+	CertExpiryWarning time.Duration
 }
 
 type NewProxyFn func(id int) (Proxy, error)
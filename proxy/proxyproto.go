@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtoHeaderTimeout limits the time to wait for the PROXY protocol header
+const proxyProtoHeaderTimeout = 10 * time.Second
+
+var (
+	proxyProtoV1Prefix  = []byte("PROXY ")
+	proxyProtoSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtoListener reads PROXY protocol headers of the connections from the trusted networks
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyProtoConn(conn, l.trusted), nil
+}
+
+// File returns the file of the socket, so the listener can be passed to the other process
+func (l *proxyProtoListener) File() (*os.File, error) {
+	f, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("can not get file from listener of type %T", l.Listener)
+	}
+	return f.File()
+}
+
+// newProxyProtoConn wraps connections from the trusted networks, so the header is read on the first use
+func newProxyProtoConn(conn net.Conn, trusted []*net.IPNet) net.Conn {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !isTrusted(addr.IP, trusted) {
+		return conn
+	}
+	return &proxyProtoConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn reads the header on the first read or remote address lookup, whichever comes first,
+// so the listener does not block accepting other connections
+type proxyProtoConn struct {
+	net.Conn
+	br     *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readProxyProtoHeader(c.br)
+	if c.err != nil {
+		c.err = fmt.Errorf("failed to read PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// readProxyProtoHeader reads v1 or v2 header and returns the client address,
+// nil address means that the header has no address of the client, e.g. it's a health check
+func readProxyProtoHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case proxyProtoV1Prefix[0]:
+		return readProxyProtoV1(br)
+	case proxyProtoSignature[0]:
+		return readProxyProtoV2(br)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+// readProxyProtoV1 reads the human readable header, e.g. 'PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n'
+func readProxyProtoV1(br *bufio.Reader) (net.Addr, error) {
+	// Header is at most 107 bytes long including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, proxyProtoV1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtoV2 reads the binary header
+func readProxyProtoV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtoSignature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("malformed v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	// LOCAL command is sent by the load balancer on its own behalf, e.g. for health checks
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("malformed v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("malformed v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Other address families are passed as is
+	return nil, nil
+}
+
+// writeProxyProtoHeader writes the header of the version with the client and the listener addresses
+func writeProxyProtoHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && (s.IP.To4() == nil) == (d.IP.To4() == nil)
+
+	if version == 1 {
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP4"
+		if s.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+		return err
+	}
+
+	header := append([]byte{}, proxyProtoSignature...)
+	var body []byte
+	switch {
+	case !known:
+		// PROXY command with unspecified address family
+		header = append(header, 0x21, 0x00)
+	case s.IP.To4() != nil:
+		header = append(header, 0x21, 0x11)
+		body = append(append(body, s.IP.To4()...), d.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21)
+		body = append(append(body, s.IP.To16()...), d.IP.To16()...)
+	}
+	if known {
+		body = append(body, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+	}
+	header = append(header, byte(len(body)>>8), byte(len(body)))
+	_, err := w.Write(append(header, body...))
+	return err
+}
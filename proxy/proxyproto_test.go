@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&ProxyProtoSuite{})
+
+type ProxyProtoSuite struct {
+}
+
+func (s *ProxyProtoSuite) TestReadV1(c *C) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := readProxyProtoHeader(br)
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "192.168.0.1:56324")
+
+	// The rest of the data is intact
+	rest, err := ioutil.ReadAll(br)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "GET / HTTP/1.1\r\n")
+
+	addr, err = readProxyProtoHeader(bufio.NewReader(strings.NewReader("PROXY TCP6 ::1 ::2 56324 443\r\n")))
+	c.Assert(err, IsNil)
+	c.Assert(addr.String(), Equals, "[::1]:56324")
+
+	// Unknown connection keeps the real address
+	addr, err = readProxyProtoHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	c.Assert(err, IsNil)
+	c.Assert(addr, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestReadBadHeaders(c *C) {
+	headers := []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 bla 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 " + strings.Repeat("1", 100) + " 443\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x10\x11\x00\x00",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+		"\r\n\r\n\x00\r\nQUI",
+	}
+	for _, h := range headers {
+		_, err := readProxyProtoHeader(bufio.NewReader(strings.NewReader(h)))
+		c.Assert(err, NotNil, Commentf("header: %q", h))
+	}
+}
+
+func (s *ProxyProtoSuite) TestWriteRead(c *C) {
+	addrs := []struct {
+		src *net.TCPAddr
+		dst *net.TCPAddr
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+			dst: &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}
+	for _, version := range []int{1, 2} {
+		for _, a := range addrs {
+			buf := &bytes.Buffer{}
+			c.Assert(writeProxyProtoHeader(buf, version, a.src, a.dst), IsNil)
+			buf.WriteString("data")
+
+			br := bufio.NewReader(buf)
+			addr, err := readProxyProtoHeader(br)
+			c.Assert(err, IsNil)
+			c.Assert(addr.String(), Equals, a.src.String())
+			rest, err := ioutil.ReadAll(br)
+			c.Assert(err, IsNil)
+			c.Assert(string(rest), Equals, "data")
+		}
+	}
+}
+
+func (s *ProxyProtoSuite) TestWriteV1(c *C) {
+	buf := &bytes.Buffer{}
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443}
+	c.Assert(writeProxyProtoHeader(buf, 1, src, dst), IsNil)
+	c.Assert(buf.String(), Equals, "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n")
+
+	// Addresses of different families are not supported by the protocol
+	buf.Reset()
+	c.Assert(writeProxyProtoHeader(buf, 1, src, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 443}), IsNil)
+	c.Assert(buf.String(), Equals, "PROXY UNKNOWN\r\n")
+
+	// Unknown addresses are sent as unspecified in v2
+	buf.Reset()
+	c.Assert(writeProxyProtoHeader(buf, 2, &net.UnixAddr{Name: "/tmp/sock"}, dst), IsNil)
+	addr, err := readProxyProtoHeader(bufio.NewReader(buf))
+	c.Assert(err, IsNil)
+	c.Assert(addr, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestLocalCommand(c *C) {
+	// Load balancer health checks are sent with LOCAL command
+	addr, err := readProxyProtoHeader(bufio.NewReader(strings.NewReader("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")))
+	c.Assert(err, IsNil)
+	c.Assert(addr, IsNil)
+}
+
+func (s *ProxyProtoSuite) TestTrusted(c *C) {
+	_, n, err := net.ParseCIDR("10.0.0.0/8")
+	c.Assert(err, IsNil)
+	trusted := []*net.IPNet{n}
+
+	c.Assert(isTrusted(net.ParseIP("10.1.2.3"), trusted), Equals, true)
+	c.Assert(isTrusted(net.ParseIP("192.168.0.1"), trusted), Equals, false)
+	c.Assert(isTrusted(net.ParseIP("10.1.2.3"), nil), Equals, false)
+}
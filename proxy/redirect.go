@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// hostPolicies holds HTTPS redirect and HSTS settings of the hosts, they are shared by all listeners
+// and updated on the fly, so host changes do not require the listeners to restart
+type hostPolicies struct {
+	mtx   *sync.RWMutex
+	hosts map[string]hostPolicy
+}
+
+type hostPolicy struct {
+	redirect *engine.HTTPSRedirectSettings
+	hsts     string
+}
+
+func newHostPolicies() *hostPolicies {
+	return &hostPolicies{
+		mtx:   &sync.RWMutex{},
+		hosts: make(map[string]hostPolicy),
+	}
+}
+
+func (p *hostPolicies) upsert(h engine.Host) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if h.Settings.HTTPSRedirect == nil && h.Settings.HSTS == nil {
+		delete(p.hosts, h.Name)
+		return
+	}
+	hp := hostPolicy{redirect: h.Settings.HTTPSRedirect}
+	if h.Settings.HSTS != nil {
+		hp.hsts = h.Settings.HSTS.HeaderValue()
+	}
+	p.hosts[h.Name] = hp
+}
+
+func (p *hostPolicies) remove(name string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.hosts, name)
+}
+
+func (p *hostPolicies) get(name string) (hostPolicy, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	hp, ok := p.hosts[name]
+	return hp, ok
+}
+
+// hostPolicyHandler redirects requests coming to http listeners to https and
+// adds Strict-Transport-Security header to the responses served over https
+type hostPolicyHandler struct {
+	policies *hostPolicies
+	tls      bool
+	next     http.Handler
+}
+
+func (h *hostPolicyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := hostname(req.Host)
+	hp, ok := h.policies.get(name)
+	if !ok {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	if !h.tls && hp.redirect != nil {
+		host := name
+		if hp.redirect.Port != 0 {
+			host = net.JoinHostPort(name, strconv.Itoa(hp.redirect.Port))
+		} else if strings.Contains(name, ":") {
+			// IPv6 address lost its brackets along with the port
+			host = "[" + name + "]"
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), hp.redirect.StatusCode())
+		return
+	}
+	if h.tls && hp.hsts != "" {
+		w.Header().Set("Strict-Transport-Security", hp.hsts)
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+// hostname strips the port from the host header
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/vulcand/vulcand/engine"
+
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+var _ = Suite(&HostPolicySuite{})
+
+type HostPolicySuite struct {
+}
+
+func (s *HostPolicySuite) serve(h http.Handler, host string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/path?a=b", nil)
+	req.Host = host
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func (s *HostPolicySuite) TestRedirect(c *C) {
+	p := newHostPolicies()
+	p.upsert(engine.Host{Name: "example.com", Settings: engine.HostSettings{HTTPSRedirect: &engine.HTTPSRedirectSettings{}}})
+	p.upsert(engine.Host{Name: "::1", Settings: engine.HostSettings{HTTPSRedirect: &engine.HTTPSRedirectSettings{}}})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := &hostPolicyHandler{policies: p, next: next}
+
+	w := s.serve(h, "example.com:8080")
+	c.Assert(w.Code, Equals, http.StatusMovedPermanently)
+	c.Assert(w.Header().Get("Location"), Equals, "https://example.com/path?a=b")
+
+	w = s.serve(h, "[::1]:8080")
+	c.Assert(w.Code, Equals, http.StatusMovedPermanently)
+	c.Assert(w.Header().Get("Location"), Equals, "https://[::1]/path?a=b")
+
+	w = s.serve(h, "localhost")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "ok")
+
+	// HTTPS listeners serve the requests
+	h = &hostPolicyHandler{policies: p, tls: true, next: next}
+	w = s.serve(h, "example.com")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Strict-Transport-Security"), Equals, "")
+}
+
+func (s *HostPolicySuite) TestHSTS(c *C) {
+	p := newHostPolicies()
+	p.upsert(engine.Host{Name: "example.com", Settings: engine.HostSettings{
+		HSTS: &engine.HSTSSettings{MaxAge: 31536000, IncludeSubdomains: true, Preload: true},
+	}})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	h := &hostPolicyHandler{policies: p, tls: true, next: next}
+
+	w := s.serve(h, "example.com")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Strict-Transport-Security"), Equals, "max-age=31536000; includeSubDomains; preload")
+
+	w = s.serve(h, "localhost")
+	c.Assert(w.Header().Get("Strict-Transport-Security"), Equals, "")
+
+	// Plain http is served without the header
+	h = &hostPolicyHandler{policies: p, next: next}
+	w = s.serve(h, "example.com")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Strict-Transport-Security"), Equals, "")
+
+	// Host without the policies is removed
+	p.upsert(engine.Host{Name: "example.com"})
+	c.Assert(len(p.hosts), Equals, 0)
+}
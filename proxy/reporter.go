@@ -20,6 +20,8 @@ type RTWatcher struct {
 	srvs  map[surl]*memmetrics.RTMetrics
 	clock timetools.TimeProvider
 	next  http.Handler
+	// inFlight counts outstanding requests per server
+	inFlight map[surl]int64
 }
 
 func NewWatcher(next http.Handler) (*RTWatcher, error) {
@@ -34,10 +36,18 @@ func NewWatcher(next http.Handler) (*RTWatcher, error) {
 		clock: &timetools.RealTime{},
 		next:  next,
 		srvs:  make(map[surl]*memmetrics.RTMetrics),
+
+		inFlight: make(map[surl]int64),
 	}, nil
 }
 
 func (rt *RTWatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := surl{scheme: req.URL.Scheme, host: req.URL.Host}
+
+	rt.mtx.Lock()
+	rt.inFlight[key] += 1
+	rt.mtx.Unlock()
+
 	start := rt.clock.UtcNow()
 	pw := &utils.ProxyWriter{W: w}
 	rt.next.ServeHTTP(pw, req)
@@ -46,14 +56,27 @@ func (rt *RTWatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	rt.mtx.Lock()
 	defer rt.mtx.Unlock()
 
+	rt.inFlight[key] -= 1
+	if rt.inFlight[key] <= 0 {
+		delete(rt.inFlight, key)
+	}
+
 	rt.m.Record(pw.Code, diff)
 
-	sm, ok := rt.srvs[surl{scheme: req.URL.Scheme, host: req.URL.Host}]
+	sm, ok := rt.srvs[key]
 	if ok {
 		sm.Record(pw.Code, diff)
 	}
 }
 
+// serverInFlight returns the amount of requests to the server that are in flight
+func (rt *RTWatcher) serverInFlight(u *url.URL) int64 {
+	rt.mtx.Lock()
+	defer rt.mtx.Unlock()
+
+	return rt.inFlight[surl{scheme: u.Scheme, host: u.Host}]
+}
+
 func (rt *RTWatcher) rtStats() (*engine.RoundTripStats, error) {
 	rt.mtx.Lock()
 	defer rt.mtx.Unlock()
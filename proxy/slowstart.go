@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// slowStartSteps is the amount of steps the server weight is ramped up in. Load balancers
+// only support integer weights, so weights of all servers of the backend with slow start
+// are multiplied by this value, and the server gets into rotation with its original weight.
+const slowStartSteps = 10
+
+// slowStart ramps up weights of the servers that have recently got into rotation, so cold
+// servers are not overwhelmed by the full share of the traffic right away.
+// State is guarded by the mux lock, as it's updated together with the load balancers.
+type slowStart struct {
+	window   time.Duration
+	clock    timetools.TimeProvider
+	wg       *sync.WaitGroup
+	stopC    chan struct{}
+	muxStopC chan struct{}
+	// rampC wakes up the ticker when servers start ramping up
+	rampC chan struct{}
+	// inRotation holds the servers that are in rotation
+	inRotation map[string]bool
+	// since holds the times the servers that are still ramping up got into rotation
+	since map[string]time.Time
+}
+
+// newSlowStart creates the slow start, servers that are in rotation already get their full weight right away
+func newSlowStart(window time.Duration, clock timetools.TimeProvider, wg *sync.WaitGroup, muxStopC chan struct{}, servers []engine.Server) *slowStart {
+	s := &slowStart{
+		window:     window,
+		clock:      clock,
+		wg:         wg,
+		stopC:      make(chan struct{}),
+		muxStopC:   muxStopC,
+		rampC:      make(chan struct{}, 1),
+		inRotation: make(map[string]bool, len(servers)),
+		since:      make(map[string]time.Time),
+	}
+	for _, srv := range servers {
+		s.inRotation[srv.Id] = true
+	}
+	return s
+}
+
+// start updates weights of the ramping up servers on every step. The ticker only runs while some servers
+// ramp up, update returns false once all of them have reached their full weight.
+func (s *slowStart) start(update func(*slowStart) bool) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			select {
+			case <-s.rampC:
+				if !s.ramp(update) {
+					return
+				}
+			case <-s.stopC:
+				return
+			case <-s.muxStopC:
+				return
+			}
+		}
+	}()
+}
+
+// ramp ticks until the servers have ramped up, returns false if the slow start has been stopped
+func (s *slowStart) ramp(update func(*slowStart) bool) bool {
+	ticker := time.NewTicker(s.window / slowStartSteps)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !update(s) {
+				return true
+			}
+		case <-s.stopC:
+			return false
+		case <-s.muxStopC:
+			return false
+		}
+	}
+}
+
+func (s *slowStart) stop() {
+	close(s.stopC)
+}
+
+// syncServers starts the ramp up of the servers that got into rotation since the last sync
+func (s *slowStart) syncServers(servers []engine.Server, now time.Time) {
+	inRotation := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		inRotation[srv.Id] = true
+		if !s.inRotation[srv.Id] {
+			s.since[srv.Id] = now
+			s.wakeUp()
+		}
+	}
+	for id := range s.since {
+		if !inRotation[id] {
+			delete(s.since, id)
+		}
+	}
+	s.inRotation = inRotation
+}
+
+// wakeUp starts the ticker, unless it has been woken up already
+func (s *slowStart) wakeUp() {
+	select {
+	case s.rampC <- struct{}{}:
+	default:
+	}
+}
+
+// expire forgets the servers that have reached their full weight, returns true if weights have to be updated
+func (s *slowStart) expire(now time.Time) bool {
+	if len(s.since) == 0 {
+		return false
+	}
+	for id, t := range s.since {
+		if !now.Before(t.Add(s.window)) {
+			delete(s.since, id)
+		}
+	}
+	return true
+}
+
+// ratio returns the share of the full weight the server currently gets
+func (s *slowStart) ratio(id string, now time.Time) float64 {
+	t, ok := s.since[id]
+	if !ok {
+		return 1
+	}
+	r := float64(now.Sub(t)) / float64(s.window)
+	if r < 1.0/slowStartSteps {
+		return 1.0 / slowStartSteps
+	}
+	if r > 1 {
+		return 1
+	}
+	return r
+}
+
+// weight returns the weight the load balancer should use for the server
+func (s *slowStart) weight(srv engine.Server, now time.Time) int {
+	w := int(float64(srv.EffectiveWeight()*slowStartSteps)*s.ratio(srv.Id, now) + 0.5)
+	if w < 1 {
+		return 1
+	}
+	return w
+}
+
+func (s *slowStart) rampUp(srv engine.Server, now time.Time) *engine.ServerRampUp {
+	t, ok := s.since[srv.Id]
+	if !ok || !now.Before(t.Add(s.window)) {
+		return nil
+	}
+	return &engine.ServerRampUp{
+		Until:  t.Add(s.window),
+		Weight: float64(s.weight(srv, now)) / slowStartSteps,
+	}
+}
+
+// serverWeight returns the weight the load balancer should use for the server
+func (b *backend) serverWeight(s engine.Server) int {
+	if b.slowStart == nil {
+		return s.EffectiveWeight()
+	}
+	return b.slowStart.weight(s, b.slowStart.clock.UtcNow())
+}
+
+// updateSlowStart is called by the slow start on every step of the ramp up, returns true while servers ramp up
+func (b *backend) updateSlowStart(s *slowStart) bool {
+	b.mux.mtx.Lock()
+	defer b.mux.mtx.Unlock()
+
+	// Slow start could have been replaced or the backend deleted while we were waiting for the lock
+	if b.slowStart != s || b.mux.backends[engine.BackendKey{Id: b.backend.Id}] != b {
+		return false
+	}
+	if !s.expire(s.clock.UtcNow()) {
+		return false
+	}
+	if err := b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", b, err)
+	}
+	return len(s.since) != 0
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/timetools"
+	. "github.com/vulcand/vulcand/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/vulcand/vulcand/engine"
+)
+
+var _ = Suite(&SlowStartSuite{})
+
+type SlowStartSuite struct {
+	now time.Time
+}
+
+func (s *SlowStartSuite) SetUpTest(c *C) {
+	s.now = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *SlowStartSuite) newSlowStart(servers ...engine.Server) *slowStart {
+	return newSlowStart(10*time.Second, &timetools.FreezedTime{CurrentTime: s.now}, &sync.WaitGroup{}, make(chan struct{}), servers)
+}
+
+func (s *SlowStartSuite) TestRampUp(c *C) {
+	s1, s2 := engine.Server{Id: "s1"}, engine.Server{Id: "s2", Weight: 2}
+	ss := s.newSlowStart(s1)
+
+	// Servers that were in rotation already are at full weight
+	ss.syncServers([]engine.Server{s1, s2}, s.now)
+	c.Assert(ss.weight(s1, s.now), Equals, 10)
+	c.Assert(ss.rampUp(s1, s.now), IsNil)
+
+	// New server starts with a small weight
+	c.Assert(ss.weight(s2, s.now), Equals, 2)
+	c.Assert(ss.rampUp(s2, s.now), DeepEquals, &engine.ServerRampUp{Until: s.now.Add(10 * time.Second), Weight: 0.2})
+
+	// and ramps up linearly
+	c.Assert(ss.weight(s2, s.now.Add(5*time.Second)), Equals, 10)
+	c.Assert(ss.weight(s2, s.now.Add(9*time.Second)), Equals, 18)
+
+	c.Assert(ss.expire(s.now.Add(9*time.Second)), Equals, true)
+	c.Assert(ss.expire(s.now.Add(10*time.Second)), Equals, true)
+	c.Assert(ss.weight(s2, s.now.Add(10*time.Second)), Equals, 20)
+	c.Assert(ss.rampUp(s2, s.now.Add(10*time.Second)), IsNil)
+
+	// Nothing to update once all servers are at full weight
+	c.Assert(ss.expire(s.now.Add(11*time.Second)), Equals, false)
+}
+
+func (s *SlowStartSuite) TestReenabledServer(c *C) {
+	s1, s2 := engine.Server{Id: "s1"}, engine.Server{Id: "s2"}
+	ss := s.newSlowStart(s1, s2)
+
+	// Server goes out of rotation and returns back
+	ss.syncServers([]engine.Server{s1}, s.now)
+	c.Assert(ss.weight(s2, s.now), Equals, 10)
+
+	s.now = s.now.Add(time.Minute)
+	ss.syncServers([]engine.Server{s1, s2}, s.now)
+	c.Assert(ss.weight(s2, s.now), Equals, 1)
+
+	// Server that leaves rotation while ramping up starts over
+	ss.syncServers([]engine.Server{s1}, s.now.Add(5*time.Second))
+	c.Assert(ss.since, DeepEquals, map[string]time.Time{})
+}
+
+func (s *SlowStartSuite) TestWakeUp(c *C) {
+	s1, s2 := engine.Server{Id: "s1"}, engine.Server{Id: "s2"}
+	ss := s.newSlowStart(s1)
+
+	// Servers that are in rotation already do not need the ticker
+	ss.syncServers([]engine.Server{s1}, s.now)
+	c.Assert(len(ss.rampC), Equals, 0)
+
+	// New server wakes it up
+	ss.syncServers([]engine.Server{s1, s2}, s.now)
+	c.Assert(len(ss.rampC), Equals, 1)
+}
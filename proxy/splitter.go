@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// upstream is a load balancer over the servers of one of the frontend's backends
+type upstream struct {
+	backend *backend
+	lb      balancer
+	watcher *RTWatcher
+	// sticky is set when sticky sessions are turned on for the backend
+	sticky *stickySessions
+	// handler is the entry point of the upstream
+	handler http.Handler
+	// weights of the servers currently set in the load balancer
+	weights map[string]int
+}
+
+func (u *upstream) syncServers(m *mux) error {
+	if err := syncServers(m, u.lb, u.backend, u.watcher, u.weights); err != nil {
+		return err
+	}
+	if u.sticky != nil {
+		servers := make(map[string]*url.URL)
+		for _, s := range u.backend.sessionServers() {
+			if su, err := url.Parse(s.URL); err == nil {
+				servers[s.Id] = su
+			}
+		}
+		u.sticky.setServers(servers)
+	}
+	return nil
+}
+
+// splitter distributes requests across upstreams according to their percentage weights.
+// Requests pinned by sticky sessions go to the upstream of the pinned server regardless of the weights.
+type splitter struct {
+	mtx       *sync.RWMutex
+	upstreams []*upstream
+	weights   []int
+	total     int
+}
+
+func newSplitter(upstreams []*upstream, weights []int) *splitter {
+	s := &splitter{
+		mtx:       &sync.RWMutex{},
+		upstreams: upstreams,
+	}
+	s.setWeights(weights)
+	return s
+}
+
+// setWeights updates weights in place, requests in flight are not affected
+func (s *splitter) setWeights(weights []int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	s.weights = weights
+	s.total = total
+}
+
+func (s *splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if u := s.pinned(req); u != nil {
+		u.handler.ServeHTTP(w, req)
+		return
+	}
+	s.next().ServeHTTP(w, req)
+}
+
+// pinned returns the upstream with the server the request is pinned to
+func (s *splitter) pinned(req *http.Request) *upstream {
+	for _, u := range s.upstreams {
+		if u.sticky != nil && u.sticky.pinned(req) != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *splitter) next() http.Handler {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.total > 0 {
+		n := rand.Intn(s.total)
+		for i, w := range s.weights {
+			if n < w {
+				return s.upstreams[i].handler
+			}
+			n -= w
+		}
+	}
+	return s.upstreams[0].handler
+}
@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 
 	"fmt"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/golang.org/x/crypto/ocsp"
 	"net"
 	"net/http"
+	"os"
 
 	"github.com/vulcand/vulcand/engine"
 
@@ -25,13 +27,19 @@ type srv struct {
 	listener    engine.Listener
 	options     Options
 	state       int
+	// http2 is set when the running server serves HTTP/2
+	http2 bool
+	// tcp is set for TCP listeners, it serves connections instead of the HTTP server
+	tcp *tcpServer
+	// proxyProto is set when the running server accepts PROXY protocol headers
+	proxyProto *proxyProtoListener
 }
 
 func (s *srv) GetFile() (*FileDescriptor, error) {
-	if !s.hasListeners() || s.srv == nil {
+	if !s.hasListeners() || (s.srv == nil && s.tcp == nil) {
 		return nil, nil
 	}
-	file, err := s.srv.GetFile()
+	file, err := s.file()
 	if err != nil {
 		return nil, err
 	}
@@ -41,11 +49,35 @@ func (s *srv) GetFile() (*FileDescriptor, error) {
 	}, nil
 }
 
+// file returns the file of the socket the server listens on
+func (s *srv) file() (*os.File, error) {
+	switch {
+	case s.tcp != nil:
+		return s.tcp.getFile()
+	case s.proxyProto != nil:
+		// manners does not know about the listener reading PROXY protocol headers
+		return s.proxyProto.File()
+	}
+	return s.srv.GetFile()
+}
+
 func (s *srv) String() string {
 	return fmt.Sprintf("%s->srv(%v, %v)", s.mux, s.state, &s.listener)
 }
 
 func newSrv(m *mux, l engine.Listener) (*srv, error) {
+	if l.Protocol == engine.TCP {
+		t, err := newTCPServer(m, l)
+		if err != nil {
+			return nil, err
+		}
+		return &srv{
+			mux:      m,
+			listener: l,
+			tcp:      t,
+			state:    srvStateInit,
+		}, nil
+	}
 	defaultHost := ""
 	keyPairs := make(map[engine.HostKey]engine.KeyPair)
 	for hk, h := range m.hosts {
@@ -56,7 +88,7 @@ func newSrv(m *mux, l engine.Listener) (*srv, error) {
 			defaultHost = hk.Name
 		}
 	}
-	h, err := scopedHandler(l.Scope, m.router)
+	h, err := scopedHandler(l.Scope, m.routes)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +102,11 @@ func newSrv(m *mux, l engine.Listener) (*srv, error) {
 }
 
 func (s *srv) isTLS() bool {
-	return s.listener.Protocol == engine.HTTPS
+	return s.listener.TerminatesTLS()
+}
+
+func (s *srv) isHTTP2() bool {
+	return s.isTLS() && s.listener.Settings != nil && s.listener.Settings.HTTP2
 }
 
 func (s *srv) updateListener(l engine.Listener) error {
@@ -83,7 +119,14 @@ func (s *srv) updateListener(l engine.Listener) error {
 	}
 
 	log.Infof("%v update %v", s, &l)
-	handler, err := scopedHandler(l.Scope, s.mux.router)
+	if s.tcp != nil {
+		if err := s.tcp.update(l); err != nil {
+			return err
+		}
+		s.listener = l
+		return s.reload()
+	}
+	handler, err := scopedHandler(l.Scope, s.mux.routes)
 	if err != nil {
 		return err
 	}
@@ -109,37 +152,89 @@ func (s *srv) takeFile(f *FileDescriptor) error {
 		return err
 	}
 
+	if s.tcp != nil {
+		s.tcp.listener = listener
+		s.state = srvStateHijacked
+		return s.updateTCPConfig()
+	}
+
 	if s.isTLS() {
-		tcpListener, ok := listener.(*net.TCPListener)
-		if !ok {
+		if _, ok := listener.(*net.TCPListener); !ok {
 			return fmt.Errorf(`%s failed to take file descriptor - it is running in TLS mode so I need a TCP listener, 
 but the file descriptor that was given corresponded to a listener of type %T. More about file descriptor: %s`, listener, s, f)
 		}
+	}
+	gracefulServer, proxyProto, err := s.newGracefulServer(listener)
+	if err != nil {
+		return err
+	}
+	s.srv = gracefulServer
+	s.proxyProto = proxyProto
+	s.http2 = s.isHTTP2()
+	s.state = srvStateHijacked
+	return nil
+}
+
+// newGracefulServer creates the server listening on the socket, the socket is wrapped to accept
+// PROXY protocol headers and to terminate TLS according to the listener settings
+func (s *srv) newGracefulServer(socket net.Listener) (*manners.GracefulServer, *proxyProtoListener, error) {
+	nets, err := s.listener.ProxyProtocolNetworks()
+	if err != nil {
+		return nil, nil, err
+	}
+	var proxyProto *proxyProtoListener
+	listener := socket
+	if s.isTLS() {
+		listener = manners.TCPKeepAliveListener{socket.(*net.TCPListener)}
+	}
+	if nets != nil {
+		proxyProto = &proxyProtoListener{Listener: listener, trusted: nets}
+		listener = proxyProto
+	}
+	if s.isTLS() {
 		config, err := s.newTLSConfig()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		listener = manners.NewTLSListener(
-			manners.TCPKeepAliveListener{tcpListener}, config)
+		listener = manners.NewTLSListener(listener, config)
 	}
-
-	s.srv = manners.NewWithOptions(
+	gracefulServer := manners.NewWithOptions(
 		manners.Options{
 			Server:       s.newHTTPServer(),
 			Listener:     listener,
 			StateHandler: s.mux.connTracker.onStateChange,
 		})
-	s.state = srvStateHijacked
-	return nil
+	return gracefulServer, proxyProto, nil
 }
 
 func (s *srv) newHTTPServer() *http.Server {
-	return &http.Server{
-		Handler:        s.proxy,
+	var handler http.Handler = &hostPolicyHandler{policies: s.mux.policies, tls: s.isTLS(), next: s.proxy}
+	if !s.isTLS() && s.mux.options.ACMEChallenges != nil {
+		handler = &acmeChallengeHandler{responder: s.mux.options.ACMEChallenges, next: handler}
+	}
+	handler = &clientCertHandler{
+		forward: s.isTLS() && s.listener.Settings != nil && s.listener.Settings.ForwardClientCert,
+		next:    handler,
+	}
+	srv := &http.Server{
+		Handler:        handler,
 		ReadTimeout:    s.options.ReadTimeout,
 		WriteTimeout:   s.options.WriteTimeout,
 		MaxHeaderBytes: s.options.MaxHeaderBytes,
 	}
+	if s.isHTTP2() {
+		srv.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: s.listener.Settings.MaxConcurrentStreams}
+	}
+	return srv
+}
+
+// closeServer stops the server gracefully. HTTP/2 connections never become idle, so manners
+// would wait for them forever, instead they are asked to go away by the server shutdown.
+func (s *srv) closeServer(gs *manners.GracefulServer, http2 bool) {
+	gs.Close()
+	if http2 {
+		go gs.Server.Shutdown(context.Background())
+	}
 }
 
 func (s *srv) reload() error {
@@ -147,30 +242,58 @@ func (s *srv) reload() error {
 		return nil
 	}
 
-	var config *tls.Config
-
-	if s.isTLS() {
-		cfg, err := s.newTLSConfig()
-		if err != nil {
-			return err
-		}
-		config = cfg
+	// TCP listener keeps the socket and applies the new config to new connections
+	if s.tcp != nil {
+		return s.updateTCPConfig()
 	}
 
-	gracefulServer, err := s.srv.HijackListener(s.newHTTPServer(), config)
+	// New server takes over the copy of the socket, so the old one can close its copy gracefully
+	file, err := s.file()
 	if err != nil {
 		return err
 	}
+	socket, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	gracefulServer, proxyProto, err := s.newGracefulServer(socket)
+	if err != nil {
+		socket.Close()
+		return err
+	}
 	go s.serve(gracefulServer)
 
-	s.srv.Close()
+	s.closeServer(s.srv, s.http2)
 	s.srv = gracefulServer
+	s.proxyProto = proxyProto
+	s.http2 = s.isHTTP2()
+	return nil
+}
+
+// updateTCPConfig sets the TLS config and PROXY protocol trusted networks of the TCP listener
+func (s *srv) updateTCPConfig() error {
+	nets, err := s.listener.ProxyProtocolNetworks()
+	if err != nil {
+		return err
+	}
+	var config *tls.Config
+	if s.isTLS() {
+		if config, err = s.newTLSConfig(); err != nil {
+			return err
+		}
+	}
+	s.tcp.setConfig(config, nets)
 	return nil
 }
 
 func (s *srv) shutdown() {
+	if s.tcp != nil {
+		s.tcp.close()
+		return
+	}
 	if s.srv != nil {
-		s.srv.Close()
+		s.closeServer(s.srv, s.http2)
 	}
 }
 
@@ -180,8 +303,13 @@ func (s *srv) newTLSConfig() (*tls.Config, error) {
 		return nil, err
 	}
 
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+	// TCP listeners pass any protocol as is
+	if config.NextProtos == nil && s.listener.Protocol == engine.HTTPS {
+		if s.isHTTP2() {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		} else {
+			config.NextProtos = []string{"http/1.1"}
+		}
 	}
 
 	pairs := map[string]tls.Certificate{}
@@ -236,20 +364,25 @@ func (s *srv) start() error {
 			return err
 		}
 
-		if s.isTLS() {
-			config, err := s.newTLSConfig()
-			if err != nil {
+		if s.tcp != nil {
+			s.tcp.listener = listener
+			if err := s.updateTCPConfig(); err != nil {
+				listener.Close()
 				return err
 			}
-			listener = manners.NewTLSListener(
-				manners.TCPKeepAliveListener{listener.(*net.TCPListener)}, config)
+			s.state = srvStateActive
+			go s.serve(nil)
+			return nil
+		}
+
+		gracefulServer, proxyProto, err := s.newGracefulServer(listener)
+		if err != nil {
+			listener.Close()
+			return err
 		}
-		s.srv = manners.NewWithOptions(
-			manners.Options{
-				Server:       s.newHTTPServer(),
-				Listener:     listener,
-				StateHandler: s.mux.connTracker.onStateChange,
-			})
+		s.srv = gracefulServer
+		s.proxyProto = proxyProto
+		s.http2 = s.isHTTP2()
 		s.state = srvStateActive
 		go s.serve(s.srv)
 		return nil
@@ -267,7 +400,11 @@ func (s *srv) serve(srv *manners.GracefulServer) {
 	s.mux.wg.Add(1)
 	defer s.mux.wg.Done()
 
-	srv.ListenAndServe()
+	if s.tcp != nil {
+		s.tcp.serve()
+	} else {
+		srv.ListenAndServe()
+	}
 
 	log.Infof("%v stop", s)
 }
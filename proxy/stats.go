@@ -24,6 +24,9 @@ func (mx *mux) emitMetrics() error {
 		}
 	}
 
+	// Emit days until the host certificates expire
+	mx.emitCertMetrics()
+
 	// Emit frontend metrics stats
 	frontends, err := mx.topFrontends(nil)
 	if err != nil {
@@ -48,6 +51,38 @@ func (mx *mux) emitMetrics() error {
 		}
 	}
 
+	// Emit stats of the requests mirrored to other backends separately from the frontend traffic
+	for _, f := range mx.frontends {
+		for id, mr := range f.mirrors {
+			s, err := mr.watcher.rtStats()
+			if err != nil {
+				log.Errorf("failed to get %v stats: %v", mr, err)
+				continue
+			}
+			m := c.Metric("frontend", strings.Replace(f.frontend.Id, ".", "_", -1), "mirror", strings.Replace(id, ".", "_", -1))
+			for _, scode := range s.Counters.StatusCodes {
+				c.Gauge(m.Metric("code", strconv.Itoa(scode.Code)), scode.Count, 1)
+			}
+			c.Gauge(m.Metric("neterr"), s.Counters.NetErrors, 1)
+			c.Gauge(m.Metric("reqs"), s.Counters.Total, 1)
+		}
+	}
+
+	// Emit server health as seen by active health checks
+	for _, b := range mx.backends {
+		if b.checker == nil {
+			continue
+		}
+		m := c.Metric("backend", strings.Replace(b.backend.Id, ".", "_", -1))
+		for _, s := range b.servers {
+			var healthy int64
+			if b.checker.isHealthy(s.Id) {
+				healthy = 1
+			}
+			c.Gauge(m.Metric("server", strings.Replace(s.Id, ".", "_", -1), "healthy"), healthy, 1)
+		}
+	}
+
 	return nil
 }
 
@@ -56,7 +91,7 @@ func (mx *mux) frontendStats(key engine.FrontendKey) (*engine.RoundTripStats, er
 	if !ok {
 		return nil, fmt.Errorf("%v not found", key)
 	}
-	return f.watcher.rtStats()
+	return f.rtStats()
 }
 
 func (mx *mux) backendStats(key engine.BackendKey) (*engine.RoundTripStats, error) {
@@ -65,11 +100,13 @@ func (mx *mux) backendStats(key engine.BackendKey) (*engine.RoundTripStats, erro
 		return nil, err
 	}
 	for _, f := range mx.frontends {
-		if f.backend.backend.Id != key.Id {
-			continue
-		}
-		if err := f.watcher.collectMetrics(m); err != nil {
-			return nil, err
+		for _, u := range f.upstreams {
+			if u.backend.backend.Id != key.Id {
+				continue
+			}
+			if err := u.watcher.collectMetrics(m); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return engine.NewRoundTripStats(m)
@@ -94,25 +131,34 @@ func (mx *mux) serverStats(key engine.ServerKey) (*engine.RoundTripStats, error)
 	if err != nil {
 		return nil, err
 	}
+	var inFlight int64
 	for _, f := range mx.frontends {
-		if f.backend.backend.Id != key.BackendKey.Id {
-			continue
-		}
-		if err := f.watcher.collectServerMetrics(m, u); err != nil {
-			return nil, err
+		for _, up := range f.upstreams {
+			if up.backend.backend.Id != key.BackendKey.Id {
+				continue
+			}
+			if err := up.watcher.collectServerMetrics(m, u); err != nil {
+				return nil, err
+			}
+			inFlight += up.watcher.serverInFlight(u)
 		}
 	}
-	return engine.NewRoundTripStats(m)
+	stats, err := engine.NewRoundTripStats(m)
+	if err != nil {
+		return nil, err
+	}
+	stats.InFlight = inFlight
+	return stats, nil
 }
 
 func (mx *mux) topFrontends(key *engine.BackendKey) ([]engine.Frontend, error) {
 	frontends := []engine.Frontend{}
 	for _, m := range mx.frontends {
-		if key != nil && key.Id != m.backend.backend.Id {
+		if key != nil && !m.usesBackend(key.Id) {
 			continue
 		}
 		f := m.frontend
-		stats, err := m.watcher.rtStats()
+		stats, err := m.rtStats()
 		if err != nil {
 			return nil, err
 		}
@@ -126,21 +172,24 @@ func (mx *mux) topFrontends(key *engine.BackendKey) ([]engine.Frontend, error) {
 func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 	metrics := map[string]*sval{}
 	for _, f := range mx.frontends {
-		if key != nil && key.Id != f.backend.backend.Id {
-			continue
-		}
-		for _, s := range f.backend.servers {
-			val, ok := metrics[s.URL]
-			if !ok {
-				sval, err := newSval(s)
-				if err != nil {
+		for _, u := range f.upstreams {
+			if key != nil && key.Id != u.backend.backend.Id {
+				continue
+			}
+			for _, s := range u.backend.servers {
+				val, ok := metrics[s.URL]
+				if !ok {
+					sval, err := newSval(s)
+					if err != nil {
+						return nil, err
+					}
+					metrics[s.URL] = sval
+					val = sval
+				}
+				if err := u.watcher.collectServerMetrics(val.m, val.u); err != nil {
 					return nil, err
 				}
-				metrics[s.URL] = sval
-				val = sval
-			}
-			if err := f.watcher.collectServerMetrics(val.m, val.u); err != nil {
-				return nil, err
+				val.inFlight += u.watcher.serverInFlight(val.u)
 			}
 		}
 	}
@@ -150,6 +199,7 @@ func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		stats.InFlight = v.inFlight
 		v.srv.Stats = stats
 		servers = append(servers, *v.srv)
 	}
@@ -158,9 +208,10 @@ func (mx *mux) topServers(key *engine.BackendKey) ([]engine.Server, error) {
 }
 
 type sval struct {
-	u   *url.URL
-	srv *engine.Server
-	m   *memmetrics.RTMetrics
+	u        *url.URL
+	srv      *engine.Server
+	m        *memmetrics.RTMetrics
+	inFlight int64
 }
 
 func newSval(s engine.Server) (*sval, error) {
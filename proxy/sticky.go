@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// stickySessions routes requests carrying the session cookie to the server named by the cookie.
+// Requests without the cookie, or with the cookie naming the server that is no longer
+// in rotation, are load balanced as usual and get the cookie naming the chosen server.
+//
+// The cookie names the backend along with the server, as server ids are unique within the backend only
+// and the frontend splitting the traffic may route to several backends setting the same cookie.
+type stickySessions struct {
+	mtx       *sync.RWMutex
+	backendId string
+	settings  engine.StickySessionSettings
+	lb        http.Handler
+	next      http.Handler
+	// conns counts the pinned requests, set for least-conn balancers
+	conns *serverConns
+	// servers in rotation by id and their ids by URL
+	urls map[string]*url.URL
+	ids  map[surl]string
+}
+
+func newStickySessions(backendId string, s engine.StickySessionSettings, next http.Handler) *stickySessions {
+	return &stickySessions{
+		mtx:       &sync.RWMutex{},
+		backendId: backendId,
+		settings:  s,
+		next:      next,
+		urls:      make(map[string]*url.URL),
+		ids:       make(map[surl]string),
+	}
+}
+
+// setServers updates servers that sessions can be pinned to, servers maps server ids to URLs
+func (s *stickySessions) setServers(servers map[string]*url.URL) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.urls = servers
+	s.ids = make(map[surl]string, len(servers))
+	for id, u := range servers {
+		s.ids[surl{scheme: u.Scheme, host: u.Host}] = id
+	}
+}
+
+func (s *stickySessions) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if u := s.pinned(req); u != nil {
+		if s.conns != nil {
+			s.conns.acquire(u)
+			defer s.conns.release(u)
+		}
+		newReq := *req
+		newReq.URL = u
+		s.next.ServeHTTP(w, &newReq)
+		return
+	}
+	s.lb.ServeHTTP(w, req)
+}
+
+// pin is called by the load balancer with the request URL set to the chosen server
+func (s *stickySessions) pin(w http.ResponseWriter, req *http.Request) {
+	s.mtx.RLock()
+	id, ok := s.ids[surl{scheme: req.URL.Scheme, host: req.URL.Host}]
+	s.mtx.RUnlock()
+
+	if ok {
+		c := &http.Cookie{
+			Name:     s.settings.CookieName,
+			Value:    sessionCookieValue(s.backendId, id),
+			Path:     "/",
+			Secure:   s.settings.Secure,
+			HttpOnly: s.settings.HTTPOnly,
+		}
+		if s.settings.TTL != 0 {
+			c.MaxAge = int(s.settings.TTL.Seconds())
+		}
+		http.SetCookie(w, c)
+	}
+	s.next.ServeHTTP(w, req)
+}
+
+// pinned returns the URL of the server the request is pinned to, or nil if the cookie is missing
+// or names a server of another backend or the server that does not serve sessions
+func (s *stickySessions) pinned(req *http.Request) *url.URL {
+	c, err := req.Cookie(s.settings.CookieName)
+	if err != nil {
+		return nil
+	}
+	parts := strings.SplitN(c.Value, "/", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	backendId, err := url.QueryUnescape(parts[0])
+	if err != nil || backendId != s.backendId {
+		return nil
+	}
+	id, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.urls[id]
+}
+
+// sessionCookieValue returns the cookie value pinning the session to the server of the backend
+func sessionCookieValue(backendId, serverId string) string {
+	return url.QueryEscape(backendId) + "/" + url.QueryEscape(serverId)
+}
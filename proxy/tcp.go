@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// tcpServer accepts connections on the TCP listener and forwards them to the servers of the listener's backend.
+// Connections are passed through the same load balancers as HTTP requests, every connection being a single
+// request that lasts until either side closes the connection.
+type tcpServer struct {
+	mux *mux
+	key engine.ListenerKey
+	// backend is guarded by the mux lock
+	backend *backend
+
+	mtx      *sync.RWMutex
+	upstream *upstream
+	// config is set when the listener terminates TLS
+	config *tls.Config
+	// trusted is set when the listener accepts PROXY protocol headers from these networks
+	trusted  []*net.IPNet
+	listener net.Listener
+}
+
+func newTCPServer(m *mux, l engine.Listener) (*tcpServer, error) {
+	if l.TCP == nil {
+		return nil, fmt.Errorf("%v has no tcp settings", &l)
+	}
+	bk := engine.BackendKey{Id: l.TCP.BackendId}
+	b, ok := m.backends[bk]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+	}
+	t := &tcpServer{
+		mux:     m,
+		key:     engine.ListenerKey{Id: l.Id},
+		backend: b,
+		mtx:     &sync.RWMutex{},
+	}
+	if err := t.rebuild(); err != nil {
+		return nil, err
+	}
+	b.linkListener(t.key, t)
+	return t, nil
+}
+
+func (t *tcpServer) String() string {
+	return fmt.Sprintf("%v tcp(%v)", t.mux, t.key)
+}
+
+// rebuild sets up the load balancer using the current backend settings
+func (t *tcpServer) rebuild() error {
+	proxyProto, err := t.backend.backend.ProxyProtocolVersion()
+	if err != nil {
+		return err
+	}
+	watcher, err := NewWatcher(&tcpForwarder{mux: t.mux, dial: t.backend.transport.Dial, proxyProto: proxyProto})
+	if err != nil {
+		return err
+	}
+	ls, err := t.backend.backend.LoadBalancerSettings()
+	if err != nil {
+		return err
+	}
+	lb, err := newBalancer(*ls, watcher, t.backend.conns, log.GetGlobalLogger())
+	if err != nil {
+		return err
+	}
+	u := &upstream{
+		backend: t.backend,
+		lb:      lb,
+		watcher: watcher,
+		handler: lb,
+		weights: make(map[string]int),
+	}
+	if err := u.syncServers(t.mux); err != nil {
+		return err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.upstream = u
+	return nil
+}
+
+// update switches the listener to the other backend
+func (t *tcpServer) update(l engine.Listener) error {
+	bk := engine.BackendKey{Id: l.TCP.BackendId}
+	if bk.Id == t.backend.backend.Id {
+		return nil
+	}
+	b, ok := t.mux.backends[bk]
+	if !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
+	}
+	log.Infof("%v updating backend from %v to %v", t, t.backend, b)
+	t.backend.unlinkListener(t.key)
+	t.backend = b
+	b.linkListener(t.key, t)
+	return t.rebuild()
+}
+
+func (t *tcpServer) unlink() {
+	t.backend.unlinkListener(t.key)
+}
+
+// syncBackend syncs load balancer with the backend servers
+func (t *tcpServer) syncBackend() error {
+	t.mtx.RLock()
+	u := t.upstream
+	t.mtx.RUnlock()
+
+	return u.syncServers(t.mux)
+}
+
+func (t *tcpServer) setConfig(config *tls.Config, trusted []*net.IPNet) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.config = config
+	t.trusted = trusted
+}
+
+func (t *tcpServer) getFile() (*os.File, error) {
+	l, ok := t.listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("%v can not get file from listener of type %T", t, t.listener)
+	}
+	return l.File()
+}
+
+func (t *tcpServer) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warningf("%v accept error: %v", t, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Infof("%v stop: %v", t, err)
+			return
+		}
+		go t.serveConn(conn)
+	}
+}
+
+// close stops accepting new connections, existing connections are served until they are closed
+func (t *tcpServer) close() {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+}
+
+func (t *tcpServer) serveConn(conn net.Conn) {
+	tracker := t.mux.connTracker
+	tracker.onStateChange(conn, http.StateNew, http.StateNew)
+	tracker.onStateChange(conn, http.StateNew, http.StateActive)
+	defer tracker.onStateChange(conn, http.StateActive, http.StateClosed)
+	defer conn.Close()
+
+	t.mtx.RLock()
+	u, config, trusted := t.upstream, t.config, t.trusted
+	t.mtx.RUnlock()
+
+	// PROXY protocol header comes first, even before the TLS handshake
+	if trusted != nil {
+		conn = newProxyProtoConn(conn, trusted)
+	}
+	if config != nil {
+		// Handshake is limited by the read timeout, the same way it is for HTTPS listeners
+		tconn := tls.Server(conn, config)
+		if d := t.mux.options.ReadTimeout; d != 0 {
+			tconn.SetDeadline(time.Now().Add(d))
+		}
+		if err := tconn.Handshake(); err != nil {
+			log.Infof("%v TLS handshake with %v failed: %v", t, conn.RemoteAddr(), err)
+			return
+		}
+		tconn.SetDeadline(time.Time{})
+		conn = tconn
+	}
+
+	req := &http.Request{
+		URL:        &url.URL{},
+		Header:     make(http.Header),
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	w := &tcpResponseWriter{header: make(http.Header)}
+	u.handler.ServeHTTP(w, req.WithContext(context.WithValue(context.Background(), tcpConnKey{}, conn)))
+	if w.code != http.StatusOK {
+		log.Warningf("%v failed to forward connection from %v, code: %d", t, conn.RemoteAddr(), w.code)
+	}
+}
+
+type tcpConnKey struct{}
+
+// tcpForwarder dials the server picked by the load balancer and splices it with the client connection.
+// Failure to dial is reported as 502, so the load balancer and metrics treat it as a failed request.
+type tcpForwarder struct {
+	mux  *mux
+	dial func(network, addr string) (net.Conn, error)
+	// proxyProto is the version of PROXY protocol headers sent to the servers, 0 if turned off
+	proxyProto int
+}
+
+func (f *tcpForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn := req.Context().Value(tcpConnKey{}).(net.Conn)
+	server, err := f.dial("tcp", req.URL.Host)
+	if err != nil {
+		log.Errorf("%v failed to dial %v: %v", f.mux, req.URL, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if f.proxyProto != 0 {
+		if err := writeProxyProtoHeader(server, f.proxyProto, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			log.Errorf("%v failed to send PROXY protocol header to %v: %v", f.mux, req.URL, err)
+			server.Close()
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	splice(conn, conn, server, server)
+}
+
+// tcpResponseWriter records the outcome of the forwarded connection
+type tcpResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *tcpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *tcpResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *tcpResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
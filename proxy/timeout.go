@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+)
+
+// deadlineHandler limits the total time of the request, including failover attempts
+type deadlineHandler struct {
+	timeout time.Duration
+	next    http.Handler
+}
+
+func (h *deadlineHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+	h.next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// headerTimeoutTransport limits the time to wait for the server response headers. Backend transport
+// is shared by all frontends using the backend, so the timeout is enforced per request.
+type headerTimeoutTransport struct {
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(t.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, &timeoutError{"timeout awaiting response headers"}
+		}
+		return nil, err
+	}
+	// Request context is canceled once the response body is consumed
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type timeoutError struct {
+	message string
+}
+
+func (e *timeoutError) Error() string   { return e.message }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var _ net.Error = &timeoutError{}
+
+// timeoutErrorHandler replies with 504 and the configured body to timed out requests,
+// other errors are handled as usual
+type timeoutErrorHandler struct {
+	body string
+}
+
+func (h *timeoutErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	body := h.body
+	if body == "" {
+		body = http.StatusText(http.StatusGatewayTimeout)
+	}
+	// stream drops bodies of the buffered responses without content length
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write([]byte(body))
+}
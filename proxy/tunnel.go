@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/oxy/utils"
+)
+
+// isUpgrade returns true if the client asks to switch the protocol, e.g. to websocket
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type hijackerKey struct{}
+
+// upgradeSwitch sends upgrade requests around the stream, as it buffers responses and can not
+// tunnel connections, and around the request deadline, as tunnels are long lived. The client
+// connection is passed to the tunnel in the request context, as middlewares and watchers wrap
+// the response writer.
+type upgradeSwitch struct {
+	upgrade http.Handler
+	next    http.Handler
+}
+
+func (s *upgradeSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := w.(http.Hijacker)
+	if !ok || !isUpgrade(req) {
+		s.next.ServeHTTP(w, req)
+		return
+	}
+	s.upgrade.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), hijackerKey{}, h)))
+}
+
+// tunnel proxies upgrade requests to the server chosen by the load balancer. If the server agrees
+// to switch the protocol, the client connection is hijacked and spliced with the server connection.
+// Other requests are passed to the forwarder.
+type tunnel struct {
+	mux     *mux
+	tunnels *openTunnels
+	// conns counts the open tunnels, set for least-conn balancers
+	conns      *serverConns
+	transport  *http.Transport
+	rewriter   forward.ReqRewriter
+	passHost   bool
+	timeout    time.Duration
+	errHandler utils.ErrorHandler
+	next       http.Handler
+}
+
+func (t *tunnel) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := req.Context().Value(hijackerKey{}).(http.Hijacker)
+	if !ok {
+		t.next.ServeHTTP(w, req)
+		return
+	}
+
+	conn, err := t.dial(req)
+	if err != nil {
+		log.Errorf("%v failed to dial %v: %v", t.mux, req.URL, err)
+		t.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	outReq := t.copyRequest(req)
+	if t.timeout != 0 {
+		conn.SetDeadline(time.Now().Add(t.timeout))
+	}
+	br := bufio.NewReader(conn)
+	var re *http.Response
+	if err = outReq.Write(conn); err == nil {
+		re, err = http.ReadResponse(br, outReq)
+	}
+	if err != nil {
+		conn.Close()
+		log.Errorf("%v failed to upgrade %v: %v", t.mux, req.URL, err)
+		t.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Server refused to switch the protocol, so the response is passed as is
+	if re.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		defer re.Body.Close()
+		utils.CopyHeaders(w.Header(), re.Header)
+		w.WriteHeader(re.StatusCode)
+		io.Copy(w, re.Body)
+		return
+	}
+
+	clientConn, brw, err := h.Hijack()
+	if err != nil {
+		conn.Close()
+		log.Errorf("%v failed to hijack connection: %v", t.mux, err)
+		t.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	// Watcher records the status code of the handshake, writing it to the hijacked connection is not allowed
+	if pw, ok := w.(*utils.ProxyWriter); ok {
+		pw.Code = re.StatusCode
+	}
+	if _, err := fmt.Fprintf(clientConn, "HTTP/1.1 %s\r\n", re.Status); err == nil {
+		if err = re.Header.Write(clientConn); err == nil {
+			_, err = io.WriteString(clientConn, "\r\n")
+		}
+	}
+	if err != nil {
+		log.Errorf("%v failed to reply to upgrade: %v", t.mux, err)
+		clientConn.Close()
+		conn.Close()
+		return
+	}
+
+	// Connection is spliced in the background, so the watcher records the handshake only
+	t.mux.connTracker.onTunnelOpen(clientConn)
+	srv := surl{scheme: req.URL.Scheme, host: req.URL.Host}
+	t.tunnels.add(srv, conn)
+	if t.conns != nil {
+		t.conns.acquire(req.URL)
+	}
+	go func() {
+		defer t.mux.connTracker.onTunnelClose(clientConn)
+		defer t.tunnels.remove(srv, conn)
+		if t.conns != nil {
+			defer t.conns.release(req.URL)
+		}
+		splice(clientConn, brw.Reader, conn, br)
+	}()
+}
+
+// dial connects to the server using the backend dial and TLS settings
+func (t *tunnel) dial(req *http.Request) (net.Conn, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if req.URL.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	dial := t.transport.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "https" {
+		return conn, nil
+	}
+
+	config := &tls.Config{}
+	if t.transport.TLSClientConfig != nil {
+		config = t.transport.TLSClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config.ServerName = host
+	}
+	// Upgrades are HTTP/1.1 only, while the transport adds h2 to the shared config when HTTP/2 is on
+	config.NextProtos = []string{"http/1.1"}
+	tconn := tls.Client(conn, config)
+	if t.transport.TLSHandshakeTimeout != 0 {
+		tconn.SetDeadline(time.Now().Add(t.transport.TLSHandshakeTimeout))
+	}
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tconn.SetDeadline(time.Time{})
+	return tconn, nil
+}
+
+// copyRequest prepares the request to the server the same way the forwarder does, keeping the upgrade headers
+func (t *tunnel) copyRequest(req *http.Request) *http.Request {
+	outReq := new(http.Request)
+	*outReq = *req
+
+	outReq.URL = utils.CopyURL(req.URL)
+	outReq.URL.Opaque = req.RequestURI
+	outReq.URL.RawQuery = ""
+	if !t.passHost {
+		outReq.Host = req.URL.Host
+	}
+	outReq.Proto = "HTTP/1.1"
+	outReq.ProtoMajor = 1
+	outReq.ProtoMinor = 1
+	outReq.Close = false
+
+	outReq.Header = make(http.Header)
+	utils.CopyHeaders(outReq.Header, req.Header)
+	if t.rewriter != nil {
+		t.rewriter.Rewrite(outReq)
+	}
+	// Rewriter removes hop by hop headers, but the server needs them to switch the protocol
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+	return outReq
+}
+
+// splice copies data both ways until either side closes the connection, readers
+// hold the data buffered before the connections were spliced
+func splice(client net.Conn, clientR io.Reader, server net.Conn, serverR io.Reader) {
+	errC := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(server, clientR)
+		errC <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, serverR)
+		errC <- err
+	}()
+	<-errC
+	client.Close()
+	server.Close()
+	<-errC
+}
+
+// openTunnels holds the server connections of the open tunnels by server, so the tunnels
+// can be closed when the server is disabled
+type openTunnels struct {
+	mtx   *sync.Mutex
+	conns map[surl]map[net.Conn]bool
+}
+
+func newOpenTunnels() *openTunnels {
+	return &openTunnels{
+		mtx:   &sync.Mutex{},
+		conns: make(map[surl]map[net.Conn]bool),
+	}
+}
+
+func (o *openTunnels) add(srv surl, conn net.Conn) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.conns[srv] == nil {
+		o.conns[srv] = make(map[net.Conn]bool)
+	}
+	o.conns[srv][conn] = true
+}
+
+func (o *openTunnels) remove(srv surl, conn net.Conn) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	delete(o.conns[srv], conn)
+	if len(o.conns[srv]) == 0 {
+		delete(o.conns, srv)
+	}
+}
+
+// closeServer closes the tunnels to the server with the given URL, splice closes the client side
+func (o *openTunnels) closeServer(serverURL string) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	srv := surl{scheme: u.Scheme, host: u.Host}
+	if len(o.conns[srv]) != 0 {
+		log.Infof("closing %d tunnels to %v", len(o.conns[srv]), serverURL)
+	}
+	for conn := range o.conns[srv] {
+		conn.Close()
+	}
+}
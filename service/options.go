@@ -7,6 +7,15 @@ import (
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/coreos/go-etcd/etcd"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/log"
+	"github.com/vulcand/vulcand/acme"
+	"github.com/vulcand/vulcand/proxy"
+)
+
+const (
+	EngineEtcd  = "etcd"
+	EngineEtcd3 = "etcd3"
+	EngineBolt  = "bolt"
+	EngineFile  = "file"
 )
 
 type Options struct {
@@ -19,6 +28,11 @@ type Options struct {
 	Interface string
 	CertPath  string
 
+	// Engine is the configuration storage, one of EngineEtcd, EngineEtcd3, EngineBolt or EngineFile
+	Engine   string
+	BoltPath string
+	FileDir  string
+
 	EtcdNodes               listOptions
 	EtcdKey                 string
 	EtcdCaFile              string
@@ -43,6 +57,13 @@ type Options struct {
 	StatsdPrefix string
 
 	DefaultListener bool
+
+	ACMEDirectory   string
+	ACMEEmail       string
+	ACMECaFile      string
+	ACMERenewBefore time.Duration
+
+	CertExpiryWarning time.Duration
 }
 
 type SeverityFlag struct {
@@ -80,6 +101,11 @@ func (o *listOptions) Set(value string) error {
 }
 
 func validateOptions(o Options) (Options, error) {
+	switch o.Engine {
+	case EngineEtcd, EngineEtcd3, EngineBolt, EngineFile:
+	default:
+		return o, fmt.Errorf("unsupported engine '%s', use one of %s, %s, %s or %s", o.Engine, EngineEtcd, EngineEtcd3, EngineBolt, EngineFile)
+	}
 	if o.EndpointDialTimeout+o.EndpointReadTimeout >= o.ServerWriteTimeout {
 		fmt.Printf("!!!!!! WARN: serverWriteTimout(%s) should be > endpointDialTimeout(%s) + endpointReadTimeout(%s)\n\n",
 			o.ServerWriteTimeout, o.EndpointDialTimeout, o.EndpointReadTimeout)
@@ -96,6 +122,10 @@ func validateOptions(o Options) (Options, error) {
 }
 
 func ParseCommandLine() (options Options, err error) {
+	flag.StringVar(&options.Engine, "engine", EngineEtcd, "Configuration engine: etcd, etcd3 (etcd v3 API), bolt (embedded database file) or file (directory of JSON or YAML files)")
+	flag.StringVar(&options.BoltPath, "boltPath", "vulcand.db", "Path to the database file of the bolt engine")
+	flag.StringVar(&options.FileDir, "fileDir", "vulcand.d", "Directory with the configuration files of the file engine")
+
 	flag.Var(&options.EtcdNodes, "etcd", "Etcd discovery service API endpoints")
 	flag.StringVar(&options.EtcdKey, "etcdKey", "vulcand", "Etcd key for storing configuration")
 	flag.StringVar(&options.EtcdCaFile, "etcdCaFile", "", "Path to CA file for etcd communication")
@@ -130,6 +160,13 @@ func ParseCommandLine() (options Options, err error) {
 
 	flag.BoolVar(&options.DefaultListener, "default-listener", true, "Enables the default listener on startup (Default value: true)")
 
+	flag.StringVar(&options.ACMEDirectory, "acmeDirectory", "", "ACME directory URL, enables certificates issuance for the hosts with AutoCert, e.g. https://acme-v02.api.letsencrypt.org/directory")
+	flag.StringVar(&options.ACMEEmail, "acmeEmail", "", "Contact email of the ACME account")
+	flag.StringVar(&options.ACMECaFile, "acmeCaFile", "", "Path to CA file for ACME server communication, e.g. the root of the Pebble test server")
+	flag.DurationVar(&options.ACMERenewBefore, "acmeRenewBefore", acme.DefaultRenewBefore, "Renew the certificates issued by ACME server this long before they expire")
+
+	flag.DurationVar(&options.CertExpiryWarning, "certExpiryWarning", proxy.DefaultCertExpiryWarning, "Log warnings about the host certificates expiring within this period")
+
 	flag.Parse()
 	options, err = validateOptions(options)
 	if err != nil {
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,9 +19,13 @@ import (
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/manners"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/metrics"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/mailgun/scroll"
+	"github.com/vulcand/vulcand/acme"
 	"github.com/vulcand/vulcand/api"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/boltng"
 	"github.com/vulcand/vulcand/engine/etcdng"
+	"github.com/vulcand/vulcand/engine/etcdv3ng"
+	"github.com/vulcand/vulcand/engine/fileng"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/proxy"
 	"github.com/vulcand/vulcand/secret"
@@ -54,6 +60,7 @@ type Service struct {
 	apiServer     *manners.GracefulServer
 	ng            engine.Engine
 	stapler       stapler.Stapler
+	acme          *acme.Manager
 }
 
 func NewService(options Options, registry *plugin.Registry) *Service {
@@ -95,6 +102,10 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	if err := s.newACME(); err != nil {
+		return err
+	}
+
 	s.stapler = stapler.New()
 	s.supervisor = supervisor.New(
 		s.newProxy, s.ng, s.errorC, supervisor.Options{Files: muxFiles})
@@ -104,6 +115,10 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	if s.acme != nil {
+		s.acme.Start()
+	}
+
 	if err := s.initApi(); err != nil {
 		return err
 	}
@@ -124,6 +139,9 @@ func (s *Service) Start() error {
 			switch signal {
 			case syscall.SIGTERM, syscall.SIGINT:
 				log.Infof("Got signal '%s', shutting down gracefully", signal)
+				if s.acme != nil {
+					s.acme.Stop()
+				}
 				s.supervisor.Stop(true)
 				log.Infof("All servers stopped")
 				return nil
@@ -265,18 +283,37 @@ func (s *Service) newEngine() error {
 	if err != nil {
 		return err
 	}
-	ng, err := etcdng.New(
-		s.options.EtcdNodes,
-		s.options.EtcdKey,
-		s.registry,
-		etcdng.Options{
-			EtcdCaFile:              s.options.EtcdCaFile,
-			EtcdCertFile:            s.options.EtcdCertFile,
-			EtcdKeyFile:             s.options.EtcdKeyFile,
-			EtcdConsistency:         s.options.EtcdConsistency,
-			EtcdSyncIntervalSeconds: s.options.EtcdSyncIntervalSeconds,
-			Box: box,
-		})
+	var ng engine.Engine
+	switch s.options.Engine {
+	case EngineBolt:
+		ng, err = boltng.New(s.options.BoltPath, s.registry, boltng.Options{Box: box})
+	case EngineFile:
+		ng, err = fileng.New(s.options.FileDir, s.registry, fileng.Options{Box: box})
+	case EngineEtcd3:
+		ng, err = etcdv3ng.New(
+			s.options.EtcdNodes,
+			s.options.EtcdKey,
+			s.registry,
+			etcdv3ng.Options{
+				EtcdCaFile:   s.options.EtcdCaFile,
+				EtcdCertFile: s.options.EtcdCertFile,
+				EtcdKeyFile:  s.options.EtcdKeyFile,
+				Box:          box,
+			})
+	default:
+		ng, err = etcdng.New(
+			s.options.EtcdNodes,
+			s.options.EtcdKey,
+			s.registry,
+			etcdng.Options{
+				EtcdCaFile:              s.options.EtcdCaFile,
+				EtcdCertFile:            s.options.EtcdCertFile,
+				EtcdKeyFile:             s.options.EtcdKeyFile,
+				EtcdConsistency:         s.options.EtcdConsistency,
+				EtcdSyncIntervalSeconds: s.options.EtcdSyncIntervalSeconds,
+				Box:                     box,
+			})
+	}
 	if err != nil {
 		return err
 	}
@@ -284,6 +321,38 @@ func (s *Service) newEngine() error {
 	return err
 }
 
+// newACME sets up the manager obtaining the certificates for the hosts with AutoCert setting, if ACME directory is set
+func (s *Service) newACME() error {
+	if s.options.ACMEDirectory == "" {
+		return nil
+	}
+	o := acme.Options{
+		DirectoryURL: s.options.ACMEDirectory,
+		Email:        s.options.ACMEEmail,
+		RenewBefore:  s.options.ACMERenewBefore,
+	}
+	if s.options.ACMECaFile != "" {
+		data, err := ioutil.ReadFile(s.options.ACMECaFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("failed to parse ACME CA file %s", s.options.ACMECaFile)
+		}
+		o.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   time.Minute,
+		}
+	}
+	m, err := acme.New(s.ng, o)
+	if err != nil {
+		return err
+	}
+	s.acme = m
+	return nil
+}
+
 func (s *Service) reportSystemMetrics() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -299,7 +368,7 @@ func (s *Service) reportSystemMetrics() {
 }
 
 func (s *Service) newProxy(id int) (proxy.Proxy, error) {
-	return proxy.New(id, s.stapler, proxy.Options{
+	o := proxy.Options{
 		MetricsClient:      s.metricsClient,
 		DialTimeout:        s.options.EndpointDialTimeout,
 		ReadTimeout:        s.options.ServerReadTimeout,
@@ -308,7 +377,11 @@ func (s *Service) newProxy(id int) (proxy.Proxy, error) {
 		DefaultListener:    constructDefaultListener(s.options),
 		NotFoundMiddleware: s.registry.GetNotFoundMiddleware(),
 		Router:             s.registry.GetRouter(),
-	})
+		CertExpiryWarning:  s.options.CertExpiryWarning,
+		// challenges are stored in the engine, so instances without ACME enabled answer them too
+		ACMEChallenges: acme.NewResponder(s.ng),
+	}
+	return proxy.New(id, s.stapler, o)
 }
 
 func (s *Service) initApi() error {
@@ -142,12 +142,47 @@ func (s *Supervisor) TopServers(key *engine.BackendKey) ([]engine.Server, error)
 	return nil, fmt.Errorf("no current proxy")
 }
 
+// ServerHealth returns the result of active health checking of the server
+func (s *Supervisor) ServerHealth(key engine.ServerKey) (*engine.ServerHealth, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ServerHealth(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+// ServerEjection returns the state of passive outlier ejection of the server
+func (s *Supervisor) ServerEjection(key engine.ServerKey) (*engine.ServerEjection, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ServerEjection(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+// ServerRampUp returns the state of the slow start of the server
+func (s *Supervisor) ServerRampUp(key engine.ServerKey) (*engine.ServerRampUp, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ServerRampUp(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+func (s *Supervisor) nextId() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	id := s.lastId
+	s.lastId += 1
+	return id
+}
+
 func (s *Supervisor) init() error {
-	proxy, err := s.newProxy(s.lastId)
+	id := s.nextId()
+	proxy, err := s.newProxy(id)
 	if err != nil {
 		return err
 	}
-	s.lastId += 1
 
 	if err := initProxy(s.engine, proxy); err != nil {
 		return err
@@ -155,7 +190,7 @@ func (s *Supervisor) init() error {
 
 	// This is the first start, pass the files that could have been passed
 	// to us by the parent process
-	if s.lastId == 1 && len(s.options.Files) != 0 {
+	if id == 0 && len(s.options.Files) != 0 {
 		log.Infof("Passing files %v to %v", s.options.Files, proxy)
 		if err := proxy.TakeFiles(s.options.Files); err != nil {
 			return err
@@ -415,6 +450,9 @@ func processChange(p proxy.Proxy, ch interface{}) error {
 		return p.UpsertServer(change.BackendKey, change.Server)
 	case *engine.ServerDeleted:
 		return p.DeleteServer(change.ServerKey)
+
+	case *engine.ChangeSetApplied:
+		return p.ApplyChanges(change.Changes)
 	}
 	return fmt.Errorf("unsupported change: %#v", ch)
 }
@@ -166,6 +166,44 @@ func (s *SupervisorSuite) TestTransferFiles(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
 }
 
+func (s *SupervisorSuite) TestApplyChangeSet(c *C) {
+	e1 := testutils.NewResponder("Hi, I'm endpoint 1")
+	defer e1.Close()
+	e2 := testutils.NewResponder("Hi, I'm endpoint 2")
+	defer e2.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11800", Route: `Path("/")`, URL: e1.URL})
+
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertFrontend(b.F, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertListener(b.L), IsNil)
+
+	c.Assert(s.sv.Start(), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 1")
+	p := s.sv.getCurrentProxy()
+
+	// Move the frontend to the new backend and delete the old one
+	bk := MakeBackend()
+	srv := MakeServer(e2.URL)
+	f := b.F
+	f.BackendId = bk.Id
+	c.Assert(s.ng.Apply(engine.ChangeSet{Changes: []engine.Change{
+		{Event: &engine.BackendUpserted{Backend: bk}},
+		{Event: &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: bk.Id}, Server: srv}},
+		{Event: &engine.FrontendUpserted{Frontend: f}},
+		{Event: &engine.BackendDeleted{BackendKey: b.BK}},
+	}}), IsNil)
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint 2")
+	// The change set is applied to the running proxy, so its state is kept
+	c.Assert(s.sv.getCurrentProxy(), Equals, p)
+	_, err := p.FrontendStats(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+}
+
 func GETResponse(c *C, url string, opts ...testutils.ReqOption) string {
 	response, body, err := testutils.Get(url, opts...)
 	c.Assert(err, IsNil)
@@ -1,6 +1,8 @@
 package command
 
 import (
+	"io/ioutil"
+
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/engine"
 )
@@ -100,14 +102,108 @@ func getBackendSettings(c *cli.Context) (engine.HTTPBackendSettings, error) {
 	s.KeepAlive.Period = c.Duration("keepAlivePeriod").String()
 	s.KeepAlive.MaxIdleConnsPerHost = c.Int("maxIdleConns")
 
-	tlsSettings, err := getTLSSettings(c)
+	tlsSettings, err := getBackendTLSSettings(c)
 	if err != nil {
 		return s, err
 	}
 	s.TLS = tlsSettings
+	s.HealthCheck = getHealthCheck(c)
+	s.LoadBalancer = getLoadBalancer(c)
+	s.StickySession = getStickySession(c)
+	s.OutlierDetection = getOutlierDetection(c)
+	if d := c.Duration("slowStart"); d != 0 {
+		s.SlowStart = d.String()
+	}
+	s.HTTP2 = c.Bool("http2")
+	s.ProxyProtocol = c.String("proxyProtocol")
+	return s, nil
+}
+
+// getBackendTLSSettings returns TLS settings with the client certificate and root CAs used to verify the servers
+func getBackendTLSSettings(c *cli.Context) (*engine.TLSSettings, error) {
+	s, err := getTLSSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	if path := c.String("tlsRootCAs"); path != "" {
+		if s.RootCAs, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if c.String("tlsCert") != "" || c.String("tlsKey") != "" {
+		if s.KeyPair, err = readKeyPair(c.String("tlsCert"), c.String("tlsKey")); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := engine.NewTLSConfig(s); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+func getOutlierDetection(c *cli.Context) *engine.HTTPBackendOutlierDetection {
+	if !c.Bool("outlierDetection") {
+		return nil
+	}
+	o := &engine.HTTPBackendOutlierDetection{
+		MaxEjectionPercent: c.Int("maxEjectionPercent"),
+	}
+	if d := c.Duration("outlierInterval"); d != 0 {
+		o.Interval = d.String()
+	}
+	if d := c.Duration("baseEjectionTime"); d != 0 {
+		o.BaseEjectionTime = d.String()
+	}
+	if d := c.Duration("maxEjectionTime"); d != 0 {
+		o.MaxEjectionTime = d.String()
+	}
+	return o
+}
+
+func getStickySession(c *cli.Context) *engine.HTTPBackendStickySession {
+	if !c.Bool("sticky") {
+		return nil
+	}
+	s := &engine.HTTPBackendStickySession{
+		CookieName: c.String("stickyCookie"),
+		Secure:     c.Bool("stickySecure"),
+		HTTPOnly:   c.Bool("stickyHttpOnly"),
+	}
+	if d := c.Duration("stickyTTL"); d != 0 {
+		s.TTL = d.String()
+	}
+	return s
+}
+
+func getLoadBalancer(c *cli.Context) *engine.HTTPBackendLoadBalancer {
+	if c.String("lb") == "" {
+		return nil
+	}
+	return &engine.HTTPBackendLoadBalancer{
+		Algorithm:    c.String("lb"),
+		HashVariable: c.String("lbHashVar"),
+	}
+}
+
+func getHealthCheck(c *cli.Context) *engine.HTTPBackendHealthCheck {
+	if c.String("healthCheckPath") == "" {
+		return nil
+	}
+	h := &engine.HTTPBackendHealthCheck{
+		Path:               c.String("healthCheckPath"),
+		ExpectedCodes:      c.IntSlice("healthCheckCode"),
+		HealthyThreshold:   c.Int("healthyThreshold"),
+		UnhealthyThreshold: c.Int("unhealthyThreshold"),
+	}
+	if d := c.Duration("healthCheckInterval"); d != 0 {
+		h.Interval = d.String()
+	}
+	if d := c.Duration("healthCheckTimeout"); d != 0 {
+		h.Timeout = d.String()
+	}
+	return h
+}
+
 func backendOptions() []cli.Flag {
 	return []cli.Flag{
 		// Timeouts
@@ -118,5 +214,45 @@ func backendOptions() []cli.Flag {
 		// Keep-alive parameters
 		cli.StringFlag{Name: "keepAlivePeriod", Usage: "keep-alive period"},
 		cli.IntFlag{Name: "maxIdleConns", Usage: "maximum idle connections per host"},
+
+		// Active health checks
+		cli.StringFlag{Name: "healthCheckPath", Usage: "turns on active health checks, path to request, e.g. /health"},
+		cli.DurationFlag{Name: "healthCheckInterval", Usage: "interval between health checks"},
+		cli.DurationFlag{Name: "healthCheckTimeout", Usage: "timeout of a single health check"},
+		cli.IntSliceFlag{Name: "healthCheckCode", Usage: "response code that marks check as passed, 200 by default", Value: &cli.IntSlice{}},
+		cli.IntFlag{Name: "healthyThreshold", Usage: "consecutive passed checks to bring server back into rotation"},
+		cli.IntFlag{Name: "unhealthyThreshold", Usage: "consecutive failed checks to take server out of rotation"},
+
+		// Load balancing
+		cli.StringFlag{Name: "lb", Usage: "load balancing algorithm: roundrobin, leastconn or consistenthash"},
+		cli.StringFlag{Name: "lbHashVar", Usage: "variable to hash with consistenthash, e.g. client.ip or request.header.X-User"},
+
+		// Sticky sessions
+		cli.BoolFlag{Name: "sticky", Usage: "pin clients to servers with a cookie"},
+		cli.StringFlag{Name: "stickyCookie", Usage: "sticky session cookie name, vulcand_server by default"},
+		cli.DurationFlag{Name: "stickyTTL", Usage: "sticky session cookie max age, lasts until browser session ends if omitted"},
+		cli.BoolFlag{Name: "stickySecure", Usage: "set secure flag on the sticky session cookie"},
+		cli.BoolFlag{Name: "stickyHttpOnly", Usage: "set httponly flag on the sticky session cookie"},
+
+		// Passive outlier detection
+		cli.BoolFlag{Name: "outlierDetection", Usage: "eject servers that stand out by errors or latency"},
+		cli.DurationFlag{Name: "outlierInterval", Usage: "interval between outlier detections"},
+		cli.DurationFlag{Name: "baseEjectionTime", Usage: "ejection time, doubled for every consecutive ejection"},
+		cli.DurationFlag{Name: "maxEjectionTime", Usage: "maximum ejection time"},
+		cli.IntFlag{Name: "maxEjectionPercent", Usage: "maximum percent of backend servers ejected at once"},
+
+		// Slow start
+		cli.DurationFlag{Name: "slowStart", Usage: "ramp up new servers to their full weight during this period"},
+
+		// HTTP/2
+		cli.BoolFlag{Name: "http2", Usage: "use HTTP/2 with the servers that support it"},
+
+		// Client certificate and root CAs
+		cli.StringFlag{Name: "tlsCert", Usage: "path to the client certificate presented to the servers"},
+		cli.StringFlag{Name: "tlsKey", Usage: "path to the client certificate private key"},
+		cli.StringFlag{Name: "tlsRootCAs", Usage: "path to the CA certificates used to verify the servers"},
+
+		// PROXY protocol
+		cli.StringFlag{Name: "proxyProtocol", Usage: "PROXY protocol header version sent to the servers by tcp listeners, v1 or v2"},
 	}
 }
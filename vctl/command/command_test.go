@@ -111,10 +111,32 @@ func (s *CmdSuite) TestHostCRUD(c *C) {
 	c.Assert(h.Settings.OCSP.Responders, DeepEquals, []string{"http://a.com", "http://b.com"})
 	c.Assert(h.Settings.OCSP.SkipSignatureCheck, Equals, true)
 
-	c.Assert(s.run("host", "show", "-name", host), Matches, ".*"+host+".*")
+	c.Assert(s.run("host", "show", "-name", host), Matches, ".*"+host+".*Certificate.*Acme Co.*2049.*")
 	c.Assert(s.run("host", "rm", "-name", host), Matches, OK)
 }
 
+func (s *CmdSuite) TestHostHTTPSRedirect(c *C) {
+	host := "localhost"
+	c.Assert(s.run("host", "upsert", "-name", host,
+		"-httpsRedirect", "-httpsRedirectCode", "308", "-httpsRedirectPort", "8443",
+		"-hstsMaxAge", "8760h", "-hstsIncludeSubdomains"), Matches, OK)
+
+	h, err := s.ng.GetHost(engine.HostKey{Name: host})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.HTTPSRedirect, DeepEquals, &engine.HTTPSRedirectSettings{Code: 308, Port: 8443})
+	c.Assert(h.Settings.HSTS, DeepEquals, &engine.HSTSSettings{MaxAge: 31536000, IncludeSubdomains: true})
+}
+
+func (s *CmdSuite) TestHostAutoCert(c *C) {
+	host := "localhost"
+	c.Assert(s.run("host", "upsert", "-name", host, "-autoCert"), Matches, OK)
+
+	h, err := s.ng.GetHost(engine.HostKey{Name: host})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.AutoCert, Equals, true)
+	c.Assert(h.Settings.KeyPair, IsNil)
+}
+
 func (s *CmdSuite) TestLogSeverity(c *C) {
 	for _, sev := range []log.Severity{log.SeverityInfo, log.SeverityWarning, log.SeverityError} {
 		c.Assert(s.run("log", "set_severity", "-s", sev.String()), Matches, ".*updated.*")
@@ -0,0 +1,53 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/engine/etcdv3ng"
+)
+
+func NewEtcdCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:  "etcd",
+		Usage: "Operations with the etcd configuration storage",
+		Subcommands: []cli.Command{
+			{
+				Name:   "migrate",
+				Usage:  "Copy the configuration from the etcd v2 API to the etcd v3 API, used by the etcd3 engine",
+				Action: cmd.migrateEtcdAction,
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{Name: "from", Usage: "Etcd v2 API endpoints", Value: &cli.StringSlice{}},
+					cli.StringFlag{Name: "fromKey", Value: "vulcand", Usage: "Etcd v2 key with the configuration"},
+					cli.StringSliceFlag{Name: "to", Usage: "Etcd v3 API endpoints, the v2 endpoints are used if not set", Value: &cli.StringSlice{}},
+					cli.StringFlag{Name: "toKey", Value: "vulcand", Usage: "Etcd v3 key prefix to copy the configuration to, has to be empty"},
+					cli.StringFlag{Name: "etcdCaFile", Usage: "Path to CA file for etcd communication"},
+					cli.StringFlag{Name: "etcdCertFile", Usage: "Path to cert file for etcd communication"},
+					cli.StringFlag{Name: "etcdKeyFile", Usage: "Path to key file for etcd communication"},
+				},
+			},
+		},
+	}
+}
+
+func (cmd *Command) migrateEtcdAction(c *cli.Context) {
+	from := c.StringSlice("from")
+	if len(from) == 0 {
+		cmd.printError(fmt.Errorf("provide etcd v2 endpoints with --from"))
+		return
+	}
+	to := c.StringSlice("to")
+	if len(to) == 0 {
+		to = from
+	}
+	copied, err := etcdv3ng.MigrateV2(from, c.String("fromKey"), to, c.String("toKey"), etcdv3ng.Options{
+		EtcdCaFile:   c.String("etcdCaFile"),
+		EtcdCertFile: c.String("etcdCertFile"),
+		EtcdKeyFile:  c.String("etcdKeyFile"),
+	})
+	if err != nil {
+		cmd.printError(fmt.Errorf("migration failed after copying %d keys: %s", copied, err))
+		return
+	}
+	cmd.printOk("copied %d keys from %s to %s", copied, c.String("fromKey"), c.String("toKey"))
+}
@@ -1,6 +1,10 @@
 package command
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/vulcand/route"
 	"github.com/vulcand/vulcand/engine"
@@ -32,7 +36,16 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "id, autogenerated if empty"},
 					cli.StringFlag{Name: "route", Usage: "roue, will be matched against request's path"},
 					cli.DurationFlag{Name: "ttl", Usage: "time to live duration, persistent if omitted"},
+					cli.IntFlag{
+						Name:  "revision",
+						Usage: "revision shown by frontend show, fails if the frontend has been changed since, unconditional if omitted",
+					},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+					cli.StringSliceFlag{
+						Name:  "split",
+						Usage: "split traffic across backends, <backend id>=<percent>, e.g. --split v1=95 --split v2=5",
+						Value: &cli.StringSlice{},
+					},
 				}, frontendOptions()...),
 				Action: cmd.upsertFrontendAction,
 			},
@@ -79,11 +92,27 @@ func (cmd *Command) upsertFrontendAction(c *cli.Context) {
 		cmd.printError(err)
 		return
 	}
-	f, err := engine.NewHTTPFrontend(route.NewMux(), c.String("id"), c.String("b"), c.String("route"), settings)
+	split, err := parseBackendSplit(c.StringSlice("split"))
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
+	backendId := c.String("b")
+	if backendId == "" && len(split) != 0 {
+		backendId = split[0].Id
+	}
+	f, err := engine.NewHTTPFrontend(route.NewMux(), c.String("id"), backendId, c.String("route"), settings)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	if len(split) != 0 {
+		if err := f.SetBackends(split); err != nil {
+			cmd.printError(err)
+			return
+		}
+	}
+	f.Revision = int64(c.Int("revision"))
 	if err := cmd.client.UpsertFrontend(*f, c.Duration("ttl")); err != nil {
 		cmd.printError(err)
 		return
@@ -100,12 +129,37 @@ func (cmd *Command) deleteFrontendAction(c *cli.Context) {
 	cmd.printOk("frontend deleted")
 }
 
+// parseBackendSplit parses backend weights in form <backend id>=<percent>
+func parseBackendSplit(vals []string) ([]engine.WeightedBackend, error) {
+	out := make([]engine.WeightedBackend, 0, len(vals))
+	for _, v := range vals {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected <backend id>=<percent>, got '%s'", v)
+		}
+		weight, err := strconv.Atoi(strings.TrimSuffix(parts[1], "%"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid percent in '%s': %v", v, err)
+		}
+		out = append(out, engine.WeightedBackend{Id: parts[0], Weight: weight})
+	}
+	return out, nil
+}
+
 func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s := engine.HTTPFrontendSettings{}
 
 	s.Limits.MaxMemBodyBytes = int64(c.Int("maxMemBodyKB") * 1024)
 	s.Limits.MaxBodyBytes = int64(c.Int("maxBodyKB") * 1024)
 
+	if d := c.Duration("requestTimeout"); d != 0 {
+		s.Timeouts.Request = d.String()
+	}
+	if d := c.Duration("responseHeaderTimeout"); d != 0 {
+		s.Timeouts.ResponseHeader = d.String()
+	}
+	s.Timeouts.Body = c.String("timeoutBody")
+
 	s.FailoverPredicate = c.String("failoverPredicate")
 	s.Hostname = c.String("forwardHost")
 	s.TrustForwardHeader = c.Bool("trustForwardHeader")
@@ -120,6 +174,11 @@ func frontendOptions() []cli.Flag {
 		cli.IntFlag{Name: "maxMemBodyKB", Usage: "maximum request size to cache in memory, in KB"},
 		cli.IntFlag{Name: "maxBodyKB", Usage: "maximum request size to allow for a frontend, in KB"},
 
+		// Frontend timeouts
+		cli.DurationFlag{Name: "requestTimeout", Usage: "total request deadline, including failover attempts"},
+		cli.DurationFlag{Name: "responseHeaderTimeout", Usage: "time to wait for the server response headers in every attempt"},
+		cli.StringFlag{Name: "timeoutBody", Usage: "body of the 504 response sent on timeout"},
+
 		// Misc options
 		cli.StringFlag{Name: "failoverPredicate", Usage: "predicate that defines cases when failover is allowed"},
 		cli.StringFlag{Name: "forwardHost", Usage: "hostname to set when forwarding a request"},
@@ -33,11 +33,20 @@ func NewHostCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "name", Usage: "hostname"},
 					cli.StringFlag{Name: "privateKey", Usage: "Path to a private key"},
 					cli.StringFlag{Name: "cert", Usage: "Path to a certificate"},
+					cli.BoolFlag{Name: "autoCert", Usage: "Obtain and renew the certificate from ACME certificate authority"},
 
 					cli.BoolFlag{Name: "ocsp", Usage: "Turn OCSP on"},
 					cli.BoolFlag{Name: "ocspSkipCheck", Usage: "Insecure: skip signature checking for the OCSP certificate"},
 					cli.DurationFlag{Name: "ocspPeriod", Usage: "optional OCSP period", Value: time.Hour},
 					cli.StringSliceFlag{Name: "ocspResponder", Usage: "Optional list of OCSP responders", Value: &cli.StringSlice{}},
+
+					cli.BoolFlag{Name: "httpsRedirect", Usage: "Redirect requests coming to http listeners to https"},
+					cli.IntFlag{Name: "httpsRedirectCode", Usage: "Redirect status code, 301 or 308", Value: 301},
+					cli.IntFlag{Name: "httpsRedirectPort", Usage: "Optional https port to redirect to"},
+
+					cli.DurationFlag{Name: "hstsMaxAge", Usage: "Send Strict-Transport-Security header with this max age over https"},
+					cli.BoolFlag{Name: "hstsIncludeSubdomains", Usage: "Apply Strict-Transport-Security policy to the subdomains"},
+					cli.BoolFlag{Name: "hstsPreload", Usage: "Allow adding the host to the browsers HSTS preload lists"},
 				},
 				Usage:  "Update or insert a new host to vulcan proxy",
 				Action: cmd.upsertHostAction,
@@ -86,12 +95,26 @@ func (cmd *Command) upsertHostAction(c *cli.Context) {
 		}
 		host.Settings.KeyPair = keyPair
 	}
+	host.Settings.AutoCert = c.Bool("autoCert")
 	host.Settings.OCSP = engine.OCSPSettings{
 		Enabled:            c.Bool("ocsp"),
 		SkipSignatureCheck: c.Bool("ocspSkipCheck"),
 		Period:             c.Duration("ocspPeriod").String(),
 		Responders:         c.StringSlice("ocspResponder"),
 	}
+	if c.Bool("httpsRedirect") {
+		host.Settings.HTTPSRedirect = &engine.HTTPSRedirectSettings{
+			Code: c.Int("httpsRedirectCode"),
+			Port: c.Int("httpsRedirectPort"),
+		}
+	}
+	if d := c.Duration("hstsMaxAge"); d != 0 {
+		host.Settings.HSTS = &engine.HSTSSettings{
+			MaxAge:            int(d / time.Second),
+			IncludeSubdomains: c.Bool("hstsIncludeSubdomains"),
+			Preload:           c.Bool("hstsPreload"),
+		}
+	}
 	if err := cmd.client.UpsertHost(*host); err != nil {
 		cmd.printError(err)
 		return
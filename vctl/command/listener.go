@@ -1,6 +1,8 @@
 package command
 
 import (
+	"io/ioutil"
+
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/engine"
 )
@@ -29,10 +31,18 @@ func NewListenerCommand(cmd *Command) cli.Command {
 				Usage: "Update or insert a listener",
 				Flags: append([]cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "id"},
-					cli.StringFlag{Name: "proto", Usage: "protocol, either http or https"},
+					cli.StringFlag{Name: "proto", Usage: "protocol, either http, https or tcp"},
 					cli.StringFlag{Name: "net", Value: "tcp", Usage: "network, tcp or unix"},
 					cli.StringFlag{Name: "addr", Value: "tcp", Usage: "address to bind to, e.g. 'localhost:31000'"},
 					cli.StringFlag{Name: "scope", Usage: "scope expression limits the listener, e.g. 'Hostname(`myhost`)'"},
+					cli.BoolFlag{Name: "http2", Usage: "advertise HTTP/2 to the clients, https only"},
+					cli.IntFlag{Name: "maxConcurrentStreams", Usage: "HTTP/2 concurrent streams per connection, 250 by default"},
+					cli.StringFlag{Name: "backend", Usage: "backend receiving the connections, tcp only"},
+					cli.BoolFlag{Name: "tls", Usage: "terminate TLS using the host certificates, tcp only"},
+					cli.StringSliceFlag{Name: "proxyProtocolCIDR", Usage: "accept PROXY protocol headers from these networks", Value: &cli.StringSlice{}},
+					cli.StringFlag{Name: "clientAuth", Usage: "client certificate authentication, either none, request, require or verify"},
+					cli.StringFlag{Name: "clientCAs", Usage: "path to PEM bundle of CA certificates verifying client certificates"},
+					cli.BoolFlag{Name: "forwardClientCert", Usage: "pass verified client certificate subject and SANs to the servers, https only"},
 				}, getTLSFlags()...),
 				Action: cmd.upsertListenerAction,
 			},
@@ -49,20 +59,53 @@ func NewListenerCommand(cmd *Command) cli.Command {
 }
 
 func (cmd *Command) upsertListenerAction(c *cli.Context) {
+	if c.String("proto") == engine.TCP {
+		cmd.upsertTCPListener(c)
+		return
+	}
 	var settings *engine.HTTPSListenerSettings
 	if c.String("proto") == engine.HTTPS {
-		s, err := getTLSSettings(c)
+		s, err := getListenerTLSSettings(c)
 		if err != nil {
 			cmd.printError(err)
 			return
 		}
-		settings = &engine.HTTPSListenerSettings{TLS: *s}
+		settings = &engine.HTTPSListenerSettings{
+			TLS:                  *s,
+			HTTP2:                c.Bool("http2"),
+			MaxConcurrentStreams: c.Int("maxConcurrentStreams"),
+			ForwardClientCert:    c.Bool("forwardClientCert"),
+		}
 	}
 	listener, err := engine.NewListener(c.String("id"), c.String("proto"), c.String("net"), c.String("addr"), c.String("scope"), settings)
 	if err != nil {
 		cmd.printError(err)
 		return
 	}
+	listener.ProxyProtocol = getProxyProtocol(c)
+	if err := cmd.client.UpsertListener(*listener); err != nil {
+		cmd.printError(err)
+		return
+	}
+	cmd.printOk("listener upserted")
+}
+
+func (cmd *Command) upsertTCPListener(c *cli.Context) {
+	settings := engine.TCPListenerSettings{BackendId: c.String("backend")}
+	if c.Bool("tls") {
+		s, err := getListenerTLSSettings(c)
+		if err != nil {
+			cmd.printError(err)
+			return
+		}
+		settings.TLS = s
+	}
+	listener, err := engine.NewTCPListener(c.String("id"), c.String("net"), c.String("addr"), settings)
+	if err != nil {
+		cmd.printError(err)
+		return
+	}
+	listener.ProxyProtocol = getProxyProtocol(c)
 	if err := cmd.client.UpsertListener(*listener); err != nil {
 		cmd.printError(err)
 		return
@@ -70,6 +113,32 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) {
 	cmd.printOk("listener upserted")
 }
 
+// getListenerTLSSettings returns TLS settings with client certificate authentication
+func getListenerTLSSettings(c *cli.Context) (*engine.TLSSettings, error) {
+	s, err := getTLSSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	s.ClientAuth = c.String("clientAuth")
+	if path := c.String("clientCAs"); path != "" {
+		if s.ClientCAs, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := engine.NewTLSConfig(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func getProxyProtocol(c *cli.Context) *engine.ProxyProtocolSettings {
+	cidrs := c.StringSlice("proxyProtocolCIDR")
+	if len(cidrs) == 0 {
+		return nil
+	}
+	return &engine.ProxyProtocolSettings{TrustedCIDRs: cidrs}
+}
+
 func (cmd *Command) deleteListenerAction(c *cli.Context) {
 	if err := cmd.client.DeleteListener(engine.ListenerKey{Id: c.String("id")}); err != nil {
 		cmd.printError(err)
@@ -27,7 +27,7 @@ func frontendsOverview(frontends []engine.Frontend) string {
 
 func serversOverview(servers []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\tReqs/sec\t50ile[ms]\t95ile[ms]\t99ile[ms]\tStatus codes %%\tNet. errors %%\tMessages\n")
+	fmt.Fprint(t, "Id\tURL\tReqs/sec\tIn flight\t50ile[ms]\t95ile[ms]\t99ile[ms]\tStatus codes %%\tNet. errors %%\tMessages\n")
 
 	for _, e := range servers {
 		serverOverview(t, e)
@@ -58,10 +58,11 @@ func serverOverview(w io.Writer, srv engine.Server) {
 		anomalies = fmt.Sprintf("%v", s.Verdict.Anomalies)
 	}
 
-	fmt.Fprintf(w, "%s\t%s\t%0.1f\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\t%s\n",
+	fmt.Fprintf(w, "%s\t%s\t%0.1f\t%d\t%0.2f\t%0.2f\t%0.2f\t%s\t%s\t%s\n",
 		srv.Id,
 		srv.URL,
 		s.RequestsPerSecond(),
+		s.InFlight,
 		latencyAtQuantile(50.0, s),
 		latencyAtQuantile(95.0, s),
 		latencyAtQuantile(99.0, s),
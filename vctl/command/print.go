@@ -45,6 +45,10 @@ func (cmd *Command) printHosts(hosts []engine.Host) {
 func (cmd *Command) printHost(host *engine.Host) {
 	fmt.Fprintf(cmd.out, "\n[Host]\n")
 	writeS(cmd.out, hostsView([]engine.Host{*host}))
+	if host.Certificate != nil {
+		fmt.Fprintf(cmd.out, "\n[Certificate]\n")
+		writeS(cmd.out, certificateView(host.Certificate))
+	}
 }
 
 func (cmd *Command) printListeners(ls []engine.Listener) {
@@ -99,6 +103,9 @@ func (cmd *Command) printFrontends(fs []engine.Frontend) {
 func (cmd *Command) printFrontend(f *engine.Frontend, ms []engine.Middleware) {
 	fmt.Fprintf(cmd.out, "\n[Frontend]\n")
 	writeS(cmd.out, frontendsView([]engine.Frontend{*f}))
+	if f.Revision != 0 {
+		fmt.Fprintf(cmd.out, "Revision: %d\n", f.Revision)
+	}
 	fmt.Fprintf(cmd.out, "\n[Middlewares]\n")
 	writeS(cmd.out, middlewaresView(ms))
 }
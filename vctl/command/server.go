@@ -35,9 +35,28 @@ func NewServerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "server id"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
 					cli.StringFlag{Name: "url", Usage: "url in form <scheme>://<host>:<port>"},
+					cli.IntFlag{Name: "weight", Usage: "relative weight of the server, 1 by default"},
 					cli.DurationFlag{Name: "ttl", Usage: "ttl"},
 				},
 			},
+			{
+				Name:   "drain",
+				Usage:  "Stop sending new requests to the server, in-flight requests are allowed to finish",
+				Action: cmd.serverStateAction(engine.ServerStateDraining),
+				Flags:  serverStateFlags(),
+			},
+			{
+				Name:   "disable",
+				Usage:  "Take the server out of rotation",
+				Action: cmd.serverStateAction(engine.ServerStateDisabled),
+				Flags:  serverStateFlags(),
+			},
+			{
+				Name:   "enable",
+				Usage:  "Return the server back into rotation",
+				Action: cmd.serverStateAction(engine.ServerStateActive),
+				Flags:  serverStateFlags(),
+			},
 			{
 				Name:  "rm",
 				Usage: "Remove endpoint from location",
@@ -57,6 +76,10 @@ func (cmd *Command) upsertServerAction(c *cli.Context) {
 		cmd.printError(err)
 		return
 	}
+	if err := s.SetWeight(c.Int("weight")); err != nil {
+		cmd.printError(err)
+		return
+	}
 	if err := cmd.client.UpsertServer(engine.BackendKey{Id: c.String("backend")}, *s, c.Duration("ttl")); err != nil {
 		cmd.printError(err)
 		return
@@ -64,6 +87,25 @@ func (cmd *Command) upsertServerAction(c *cli.Context) {
 	cmd.printOk("server upserted")
 }
 
+func serverStateFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "id", Usage: "server id"},
+		cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+		cli.DurationFlag{Name: "ttl", Usage: "new ttl, by default servers registered with ttl keep expiring as before"},
+	}
+}
+
+func (cmd *Command) serverStateAction(state string) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: c.String("id")}
+		if err := cmd.client.UpdateServerState(sk, state, c.Duration("ttl")); err != nil {
+			cmd.printError(err)
+			return
+		}
+		cmd.printOk("server %v is %v", sk.Id, state)
+	}
+}
+
 func (cmd *Command) deleteServerAction(c *cli.Context) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: c.String("id")}
 	if err := cmd.client.DeleteServer(sk); err != nil {
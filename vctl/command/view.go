@@ -3,6 +3,8 @@ package command
 import (
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/vulcand/vulcand/Godeps/_workspace/src/github.com/buger/goterm"
 	"github.com/vulcand/vulcand/engine"
@@ -25,6 +27,14 @@ func hostView(h *engine.Host) string {
 	return fmt.Sprintf("%s\t%t\n", h.Name, h.Settings.Default)
 }
 
+func certificateView(i *engine.CertificateInfo) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Subject\tIssuer\tSANs\tNot Before\tNot After\n")
+	fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", i.Subject, i.Issuer, strings.Join(i.SANs, ","),
+		i.NotBefore.Format(time.RFC3339), i.NotAfter.Format(time.RFC3339))
+	return t.String()
+}
+
 func listenersView(ls []engine.Listener) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
 	fmt.Fprint(t, "Id\tProtocol\tNetwork\tAddress\tScope\n")
@@ -56,7 +66,15 @@ func frontendsView(fs []engine.Frontend) string {
 }
 
 func frontendView(f *engine.Frontend) string {
-	return fmt.Sprintf("%s\t%s\t%s\t%s\n", f.Id, f.Route, f.BackendId, f.Type)
+	backend := f.BackendId
+	if len(f.Backends) != 0 {
+		split := make([]string, len(f.Backends))
+		for i, b := range f.Backends {
+			split[i] = fmt.Sprintf("%s(%d%%)", b.Id, b.Weight)
+		}
+		backend = strings.Join(split, ",")
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\n", f.Id, f.Route, backend, f.Type)
 }
 
 func backendsView(bs []engine.Backend) string {
@@ -78,7 +96,7 @@ func backendView(b *engine.Backend) string {
 
 func serversView(srvs []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\n")
+	fmt.Fprint(t, "Id\tURL\tWeight\tState\tHealth\n")
 	if len(srvs) == 0 {
 		return t.String()
 	}
@@ -89,7 +107,18 @@ func serversView(srvs []engine.Server) string {
 }
 
 func serverView(s *engine.Server) string {
-	return fmt.Sprintf("%s\t%s\n", s.Id, s.URL)
+	health := "-"
+	if s.Health != nil {
+		health = s.Health.String()
+	}
+	if s.Ejection != nil && s.Ejection.Ejected {
+		health = s.Ejection.String()
+	}
+	weight := fmt.Sprintf("%d", s.EffectiveWeight())
+	if s.RampUp != nil {
+		weight = fmt.Sprintf("%.1f/%d (ramping up)", s.RampUp.Weight, s.EffectiveWeight())
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", s.Id, s.URL, weight, s.GetState(), health)
 }
 
 func middlewaresView(ms []engine.Middleware) string {